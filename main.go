@@ -18,6 +18,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"runtime"
@@ -35,11 +36,11 @@ import (
 	"github.com/joelanford/helm-operator/pkg/annotation"
 	"github.com/joelanford/helm-operator/pkg/backup"
 	helmclient "github.com/joelanford/helm-operator/pkg/client"
-	"github.com/joelanford/helm-operator/pkg/hook"
 	"github.com/joelanford/helm-operator/pkg/manager"
 	pluginv1 "github.com/joelanford/helm-operator/pkg/plugin/v1"
 	"github.com/joelanford/helm-operator/pkg/reconciler"
 	"github.com/joelanford/helm-operator/pkg/restore"
+	"github.com/joelanford/helm-operator/pkg/snapshot"
 	"github.com/joelanford/helm-operator/pkg/watches"
 	"github.com/joelanford/helm-operator/version"
 )
@@ -83,10 +84,17 @@ func newRunCmd() *cobra.Command {
 		enableLeaderElection    bool
 		leaderElectionID        string
 		leaderElectionNamespace string
+		enableWebhooks          bool
+		webhookPort             int
 
 		watchesFile                    string
 		defaultMaxConcurrentReconciles int
 		defaultReconcilePeriod         time.Duration
+		defaultVeleroNamespace         string
+		defaultBackupProvider          string
+		defaultBackupDir               string
+		defaultPreDeleteBackup         bool
+		defaultPreDeleteBackupTimeout  time.Duration
 
 		// Deprecated: use defaultMaxConcurrentReconciles
 		defaultMaxWorkers int
@@ -105,9 +113,18 @@ func newRunCmd() *cobra.Command {
 	runCmd.Flags().StringVar(&leaderElectionNamespace, "leader-election-namespace", "",
 		"Namespace in which to create the leader election configmap for holding the leader lock (required if running locally).")
 
+	runCmd.Flags().BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"Serve a validating webhook for every watched resource. The serving certificate is read from /tmp/k8s-webhook-server/serving-certs.")
+	runCmd.Flags().IntVar(&webhookPort, "webhook-port", 9443, "The port the webhook server binds to.")
+
 	runCmd.Flags().StringVar(&watchesFile, "watches-file", "./watches.yaml", "Path to watches.yaml file.")
 	runCmd.Flags().DurationVar(&defaultReconcilePeriod, "reconcile-period", time.Minute, "Default reconcile period for controllers (use 0 to disable periodic reconciliation)")
 	runCmd.Flags().IntVar(&defaultMaxConcurrentReconciles, "max-concurrent-reconciles", runtime.NumCPU(), "Default maximum number of concurrent reconciles for controllers.")
+	runCmd.Flags().StringVar(&defaultVeleroNamespace, "velero-namespace", "velero", "Default namespace in which Velero Backup and Restore objects are created.")
+	runCmd.Flags().StringVar(&defaultBackupProvider, "backup-provider", "velero", fmt.Sprintf("Default provider that takes and restores backups, one of %v.", watches.BackupProviders))
+	runCmd.Flags().StringVar(&defaultBackupDir, "backup-dir", "/var/lib/helm-operator/backups", "Default directory in which the local backup provider writes its archives.")
+	runCmd.Flags().BoolVar(&defaultPreDeleteBackup, "pre-delete-backup", false, "Take a final backup of a release before it is uninstalled by default.")
+	runCmd.Flags().DurationVar(&defaultPreDeleteBackupTimeout, "pre-delete-backup-timeout", time.Hour, "Default maximum time an uninstall waits for the final backup (use 0 to wait indefinitely).")
 
 	// Deprecated: --max-workers flag does not align well with the name of the option it configures on the controller
 	//   (MaxConcurrentReconciles). Flag `--max-concurrent-reconciles` should be used instead.
@@ -158,6 +175,7 @@ func newRunCmd() *cobra.Command {
 			LeaderElectionID:        leaderElectionID,
 			LeaderElectionNamespace: leaderElectionNamespace,
 			NewClient:               manager.NewDelegatingClientFunc(),
+			Port:                    webhookPort,
 		}
 		manager.ConfigureWatchNamespaces(&options, setupLog)
 		mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
@@ -181,9 +199,6 @@ func newRunCmd() *cobra.Command {
 		cfgGetter := helmclient.NewActionConfigGetter(cfg, mgr.GetRESTMapper(), acgLog)
 		acg := helmclient.NewActionClientGetter(cfgGetter)
 
-		b := backup.NewBackup(mgr.GetClient(), acg)
-		r := restore.NewRestore(mgr.GetClient(), acg)
-
 		for _, w := range ws {
 			reconcilePeriod := defaultReconcilePeriod
 			if w.ReconcilePeriod != nil {
@@ -195,6 +210,41 @@ func newRunCmd() *cobra.Command {
 				maxConcurrentReconciles = *w.MaxConcurrentReconciles
 			}
 
+			veleroNamespace := defaultVeleroNamespace
+			if w.VeleroNamespace != "" {
+				veleroNamespace = w.VeleroNamespace
+			}
+			backupProvider := defaultBackupProvider
+			if w.BackupProvider != "" {
+				backupProvider = w.BackupProvider
+			}
+			backupDir := defaultBackupDir
+			if w.BackupDir != "" {
+				backupDir = w.BackupDir
+			}
+			var provider backup.BackupProvider
+			switch backupProvider {
+			case "velero":
+				provider = backup.NewVeleroProvider(mgr.GetClient(), veleroNamespace)
+			case "local":
+				provider = backup.NewLocalProvider(mgr.GetClient(), backupDir)
+			default:
+				setupLog.Error(fmt.Errorf("unknown backup provider %q", backupProvider), "unable to create backup provider", "gvk", w.GroupVersionKind)
+				os.Exit(1)
+			}
+			b := backup.NewBackup(provider)
+			m := backup.NewMetrics(w.GroupVersionKind.Kind)
+			preDeleteBackup := defaultPreDeleteBackup
+			if w.PreDeleteBackup != nil {
+				preDeleteBackup = *w.PreDeleteBackup
+			}
+			preDeleteBackupTimeout := defaultPreDeleteBackupTimeout
+			if w.PreDeleteBackupTimeout != nil {
+				preDeleteBackupTimeout = w.PreDeleteBackupTimeout.Duration
+			}
+			rs := restore.NewRestore(provider, acg, mgr.GetClient(), m)
+			sn := snapshot.NewSnapshotter(mgr.GetClient())
+
 			r, err := reconciler.New(
 				reconciler.WithChart(*w.Chart),
 				reconciler.WithGroupVersionKind(w.GroupVersionKind),
@@ -205,8 +255,13 @@ func newRunCmd() *cobra.Command {
 				reconciler.WithInstallAnnotations(annotation.DefaultInstallAnnotations...),
 				reconciler.WithUpgradeAnnotations(annotation.DefaultUpgradeAnnotations...),
 				reconciler.WithUninstallAnnotations(annotation.DefaultUninstallAnnotations...),
-				reconciler.WithPostHook(hook.PostHookFunc(b.BckupPostHook)),
-				reconciler.WithPostHook(hook.PostHookFunc(r.RestorePostHook)),
+				reconciler.WithBackup(&b),
+				reconciler.WithPreDeleteBackup(preDeleteBackup, preDeleteBackupTimeout),
+				reconciler.WithBackupMetrics(m),
+				reconciler.WithBackupVerifier(backup.NewVerifier(provider, mgr.GetClient())),
+				reconciler.WithRestore(&rs),
+				reconciler.WithSnapshotter(&sn),
+				reconciler.WithValidatingWebhook(enableWebhooks),
 			)
 			if err != nil {
 				setupLog.Error(err, "unable to create helm reconciler", "controller", "Helm")
@@ -217,7 +272,7 @@ func newRunCmd() *cobra.Command {
 				setupLog.Error(err, "unable to create controller", "controller", "Helm")
 				os.Exit(1)
 			}
-			setupLog.Info("configured watch", "gvk", w.GroupVersionKind, "chartPath", w.ChartPath, "maxConcurrentReconciles", maxConcurrentReconciles, "reconcilePeriod", reconcilePeriod)
+			setupLog.Info("configured watch", "gvk", w.GroupVersionKind, "chartPath", w.ChartPath, "maxConcurrentReconciles", maxConcurrentReconciles, "reconcilePeriod", reconcilePeriod, "backupProvider", backupProvider, "veleroNamespace", veleroNamespace, "preDeleteBackup", preDeleteBackup, "validatingWebhook", enableWebhooks)
 		}
 
 		setupLog.Info("starting manager")
@@ -5,146 +5,419 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
-	helmclient "github.com/joelanford/helm-operator/pkg/client"
-	"github.com/joelanford/helm-operator/pkg/hook"
-	"github.com/joelanford/helm-operator/pkg/restore"
 	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/release"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"sigs.k8s.io/controller-runtime/pkg/client"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/joelanford/helm-operator/pkg/internal/values"
 )
 
+// DefaultPollInterval is how long to wait before checking on a Velero
+// Backup that has not finished yet.
+const DefaultPollInterval = 10 * time.Second
+
+const (
+	// ReleaseNameLabel and ReleaseNamespaceLabel are set on every Velero
+	// object created for a release, so that the objects can be found again
+	// from the release.
+	ReleaseNameLabel      = "helm.operator-sdk/release-name"
+	ReleaseNamespaceLabel = "helm.operator-sdk/release-namespace"
+
+	// RequestAnnotation requests an on-demand backup of the release of a
+	// custom resource. A backup is started whenever its value changes to one
+	// that has not been handled yet, e.g. a timestamp or a counter.
+	RequestAnnotation = "helm.operator-sdk/backup-request"
+
+	// PreDeleteAnnotation enables ("true") or disables ("false") the final
+	// backup of a custom resource's release before it is uninstalled,
+	// overriding the default of its watch.
+	PreDeleteAnnotation = "helm.operator-sdk/pre-delete-backup"
+
+	// SkipPreDeleteAnnotation lets the uninstall go ahead without waiting
+	// for the final backup when set to "true", e.g. when the backup cannot
+	// succeed.
+	SkipPreDeleteAnnotation = "helm.operator-sdk/skip-pre-delete-backup"
+)
+
+// Trigger is what caused a backup to be taken.
+type Trigger string
+
+const (
+	// TriggerRequest is a backup requested through RequestAnnotation.
+	TriggerRequest Trigger = "Request"
+	// TriggerValues is a backup requested by setting `backup.enabled`.
+	TriggerValues Trigger = "Values"
+	// TriggerPreDelete is the final backup taken before a release is
+	// uninstalled.
+	TriggerPreDelete Trigger = "PreDelete"
+	// TriggerPreUpgrade is the backup taken before a release is upgraded.
+	TriggerPreUpgrade Trigger = "PreUpgrade"
+)
+
+// Phase is the phase of a backup as tracked in the custom resource status.
+type Phase string
+
+const (
+	PhaseInProgress Phase = "InProgress"
+	PhaseRetrying   Phase = "Retrying"
+	PhaseCompleted  Phase = "Completed"
+	PhaseFailed     Phase = "Failed"
+)
+
+// Velero Backup phases, as reported in a Backup's `status.phase`.
+const (
+	VeleroPhaseNew              = "New"
+	VeleroPhaseCompleted        = "Completed"
+	VeleroPhasePartiallyFailed  = "PartiallyFailed"
+	VeleroPhaseFailed           = "Failed"
+	VeleroPhaseFailedValidation = "FailedValidation"
+	VeleroPhaseDeleting         = "Deleting"
+)
+
+// Status records the most recent backup of a custom resource's release. It
+// is stored in `status.backup` so that the progress of a Velero Backup can be
+// followed across reconciliations instead of waiting for it in a single one.
+//
+// RequestToken is the value of RequestAnnotation when the backup was started,
+// so that every value is handled once. RestoreName is the restore of a
+// pre-upgrade backup started after the upgrade failed. Verification is the
+// trial restore of the completed backup, if it is verified.
+//
+// A failed attempt that may be retried is recorded in the Retrying phase
+// until NextAttemptTimestamp has passed. StartTimestamp always refers to the
+// first attempt, so that the overall timeout covers all retries.
+type Status struct {
+	Name                 string        `json:"name"`
+	Phase                Phase         `json:"phase"`
+	Trigger              Trigger       `json:"trigger,omitempty"`
+	RequestToken         string        `json:"requestToken,omitempty"`
+	VeleroPhase          string        `json:"veleroPhase,omitempty"`
+	Message              string        `json:"message,omitempty"`
+	Attempt              int           `json:"attempt,omitempty"`
+	Errors               int           `json:"errors,omitempty"`
+	Warnings             int           `json:"warnings,omitempty"`
+	TimedOut             bool          `json:"timedOut,omitempty"`
+	ReleaseVersion       int           `json:"releaseVersion,omitempty"`
+	ObservedGeneration   int64         `json:"observedGeneration,omitempty"`
+	StartTimestamp       *metav1.Time  `json:"startTimestamp,omitempty"`
+	NextAttemptTimestamp *metav1.Time  `json:"nextAttemptTimestamp,omitempty"`
+	CompletionTimestamp  *metav1.Time  `json:"completionTimestamp,omitempty"`
+	RestoreName          string        `json:"restoreName,omitempty"`
+	Verification         *Verification `json:"verification,omitempty"`
+}
+
+// IsFinished returns whether the backup has reached a terminal phase.
+func (s *Status) IsFinished() bool {
+	return s != nil && (s.Phase == PhaseCompleted || s.Phase == PhaseFailed)
+}
+
+func (s *Status) isInFlight() bool {
+	return s != nil && (s.Phase == PhaseInProgress || s.Phase == PhaseRetrying)
+}
+
+// StatusFor returns the backup status recorded in obj, or nil if none has
+// been recorded yet.
+func StatusFor(obj *unstructured.Unstructured) *Status {
+	if obj == nil {
+		return nil
+	}
+	m, ok, err := unstructured.NestedMap(obj.Object, "status", "backup")
+	if err != nil || !ok {
+		return nil
+	}
+	st := &Status{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(m, st); err != nil {
+		return nil
+	}
+	return st
+}
+
 type Backup struct {
-	hook.PostHookFunc
-	client client.Client
-	acg    helmclient.ActionClientGetter
+	provider BackupProvider
 }
 
-func NewBackup(client client.Client, acg helmclient.ActionClientGetter) Backup { //, f hook.PostHookFunc
+// NewBackup returns a Backup that takes backups with provider.
+func NewBackup(provider BackupProvider) Backup {
 	return Backup{
-		client: client,
-		acg:    acg,
+		provider: provider,
 	}
 }
 
-//BckupPostHook deploys a kind:Backup
-//1. Instant Backup
-func (b *Backup) BckupPostHook(obj *unstructured.Unstructured, rel release.Release, log logr.Logger) error {
+// Reconcile moves the backup of rel forward by at most one step and returns
+// the resulting status, along with how long to wait before the next step is
+// due. It never waits for Velero itself:
+//
+//   - If no backup is in progress and one is requested, a Velero Backup is
+//     created and an InProgress status is returned.
+//   - If a backup is in progress, the Velero Backup is checked once and the
+//     status is moved to Completed or Failed when Velero is done with it.
+//   - If a failed attempt can be retried, the status is moved to Retrying and
+//     a new Velero Backup is created once the retry backoff has passed.
+//
+// A backup is requested either by a new value of RequestAnnotation, or by
+// `backup.enabled`, in which case it is taken at most once per generation of
+// the custom resource. A nil status means no backup has been requested.
+func (b *Backup) Reconcile(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) (*Status, time.Duration, error) {
+	st := StatusFor(obj)
+	if st.isInFlight() {
+		return b.advance(ctx, obj, rel, vals, st, log)
+	}
+	trigger := TriggerRequest
+	if token := obj.GetAnnotations()[RequestAnnotation]; token == "" || (st != nil && st.RequestToken == token) {
+		if !isEnabled(vals, "backup.enabled") {
+			return st, 0, nil
+		}
+		if st != nil && st.ObservedGeneration == obj.GetGeneration() {
+			return st, 0, nil
+		}
+		trigger = TriggerValues
+	}
+	return b.startNew(ctx, obj, rel, vals, st, trigger, log)
+}
 
-	log.Info("IN Backup HOOK 123")
+// PreDelete moves the final backup of rel, taken before the release is
+// uninstalled, forward by at most one step like Reconcile does. A backup that
+// is still in flight when the custom resource is deleted is finished first.
+// The final backup is taken once; a status with the TriggerPreDelete trigger
+// in a finished phase is returned as is.
+func (b *Backup) PreDelete(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) (*Status, time.Duration, error) {
+	return b.takeOnce(ctx, obj, rel, vals, TriggerPreDelete, func(st *Status) bool {
+		return st.Trigger == TriggerPreDelete
+	}, log)
+}
 
-	var vals chartutil.Values = rel.Chart.Values
-	backupEnabled, err := vals.PathValue("backup.enabled")
-	if err != nil || backupEnabled.(bool) == false {
-		log.Info(fmt.Sprintf("backupenabled: %v", backupEnabled.(bool)))
-		log.Error(err, "backupEnabled value")
-		return nil
+// takeOnce moves a backup with the given trigger forward by at most one step,
+// unless taken reports that it has already been taken. A backup in flight is
+// finished first.
+func (b *Backup) takeOnce(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, trigger Trigger, taken func(*Status) bool, log logr.Logger) (*Status, time.Duration, error) {
+	st := StatusFor(obj)
+	if st.isInFlight() {
+		return b.advance(ctx, obj, rel, vals, st, log)
 	}
-	log.Info(fmt.Sprintf("backupenabled: %v", backupEnabled.(bool)))
-	//validate before backup
-	if !restore.ValidateValues(rel.Chart.Values) {
-		err := errors.New("backup and restore cannot be enabled simultaneously")
-		log.Error(err, "please choose a single operation")
-		return err
+	if st != nil && taken(st) {
+		return st, 0, nil
 	}
+	return b.startNew(ctx, obj, rel, vals, st, trigger, log)
+}
 
-	u, _ := createBackupCR(rel, log)
-
-	err = b.client.Create(context.Background(), u)
+// advance moves the in-flight backup recorded in st forward by one step.
+func (b *Backup) advance(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status, log logr.Logger) (*Status, time.Duration, error) {
+	opts, err := optionsFor(vals)
 	if err != nil {
-		log.Error(err, "unable to create backup CR")
-		return err
-	}
-	log.Info(fmt.Sprintf("backup: %v", u))
-	u1 := &unstructured.Unstructured{}
-	u1.SetGroupVersionKind(schema.GroupVersionKind{
-		Group:   "velero.io",
-		Kind:    "Backup",
-		Version: "v1",
-	})
-
-	for {
-		b.client.Get(context.TODO(), client.ObjectKey{
-			Namespace: "default",
-			Name:      u.GetName(),
-		}, u1)
-
-		log.Info(fmt.Sprintf("backup: %v", u))
-
-		if u1.Object["status"] != nil {
-			status := u1.Object["status"].(map[string]interface{})
-			if status["phase"] == "Completed" {
-				log.Info("Backup Completed. Updating release")
-				acf, err := b.acg.ActionClientFor(obj)
-				if err != nil {
-					log.Error(err, "unable to create acf")
-					return err
-				}
-				backupMap := map[string]interface{}{
-					"backup": map[string]interface{}{
-						"enabled": false,
-					},
-				}
-				//update crd
-				semrel, err := acf.Upgrade(rel.Name, rel.Namespace, rel.Chart, backupMap)
-				if err != nil {
-					log.Error(err, "failed to update matrix")
-					return err
-				}
-				log.Info(fmt.Sprintf("release: %+v", semrel.Info))
-				break
+		return st, 0, err
+	}
+
+	switch {
+	case opts.timedOut(st):
+		st.TimedOut = true
+		log.Info("Backup timed out", "backup", st.Name, "timeout", opts.timeout)
+		return finish(st, PhaseFailed, fmt.Sprintf("backup did not finish within %s", opts.timeout)), 0, nil
+	case st.Phase == PhaseRetrying:
+		if st.NextAttemptTimestamp != nil {
+			if wait := time.Until(st.NextAttemptTimestamp.Time); wait > 0 {
+				return st, wait, nil
 			}
-			//}
-			/*if status["phase"] == "PartiallyFailed" {
-				log.Info("FAILED FAILED FAILED FAILED")
-				return nil
-			}*/
 		}
+		return b.start(ctx, obj, rel, vals, st, st.Trigger, log)
+	}
+	return b.sync(ctx, obj, rel, st, opts, log)
+}
 
+// startNew starts a new backup of rel, replacing the finished one recorded
+// in prev, if any.
+func (b *Backup) startNew(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, prev *Status, trigger Trigger, log logr.Logger) (*Status, time.Duration, error) {
+	if _, err := optionsFor(vals); err != nil {
+		return prev, 0, err
+	}
+	// A restore replaces the objects being backed up.
+	if isEnabled(vals, "restore.enabled") {
+		return prev, 0, invalidValuesError("backup", "backup and restore cannot be enabled simultaneously")
 	}
+	return b.start(ctx, obj, rel, vals, nil, trigger, log)
+}
 
-	return nil
+// start starts a backup of rel. If prev is set, the backup is a retry of the
+// attempt recorded in prev.
+func (b *Backup) start(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, prev *Status, trigger Trigger, log logr.Logger) (*Status, time.Duration, error) {
+	attempt := 1
+	if prev != nil {
+		attempt = prev.Attempt + 1
+	}
+	name, err := backupNameFor(obj, rel, vals, trigger, attempt)
+	if err != nil {
+		return prev, 0, err
+	}
+	spec, err := backupSpecFor(obj, rel, vals)
+	if err != nil {
+		return prev, 0, err
+	}
+	if err := b.provider.Create(ctx, obj, rel, name, spec); err != nil {
+		return prev, 0, err
+	}
+	log.Info("Backup started", "backup", name, "trigger", trigger, "attempt", attempt)
+
+	// Whatever the trigger, the current request has been served by this
+	// backup, so that it does not start another one.
+	st := &Status{
+		Name:               name,
+		Phase:              PhaseInProgress,
+		Trigger:            trigger,
+		RequestToken:       obj.GetAnnotations()[RequestAnnotation],
+		Attempt:            attempt,
+		ReleaseVersion:     rel.Version,
+		ObservedGeneration: obj.GetGeneration(),
+	}
+	if prev != nil {
+		st.RequestToken = prev.RequestToken
+		st.StartTimestamp = prev.StartTimestamp
+	} else {
+		now := metav1.Now().Rfc3339Copy()
+		st.StartTimestamp = &now
+	}
+	return st, DefaultPollInterval, nil
 }
 
-func createBackupCR(rel release.Release, log logr.Logger) (*unstructured.Unstructured, error) {
+func (b *Backup) sync(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, st *Status, opts options, log logr.Logger) (*Status, time.Duration, error) {
+	summary, err := b.provider.Status(ctx, st.Name)
+	if errors.Is(err, ErrNotFound) {
+		return finish(st, PhaseFailed, "velero backup no longer exists"), 0, nil
+	}
+	if err != nil {
+		return st, 0, err
+	}
+
+	phase := summary.Phase
+	st.VeleroPhase = phase
+	st.Errors = summary.Errors
+	st.Warnings = summary.Warnings
 
-	var vals chartutil.Values = rel.Chart.Values
-	backupName, err := vals.PathValue("backup.backupName")
-	if err != nil || backupName.(string) == "" {
-		backupName = "matrix-backup-" + rel.Name + "-" + strconv.Itoa(rel.Version)
+	switch phase {
+	case VeleroPhaseCompleted:
+		log.Info("Backup completed", "backup", st.Name)
+		return finish(st, PhaseCompleted, ""), 0, nil
+	case VeleroPhasePartiallyFailed, VeleroPhaseFailed:
+		message := fmt.Sprintf("velero backup finished in phase %s with %d errors and %d warnings", phase, st.Errors, st.Warnings)
+		if st.Attempt > opts.maxRetries {
+			return finish(st, PhaseFailed, message), 0, nil
+		}
+		backoff := opts.backoff(st.Attempt)
+		next := metav1.NewTime(time.Now().Add(backoff)).Rfc3339Copy()
+		st.Phase = PhaseRetrying
+		st.Message = message
+		st.NextAttemptTimestamp = &next
+		log.Info("Backup failed, retrying", "backup", st.Name, "phase", phase, "attempt", st.Attempt, "backoff", backoff)
+		return st, backoff, nil
+	case VeleroPhaseFailedValidation:
+		return finish(st, PhaseFailed, fmt.Sprintf("velero rejected the backup: %s", strings.Join(summary.ValidationErrors, "; "))), 0, nil
+	case VeleroPhaseDeleting:
+		return finish(st, PhaseFailed, "velero backup is being deleted"), 0, nil
 	}
+	return st, DefaultPollInterval, nil
+}
 
-	log.Info(fmt.Sprintf("backupName: %v", backupName))
+func finish(st *Status, phase Phase, message string) *Status {
+	now := metav1.Now().Rfc3339Copy()
+	st.Phase = phase
+	st.Message = message
+	st.NextAttemptTimestamp = nil
+	st.CompletionTimestamp = &now
+	return st
+}
 
-	u := &unstructured.Unstructured{}
-	u.SetGroupVersionKind(schema.GroupVersionKind{
-		Group:   "velero.io",
-		Kind:    "Backup",
-		Version: "v1",
-	})
+func nestedInt(obj map[string]interface{}, fields ...string) int {
+	v, ok, err := unstructured.NestedFieldNoCopy(obj, fields...)
+	if err != nil || !ok {
+		return 0
+	}
+	i, _ := values.ToInt(v)
+	return i
+}
 
-	u.Object = map[string]interface{}{
-		"apiVersion": "velero.io/v1",
-		"kind":       "Backup",
-		"metadata": map[string]interface{}{
-			"name":      backupName.(string),
-			"namespace": "default",
-			"labels": map[string]interface{}{
-				"velero.io/storage-location": "default",
-			},
-		},
-		"spec": map[string]interface{}{
-			"hooks": map[string]interface{}{},
-			"includeNamespaces": []interface{}{
-				"default",
-			},
-			"storageLocation": "matrix-backup",
-			"ttl":             "720h0m0s",
-		},
+func isEnabled(vals chartutil.Values, path string) bool {
+	v, err := vals.PathValue(path)
+	if err != nil {
+		return false
+	}
+	enabled, ok := v.(bool)
+	return ok && enabled
+}
+
+// backupNameFor returns the name of the backup of rel. Backups enabled in
+// values are named by `backup.backupName` or after the release, its namespace
+// and the generation of obj, as they are taken again for every generation,
+// whether or not it changes the release version. Requested and final backups
+// can be taken several times for the same release version, so their names
+// are always derived from the release and include the time they were
+// started. Retries get the attempt appended, as names cannot be reused.
+func backupNameFor(obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, trigger Trigger, attempt int) (string, error) {
+	parts := []string{strconv.Itoa(rel.Version)}
+	switch trigger {
+	case TriggerValues:
+		parts = append(parts, "generation", strconv.FormatInt(obj.GetGeneration(), 10))
+	case TriggerRequest:
+		parts = append(parts, time.Now().UTC().Format("20060102150405"))
+	case TriggerPreDelete:
+		parts = append(parts, "final", time.Now().UTC().Format("20060102150405"))
+	case TriggerPreUpgrade:
+		parts = append(parts, "pre-upgrade", time.Now().UTC().Format("20060102150405"))
+	}
+	name := ObjectName("matrix-backup", ReleaseNamespace(obj, rel), rel.Name, parts...)
+	if v, ok := values.Lookup(vals, "backup.backupName"); ok && trigger == TriggerValues {
+		s, ok := v.(string)
+		if !ok || len(validation.IsDNS1123Subdomain(s)) > 0 {
+			return "", invalidValuesError("backup.backupName", "%v is not a valid object name", v)
+		}
+		name = s
+	}
+	if attempt > 1 {
+		name = ShortenName(fmt.Sprintf("%s-%d", name, attempt))
+	}
+	return name, nil
+}
+
+// backupSpecFor returns the spec of a Velero Backup of rel as configured by
+// vals. The Backup covers the namespace of the release, falling back to the
+// namespace of the owning custom resource.
+func backupSpecFor(obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values) (map[string]interface{}, error) {
+	namespace := ReleaseNamespace(obj, rel)
+	spec, err := specFor(vals, namespace)
+	if err != nil {
+		return nil, err
+	}
+	scope, err := scopeFor(vals)
+	if err != nil {
+		return nil, err
+	}
+	if scope == ScopeRelease {
+		if err := scopeToRelease(spec, obj, rel); err != nil {
+			return nil, err
+		}
 	}
+	return spec, nil
+}
 
-	return u, nil
+// ReleaseNamespace returns the namespace rel is installed into, or the
+// namespace of its custom resource obj if rel is not known yet.
+func ReleaseNamespace(obj *unstructured.Unstructured, rel *release.Release) string {
+	if rel != nil && rel.Namespace != "" {
+		return rel.Namespace
+	}
+	return obj.GetNamespace()
+}
+
+// ReleaseLabels returns the labels that identify the objects created for the
+// release of obj, like Velero objects and volume snapshots. Releases are
+// named after their custom resource and installed into its namespace.
+func ReleaseLabels(obj *unstructured.Unstructured) map[string]string {
+	return map[string]string{
+		ReleaseNameLabel:      obj.GetName(),
+		ReleaseNamespaceLabel: obj.GetNamespace(),
+	}
 }
@@ -0,0 +1,344 @@
+package backup_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/kubectl/pkg/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+var _ = Describe("Backup", func() {
+	var (
+		cl   client.Client
+		b    backup.Backup
+		obj  *unstructured.Unstructured
+		rel  *release.Release
+		vals chartutil.Values
+	)
+
+	BeforeEach(func() {
+		cl = fake.NewFakeClientWithScheme(scheme.Scheme)
+		b = backup.NewBackup(backup.NewVeleroProvider(cl, "velero"))
+		obj = &unstructured.Unstructured{}
+		obj.SetName("test")
+		obj.SetNamespace("matrix")
+		obj.SetGeneration(1)
+		rel = &release.Release{Name: "test", Namespace: "matrix", Version: 1}
+		vals = chartutil.Values{"backup": map[string]interface{}{"enabled": true}}
+	})
+
+	setStatus := func(st *backup.Status) {
+		m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(st)
+		Expect(err).To(BeNil())
+		Expect(unstructured.SetNestedMap(obj.Object, m, "status", "backup")).To(Succeed())
+	}
+
+	setVeleroPhase := func(name, phase string) {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("velero.io/v1")
+		u.SetKind("Backup")
+		Expect(cl.Get(context.TODO(), client.ObjectKey{Namespace: "velero", Name: name}, u)).To(Succeed())
+		Expect(unstructured.SetNestedField(u.Object, phase, "status", "phase")).To(Succeed())
+		Expect(cl.Update(context.TODO(), u)).To(Succeed())
+	}
+
+	It("should do nothing when backup is not enabled", func() {
+		st, requeueAfter, err := b.Reconcile(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st).To(BeNil())
+		Expect(requeueAfter).To(BeZero())
+	})
+
+	It("should create a velero backup and return without waiting for it", func() {
+		st, requeueAfter, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseInProgress))
+		Expect(st.Name).To(Equal("matrix-backup-matrix-test-1-generation-1"))
+		Expect(st.ObservedGeneration).To(Equal(int64(1)))
+		Expect(requeueAfter).To(Equal(backup.DefaultPollInterval))
+
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("velero.io/v1")
+		u.SetKind("Backup")
+		Expect(cl.Get(context.TODO(), client.ObjectKey{Namespace: "velero", Name: st.Name}, u)).To(Succeed())
+		Expect(u.Object["spec"].(map[string]interface{})["includedNamespaces"]).To(Equal([]interface{}{"matrix"}))
+	})
+
+	It("should not collide with the backup of a same-named release in another namespace", func() {
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+
+		other := obj.DeepCopy()
+		other.SetNamespace("other")
+		otherRel := &release.Release{Name: "test", Namespace: "other", Version: 1}
+		otherSt, _, err := b.Reconcile(context.TODO(), other, otherRel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(otherSt.Name).To(Equal("matrix-backup-other-test-1-generation-1"))
+		Expect(otherSt.Name).NotTo(Equal(st.Name))
+	})
+
+	It("should take another backup when the generation changes without a new release version", func() {
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+		setVeleroPhase(st.Name, "Completed")
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+
+		obj.SetGeneration(2)
+		next, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(next.Phase).To(Equal(backup.PhaseInProgress))
+		Expect(next.Name).To(Equal("matrix-backup-matrix-test-1-generation-2"))
+	})
+
+	It("should take up an existing backup of the release named by backup.backupName", func() {
+		vals["backup"].(map[string]interface{})["backupName"] = "nightly"
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+		setVeleroPhase(st.Name, "Completed")
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+
+		obj.SetGeneration(2)
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Name).To(Equal("nightly"))
+		Expect(st.ObservedGeneration).To(Equal(int64(2)))
+
+		setStatus(st)
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseCompleted))
+	})
+
+	It("should not take up a backup of another release of the same name", func() {
+		vals["backup"].(map[string]interface{})["backupName"] = "nightly"
+		other := obj.DeepCopy()
+		other.SetName("other")
+		_, _, err := b.Reconcile(context.TODO(), other, &release.Release{Name: "other", Namespace: "matrix", Version: 1}, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+
+		_, _, err = b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should keep polling while velero is still working", func() {
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+		setVeleroPhase(st.Name, "InProgress")
+
+		st, requeueAfter, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseInProgress))
+		Expect(st.VeleroPhase).To(Equal("InProgress"))
+		Expect(requeueAfter).To(Equal(backup.DefaultPollInterval))
+	})
+
+	It("should complete when velero completes the backup", func() {
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+		setVeleroPhase(st.Name, "Completed")
+
+		st, requeueAfter, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseCompleted))
+		Expect(st.CompletionTimestamp).NotTo(BeNil())
+		Expect(requeueAfter).To(BeZero())
+	})
+
+	It("should fail when velero fails the backup and no retries are left", func() {
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+		setVeleroPhase(st.Name, "Failed")
+
+		st, requeueAfter, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseFailed))
+		Expect(st.VeleroPhase).To(Equal(backup.VeleroPhaseFailed))
+		Expect(requeueAfter).To(BeZero())
+	})
+
+	It("should not retry a backup that failed validation", func() {
+		vals["backup"].(map[string]interface{})["maxRetries"] = int64(3)
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+		setVeleroPhase(st.Name, "FailedValidation")
+
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseFailed))
+		Expect(st.VeleroPhase).To(Equal(backup.VeleroPhaseFailedValidation))
+	})
+
+	It("should retry a partially failed backup with backoff", func() {
+		vals["backup"].(map[string]interface{})["maxRetries"] = int64(1)
+		vals["backup"].(map[string]interface{})["retryBackoff"] = "0s"
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+		setVeleroPhase(st.Name, "PartiallyFailed")
+
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseRetrying))
+		Expect(st.NextAttemptTimestamp).NotTo(BeNil())
+		setStatus(st)
+
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseInProgress))
+		Expect(st.Attempt).To(Equal(2))
+		Expect(st.Name).To(Equal("matrix-backup-matrix-test-1-generation-1-2"))
+		setStatus(st)
+		setVeleroPhase(st.Name, "PartiallyFailed")
+
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseFailed))
+	})
+
+	It("should fail a backup that exceeds its timeout", func() {
+		vals["backup"].(map[string]interface{})["timeout"] = "1m"
+		start := metav1.NewTime(time.Now().Add(-time.Hour))
+		setStatus(&backup.Status{Name: "slow", Phase: backup.PhaseInProgress, StartTimestamp: &start})
+
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseFailed))
+		Expect(st.TimedOut).To(BeTrue())
+	})
+
+	It("should reject invalid retry settings", func() {
+		vals["backup"].(map[string]interface{})["retryBackoff"] = "soon"
+		_, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should fail when the velero backup disappears", func() {
+		setStatus(&backup.Status{Name: "missing", Phase: backup.PhaseInProgress})
+
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseFailed))
+	})
+
+	It("should take a requested backup", func() {
+		obj.SetAnnotations(map[string]string{backup.RequestAnnotation: "1"})
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseInProgress))
+		Expect(st.Trigger).To(Equal(backup.TriggerRequest))
+		Expect(st.RequestToken).To(Equal("1"))
+		Expect(st.Name).To(HavePrefix("matrix-backup-matrix-test-1-"))
+		setStatus(st)
+		setVeleroPhase(st.Name, "Completed")
+
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseCompleted))
+	})
+
+	It("should handle every backup request once", func() {
+		obj.SetAnnotations(map[string]string{backup.RequestAnnotation: "1"})
+		setStatus(&backup.Status{Name: "done", Phase: backup.PhaseCompleted, RequestToken: "1"})
+
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Name).To(Equal("done"))
+
+		obj.SetAnnotations(map[string]string{backup.RequestAnnotation: "2"})
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseInProgress))
+		Expect(st.RequestToken).To(Equal("2"))
+	})
+
+	It("should mark a pending request as handled by a backup enabled in values", func() {
+		obj.SetAnnotations(map[string]string{backup.RequestAnnotation: "1"})
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Trigger).To(Equal(backup.TriggerRequest))
+		Expect(st.RequestToken).To(Equal("1"))
+		st.Phase = backup.PhaseCompleted
+		setStatus(st)
+
+		st, _, err = b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseCompleted))
+	})
+
+	It("should reject backups while a restore is enabled", func() {
+		vals["restore"] = map[string]interface{}{"enabled": true}
+		_, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(errors.Is(err, backup.ErrInvalidValues)).To(BeTrue())
+	})
+
+	It("should take a final backup once", func() {
+		st, _, err := b.PreDelete(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseInProgress))
+		Expect(st.Trigger).To(Equal(backup.TriggerPreDelete))
+		Expect(st.Name).To(HavePrefix("matrix-backup-matrix-test-1-final-"))
+		setStatus(st)
+		setVeleroPhase(st.Name, "Completed")
+
+		st, _, err = b.PreDelete(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(backup.PhaseCompleted))
+		setStatus(st)
+
+		final := st.Name
+		st, requeueAfter, err := b.PreDelete(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Name).To(Equal(final))
+		Expect(requeueAfter).To(BeZero())
+	})
+
+	It("should finish a backup in flight before taking the final backup", func() {
+		st, _, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+		setVeleroPhase(st.Name, "Completed")
+
+		st, _, err = b.PreDelete(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Trigger).To(Equal(backup.TriggerValues))
+		Expect(st.Phase).To(Equal(backup.PhaseCompleted))
+		setStatus(st)
+
+		st, _, err = b.PreDelete(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Trigger).To(Equal(backup.TriggerPreDelete))
+		Expect(st.Phase).To(Equal(backup.PhaseInProgress))
+	})
+
+	It("should not back up the same generation twice", func() {
+		setStatus(&backup.Status{Name: "done", Phase: backup.PhaseCompleted, ObservedGeneration: 1})
+
+		st, requeueAfter, err := b.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Name).To(Equal("done"))
+		Expect(requeueAfter).To(BeZero())
+	})
+})
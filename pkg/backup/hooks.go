@@ -0,0 +1,288 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/joelanford/helm-operator/pkg/internal/values"
+)
+
+const (
+	// HookOnErrorContinue and HookOnErrorFail tell Velero whether a failing
+	// hook command fails the backup.
+	HookOnErrorContinue = "Continue"
+	HookOnErrorFail     = "Fail"
+
+	// PostgresModeCheckpoint and PostgresModeDump are the modes of the
+	// built-in PostgreSQL hook. A checkpoint flushes all dirty buffers to
+	// disk right before the volume snapshot, a dump writes a pg_dumpall of
+	// the whole cluster next to the data directory.
+	PostgresModeCheckpoint = "checkpoint"
+	PostgresModeDump       = "dump"
+
+	// DefaultPostgresPodSelector selects the pods of the PostgreSQL subchart.
+	DefaultPostgresPodSelector = "app.kubernetes.io/name=postgresql"
+
+	// DefaultPostgresDumpPath is where the dump of the PostgreSQL hook is
+	// written. It is on the persistent volume of the subchart, so that it is
+	// included in the volume snapshot.
+	DefaultPostgresDumpPath = "/bitnami/postgresql/backup/dump.sql"
+
+	defaultPostgresHookTimeout = "5m0s"
+)
+
+// pgClient runs a PostgreSQL client as the superuser configured by the
+// PostgreSQL subchart.
+const pgClient = `PGPASSWORD="${POSTGRES_POSTGRES_PASSWORD:-$POSTGRES_PASSWORD}" %s -h 127.0.0.1 -U "${POSTGRES_USER:-postgres}"`
+
+// hooksFor builds the hooks of a Velero Backup of namespace from the
+// following values:
+//
+//   - backup.hooks - a list of exec hooks. Each hook has a name, a
+//     podSelector given like backup.labelSelector, an optional container,
+//     pre and post commands, a timeout and an onError policy (Continue or
+//     Fail). A command is a list of strings, and pre and post take either a
+//     single command or a list of commands.
+//   - backup.postgresHook - the built-in hook for the PostgreSQL subchart.
+//     It is enabled with `enabled: true` and takes a mode (checkpoint or
+//     dump, default checkpoint), a podSelector, a container, a dumpPath, a
+//     timeout and an onError policy.
+//
+// Velero only runs hooks in pods that are part of the backup, so hooks
+// cannot be combined with resource filters that leave out pods.
+func hooksFor(vals chartutil.Values, namespace string) (map[string]interface{}, error) {
+	var resources []interface{}
+
+	if v, ok := values.Lookup(vals, "backup.hooks"); ok {
+		hooks, ok := v.([]interface{})
+		if !ok {
+			return nil, invalidValuesError("backup.hooks", "must be a list of hooks, got %v", v)
+		}
+		for i, h := range hooks {
+			path := fmt.Sprintf("backup.hooks[%d]", i)
+			m, ok := h.(map[string]interface{})
+			if !ok {
+				return nil, invalidValuesError(path, "must be a hook, got %v", h)
+			}
+			hook, err := hookFor(path, m, namespace)
+			if err != nil {
+				return nil, err
+			}
+			resources = append(resources, hook)
+		}
+	}
+
+	if v, ok := values.Lookup(vals, "backup.postgresHook"); ok {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, invalidValuesError("backup.postgresHook", "must be a map, got %v", v)
+		}
+		hook, err := postgresHookFor(m, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if hook != nil {
+			resources = append(resources, hook)
+		}
+	}
+
+	if len(resources) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	names := map[string]bool{}
+	for _, r := range resources {
+		name := r.(map[string]interface{})["name"].(string)
+		if names[name] {
+			return nil, invalidValuesError("backup.hooks", "hook name %q is used more than once", name)
+		}
+		names[name] = true
+	}
+	if err := checkHooksIncludePods(vals); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"resources": resources}, nil
+}
+
+// hookFor converts a hook given in values into the unstructured form of a
+// Velero BackupResourceHookSpec.
+func hookFor(path string, m map[string]interface{}, namespace string) (map[string]interface{}, error) {
+	name, ok := m["name"].(string)
+	if !ok || len(validation.IsDNS1123Label(name)) > 0 {
+		return nil, invalidValuesError(path+".name", "must be a valid name, got %v", m["name"])
+	}
+	selector, ok := m["podSelector"]
+	if !ok {
+		return nil, invalidValuesError(path+".podSelector", "must be set")
+	}
+	labelSelector, err := labelSelectorFor(selector)
+	if err != nil {
+		return nil, invalidValuesError(path+".podSelector", "%v", err)
+	}
+	exec, err := execFor(path, m)
+	if err != nil {
+		return nil, err
+	}
+
+	hook := map[string]interface{}{
+		"name":               name,
+		"includedNamespaces": []interface{}{namespace},
+		"includedResources":  []interface{}{"pods"},
+		"labelSelector":      labelSelector,
+	}
+	for _, phase := range []string{"pre", "post"} {
+		v, ok := m[phase]
+		if !ok {
+			continue
+		}
+		commands, ok := toCommands(v)
+		if !ok {
+			return nil, invalidValuesError(path+"."+phase, "must be a command or a list of commands, got %v", v)
+		}
+		var hooks []interface{}
+		for _, command := range commands {
+			e := map[string]interface{}{"command": toInterfaceSlice(command)}
+			for k, v := range exec {
+				e[k] = v
+			}
+			hooks = append(hooks, map[string]interface{}{"exec": e})
+		}
+		hook[phase] = hooks
+	}
+	if hook["pre"] == nil && hook["post"] == nil {
+		return nil, invalidValuesError(path, "must have pre or post commands")
+	}
+	return hook, nil
+}
+
+// execFor reads the settings shared by all commands of a hook.
+func execFor(path string, m map[string]interface{}) (map[string]interface{}, error) {
+	exec := map[string]interface{}{}
+	if v, ok := m["container"]; ok {
+		container, ok := v.(string)
+		if !ok || len(validation.IsDNS1123Label(container)) > 0 {
+			return nil, invalidValuesError(path+".container", "must be a container name, got %v", v)
+		}
+		exec["container"] = container
+	}
+	if v, ok := m["timeout"]; ok {
+		timeout, err := parseDuration(v)
+		if err != nil || timeout == 0 {
+			return nil, invalidValuesError(path+".timeout", "must be a positive duration, got %v", v)
+		}
+		exec["timeout"] = timeout.String()
+	}
+	if v, ok := m["onError"]; ok {
+		if v != HookOnErrorContinue && v != HookOnErrorFail {
+			return nil, invalidValuesError(path+".onError", "must be %s or %s, got %v", HookOnErrorContinue, HookOnErrorFail, v)
+		}
+		exec["onError"] = v
+	}
+	return exec, nil
+}
+
+// postgresHookFor builds the built-in PostgreSQL hook from its values, or
+// returns nil if it is not enabled.
+func postgresHookFor(m map[string]interface{}, namespace string) (map[string]interface{}, error) {
+	const path = "backup.postgresHook"
+	v, ok := m["enabled"]
+	if !ok {
+		return nil, nil
+	}
+	if enabled, ok := v.(bool); !ok {
+		return nil, invalidValuesError(path+".enabled", "must be a boolean, got %v", v)
+	} else if !enabled {
+		return nil, nil
+	}
+
+	mode := PostgresModeCheckpoint
+	if v, ok := m["mode"]; ok {
+		if v != PostgresModeCheckpoint && v != PostgresModeDump {
+			return nil, invalidValuesError(path+".mode", "must be %s or %s, got %v", PostgresModeCheckpoint, PostgresModeDump, v)
+		}
+		mode = v.(string)
+	}
+	dumpPath := DefaultPostgresDumpPath
+	if v, ok := m["dumpPath"]; ok {
+		s, ok := v.(string)
+		if !ok || !strings.HasPrefix(s, "/") || strings.Contains(s, "'") {
+			return nil, invalidValuesError(path+".dumpPath", "must be an absolute path, got %v", v)
+		}
+		dumpPath = s
+	}
+
+	hook := map[string]interface{}{
+		"name":        "postgresql",
+		"podSelector": DefaultPostgresPodSelector,
+		"timeout":     defaultPostgresHookTimeout,
+		"onError":     HookOnErrorFail,
+	}
+	for _, k := range []string{"podSelector", "container", "timeout", "onError"} {
+		if v, ok := m[k]; ok {
+			hook[k] = v
+		}
+	}
+	switch mode {
+	case PostgresModeCheckpoint:
+		hook["pre"] = []interface{}{"/bin/sh", "-c", fmt.Sprintf(pgClient, "psql") + " -v ON_ERROR_STOP=1 -c CHECKPOINT"}
+	case PostgresModeDump:
+		// The dump is written to a temporary file first, so that a failed
+		// dump never replaces the one of the previous backup.
+		dump := fmt.Sprintf(pgClient, "pg_dumpall")
+		hook["pre"] = []interface{}{"/bin/sh", "-c",
+			fmt.Sprintf(`mkdir -p "$(dirname '%[1]s')" && %[2]s -f '%[1]s.tmp' && mv '%[1]s.tmp' '%[1]s'`, dumpPath, dump)}
+	}
+	return hookFor(path, hook, namespace)
+}
+
+// checkHooksIncludePods makes sure that pods are part of the backup, as
+// Velero only runs hooks in pods it backs up.
+func checkHooksIncludePods(vals chartutil.Values) error {
+	if v, ok := values.Lookup(vals, "backup.includedResources"); ok {
+		names, _ := toStringSlice(v)
+		included := false
+		for _, name := range names {
+			if name == "*" || name == "pods" {
+				included = true
+			}
+		}
+		if !included {
+			return invalidValuesError("backup.includedResources", "must include pods when backup hooks are set")
+		}
+	}
+	if v, ok := values.Lookup(vals, "backup.excludedResources"); ok {
+		names, _ := toStringSlice(v)
+		for _, name := range names {
+			if name == "pods" {
+				return invalidValuesError("backup.excludedResources", "must not exclude pods when backup hooks are set")
+			}
+		}
+	}
+	return nil
+}
+
+// toCommands accepts either a single command, given as a list of strings,
+// or a list of such commands.
+func toCommands(v interface{}) ([][]string, bool) {
+	if command, ok := toStringSlice(v); ok {
+		if len(command) == 0 {
+			return nil, false
+		}
+		return [][]string{command}, true
+	}
+	l, ok := v.([]interface{})
+	if !ok || len(l) == 0 {
+		return nil, false
+	}
+	commands := make([][]string, 0, len(l))
+	for _, e := range l {
+		command, ok := toStringSlice(e)
+		if !ok || len(command) == 0 {
+			return nil, false
+		}
+		commands = append(commands, command)
+	}
+	return commands, true
+}
@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+var _ = Describe("hooksFor", func() {
+	backupVals := func(m map[string]interface{}) chartutil.Values {
+		return chartutil.Values{"backup": m}
+	}
+
+	It("should return no hooks when nothing is set", func() {
+		hooks, err := hooksFor(chartutil.Values{}, "matrix")
+		Expect(err).To(BeNil())
+		Expect(hooks).To(BeEmpty())
+	})
+
+	It("should map a custom hook", func() {
+		hooks, err := hooksFor(backupVals(map[string]interface{}{
+			"hooks": []interface{}{
+				map[string]interface{}{
+					"name":        "synapse",
+					"podSelector": "app=synapse",
+					"container":   "synapse",
+					"pre":         []interface{}{"/bin/sh", "-c", "sync"},
+					"post": []interface{}{
+						[]interface{}{"/bin/true"},
+						[]interface{}{"/bin/echo", "done"},
+					},
+					"timeout": "1m",
+					"onError": "Continue",
+				},
+			},
+		}), "matrix")
+		Expect(err).To(BeNil())
+		Expect(hooks).To(Equal(map[string]interface{}{
+			"resources": []interface{}{
+				map[string]interface{}{
+					"name":               "synapse",
+					"includedNamespaces": []interface{}{"matrix"},
+					"includedResources":  []interface{}{"pods"},
+					"labelSelector": map[string]interface{}{
+						"matchLabels": map[string]interface{}{"app": "synapse"},
+					},
+					"pre": []interface{}{
+						map[string]interface{}{"exec": map[string]interface{}{
+							"command":   []interface{}{"/bin/sh", "-c", "sync"},
+							"container": "synapse",
+							"timeout":   "1m0s",
+							"onError":   "Continue",
+						}},
+					},
+					"post": []interface{}{
+						map[string]interface{}{"exec": map[string]interface{}{
+							"command":   []interface{}{"/bin/true"},
+							"container": "synapse",
+							"timeout":   "1m0s",
+							"onError":   "Continue",
+						}},
+						map[string]interface{}{"exec": map[string]interface{}{
+							"command":   []interface{}{"/bin/echo", "done"},
+							"container": "synapse",
+							"timeout":   "1m0s",
+							"onError":   "Continue",
+						}},
+					},
+				},
+			},
+		}))
+	})
+
+	It("should not add the postgres hook unless it is enabled", func() {
+		hooks, err := hooksFor(backupVals(map[string]interface{}{
+			"postgresHook": map[string]interface{}{"enabled": false, "mode": "dump"},
+		}), "matrix")
+		Expect(err).To(BeNil())
+		Expect(hooks).To(BeEmpty())
+	})
+
+	It("should add a checkpoint before the snapshot with the postgres preset", func() {
+		hooks, err := hooksFor(backupVals(map[string]interface{}{
+			"postgresHook": map[string]interface{}{"enabled": true},
+		}), "matrix")
+		Expect(err).To(BeNil())
+		hook := hooks["resources"].([]interface{})[0].(map[string]interface{})
+		Expect(hook["name"]).To(Equal("postgresql"))
+		Expect(hook["labelSelector"]).To(Equal(map[string]interface{}{
+			"matchLabels": map[string]interface{}{"app.kubernetes.io/name": "postgresql"},
+		}))
+		Expect(hook).NotTo(HaveKey("post"))
+		exec := hook["pre"].([]interface{})[0].(map[string]interface{})["exec"].(map[string]interface{})
+		Expect(exec["onError"]).To(Equal(HookOnErrorFail))
+		Expect(exec["timeout"]).To(Equal("5m0s"))
+		Expect(exec["command"].([]interface{})[2]).To(ContainSubstring("psql"))
+		Expect(exec["command"].([]interface{})[2]).To(ContainSubstring("CHECKPOINT"))
+	})
+
+	It("should dump the database with the postgres preset in dump mode", func() {
+		hooks, err := hooksFor(backupVals(map[string]interface{}{
+			"postgresHook": map[string]interface{}{
+				"enabled":     true,
+				"mode":        "dump",
+				"dumpPath":    "/data/dump.sql",
+				"podSelector": "app=postgres",
+				"container":   "postgres",
+			},
+		}), "matrix")
+		Expect(err).To(BeNil())
+		hook := hooks["resources"].([]interface{})[0].(map[string]interface{})
+		exec := hook["pre"].([]interface{})[0].(map[string]interface{})["exec"].(map[string]interface{})
+		Expect(exec["container"]).To(Equal("postgres"))
+		Expect(exec["command"].([]interface{})[2]).To(ContainSubstring("pg_dumpall"))
+		Expect(exec["command"].([]interface{})[2]).To(ContainSubstring("'/data/dump.sql'"))
+	})
+
+	DescribeTable("should reject invalid values",
+		func(m map[string]interface{}) {
+			_, err := hooksFor(backupVals(m), "matrix")
+			Expect(errors.Is(err, ErrInvalidValues)).To(BeTrue())
+		},
+		Entry("hooks not a list", map[string]interface{}{"hooks": "pre"}),
+		Entry("hook without name", map[string]interface{}{"hooks": []interface{}{
+			map[string]interface{}{"podSelector": "app=a", "pre": []interface{}{"true"}},
+		}}),
+		Entry("hook without pod selector", map[string]interface{}{"hooks": []interface{}{
+			map[string]interface{}{"name": "a", "pre": []interface{}{"true"}},
+		}}),
+		Entry("hook without commands", map[string]interface{}{"hooks": []interface{}{
+			map[string]interface{}{"name": "a", "podSelector": "app=a"},
+		}}),
+		Entry("hook with invalid onError", map[string]interface{}{"hooks": []interface{}{
+			map[string]interface{}{"name": "a", "podSelector": "app=a", "pre": []interface{}{"true"}, "onError": "Ignore"},
+		}}),
+		Entry("hook with invalid timeout", map[string]interface{}{"hooks": []interface{}{
+			map[string]interface{}{"name": "a", "podSelector": "app=a", "pre": []interface{}{"true"}, "timeout": "later"},
+		}}),
+		Entry("duplicate hook names", map[string]interface{}{"hooks": []interface{}{
+			map[string]interface{}{"name": "a", "podSelector": "app=a", "pre": []interface{}{"true"}},
+			map[string]interface{}{"name": "a", "podSelector": "app=b", "post": []interface{}{"true"}},
+		}}),
+		Entry("pods not included", map[string]interface{}{
+			"includedResources": []interface{}{"secrets"},
+			"postgresHook":      map[string]interface{}{"enabled": true},
+		}),
+		Entry("pods excluded", map[string]interface{}{
+			"excludedResources": []interface{}{"pods"},
+			"postgresHook":      map[string]interface{}{"enabled": true},
+		}),
+		Entry("invalid postgres mode", map[string]interface{}{
+			"postgresHook": map[string]interface{}{"enabled": true, "mode": "vacuum"},
+		}),
+		Entry("relative postgres dump path", map[string]interface{}{
+			"postgresHook": map[string]interface{}{"enabled": true, "mode": "dump", "dumpPath": "dump.sql"},
+		}),
+	)
+})
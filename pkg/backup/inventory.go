@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// scheduleNameLabel is set by Velero on the Backups created by a Schedule.
+const scheduleNameLabel = "velero.io/schedule-name"
+
+// MaxStatusBackups is the number of backups listed in `status.backups`.
+// Scheduled backups accumulate, so only the newest are listed to keep the
+// custom resource small.
+const MaxStatusBackups = 20
+
+// Summary describes one Velero Backup of a release. The summaries of the
+// newest MaxStatusBackups backups are kept in `status.backups`, so that the
+// recent restore points can be seen without access to Velero.
+type Summary struct {
+	Name                string       `json:"name"`
+	Phase               string       `json:"phase,omitempty"`
+	Schedule            string       `json:"schedule,omitempty"`
+	StartTimestamp      *metav1.Time `json:"startTimestamp,omitempty"`
+	CompletionTimestamp *metav1.Time `json:"completionTimestamp,omitempty"`
+	Expiration          *metav1.Time `json:"expiration,omitempty"`
+	ItemsBackedUp       int          `json:"itemsBackedUp,omitempty"`
+	TotalItems          int          `json:"totalItems,omitempty"`
+	Errors              int          `json:"errors,omitempty"`
+	Warnings            int          `json:"warnings,omitempty"`
+	ValidationErrors    []string     `json:"validationErrors,omitempty"`
+}
+
+// Inventory returns a summary of every Velero Backup of the release of obj,
+// on demand or scheduled, newest first.
+func (b *Backup) Inventory(ctx context.Context, obj *unstructured.Unstructured) ([]Summary, error) {
+	summaries, err := b.provider.List(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return newer(summaries[i], summaries[j])
+	})
+	return summaries, nil
+}
+
+// Newest returns the first n summaries, which are the newest n if summaries
+// come from Inventory.
+func Newest(summaries []Summary, n int) []Summary {
+	if len(summaries) > n {
+		return summaries[:n]
+	}
+	return summaries
+}
+
+// LatestCompleted returns the newest completed backup among summaries that
+// started no later than before, or nil if there is none. A zero before
+// matches every backup.
+func LatestCompleted(summaries []Summary, before time.Time) *Summary {
+	var latest *Summary
+	for i := range summaries {
+		s := &summaries[i]
+		if s.Phase != VeleroPhaseCompleted || s.StartTimestamp == nil {
+			continue
+		}
+		if !before.IsZero() && s.StartTimestamp.Time.After(before) {
+			continue
+		}
+		if latest == nil || newer(*s, *latest) {
+			latest = s
+		}
+	}
+	return latest
+}
+
+// newer orders summaries by start time, newest first. Backups that have not
+// started yet come before all others.
+func newer(a, b Summary) bool {
+	switch {
+	case a.StartTimestamp == nil && b.StartTimestamp == nil:
+		return a.Name > b.Name
+	case a.StartTimestamp == nil:
+		return true
+	case b.StartTimestamp == nil:
+		return false
+	case !a.StartTimestamp.Equal(b.StartTimestamp):
+		return b.StartTimestamp.Before(a.StartTimestamp)
+	}
+	return a.Name > b.Name
+}
+
+func summaryFor(u *unstructured.Unstructured) Summary {
+	phase, _, _ := unstructured.NestedString(u.Object, "status", "phase")
+	validationErrors, _, _ := unstructured.NestedStringSlice(u.Object, "status", "validationErrors")
+	return Summary{
+		Name:                u.GetName(),
+		Phase:               phase,
+		Schedule:            u.GetLabels()[scheduleNameLabel],
+		StartTimestamp:      nestedTime(u.Object, "status", "startTimestamp"),
+		CompletionTimestamp: nestedTime(u.Object, "status", "completionTimestamp"),
+		Expiration:          nestedTime(u.Object, "status", "expiration"),
+		ItemsBackedUp:       nestedInt(u.Object, "status", "progress", "itemsBackedUp"),
+		TotalItems:          nestedInt(u.Object, "status", "progress", "totalItems"),
+		Errors:              nestedInt(u.Object, "status", "errors"),
+		Warnings:            nestedInt(u.Object, "status", "warnings"),
+		ValidationErrors:    validationErrors,
+	}
+}
+
+func nestedTime(obj map[string]interface{}, fields ...string) *metav1.Time {
+	s, ok, err := unstructured.NestedString(obj, fields...)
+	if err != nil || !ok {
+		return nil
+	}
+	t := &metav1.Time{}
+	if err := t.UnmarshalQueryParameter(s); err != nil {
+		return nil
+	}
+	return t
+}
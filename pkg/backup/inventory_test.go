@@ -0,0 +1,146 @@
+package backup_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+var _ = Describe("Inventory", func() {
+	var (
+		cl  client.Client
+		b   backup.Backup
+		obj *unstructured.Unstructured
+	)
+
+	BeforeEach(func() {
+		sch := runtime.NewScheme()
+		sch.AddKnownTypeWithName(schema.GroupVersionKind{Group: "velero.io", Version: "v1", Kind: "BackupList"}, &unstructured.UnstructuredList{})
+		cl = fake.NewFakeClientWithScheme(sch)
+		b = backup.NewBackup(backup.NewVeleroProvider(cl, "velero"))
+		obj = &unstructured.Unstructured{}
+		obj.SetName("test")
+		obj.SetNamespace("matrix")
+	})
+
+	createBackup := func(name, release string, labels map[string]string, status map[string]interface{}) {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("velero.io/v1")
+		u.SetKind("Backup")
+		u.SetNamespace("velero")
+		u.SetName(name)
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[backup.ReleaseNameLabel] = release
+		labels[backup.ReleaseNamespaceLabel] = "matrix"
+		u.SetLabels(labels)
+		if status != nil {
+			u.Object["status"] = status
+		}
+		Expect(cl.Create(context.TODO(), u)).To(Succeed())
+	}
+
+	It("should be empty without backups", func() {
+		summaries, err := b.Inventory(context.TODO(), obj)
+		Expect(err).To(BeNil())
+		Expect(summaries).To(BeEmpty())
+	})
+
+	It("should summarize the backups of the release, newest first", func() {
+		createBackup("old", "test", nil, map[string]interface{}{
+			"phase":               "Completed",
+			"startTimestamp":      "2020-08-01T03:00:00Z",
+			"completionTimestamp": "2020-08-01T03:05:00Z",
+			"expiration":          "2020-08-31T03:00:00Z",
+			"progress":            map[string]interface{}{"itemsBackedUp": int64(42), "totalItems": int64(42)},
+			"warnings":            int64(2),
+		})
+		createBackup("nightly-20200802030000", "test", map[string]string{"velero.io/schedule-name": "nightly"}, map[string]interface{}{
+			"phase":          "PartiallyFailed",
+			"startTimestamp": "2020-08-02T03:00:00Z",
+			"errors":         int64(1),
+		})
+		createBackup("new", "test", nil, nil)
+		createBackup("other", "other", nil, nil)
+
+		summaries, err := b.Inventory(context.TODO(), obj)
+		Expect(err).To(BeNil())
+		Expect(summaries).To(HaveLen(3))
+		Expect(summaries[0]).To(Equal(backup.Summary{Name: "new"}))
+		Expect(summaries[1]).To(Equal(backup.Summary{
+			Name:           "nightly-20200802030000",
+			Phase:          "PartiallyFailed",
+			Schedule:       "nightly",
+			StartTimestamp: timePtr("2020-08-02T03:00:00Z"),
+			Errors:         1,
+		}))
+		Expect(summaries[2]).To(Equal(backup.Summary{
+			Name:                "old",
+			Phase:               "Completed",
+			StartTimestamp:      timePtr("2020-08-01T03:00:00Z"),
+			CompletionTimestamp: timePtr("2020-08-01T03:05:00Z"),
+			Expiration:          timePtr("2020-08-31T03:00:00Z"),
+			ItemsBackedUp:       42,
+			TotalItems:          42,
+			Warnings:            2,
+		}))
+	})
+})
+
+var _ = Describe("LatestCompleted", func() {
+	var summaries []backup.Summary
+
+	BeforeEach(func() {
+		summaries = []backup.Summary{
+			{Name: "old", Phase: backup.VeleroPhaseCompleted, StartTimestamp: timePtr("2020-01-01T00:00:00Z")},
+			{Name: "failed", Phase: backup.VeleroPhasePartiallyFailed, StartTimestamp: timePtr("2020-01-04T00:00:00Z")},
+			{Name: "new", Phase: backup.VeleroPhaseCompleted, StartTimestamp: timePtr("2020-01-03T00:00:00Z")},
+			{Name: "middle", Phase: backup.VeleroPhaseCompleted, StartTimestamp: timePtr("2020-01-02T00:00:00Z")},
+			{Name: "running", Phase: "InProgress"},
+		}
+	})
+
+	It("should return the newest completed backup", func() {
+		Expect(backup.LatestCompleted(summaries, time.Time{}).Name).To(Equal("new"))
+	})
+
+	It("should return the newest completed backup before a point in time", func() {
+		Expect(backup.LatestCompleted(summaries, timePtr("2020-01-02T12:00:00Z").Time).Name).To(Equal("middle"))
+		Expect(backup.LatestCompleted(summaries, timePtr("2020-01-02T00:00:00Z").Time).Name).To(Equal("middle"))
+	})
+
+	It("should return nil without a matching backup", func() {
+		Expect(backup.LatestCompleted(summaries, timePtr("2019-12-31T00:00:00Z").Time)).To(BeNil())
+		Expect(backup.LatestCompleted(nil, time.Time{})).To(BeNil())
+	})
+})
+
+func timePtr(s string) *metav1.Time {
+	t := &metav1.Time{}
+	Expect(t.UnmarshalQueryParameter(s)).To(Succeed())
+	return t
+}
+
+var _ = Describe("Newest", func() {
+	It("should return the first n summaries", func() {
+		summaries := []backup.Summary{{Name: "c"}, {Name: "b"}, {Name: "a"}}
+		Expect(backup.Newest(summaries, 2)).To(Equal([]backup.Summary{{Name: "c"}, {Name: "b"}}))
+	})
+
+	It("should return all summaries if there are no more than n", func() {
+		summaries := []backup.Summary{{Name: "b"}, {Name: "a"}}
+		Expect(backup.Newest(summaries, 2)).To(Equal(summaries))
+		Expect(backup.Newest(nil, 2)).To(BeEmpty())
+	})
+})
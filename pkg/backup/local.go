@@ -0,0 +1,409 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+var localLog = logf.Log.WithName("local_backup")
+
+// LocalProvider is a BackupProvider that writes backups to archives in a
+// local directory, e.g. a mounted PersistentVolumeClaim. A backup holds the
+// Helm release secrets, the live objects of the release manifest and the
+// custom resource, so it does not need Velero. It does not include volume
+// data, and the parts of the backup spec that only apply to Velero are
+// ignored.
+//
+// Backups are taken and restored synchronously, so they have already
+// finished when Create and Restore return.
+type LocalProvider struct {
+	client client.Client
+
+	// dir is the directory the archives are written to.
+	dir string
+}
+
+var _ BackupProvider = &LocalProvider{}
+
+// localBackup is the record of a backup kept next to its archive.
+type localBackup struct {
+	ReleaseName      string  `json:"releaseName"`
+	ReleaseNamespace string  `json:"releaseNamespace"`
+	Summary          Summary `json:"summary"`
+}
+
+// localRestore is the record of a restore.
+type localRestore struct {
+	BackupName string `json:"backupName"`
+	Phase      string `json:"phase"`
+	Errors     int    `json:"errors,omitempty"`
+	Warnings   int    `json:"warnings,omitempty"`
+}
+
+// Archive entries are restored in the order they are written: the release
+// secrets first, so that Helm sees the release when the custom resource is
+// reconciled, and the custom resource last.
+const (
+	releaseEntryPrefix  = "release/"
+	objectEntryPrefix   = "objects/"
+	customResourceEntry = "custom-resource.yaml"
+)
+
+// NewLocalProvider returns a LocalProvider that writes archives to dir.
+func NewLocalProvider(client client.Client, dir string) *LocalProvider {
+	return &LocalProvider{
+		client: client,
+		dir:    dir,
+	}
+}
+
+func (p *LocalProvider) Create(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, name string, _ map[string]interface{}) error {
+	if err := checkFileName(name); err != nil {
+		return err
+	}
+	start := metav1.Now().Rfc3339Copy()
+	entries, missing, err := p.collect(ctx, obj, rel)
+	if err != nil {
+		return fmt.Errorf("collect objects of release %q: %w", rel.Name, err)
+	}
+	if err := p.writeArchive(name, entries); err != nil {
+		return fmt.Errorf("write backup %q: %w", name, err)
+	}
+	completion := metav1.Now().Rfc3339Copy()
+
+	record := localBackup{
+		ReleaseName:      obj.GetName(),
+		ReleaseNamespace: obj.GetNamespace(),
+		Summary: Summary{
+			Name:                name,
+			Phase:               VeleroPhaseCompleted,
+			StartTimestamp:      &start,
+			CompletionTimestamp: &completion,
+			ItemsBackedUp:       len(entries),
+			TotalItems:          len(entries) + missing,
+			Warnings:            missing,
+		},
+	}
+	return p.writeRecord(name+".json", record)
+}
+
+func (p *LocalProvider) Status(_ context.Context, name string) (*Summary, error) {
+	if err := checkFileName(name); err != nil {
+		return nil, err
+	}
+	var record localBackup
+	if err := p.readRecord(name+".json", &record); err != nil {
+		return nil, err
+	}
+	return &record.Summary, nil
+}
+
+// List returns the backups of the release of obj. Other files in the backup
+// directory, and records that cannot be read, are skipped, so that a single
+// stray or damaged file does not hide all backups.
+func (p *LocalProvider) List(_ context.Context, obj *unstructured.Unstructured) ([]Summary, error) {
+	files, err := filepath.Glob(filepath.Join(p.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var summaries []Summary
+	for _, f := range files {
+		var record localBackup
+		if err := p.readRecord(filepath.Base(f), &record); err != nil {
+			localLog.Error(err, "Skipping unreadable backup record", "file", f)
+			continue
+		}
+		if record.Summary.Name == "" {
+			localLog.Info("Skipping file that is not a backup record", "file", f)
+			continue
+		}
+		if record.ReleaseName == obj.GetName() && record.ReleaseNamespace == obj.GetNamespace() {
+			summaries = append(summaries, record.Summary)
+		}
+	}
+	return summaries, nil
+}
+
+func (p *LocalProvider) Delete(_ context.Context, name string) error {
+	if err := checkFileName(name); err != nil {
+		return err
+	}
+	for _, f := range []string{name + ".tar.gz", name + ".json"} {
+		if err := os.Remove(filepath.Join(p.dir, f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore creates the objects in the backup named by spec["backupName"].
+// Like Velero, it leaves objects that already exist alone and counts them as
+// warnings. Of the rest of the spec, it honours spec["namespaceMapping"] and
+// the kinds listed in spec["excludedResources"], e.g. "matrix.example.com".
+func (p *LocalProvider) Restore(ctx context.Context, _ *unstructured.Unstructured, name string, spec map[string]interface{}) error {
+	if err := checkFileName(name); err != nil {
+		return err
+	}
+	backupName, _ := spec["backupName"].(string)
+	if err := checkFileName(backupName); err != nil {
+		return err
+	}
+	objs, err := p.readArchive(backupName)
+	if err != nil {
+		return fmt.Errorf("read backup %q: %w", backupName, err)
+	}
+
+	mapping, _ := spec["namespaceMapping"].(map[string]interface{})
+	excluded, _ := toStringSlice(spec["excludedResources"])
+	record := localRestore{BackupName: backupName, Phase: VeleroPhaseCompleted}
+	for i := range objs {
+		if isExcludedKind(&objs[i], excluded) {
+			continue
+		}
+		if namespace, ok := mapping[objs[i].GetNamespace()].(string); ok {
+			objs[i].SetNamespace(namespace)
+		}
+		err := p.client.Create(ctx, &objs[i])
+		switch {
+		case apierrors.IsAlreadyExists(err):
+			record.Warnings++
+		case err != nil:
+			record.Errors++
+		}
+	}
+	if record.Errors > 0 {
+		record.Phase = VeleroPhasePartiallyFailed
+	}
+	return p.writeRecord(filepath.Join("restores", name+".json"), record)
+}
+
+func (p *LocalProvider) RestoreStatus(_ context.Context, name string) (string, error) {
+	if err := checkFileName(name); err != nil {
+		return "", err
+	}
+	var record localRestore
+	if err := p.readRecord(filepath.Join("restores", name+".json"), &record); err != nil {
+		return "", err
+	}
+	return record.Phase, nil
+}
+
+func (p *LocalProvider) DeleteRestore(_ context.Context, name string) error {
+	if err := checkFileName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(p.dir, "restores", name+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isExcludedKind returns whether the kind of obj, lower-cased and qualified
+// with its group, is one of excluded.
+func isExcludedKind(obj *unstructured.Unstructured, excluded []string) bool {
+	kind := strings.ToLower(obj.GetKind())
+	if group := obj.GroupVersionKind().Group; group != "" {
+		kind += "." + group
+	}
+	for _, e := range excluded {
+		if e == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// collect returns the archive entries for the release of obj, along with the
+// number of manifest objects that no longer exist.
+func (p *LocalProvider) collect(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release) ([]archiveEntry, int, error) {
+	var entries []archiveEntry
+
+	secrets := &unstructured.UnstructuredList{}
+	secrets.SetAPIVersion("v1")
+	secrets.SetKind("SecretList")
+	if err := p.client.List(ctx, secrets, client.InNamespace(rel.Namespace), client.MatchingLabels{"owner": "helm", "name": rel.Name}); err != nil {
+		return nil, 0, err
+	}
+	for i := range secrets.Items {
+		entries = append(entries, newArchiveEntry(releaseEntryPrefix, &secrets.Items[i]))
+	}
+
+	manifestObjs, err := releaseObjects(rel, obj)
+	if err != nil {
+		return nil, 0, err
+	}
+	missing := 0
+	for _, m := range manifestObjs {
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(m.GroupVersionKind())
+		namespace := m.GetNamespace()
+		if namespace == "" {
+			namespace = rel.Namespace
+		}
+		err := p.client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: m.GetName()}, live)
+		if apierrors.IsNotFound(err) {
+			missing++
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, newArchiveEntry(objectEntryPrefix, live))
+	}
+
+	cr := obj.DeepCopy()
+	sanitize(cr)
+	entries = append(entries, archiveEntry{name: customResourceEntry, obj: cr})
+	return entries, missing, nil
+}
+
+type archiveEntry struct {
+	name string
+	obj  *unstructured.Unstructured
+}
+
+func newArchiveEntry(prefix string, obj *unstructured.Unstructured) archiveEntry {
+	obj = obj.DeepCopy()
+	sanitize(obj)
+	name := strings.ToLower(obj.GetKind())
+	if group := obj.GroupVersionKind().Group; group != "" {
+		name += "." + group
+	}
+	return archiveEntry{name: fmt.Sprintf("%s%s/%s.yaml", prefix, name, obj.GetName()), obj: obj}
+}
+
+// sanitize removes the fields that are set by the API server, so that obj
+// can be created again. Owner references are removed as well, as they refer
+// to the UID of the custom resource at backup time; the operator adds them
+// again when it reconciles the restored release.
+func sanitize(obj *unstructured.Unstructured) {
+	delete(obj.Object, "status")
+	for _, field := range []string{"resourceVersion", "uid", "selfLink", "creationTimestamp", "generation", "managedFields", "deletionTimestamp", "deletionGracePeriodSeconds", "finalizers", "ownerReferences"} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+}
+
+// writeArchive writes the entries to the archive of the backup named name.
+// The archive is written to a temporary file first, so that a failed backup
+// never leaves a truncated archive behind.
+func (p *LocalProvider) writeArchive(name string, entries []archiveEntry) error {
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(p.dir, "."+name+"-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		data, err := yaml.Marshal(e.obj.Object)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0600, Size: int64(len(data))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(p.dir, name+".tar.gz"))
+}
+
+// readArchive returns the objects in the archive of the backup named name,
+// in the order they were written.
+func (p *LocalProvider) readArchive(name string) ([]unstructured.Unstructured, error) {
+	f, err := os.Open(filepath.Join(p.dir, name+".tar.gz"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	var objs []unstructured.Unstructured
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return nil, err
+		}
+		var obj unstructured.Unstructured
+		if err := yaml.Unmarshal(buf.Bytes(), &obj.Object); err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+func (p *LocalProvider) writeRecord(file string, record interface{}) error {
+	path := filepath.Join(p.dir, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func (p *LocalProvider) readRecord(file string, record interface{}) error {
+	data, err := ioutil.ReadFile(filepath.Join(p.dir, file))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, record)
+}
+
+// checkFileName makes sure that name can be used as a file name in the
+// backup directory.
+func checkFileName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid backup or restore name %q", name)
+	}
+	return nil
+}
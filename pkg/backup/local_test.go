@@ -0,0 +1,198 @@
+package backup_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+const localTestManifest = `---
+apiVersion: v1
+kind: Service
+metadata:
+  name: synapse
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: missing
+`
+
+// newLocalTestClient returns a fake client that handles secrets as
+// unstructured objects, as the fake client cannot list typed objects into an
+// UnstructuredList.
+func newLocalTestClient() client.Client {
+	sch := runtime.NewScheme()
+	sch.AddKnownTypeWithName(schema.GroupVersionKind{Version: "v1", Kind: "SecretList"}, &unstructured.UnstructuredList{})
+	return fake.NewFakeClientWithScheme(sch)
+}
+
+var _ = Describe("LocalProvider", func() {
+	var (
+		dir string
+		cl  client.Client
+		p   *backup.LocalProvider
+		obj *unstructured.Unstructured
+		rel *release.Release
+	)
+
+	newObject := func(apiVersion, kind, name string, labels map[string]string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion(apiVersion)
+		u.SetKind(kind)
+		u.SetNamespace("matrix")
+		u.SetName(name)
+		u.SetLabels(labels)
+		return u
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "local-provider-")
+		Expect(err).To(BeNil())
+
+		cl = newLocalTestClient()
+		p = backup.NewLocalProvider(cl, dir)
+		obj = newObject("matrix.example.com/v1", "Matrix", "test", nil)
+		obj.SetUID("1234")
+		Expect(unstructured.SetNestedField(obj.Object, "matrix.example.com", "spec", "serverName")).To(Succeed())
+		rel = &release.Release{Name: "test", Namespace: "matrix", Version: 1, Manifest: localTestManifest}
+
+		Expect(cl.Create(context.TODO(), newObject("v1", "Secret", "sh.helm.release.v1.test.v1", map[string]string{"owner": "helm", "name": "test"}))).To(Succeed())
+		Expect(cl.Create(context.TODO(), newObject("v1", "Service", "synapse", nil))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should take a backup synchronously", func() {
+		Expect(p.Create(context.TODO(), obj, rel, "first", nil)).To(Succeed())
+		Expect(filepath.Join(dir, "first.tar.gz")).To(BeAnExistingFile())
+
+		s, err := p.Status(context.TODO(), "first")
+		Expect(err).To(BeNil())
+		Expect(s.Name).To(Equal("first"))
+		Expect(s.Phase).To(Equal(backup.VeleroPhaseCompleted))
+		Expect(s.StartTimestamp).NotTo(BeNil())
+		Expect(s.CompletionTimestamp).NotTo(BeNil())
+		// The release secret, the service and the custom resource; the
+		// config map no longer exists.
+		Expect(s.ItemsBackedUp).To(Equal(3))
+		Expect(s.TotalItems).To(Equal(4))
+		Expect(s.Warnings).To(Equal(1))
+	})
+
+	It("should list the backups of the release only", func() {
+		other := newObject("matrix.example.com/v1", "Matrix", "other", nil)
+		Expect(p.Create(context.TODO(), obj, rel, "first", nil)).To(Succeed())
+		Expect(p.Create(context.TODO(), other, &release.Release{Name: "other", Namespace: "matrix"}, "second", nil)).To(Succeed())
+
+		summaries, err := p.List(context.TODO(), obj)
+		Expect(err).To(BeNil())
+		Expect(summaries).To(HaveLen(1))
+		Expect(summaries[0].Name).To(Equal("first"))
+	})
+
+	It("should skip files that are not backup records", func() {
+		Expect(p.Create(context.TODO(), obj, rel, "first", nil)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "other.json"), []byte(`{"releaseName": "test", "releaseNamespace": "matrix"}`), 0600)).To(Succeed())
+
+		summaries, err := p.List(context.TODO(), obj)
+		Expect(err).To(BeNil())
+		Expect(summaries).To(HaveLen(1))
+		Expect(summaries[0].Name).To(Equal("first"))
+	})
+
+	It("should restore the release into an empty cluster", func() {
+		Expect(p.Create(context.TODO(), obj, rel, "first", nil)).To(Succeed())
+
+		target := newLocalTestClient()
+		rp := backup.NewLocalProvider(target, dir)
+		Expect(rp.Restore(context.TODO(), obj, "restore-1", map[string]interface{}{"backupName": "first"})).To(Succeed())
+		phase, err := rp.RestoreStatus(context.TODO(), "restore-1")
+		Expect(err).To(BeNil())
+		Expect(phase).To(Equal(backup.VeleroPhaseCompleted))
+
+		secret := newObject("v1", "Secret", "", nil)
+		Expect(target.Get(context.TODO(), client.ObjectKey{Namespace: "matrix", Name: "sh.helm.release.v1.test.v1"}, secret)).To(Succeed())
+		Expect(secret.GetLabels()).To(HaveKeyWithValue("owner", "helm"))
+
+		cr := newObject("matrix.example.com/v1", "Matrix", "", nil)
+		Expect(target.Get(context.TODO(), client.ObjectKey{Namespace: "matrix", Name: "test"}, cr)).To(Succeed())
+		Expect(cr.GetUID()).NotTo(Equal(obj.GetUID()))
+		Expect(cr.Object["spec"]).To(Equal(obj.Object["spec"]))
+	})
+
+	It("should map namespaces and leave out excluded kinds", func() {
+		Expect(p.Create(context.TODO(), obj, rel, "first", nil)).To(Succeed())
+
+		target := newLocalTestClient()
+		rp := backup.NewLocalProvider(target, dir)
+		Expect(rp.Restore(context.TODO(), obj, "restore-1", map[string]interface{}{
+			"backupName":        "first",
+			"namespaceMapping":  map[string]interface{}{"matrix": "scratch"},
+			"excludedResources": []interface{}{"matrix.matrix.example.com"},
+		})).To(Succeed())
+
+		svc := newObject("v1", "Service", "", nil)
+		Expect(target.Get(context.TODO(), client.ObjectKey{Namespace: "scratch", Name: "synapse"}, svc)).To(Succeed())
+		cr := newObject("matrix.example.com/v1", "Matrix", "", nil)
+		Expect(target.Get(context.TODO(), client.ObjectKey{Namespace: "scratch", Name: "test"}, cr)).NotTo(Succeed())
+		Expect(target.Get(context.TODO(), client.ObjectKey{Namespace: "matrix", Name: "test"}, cr)).NotTo(Succeed())
+	})
+
+	It("should count objects that already exist as warnings", func() {
+		Expect(p.Create(context.TODO(), obj, rel, "first", nil)).To(Succeed())
+		Expect(p.Restore(context.TODO(), obj, "restore-1", map[string]interface{}{"backupName": "first"})).To(Succeed())
+		phase, err := p.RestoreStatus(context.TODO(), "restore-1")
+		Expect(err).To(BeNil())
+		Expect(phase).To(Equal(backup.VeleroPhaseCompleted))
+	})
+
+	It("should delete a backup", func() {
+		Expect(p.Create(context.TODO(), obj, rel, "first", nil)).To(Succeed())
+		Expect(p.Delete(context.TODO(), "first")).To(Succeed())
+		Expect(filepath.Join(dir, "first.tar.gz")).NotTo(BeAnExistingFile())
+		_, err := p.Status(context.TODO(), "first")
+		Expect(errors.Is(err, backup.ErrNotFound)).To(BeTrue())
+		Expect(p.Delete(context.TODO(), "first")).To(Succeed())
+	})
+
+	It("should delete a restore", func() {
+		Expect(p.Create(context.TODO(), obj, rel, "first", nil)).To(Succeed())
+		Expect(p.Restore(context.TODO(), obj, "restore-1", map[string]interface{}{"backupName": "first"})).To(Succeed())
+		Expect(p.DeleteRestore(context.TODO(), "restore-1")).To(Succeed())
+		_, err := p.RestoreStatus(context.TODO(), "restore-1")
+		Expect(errors.Is(err, backup.ErrNotFound)).To(BeTrue())
+		Expect(p.DeleteRestore(context.TODO(), "restore-1")).To(Succeed())
+	})
+
+	It("should reject names that are not file names", func() {
+		Expect(p.Create(context.TODO(), obj, rel, "../first", nil)).NotTo(Succeed())
+		Expect(p.Restore(context.TODO(), obj, "restore-1", map[string]interface{}{"backupName": "../first"})).NotTo(Succeed())
+	})
+
+	It("should not support schedules", func() {
+		b := backup.NewBackup(p)
+		vals := chartutil.Values{"backup": map[string]interface{}{"schedule": "0 3 * * *"}}
+		_, err := b.ReconcileSchedule(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(errors.Is(err, backup.ErrInvalidValues)).To(BeTrue())
+	})
+})
@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Metrics are the Prometheus metrics of the backups and restores of the
+// releases of one kind of custom resource. They are labelled with the
+// namespace and name of the custom resource. All methods can be called on a
+// nil *Metrics, in which case nothing is recorded.
+type Metrics struct {
+	backupDuration    *prometheus.HistogramVec
+	backupLastSuccess *prometheus.GaugeVec
+	backupFailures    *prometheus.CounterVec
+	backupsRetained   *prometheus.GaugeVec
+
+	restoreDuration    *prometheus.HistogramVec
+	restoreLastSuccess *prometheus.GaugeVec
+	restoreFailures    *prometheus.CounterVec
+}
+
+// failurePhases are the values of the phase label of the failure counters.
+// Besides the Velero phases a backup or restore can fail in, TimedOut is used
+// for a backup that did not finish in time and Unknown for one whose Velero
+// object disappeared.
+var failurePhases = []string{VeleroPhasePartiallyFailed, VeleroPhaseFailed, VeleroPhaseFailedValidation, VeleroPhaseDeleting, "TimedOut", "Unknown"}
+
+// durationBuckets range from 30 seconds to a little over 4 hours.
+var durationBuckets = prometheus.ExponentialBuckets(30, 2, 10)
+
+// NewMetrics returns the metrics of the custom resources of kind. Their names
+// are prefixed with the lower-cased kind, like the info metric of the
+// reconciler.
+func NewMetrics(kind string) *Metrics {
+	prefix := strings.ToLower(kind)
+	labels := []string{"namespace", "name"}
+	return &Metrics{
+		backupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prefix + "_backup_duration_seconds",
+			Help:    fmt.Sprintf("Duration of the completed backups of %s releases.", kind),
+			Buckets: durationBuckets,
+		}, labels),
+		backupLastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + "_backup_last_success_timestamp_seconds",
+			Help: fmt.Sprintf("Time the last successful backup of a %s release completed.", kind),
+		}, labels),
+		backupFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_backup_failures_total",
+			Help: fmt.Sprintf("Number of failed backups of %s releases by Velero phase.", kind),
+		}, append(labels, "phase")),
+		backupsRetained: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + "_backups_retained",
+			Help: fmt.Sprintf("Number of completed backups kept of a %s release.", kind),
+		}, labels),
+		restoreDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prefix + "_restore_duration_seconds",
+			Help:    fmt.Sprintf("Duration of the completed restores of %s releases.", kind),
+			Buckets: durationBuckets,
+		}, labels),
+		restoreLastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + "_restore_last_success_timestamp_seconds",
+			Help: fmt.Sprintf("Time the last successful restore of a %s release completed.", kind),
+		}, labels),
+		restoreFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_restore_failures_total",
+			Help: fmt.Sprintf("Number of failed restores of %s releases by Velero phase.", kind),
+		}, append(labels, "phase")),
+	}
+}
+
+// Register registers all metrics with reg.
+func (m *Metrics) Register(reg prometheus.Registerer) error {
+	for _, c := range m.collectors() {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ObserveBackup records a backup that has just finished. The completion of
+// the last successful backup is left to SetLastSuccess, which also sees the
+// backups that were not taken by the operator.
+func (m *Metrics) ObserveBackup(obj *unstructured.Unstructured, st *Status) {
+	if m == nil || !st.IsFinished() {
+		return
+	}
+	if st.Phase == PhaseFailed {
+		phase := st.VeleroPhase
+		switch {
+		case st.TimedOut:
+			phase = "TimedOut"
+		case phase == "":
+			phase = "Unknown"
+		}
+		m.backupFailures.WithLabelValues(obj.GetNamespace(), obj.GetName(), phase).Inc()
+		return
+	}
+	if st.StartTimestamp != nil && st.CompletionTimestamp != nil {
+		m.backupDuration.WithLabelValues(obj.GetNamespace(), obj.GetName()).
+			Observe(st.CompletionTimestamp.Sub(st.StartTimestamp.Time).Seconds())
+	}
+}
+
+// ObserveRestore records a restore that has finished in the given Velero
+// phase after running for duration.
+func (m *Metrics) ObserveRestore(obj *unstructured.Unstructured, phase string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	if phase != VeleroPhaseCompleted {
+		if phase == "" {
+			phase = "Unknown"
+		}
+		m.restoreFailures.WithLabelValues(obj.GetNamespace(), obj.GetName(), phase).Inc()
+		return
+	}
+	m.restoreDuration.WithLabelValues(obj.GetNamespace(), obj.GetName()).Observe(duration.Seconds())
+	m.restoreLastSuccess.WithLabelValues(obj.GetNamespace(), obj.GetName()).SetToCurrentTime()
+}
+
+// SetRetained records the number of completed backups among summaries, the
+// backups kept of the release of obj. Backups that failed or are still in
+// progress cannot be restored, so they are not counted.
+func (m *Metrics) SetRetained(obj *unstructured.Unstructured, summaries []Summary) {
+	if m == nil {
+		return
+	}
+	n := 0
+	for _, s := range summaries {
+		if s.Phase == VeleroPhaseCompleted {
+			n++
+		}
+	}
+	m.backupsRetained.WithLabelValues(obj.GetNamespace(), obj.GetName()).Set(float64(n))
+}
+
+// SetLastSuccess records the completion time of s, the newest completed
+// backup of the release of obj, so that backups taken on a schedule count as
+// well and the gauge survives restarts of the operator. Nothing is recorded
+// if s is nil.
+func (m *Metrics) SetLastSuccess(obj *unstructured.Unstructured, s *Summary) {
+	if m == nil || s == nil {
+		return
+	}
+	completion := s.StartTimestamp
+	if s.CompletionTimestamp != nil {
+		completion = s.CompletionTimestamp
+	}
+	if completion == nil {
+		return
+	}
+	m.backupLastSuccess.WithLabelValues(obj.GetNamespace(), obj.GetName()).Set(float64(completion.Unix()))
+}
+
+// Delete removes the metrics of obj, e.g. once it has been deleted.
+func (m *Metrics) Delete(obj *unstructured.Unstructured) {
+	if m == nil {
+		return
+	}
+	labels := prometheus.Labels{"namespace": obj.GetNamespace(), "name": obj.GetName()}
+	m.backupDuration.Delete(labels)
+	m.backupLastSuccess.Delete(labels)
+	m.backupsRetained.Delete(labels)
+	m.restoreDuration.Delete(labels)
+	m.restoreLastSuccess.Delete(labels)
+	for _, phase := range failurePhases {
+		m.backupFailures.DeleteLabelValues(obj.GetNamespace(), obj.GetName(), phase)
+		m.restoreFailures.DeleteLabelValues(obj.GetNamespace(), obj.GetName(), phase)
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.backupDuration, m.backupLastSuccess, m.backupFailures, m.backupsRetained,
+		m.restoreDuration, m.restoreLastSuccess, m.restoreFailures,
+	}
+}
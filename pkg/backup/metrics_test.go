@@ -0,0 +1,136 @@
+package backup_test
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		m   *backup.Metrics
+		reg *prometheus.Registry
+		obj *unstructured.Unstructured
+	)
+
+	BeforeEach(func() {
+		m = backup.NewMetrics("Matrix")
+		reg = prometheus.NewRegistry()
+		Expect(m.Register(reg)).To(Succeed())
+		obj = &unstructured.Unstructured{}
+		obj.SetNamespace("matrix")
+		obj.SetName("test")
+	})
+
+	count := func(name string) int {
+		families, err := reg.Gather()
+		Expect(err).To(BeNil())
+		for _, f := range families {
+			if f.GetName() == name {
+				return len(f.GetMetric())
+			}
+		}
+		return 0
+	}
+
+	It("should record completed backups", func() {
+		start := metav1.NewTime(time.Unix(1000, 0))
+		completion := metav1.NewTime(time.Unix(1090, 0))
+		m.ObserveBackup(obj, &backup.Status{Name: "b", Phase: backup.PhaseCompleted, StartTimestamp: &start, CompletionTimestamp: &completion})
+
+		Expect(count("matrix_backup_duration_seconds")).To(Equal(1))
+		Expect(count("matrix_backup_failures_total")).To(Equal(0))
+		// Only the inventory sets the last success.
+		Expect(count("matrix_backup_last_success_timestamp_seconds")).To(Equal(0))
+	})
+
+	It("should count only completed backups as retained", func() {
+		m.SetRetained(obj, []backup.Summary{
+			{Name: "a", Phase: backup.VeleroPhaseCompleted},
+			{Name: "b", Phase: backup.VeleroPhaseFailed},
+			{Name: "c", Phase: backup.VeleroPhaseNew},
+			{Name: "d", Phase: backup.VeleroPhaseCompleted},
+		})
+		Expect(testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP matrix_backups_retained Number of completed backups kept of a Matrix release.
+# TYPE matrix_backups_retained gauge
+matrix_backups_retained{name="test",namespace="matrix"} 2
+`), "matrix_backups_retained")).To(Succeed())
+	})
+
+	It("should record the newest completed backup of the inventory", func() {
+		start := metav1.NewTime(time.Unix(1000, 0))
+		completion := metav1.NewTime(time.Unix(1090, 0))
+		m.SetLastSuccess(obj, nil)
+		Expect(count("matrix_backup_last_success_timestamp_seconds")).To(Equal(0))
+
+		m.SetLastSuccess(obj, &backup.Summary{Name: "b", Phase: backup.VeleroPhaseCompleted, StartTimestamp: &start, CompletionTimestamp: &completion})
+		Expect(testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP matrix_backup_last_success_timestamp_seconds Time the last successful backup of a Matrix release completed.
+# TYPE matrix_backup_last_success_timestamp_seconds gauge
+matrix_backup_last_success_timestamp_seconds{name="test",namespace="matrix"} 1090
+`), "matrix_backup_last_success_timestamp_seconds")).To(Succeed())
+	})
+
+	It("should count failed backups by phase", func() {
+		m.ObserveBackup(obj, &backup.Status{Name: "b", Phase: backup.PhaseFailed, VeleroPhase: backup.VeleroPhasePartiallyFailed})
+		m.ObserveBackup(obj, &backup.Status{Name: "c", Phase: backup.PhaseFailed, VeleroPhase: backup.VeleroPhasePartiallyFailed})
+		m.ObserveBackup(obj, &backup.Status{Name: "d", Phase: backup.PhaseFailed, TimedOut: true})
+
+		Expect(testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP matrix_backup_failures_total Number of failed backups of Matrix releases by Velero phase.
+# TYPE matrix_backup_failures_total counter
+matrix_backup_failures_total{name="test",namespace="matrix",phase="PartiallyFailed"} 2
+matrix_backup_failures_total{name="test",namespace="matrix",phase="TimedOut"} 1
+`), "matrix_backup_failures_total")).To(Succeed())
+		Expect(count("matrix_backup_last_success_timestamp_seconds")).To(Equal(0))
+	})
+
+	It("should ignore backups that have not finished", func() {
+		m.ObserveBackup(obj, &backup.Status{Name: "b", Phase: backup.PhaseInProgress})
+		Expect(count("matrix_backup_failures_total")).To(Equal(0))
+		Expect(count("matrix_backup_last_success_timestamp_seconds")).To(Equal(0))
+	})
+
+	It("should record restores", func() {
+		m.ObserveRestore(obj, backup.VeleroPhaseCompleted, time.Minute)
+		m.ObserveRestore(obj, backup.VeleroPhaseFailed, time.Minute)
+
+		Expect(count("matrix_restore_duration_seconds")).To(Equal(1))
+		Expect(count("matrix_restore_last_success_timestamp_seconds")).To(Equal(1))
+		Expect(testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP matrix_restore_failures_total Number of failed restores of Matrix releases by Velero phase.
+# TYPE matrix_restore_failures_total counter
+matrix_restore_failures_total{name="test",namespace="matrix",phase="Failed"} 1
+`), "matrix_restore_failures_total")).To(Succeed())
+	})
+
+	It("should delete the metrics of a custom resource", func() {
+		m.SetRetained(obj, []backup.Summary{{Name: "a", Phase: backup.VeleroPhaseCompleted}})
+		m.ObserveBackup(obj, &backup.Status{Name: "b", Phase: backup.PhaseFailed, VeleroPhase: backup.VeleroPhaseFailed})
+		m.ObserveRestore(obj, backup.VeleroPhaseCompleted, time.Minute)
+		Expect(count("matrix_backups_retained")).To(Equal(1))
+
+		m.Delete(obj)
+		Expect(count("matrix_backups_retained")).To(Equal(0))
+		Expect(count("matrix_backup_failures_total")).To(Equal(0))
+		Expect(count("matrix_restore_duration_seconds")).To(Equal(0))
+	})
+
+	It("should do nothing when nil", func() {
+		var nilMetrics *backup.Metrics
+		nilMetrics.ObserveBackup(obj, &backup.Status{Phase: backup.PhaseCompleted})
+		nilMetrics.ObserveRestore(obj, backup.VeleroPhaseCompleted, time.Minute)
+		nilMetrics.SetRetained(obj, []backup.Summary{{Phase: backup.VeleroPhaseCompleted}})
+		nilMetrics.SetLastSuccess(obj, &backup.Summary{Phase: backup.VeleroPhaseCompleted})
+		nilMetrics.Delete(obj)
+	})
+})
@@ -0,0 +1,29 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ObjectName returns the name of a Velero object created for the release
+// name in namespace: prefix, namespace and name joined with parts by dashes.
+// The Velero objects of all namespaces share the Velero namespace, so the
+// namespace is part of the name to keep releases of the same name apart.
+func ObjectName(prefix, namespace, name string, parts ...string) string {
+	return ShortenName(strings.Join(append([]string{prefix, namespace, name}, parts...), "-"))
+}
+
+// ShortenName returns name if it is a valid object name length, and
+// otherwise cuts it short and appends a hash of the full name, so that
+// shortened names remain unique.
+func ShortenName(name string) string {
+	if len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:10]
+	return strings.TrimRight(name[:validation.DNS1123SubdomainMaxLength-len(hash)-1], "-.") + "-" + hash
+}
@@ -0,0 +1,26 @@
+package backup_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+var _ = Describe("ObjectName", func() {
+	It("should include the namespace of the release", func() {
+		Expect(backup.ObjectName("matrix-backup", "matrix", "test", "1")).To(Equal("matrix-backup-matrix-test-1"))
+		Expect(backup.ObjectName("matrix-backup", "other", "test", "1")).NotTo(Equal(backup.ObjectName("matrix-backup", "matrix", "test", "1")))
+	})
+
+	It("should shorten long names and keep them unique", func() {
+		long := strings.Repeat("a", 250)
+		a := backup.ObjectName("matrix-backup", "matrix", long, "1")
+		b := backup.ObjectName("matrix-backup", "matrix", long, "2")
+		Expect(len(a)).To(BeNumerically("<=", 253))
+		Expect(len(b)).To(BeNumerically("<=", 253))
+		Expect(a).NotTo(Equal(b))
+	})
+})
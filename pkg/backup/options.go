@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"fmt"
+	"time"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+
+	"github.com/joelanford/helm-operator/pkg/internal/values"
+)
+
+const (
+	// DefaultRetryBackoff is the delay before the first retry of a failed
+	// backup when `backup.retryBackoff` is not set. It doubles with every
+	// further retry.
+	DefaultRetryBackoff = 30 * time.Second
+
+	maxRetryBackoff = time.Hour
+)
+
+// options holds the settings that control how a backup is driven to
+// completion. They are read from the following values:
+//
+//   - backup.maxRetries - how often a failed Velero Backup is retried
+//     (default 0).
+//   - backup.retryBackoff - the delay before the first retry, as a duration
+//     string (default 30s).
+//   - backup.timeout - how long a backup, including all retries, may take
+//     before it is marked as failed, as a duration string (default none).
+type options struct {
+	maxRetries   int
+	retryBackoff time.Duration
+	timeout      time.Duration
+}
+
+func optionsFor(vals chartutil.Values) (options, error) {
+	opts := options{retryBackoff: DefaultRetryBackoff}
+
+	if v, ok := values.Lookup(vals, "backup.maxRetries"); ok {
+		n, ok := values.ToInt(v)
+		if !ok || n < 0 {
+			return opts, invalidValuesError("backup.maxRetries", "must be a non-negative integer, got %v", v)
+		}
+		opts.maxRetries = n
+	}
+	for path, d := range map[string]*time.Duration{
+		"backup.retryBackoff": &opts.retryBackoff,
+		"backup.timeout":      &opts.timeout,
+	} {
+		v, ok := values.Lookup(vals, path)
+		if !ok {
+			continue
+		}
+		parsed, err := parseDuration(v)
+		if err != nil {
+			return opts, invalidValuesError(path, "%v", err)
+		}
+		*d = parsed
+	}
+	return opts, nil
+}
+
+// backoff returns how long to wait before retrying after the given attempt.
+func (o options) backoff(attempt int) time.Duration {
+	d := o.retryBackoff
+	for i := 1; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d
+}
+
+func (o options) timedOut(st *Status) bool {
+	if o.timeout == 0 || st.StartTimestamp == nil {
+		return false
+	}
+	return time.Since(st.StartTimestamp.Time) > o.timeout
+}
+
+func parseDuration(v interface{}) (time.Duration, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("must be a duration string, got %v", v)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("must not be negative, got %s", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ErrNotFound is wrapped by the errors a BackupProvider returns for backups
+// and restores that do not exist.
+var ErrNotFound = errors.New("not found")
+
+// BackupProvider stores backups of releases and restores them. Backups and
+// restores are started by one call and followed by later ones, so that a
+// reconciliation never has to wait for them.
+//
+// The spec passed to Create and Restore is the spec of a Velero Backup or
+// Restore built from the values of the custom resource. Providers other
+// than Velero use the parts of it that apply to them.
+type BackupProvider interface {
+	// Create starts a backup named name of the release of obj. If a backup
+	// of the release of obj of that name exists already, it is taken to be
+	// the one that was started.
+	Create(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, name string, spec map[string]interface{}) error
+
+	// Status returns a summary of the backup named name.
+	Status(ctx context.Context, name string) (*Summary, error)
+
+	// List returns a summary of every backup of the release of obj, in no
+	// particular order.
+	List(ctx context.Context, obj *unstructured.Unstructured) ([]Summary, error)
+
+	// Delete deletes the backup named name together with its data. Deleting
+	// a backup that does not exist or is already being deleted succeeds.
+	Delete(ctx context.Context, name string) error
+
+	// Restore starts a restore named name of the release of obj from the
+	// backup named by spec["backupName"]. Like with Create, an existing
+	// restore of the release of obj of that name is taken to be the one that
+	// was started.
+	Restore(ctx context.Context, obj *unstructured.Unstructured, name string, spec map[string]interface{}) error
+
+	// RestoreStatus returns the phase of the restore named name, using the
+	// phases of a Velero Restore.
+	RestoreStatus(ctx context.Context, name string) (string, error)
+
+	// DeleteRestore deletes the record of the restore named name. Restored
+	// objects are left alone. Deleting a restore that does not exist
+	// succeeds.
+	DeleteRestore(ctx context.Context, name string) error
+}
+
+// Scheduler is implemented by BackupProviders that can take backups of a
+// release periodically.
+type Scheduler interface {
+	// ReconcileSchedule makes sure that backups of the release of obj are
+	// taken at the times given by the cron expression, using template as
+	// the spec of every backup.
+	ReconcileSchedule(ctx context.Context, obj *unstructured.Unstructured, cron string, template map[string]interface{}, log logr.Logger) error
+
+	// DeleteSchedule stops taking backups of the release of obj. Backups
+	// taken so far are kept.
+	DeleteSchedule(ctx context.Context, obj *unstructured.Unstructured, log logr.Logger) error
+}
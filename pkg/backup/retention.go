@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/joelanford/helm-operator/pkg/internal/values"
+)
+
+// retention is the policy that decides which backups of a release are kept.
+// It is read from the following values:
+//
+//   - backup.keepLast - how many finished backups are kept (default all).
+//   - backup.maxAge - how long a backup is kept, as a duration string
+//     (default until Velero expires it through its TTL).
+//   - backup.pruneOnUninstall - whether all backups are deleted when the
+//     custom resource is deleted (default false).
+type retention struct {
+	keepLast         int
+	maxAge           time.Duration
+	pruneOnUninstall bool
+}
+
+func retentionFor(vals chartutil.Values) (retention, error) {
+	var r retention
+	if v, ok := values.Lookup(vals, "backup.keepLast"); ok {
+		n, ok := values.ToInt(v)
+		if !ok || n < 1 {
+			return r, invalidValuesError("backup.keepLast", "must be a positive integer, got %v", v)
+		}
+		r.keepLast = n
+	}
+	if v, ok := values.Lookup(vals, "backup.maxAge"); ok {
+		d, err := parseDuration(v)
+		if err != nil || d == 0 {
+			return r, invalidValuesError("backup.maxAge", "must be a positive duration, got %v", v)
+		}
+		r.maxAge = d
+	}
+	if v, ok := values.Lookup(vals, "backup.pruneOnUninstall"); ok {
+		b, ok := v.(bool)
+		if !ok {
+			return r, invalidValuesError("backup.pruneOnUninstall", "must be a boolean, got %v", v)
+		}
+		r.pruneOnUninstall = b
+	}
+	return r, nil
+}
+
+// PruneOnUninstall returns whether all backups of a release are to be
+// deleted together with its custom resource.
+func PruneOnUninstall(vals chartutil.Values) (bool, error) {
+	r, err := retentionFor(vals)
+	return r.pruneOnUninstall, err
+}
+
+// Prune deletes the backups of the release of obj that fall outside the
+// retention policy in `backup.keepLast` and `backup.maxAge`. Backups that
+// are still running or already being deleted are left alone, and the most
+// recent completed backup is always kept so that the release can be
+// restored. Scheduled backups are included, as they carry the same release
+// labels.
+//
+// It returns the names of the backups whose deletion was requested.
+func (b *Backup) Prune(ctx context.Context, obj *unstructured.Unstructured, vals chartutil.Values, log logr.Logger) ([]string, error) {
+	r, err := retentionFor(vals)
+	if err != nil {
+		return nil, err
+	}
+	if r.keepLast == 0 && r.maxAge == 0 {
+		return nil, nil
+	}
+
+	// Newest first, so that the backups to keep come first.
+	summaries, err := b.Inventory(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		pruned       []string
+		kept         int
+		keptComplete bool
+	)
+	for _, s := range summaries {
+		if !isFinishedVeleroPhase(s.Phase) {
+			continue
+		}
+		expired := r.keepLast > 0 && kept >= r.keepLast
+		if r.maxAge > 0 && s.StartTimestamp != nil && time.Since(s.StartTimestamp.Time) > r.maxAge {
+			expired = true
+		}
+		if !expired || (s.Phase == VeleroPhaseCompleted && !keptComplete) {
+			kept++
+			keptComplete = keptComplete || s.Phase == VeleroPhaseCompleted
+			continue
+		}
+		if err := b.provider.Delete(ctx, s.Name); err != nil {
+			return pruned, err
+		}
+		log.Info("Requested deletion of backup", "backup", s.Name)
+		pruned = append(pruned, s.Name)
+	}
+	return pruned, nil
+}
+
+// PruneAll deletes all backups of the release of obj except the one named
+// keep, regardless of their phase. It returns the names of the backups whose
+// deletion was requested.
+func (b *Backup) PruneAll(ctx context.Context, obj *unstructured.Unstructured, keep string, log logr.Logger) ([]string, error) {
+	summaries, err := b.provider.List(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for _, s := range summaries {
+		if s.Phase == VeleroPhaseDeleting || s.Name == keep {
+			continue
+		}
+		if err := b.provider.Delete(ctx, s.Name); err != nil {
+			return pruned, err
+		}
+		log.Info("Requested deletion of backup", "backup", s.Name)
+		pruned = append(pruned, s.Name)
+	}
+	return pruned, nil
+}
+
+// isFinishedVeleroPhase returns whether Velero is done with a Backup in the
+// given phase.
+func isFinishedVeleroPhase(phase string) bool {
+	switch phase {
+	case VeleroPhaseCompleted, VeleroPhasePartiallyFailed, VeleroPhaseFailed, VeleroPhaseFailedValidation:
+		return true
+	}
+	return false
+}
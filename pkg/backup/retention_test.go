@@ -0,0 +1,162 @@
+package backup_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+var _ = Describe("Retention", func() {
+	var (
+		cl  client.Client
+		b   backup.Backup
+		obj *unstructured.Unstructured
+	)
+
+	BeforeEach(func() {
+		sch := runtime.NewScheme()
+		sch.AddKnownTypeWithName(schema.GroupVersionKind{Group: "velero.io", Version: "v1", Kind: "BackupList"}, &unstructured.UnstructuredList{})
+		cl = fake.NewFakeClientWithScheme(sch)
+		b = backup.NewBackup(backup.NewVeleroProvider(cl, "velero"))
+		obj = &unstructured.Unstructured{}
+		obj.SetName("test")
+		obj.SetNamespace("matrix")
+	})
+
+	createBackup := func(name, release, phase string, age time.Duration) {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("velero.io/v1")
+		u.SetKind("Backup")
+		u.SetNamespace("velero")
+		u.SetName(name)
+		start := metav1.NewTime(time.Now().Add(-age)).Rfc3339Copy()
+		Expect(unstructured.SetNestedField(u.Object, start.UTC().Format(time.RFC3339), "status", "startTimestamp")).To(Succeed())
+		u.SetLabels(map[string]string{
+			backup.ReleaseNameLabel:      release,
+			backup.ReleaseNamespaceLabel: "matrix",
+		})
+		Expect(unstructured.SetNestedField(u.Object, phase, "status", "phase")).To(Succeed())
+		Expect(cl.Create(context.TODO(), u)).To(Succeed())
+	}
+
+	deletionRequested := func(name string) bool {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("velero.io/v1")
+		u.SetKind("DeleteBackupRequest")
+		err := cl.Get(context.TODO(), client.ObjectKey{Namespace: "velero", Name: name}, u)
+		if apierrors.IsNotFound(err) {
+			return false
+		}
+		Expect(err).To(BeNil())
+		Expect(u.Object["spec"].(map[string]interface{})["backupName"]).To(Equal(name))
+		return true
+	}
+
+	valsFor := func(backupVals map[string]interface{}) chartutil.Values {
+		return chartutil.Values{"backup": backupVals}
+	}
+
+	It("should do nothing without a retention policy", func() {
+		createBackup("b1", "test", "Completed", 3*time.Hour)
+		pruned, err := b.Prune(context.TODO(), obj, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(BeEmpty())
+	})
+
+	It("should keep the last backups", func() {
+		createBackup("b1", "test", "Completed", 3*time.Hour)
+		createBackup("b2", "test", "Failed", 2*time.Hour)
+		createBackup("b3", "test", "Completed", time.Hour)
+		createBackup("b4", "test", "InProgress", 0)
+		createBackup("other", "other", "Completed", 4*time.Hour)
+
+		pruned, err := b.Prune(context.TODO(), obj, valsFor(map[string]interface{}{"keepLast": 2}), testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(Equal([]string{"b1"}))
+		Expect(deletionRequested("b1")).To(BeTrue())
+		Expect(deletionRequested("other")).To(BeFalse())
+	})
+
+	It("should prune backups older than the maximum age", func() {
+		createBackup("b1", "test", "Completed", 3*time.Hour)
+		createBackup("b2", "test", "PartiallyFailed", 2*time.Hour)
+		createBackup("b3", "test", "Completed", time.Minute)
+
+		pruned, err := b.Prune(context.TODO(), obj, valsFor(map[string]interface{}{"maxAge": "1h"}), testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(ConsistOf("b1", "b2"))
+	})
+
+	It("should always keep the most recent completed backup", func() {
+		createBackup("b1", "test", "Completed", 3*time.Hour)
+		createBackup("b2", "test", "Failed", 2*time.Hour)
+
+		pruned, err := b.Prune(context.TODO(), obj, valsFor(map[string]interface{}{"keepLast": 1, "maxAge": "1h"}), testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(Equal([]string{"b2"}))
+	})
+
+	It("should be idempotent", func() {
+		createBackup("b1", "test", "Completed", 3*time.Hour)
+		createBackup("b2", "test", "Completed", 2*time.Hour)
+		vals := valsFor(map[string]interface{}{"keepLast": 1})
+
+		for i := 0; i < 2; i++ {
+			pruned, err := b.Prune(context.TODO(), obj, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(pruned).To(Equal([]string{"b1"}))
+		}
+	})
+
+	It("should reject an invalid retention policy", func() {
+		for _, v := range []map[string]interface{}{{"keepLast": 0}, {"keepLast": "two"}, {"maxAge": "soon"}, {"pruneOnUninstall": "yes"}} {
+			_, err := b.Prune(context.TODO(), obj, valsFor(v), testing.NullLogger{})
+			Expect(errors.Is(err, backup.ErrInvalidValues)).To(BeTrue())
+		}
+	})
+
+	It("should prune all backups of the release on uninstall", func() {
+		createBackup("b1", "test", "Completed", time.Hour)
+		createBackup("b2", "test", "InProgress", 0)
+		createBackup("other", "other", "Completed", time.Hour)
+
+		pruned, err := b.PruneAll(context.TODO(), obj, "", testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(ConsistOf("b1", "b2"))
+		Expect(deletionRequested("other")).To(BeFalse())
+	})
+
+	It("should keep the final backup when pruning on uninstall", func() {
+		createBackup("b1", "test", "Completed", time.Hour)
+		createBackup("final", "test", "Completed", 0)
+
+		pruned, err := b.PruneAll(context.TODO(), obj, "final", testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(ConsistOf("b1"))
+		Expect(deletionRequested("final")).To(BeFalse())
+	})
+
+	It("should read whether to prune on uninstall", func() {
+		prune, err := backup.PruneOnUninstall(valsFor(map[string]interface{}{"pruneOnUninstall": true}))
+		Expect(err).To(BeNil())
+		Expect(prune).To(BeTrue())
+
+		prune, err = backup.PruneOnUninstall(chartutil.Values{})
+		Expect(err).To(BeNil())
+		Expect(prune).To(BeFalse())
+	})
+})
@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/joelanford/helm-operator/pkg/internal/values"
+)
+
+// ReconcileSchedule makes sure that backups of rel are taken periodically at
+// the times given by the cron expression in `backup.schedule`. Scheduled
+// backups use the same spec as on-demand backups and are labelled with the
+// release, so that they can be told apart from those of other releases.
+//
+// If `backup.schedule` is not set, any existing schedule is deleted. The
+// applied cron expression is returned, or an empty string if the release has
+// no schedule. Schedules require a provider that implements Scheduler.
+func (b *Backup) ReconcileSchedule(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) (string, error) {
+	v, ok := values.Lookup(vals, "backup.schedule")
+	if !ok {
+		return "", b.DeleteSchedule(ctx, obj, log)
+	}
+	cron, ok := v.(string)
+	if !ok || !isCronExpression(cron) {
+		return "", invalidValuesError("backup.schedule", "must be a cron expression, got %v", v)
+	}
+	scheduler, ok := b.provider.(Scheduler)
+	if !ok {
+		return "", invalidValuesError("backup.schedule", "is not supported by the backup provider")
+	}
+
+	template, err := backupSpecFor(obj, rel, vals)
+	if err != nil {
+		return "", err
+	}
+	if err := scheduler.ReconcileSchedule(ctx, obj, cron, template, log); err != nil {
+		return "", err
+	}
+	return cron, nil
+}
+
+// DeleteSchedule deletes the schedule of the release of obj, if there is
+// one. Backups already taken by the schedule are kept.
+func (b *Backup) DeleteSchedule(ctx context.Context, obj *unstructured.Unstructured, log logr.Logger) error {
+	scheduler, ok := b.provider.(Scheduler)
+	if !ok {
+		return nil
+	}
+	return scheduler.DeleteSchedule(ctx, obj, log)
+}
+
+// scheduleName returns the name of the Velero Schedule for obj. Schedules
+// of all namespaces share the Velero namespace, so the name includes the
+// namespace of obj.
+func scheduleName(obj *unstructured.Unstructured) string {
+	return ObjectName("matrix-schedule", obj.GetNamespace(), obj.GetName())
+}
+
+// isCronExpression does a basic check of the cron expressions accepted by
+// Velero: five fields, or a descriptor such as "@daily" or "@every 6h".
+func isCronExpression(s string) bool {
+	if strings.HasPrefix(s, "@") {
+		return len(s) > 1
+	}
+	return len(strings.Fields(s)) == 5
+}
@@ -0,0 +1,141 @@
+package backup_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/kubectl/pkg/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+// deleteCountingClient counts the delete requests sent through it.
+type deleteCountingClient struct {
+	client.Client
+	deletes int
+}
+
+func (c *deleteCountingClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	c.deletes++
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+var _ = Describe("Schedule", func() {
+	var (
+		cl  client.Client
+		b   backup.Backup
+		obj *unstructured.Unstructured
+		rel *release.Release
+	)
+
+	BeforeEach(func() {
+		cl = fake.NewFakeClientWithScheme(scheme.Scheme)
+		b = backup.NewBackup(backup.NewVeleroProvider(cl, "velero"))
+		obj = &unstructured.Unstructured{}
+		obj.SetName("test")
+		obj.SetNamespace("matrix")
+		rel = &release.Release{Name: "test", Namespace: "matrix", Version: 1}
+	})
+
+	valsFor := func(cron interface{}) chartutil.Values {
+		return chartutil.Values{"backup": map[string]interface{}{"schedule": cron}}
+	}
+
+	getSchedule := func() (*unstructured.Unstructured, error) {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("velero.io/v1")
+		u.SetKind("Schedule")
+		err := cl.Get(context.TODO(), client.ObjectKey{Namespace: "velero", Name: "matrix-schedule-matrix-test"}, u)
+		return u, err
+	}
+
+	It("should do nothing when no schedule is set", func() {
+		cl = &deleteCountingClient{Client: cl}
+		b = backup.NewBackup(backup.NewVeleroProvider(cl, "velero"))
+		cron, err := b.ReconcileSchedule(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(cl.(*deleteCountingClient).deletes).To(BeZero())
+		Expect(err).To(BeNil())
+		Expect(cron).To(BeEmpty())
+		_, err = getSchedule()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should create a schedule with the backup spec as template", func() {
+		cron, err := b.ReconcileSchedule(context.TODO(), obj, rel, valsFor("0 3 * * *"), testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(cron).To(Equal("0 3 * * *"))
+
+		u, err := getSchedule()
+		Expect(err).To(BeNil())
+		Expect(u.GetLabels()).To(Equal(map[string]string{
+			backup.ReleaseNameLabel:      "test",
+			backup.ReleaseNamespaceLabel: "matrix",
+		}))
+		spec := u.Object["spec"].(map[string]interface{})
+		Expect(spec["schedule"]).To(Equal("0 3 * * *"))
+		Expect(spec["template"].(map[string]interface{})["includedNamespaces"]).To(Equal([]interface{}{"matrix"}))
+	})
+
+	It("should update the schedule when the values change", func() {
+		_, err := b.ReconcileSchedule(context.TODO(), obj, rel, valsFor("0 3 * * *"), testing.NullLogger{})
+		Expect(err).To(BeNil())
+
+		vals := valsFor("@daily")
+		vals["backup"].(map[string]interface{})["ttl"] = "24h"
+		_, err = b.ReconcileSchedule(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+
+		u, err := getSchedule()
+		Expect(err).To(BeNil())
+		spec := u.Object["spec"].(map[string]interface{})
+		Expect(spec["schedule"]).To(Equal("@daily"))
+		Expect(spec["template"].(map[string]interface{})["ttl"]).To(Equal("24h0m0s"))
+	})
+
+	It("should not update an unchanged schedule", func() {
+		vals := valsFor("0 3 * * *")
+		vals["backup"].(map[string]interface{})["labelSelector"] = "app=matrix"
+		_, err := b.ReconcileSchedule(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		u, err := getSchedule()
+		Expect(err).To(BeNil())
+
+		_, err = b.ReconcileSchedule(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		v, err := getSchedule()
+		Expect(err).To(BeNil())
+		Expect(v.GetResourceVersion()).To(Equal(u.GetResourceVersion()))
+	})
+
+	It("should delete the schedule when it is unset", func() {
+		_, err := b.ReconcileSchedule(context.TODO(), obj, rel, valsFor("0 3 * * *"), testing.NullLogger{})
+		Expect(err).To(BeNil())
+
+		cron, err := b.ReconcileSchedule(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(cron).To(BeEmpty())
+		_, err = getSchedule()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should reject invalid cron expressions", func() {
+		for _, cron := range []interface{}{"0 3 * *", "@", 3} {
+			_, err := b.ReconcileSchedule(context.TODO(), obj, rel, valsFor(cron), testing.NullLogger{})
+			Expect(errors.Is(err, backup.ErrInvalidValues)).To(BeTrue())
+		}
+	})
+
+	It("should ignore a missing schedule on deletion", func() {
+		Expect(b.DeleteSchedule(context.TODO(), obj, testing.NullLogger{})).To(Succeed())
+	})
+})
@@ -0,0 +1,191 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+
+	"github.com/joelanford/helm-operator/pkg/internal/sdk/handler"
+	"github.com/joelanford/helm-operator/pkg/internal/values"
+)
+
+const (
+	// ScopeNamespace backs up everything in the release namespace.
+	ScopeNamespace = "namespace"
+
+	// ScopeRelease backs up only the objects of the release, together with
+	// the pods, persistent volume claims and persistent volumes that belong
+	// to them.
+	ScopeRelease = "release"
+)
+
+// releaseDependentResources are backed up in release scope in addition to
+// the resources listed in the manifest. They are not part of the manifest,
+// but are created from it and hold the data of the release.
+var releaseDependentResources = []string{"pods", "persistentvolumeclaims", "persistentvolumes"}
+
+// scopeFor returns the scope configured in `backup.scope`.
+func scopeFor(vals chartutil.Values) (string, error) {
+	v, ok := values.Lookup(vals, "backup.scope")
+	if !ok {
+		return ScopeNamespace, nil
+	}
+	switch v {
+	case ScopeNamespace, ScopeRelease:
+		return v.(string), nil
+	}
+	return "", invalidValuesError("backup.scope", "must be %q or %q, got %v", ScopeNamespace, ScopeRelease, v)
+}
+
+// scopeToRelease restricts spec to the objects of rel that belong to owner.
+//
+// Velero can only select objects by resource and label, so the Backup is
+// limited to the resources found in the release manifest and to the labels
+// shared by all of those objects and by the pods and volume claims their
+// templates create. Charts that follow the Helm conventions share at least
+// the `app.kubernetes.io/instance` label, which tells apart several releases
+// in the same namespace.
+//
+// Only objects the operator deployed for owner into the release namespace
+// are taken into account; see releaseObjects.
+func scopeToRelease(spec map[string]interface{}, owner *unstructured.Unstructured, rel *release.Release) error {
+	if _, ok := spec["labelSelector"]; ok {
+		return invalidValuesError("backup.labelSelector", "cannot be combined with backup.scope %q", ScopeRelease)
+	}
+
+	objs, err := releaseObjects(rel, owner)
+	if err != nil {
+		return err
+	}
+	if len(objs) == 0 {
+		return fmt.Errorf("release %q has no namespaced objects to back up", rel.Name)
+	}
+
+	var common map[string]string
+	resources := map[string]struct{}{}
+	for _, obj := range objs {
+		resources[resourceFor(obj)] = struct{}{}
+		for _, labels := range labelSetsFor(obj) {
+			common = intersectLabels(common, labels)
+		}
+	}
+	if len(common) == 0 {
+		return errors.New("objects of the release share no common labels to select them by")
+	}
+
+	if _, ok := spec["includedResources"]; !ok {
+		for _, r := range releaseDependentResources {
+			resources[r] = struct{}{}
+		}
+		included := make([]string, 0, len(resources))
+		for r := range resources {
+			included = append(included, r)
+		}
+		sort.Strings(included)
+		spec["includedResources"] = toInterfaceSlice(included)
+	}
+
+	matchLabels := map[string]interface{}{}
+	for k, v := range common {
+		matchLabels[k] = v
+	}
+	spec["labelSelector"] = map[string]interface{}{"matchLabels": matchLabels}
+	return nil
+}
+
+// releaseObjects returns the objects in the manifest of rel that live in
+// the release namespace and belong to owner.
+//
+// The operator marks every object it deploys for owner: objects in the
+// namespace of owner get an owner reference, all others get the primary
+// resource annotation instead. Objects with the annotation are therefore
+// cluster-scoped or in another namespace and are not covered by the Backup.
+func releaseObjects(rel *release.Release, owner *unstructured.Unstructured) ([]unstructured.Unstructured, error) {
+	var objs []unstructured.Unstructured
+	for _, manifest := range releaseutil.SplitManifests(rel.Manifest) {
+		var obj unstructured.Unstructured
+		if err := yaml.Unmarshal([]byte(manifest), &obj); err != nil {
+			return nil, err
+		}
+		if obj.Object == nil || obj.GetKind() == "" {
+			continue
+		}
+		if _, ok := obj.GetAnnotations()[handler.NamespacedNameAnnotation]; ok {
+			continue
+		}
+		if obj.GetNamespace() != "" && obj.GetNamespace() != rel.Namespace {
+			continue
+		}
+		if !ownedBy(obj, owner) {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// ownedBy returns false if obj has a controller reference to an object other
+// than owner.
+func ownedBy(obj unstructured.Unstructured, owner *unstructured.Unstructured) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Controller != nil && *ref.Controller {
+			return ref.Kind == owner.GetKind() && ref.Name == owner.GetName()
+		}
+	}
+	return true
+}
+
+// resourceFor returns the singular resource name of obj as understood by
+// Velero, e.g. "deployment.apps".
+func resourceFor(obj unstructured.Unstructured) string {
+	gvk := obj.GroupVersionKind()
+	resource := strings.ToLower(gvk.Kind)
+	if gvk.Group != "" {
+		resource += "." + gvk.Group
+	}
+	return resource
+}
+
+// labelSetsFor returns the labels of obj and of the pods and persistent
+// volume claims created from its templates.
+func labelSetsFor(obj unstructured.Unstructured) []map[string]string {
+	sets := []map[string]string{obj.GetLabels()}
+	if labels, ok, _ := unstructured.NestedStringMap(obj.Object, "spec", "template", "metadata", "labels"); ok {
+		sets = append(sets, labels)
+	}
+	claims, _, _ := unstructured.NestedSlice(obj.Object, "spec", "volumeClaimTemplates")
+	for _, c := range claims {
+		claim, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		labels, _, _ := unstructured.NestedStringMap(claim, "metadata", "labels")
+		sets = append(sets, labels)
+	}
+	return sets
+}
+
+// intersectLabels returns the labels present with the same value in both a
+// and b. A nil a is treated as the set of all labels.
+func intersectLabels(a, b map[string]string) map[string]string {
+	if a == nil {
+		out := make(map[string]string, len(b))
+		for k, v := range b {
+			out[k] = v
+		}
+		return out
+	}
+	for k, v := range a {
+		if b[k] != v {
+			delete(a, k)
+		}
+	}
+	return a
+}
@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const testManifest = `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: synapse
+  labels:
+    app.kubernetes.io/instance: test
+    app.kubernetes.io/name: synapse
+    helm.sh/chart: matrix-1.0.0
+  ownerReferences:
+  - apiVersion: matrix.example.com/v1
+    kind: Matrix
+    name: test
+    uid: 1234
+    controller: true
+spec:
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/instance: test
+        app.kubernetes.io/name: synapse
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: postgresql
+  labels:
+    app.kubernetes.io/instance: test
+    app.kubernetes.io/name: postgresql
+spec:
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/instance: test
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+      labels:
+        app.kubernetes.io/instance: test
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: synapse
+  labels:
+    app.kubernetes.io/instance: test
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: synapse
+  annotations:
+    operator-sdk/primary-resource: matrix/test
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foreign
+  ownerReferences:
+  - apiVersion: matrix.example.com/v1
+    kind: Matrix
+    name: other
+    uid: 5678
+    controller: true
+`
+
+var _ = Describe("scopeToRelease", func() {
+	var (
+		owner *unstructured.Unstructured
+		rel   *release.Release
+	)
+
+	BeforeEach(func() {
+		owner = &unstructured.Unstructured{}
+		owner.SetAPIVersion("matrix.example.com/v1")
+		owner.SetKind("Matrix")
+		owner.SetNamespace("matrix")
+		owner.SetName("test")
+		rel = &release.Release{Name: "test", Namespace: "matrix", Manifest: testManifest}
+	})
+
+	It("should select the release objects by their common labels", func() {
+		spec, err := specFor(chartutil.Values{}, "matrix")
+		Expect(err).To(BeNil())
+		Expect(scopeToRelease(spec, owner, rel)).To(Succeed())
+		Expect(spec["labelSelector"]).To(Equal(map[string]interface{}{
+			"matchLabels": map[string]interface{}{"app.kubernetes.io/instance": "test"},
+		}))
+		Expect(spec["includedResources"]).To(Equal([]interface{}{
+			"deployment.apps", "persistentvolumeclaims", "persistentvolumes", "pods", "service", "statefulset.apps",
+		}))
+	})
+
+	It("should keep explicitly included resources", func() {
+		spec, err := specFor(chartutil.Values{"backup": map[string]interface{}{
+			"includedResources": []interface{}{"persistentvolumeclaims"},
+		}}, "matrix")
+		Expect(err).To(BeNil())
+		Expect(scopeToRelease(spec, owner, rel)).To(Succeed())
+		Expect(spec["includedResources"]).To(Equal([]interface{}{"persistentvolumeclaims"}))
+	})
+
+	It("should reject an explicit label selector", func() {
+		spec, err := specFor(chartutil.Values{"backup": map[string]interface{}{"labelSelector": "app=matrix"}}, "matrix")
+		Expect(err).To(BeNil())
+		Expect(errors.Is(scopeToRelease(spec, owner, rel), ErrInvalidValues)).To(BeTrue())
+	})
+
+	It("should fail when the release objects share no labels", func() {
+		rel.Manifest = `---
+apiVersion: v1
+kind: Service
+metadata:
+  name: a
+  labels:
+    app: a
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: b
+  labels:
+    app: b
+`
+		spec, err := specFor(chartutil.Values{}, "matrix")
+		Expect(err).To(BeNil())
+		Expect(scopeToRelease(spec, owner, rel)).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("scopeFor", func() {
+	It("should default to the namespace scope", func() {
+		Expect(scopeFor(chartutil.Values{})).To(Equal(ScopeNamespace))
+	})
+
+	It("should reject unknown scopes", func() {
+		_, err := scopeFor(chartutil.Values{"backup": map[string]interface{}{"scope": "cluster"}})
+		Expect(errors.Is(err, ErrInvalidValues)).To(BeTrue())
+	})
+})
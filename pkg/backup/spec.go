@@ -0,0 +1,246 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/joelanford/helm-operator/pkg/internal/values"
+)
+
+// ErrInvalidValues is wrapped by every error caused by backup values that
+// cannot be turned into a Velero Backup. Such errors do not go away until
+// the custom resource is changed, so they are reported rather than retried.
+var ErrInvalidValues = errors.New("invalid backup values")
+
+const (
+	// DefaultTTL is how long Velero keeps a backup when `backup.ttl` is not
+	// set.
+	DefaultTTL = 720 * time.Hour
+
+	// DefaultStorageLocation is the Velero BackupStorageLocation used when
+	// `backup.storageLocation` is not set.
+	DefaultStorageLocation = "matrix-backup"
+)
+
+func invalidValuesError(path string, format string, args ...interface{}) error {
+	return values.InvalidError(ErrInvalidValues, path, format, args...)
+}
+
+// specFor builds the spec of a Velero Backup of namespace from the following
+// values:
+//
+//   - backup.ttl - how long Velero keeps the backup (default 720h).
+//   - backup.storageLocation - the BackupStorageLocation to write to
+//     (default matrix-backup).
+//   - backup.volumeSnapshotLocations - the VolumeSnapshotLocations to use.
+//   - backup.snapshotVolumes - whether to take snapshots of persistent
+//     volumes.
+//   - backup.includedResources and backup.excludedResources - the resources
+//     to back up, e.g. "persistentvolumeclaims" or "secrets".
+//   - backup.labelSelector - only back up objects matching this selector,
+//     given either as a string ("app=matrix") or as a LabelSelector map.
+//   - backup.defaultVolumesToRestic - whether to back up all pod volumes
+//     with restic.
+//
+// Hooks are read by hooksFor.
+func specFor(vals chartutil.Values, namespace string) (map[string]interface{}, error) {
+	spec := map[string]interface{}{
+		"includedNamespaces": []interface{}{namespace},
+		"storageLocation":    DefaultStorageLocation,
+		"ttl":                DefaultTTL.String(),
+	}
+
+	if v, ok := values.Lookup(vals, "backup.ttl"); ok {
+		ttl, err := parseDuration(v)
+		if err != nil || ttl == 0 {
+			return nil, invalidValuesError("backup.ttl", "must be a positive duration, got %v", v)
+		}
+		spec["ttl"] = ttl.String()
+	}
+
+	if v, ok := values.Lookup(vals, "backup.storageLocation"); ok {
+		name, ok := v.(string)
+		if !ok || len(validation.IsDNS1123Subdomain(name)) > 0 {
+			return nil, invalidValuesError("backup.storageLocation", "must be the name of a BackupStorageLocation, got %v", v)
+		}
+		spec["storageLocation"] = name
+	}
+
+	if v, ok := values.Lookup(vals, "backup.volumeSnapshotLocations"); ok {
+		names, ok := toStringSlice(v)
+		if !ok {
+			return nil, invalidValuesError("backup.volumeSnapshotLocations", "must be a list of names, got %v", v)
+		}
+		for _, name := range names {
+			if len(validation.IsDNS1123Subdomain(name)) > 0 {
+				return nil, invalidValuesError("backup.volumeSnapshotLocations", "%q is not a valid VolumeSnapshotLocation name", name)
+			}
+		}
+		spec["volumeSnapshotLocations"] = toInterfaceSlice(names)
+	}
+
+	for _, field := range []string{"snapshotVolumes", "defaultVolumesToRestic"} {
+		v, ok := values.Lookup(vals, "backup."+field)
+		if !ok {
+			continue
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return nil, invalidValuesError("backup."+field, "must be a boolean, got %v", v)
+		}
+		spec[field] = b
+	}
+
+	included, excluded := []string{}, []string{}
+	for field, resources := range map[string]*[]string{"includedResources": &included, "excludedResources": &excluded} {
+		v, ok := values.Lookup(vals, "backup."+field)
+		if !ok {
+			continue
+		}
+		names, ok := toStringSlice(v)
+		if !ok {
+			return nil, invalidValuesError("backup."+field, "must be a list of resources, got %v", v)
+		}
+		for _, name := range names {
+			if name == "" {
+				return nil, invalidValuesError("backup."+field, "must not contain empty resource names")
+			}
+		}
+		*resources = names
+		spec[field] = toInterfaceSlice(names)
+	}
+	for _, name := range excluded {
+		if name == "*" {
+			return nil, invalidValuesError("backup.excludedResources", `must not contain "*"`)
+		}
+		for _, inc := range included {
+			if inc == name {
+				return nil, invalidValuesError("backup.excludedResources", "%q is also listed in backup.includedResources", name)
+			}
+		}
+	}
+
+	if v, ok := values.Lookup(vals, "backup.labelSelector"); ok {
+		selector, err := labelSelectorFor(v)
+		if err != nil {
+			return nil, invalidValuesError("backup.labelSelector", "%v", err)
+		}
+		spec["labelSelector"] = selector
+	}
+
+	hooks, err := hooksFor(vals, namespace)
+	if err != nil {
+		return nil, err
+	}
+	spec["hooks"] = hooks
+
+	return spec, nil
+}
+
+// labelSelectorFor converts a label selector given in values into the
+// unstructured form of a metav1.LabelSelector.
+func labelSelectorFor(v interface{}) (map[string]interface{}, error) {
+	selector, err := ParseLabelSelector(v)
+	if err != nil {
+		return nil, err
+	}
+	return runtime.DefaultUnstructuredConverter.ToUnstructured(selector)
+}
+
+// ParseLabelSelector parses a label selector given in values, either as a
+// string ("app=matrix") or as a LabelSelector map.
+func ParseLabelSelector(v interface{}) (*metav1.LabelSelector, error) {
+	selector := &metav1.LabelSelector{}
+	switch s := v.(type) {
+	case string:
+		parsed, err := metav1.ParseToLabelSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		selector = parsed
+	case map[string]interface{}:
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(s, selector); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("must be a string or a label selector, got %v", v)
+	}
+	if _, err := metav1.LabelSelectorAsSelector(selector); err != nil {
+		return nil, err
+	}
+	return selector, nil
+}
+
+func toStringSlice(v interface{}) ([]string, bool) {
+	switch l := v.(type) {
+	case []string:
+		return l, true
+	case []interface{}:
+		out := make([]string, 0, len(l))
+		for _, e := range l {
+			s, ok := e.(string)
+			if !ok {
+				return nil, false
+			}
+			out = append(out, s)
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+func toInterfaceSlice(l []string) []interface{} {
+	out := make([]interface{}, 0, len(l))
+	for _, s := range l {
+		out = append(out, s)
+	}
+	return out
+}
+
+// RestoreSpec returns the spec of a Velero Restore of the objects of
+// namespace from the backup named backupName, including the data of their
+// persistent volumes.
+func RestoreSpec(backupName, namespace string) map[string]interface{} {
+	return map[string]interface{}{
+		"backupName":         backupName,
+		"includedNamespaces": []interface{}{namespace},
+		"excludedResources": []interface{}{
+			"nodes",
+			"events",
+			"events.events.k8s.io",
+			"backups.velero.io",
+			"restores.velero.io",
+			"resticrepositories.velero.io",
+		},
+		"restorePVs": true,
+	}
+}
+
+// CloneSpec returns the spec of a Velero Restore of the release of obj from
+// the backup named backupName into other namespaces. namespaceMapping maps
+// the namespaces in the backup to the namespaces they are restored into, and
+// the namespaces in it are restored along with the release namespace. The
+// custom resource itself is left out, so that the restored copy of the
+// release is not picked up by the operator before it is adopted.
+func CloneSpec(obj *unstructured.Unstructured, rel *release.Release, backupName string, namespaceMapping map[string]string) map[string]interface{} {
+	namespace := ReleaseNamespace(obj, rel)
+	spec := RestoreSpec(backupName, namespace)
+	mapping := map[string]interface{}{}
+	for from, to := range namespaceMapping {
+		mapping[from] = to
+		if from != namespace {
+			spec["includedNamespaces"] = append(spec["includedNamespaces"].([]interface{}), from)
+		}
+	}
+	spec["namespaceMapping"] = mapping
+	spec["excludedResources"] = append(spec["excludedResources"].([]interface{}), resourceFor(*obj))
+	return spec
+}
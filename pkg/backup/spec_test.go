@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var _ = Describe("specFor", func() {
+	backupVals := func(m map[string]interface{}) chartutil.Values {
+		return chartutil.Values{"backup": m}
+	}
+
+	It("should use defaults when nothing is set", func() {
+		spec, err := specFor(chartutil.Values{}, "matrix")
+		Expect(err).To(BeNil())
+		Expect(spec).To(Equal(map[string]interface{}{
+			"hooks":              map[string]interface{}{},
+			"includedNamespaces": []interface{}{"matrix"},
+			"storageLocation":    DefaultStorageLocation,
+			"ttl":                "720h0m0s",
+		}))
+	})
+
+	It("should map all supported values", func() {
+		spec, err := specFor(backupVals(map[string]interface{}{
+			"ttl":                     "24h",
+			"storageLocation":         "aws",
+			"volumeSnapshotLocations": []interface{}{"aws-ebs"},
+			"snapshotVolumes":         true,
+			"includedResources":       []interface{}{"persistentvolumeclaims", "secrets"},
+			"excludedResources":       []interface{}{"events"},
+			"labelSelector":           "app=matrix",
+			"defaultVolumesToRestic":  false,
+		}), "matrix")
+		Expect(err).To(BeNil())
+		Expect(spec["ttl"]).To(Equal("24h0m0s"))
+		Expect(spec["storageLocation"]).To(Equal("aws"))
+		Expect(spec["volumeSnapshotLocations"]).To(Equal([]interface{}{"aws-ebs"}))
+		Expect(spec["snapshotVolumes"]).To(BeTrue())
+		Expect(spec["includedResources"]).To(Equal([]interface{}{"persistentvolumeclaims", "secrets"}))
+		Expect(spec["excludedResources"]).To(Equal([]interface{}{"events"}))
+		Expect(spec["labelSelector"]).To(Equal(map[string]interface{}{
+			"matchLabels": map[string]interface{}{"app": "matrix"},
+		}))
+		Expect(spec["defaultVolumesToRestic"]).To(BeFalse())
+	})
+
+	It("should accept a label selector map", func() {
+		spec, err := specFor(backupVals(map[string]interface{}{
+			"labelSelector": map[string]interface{}{
+				"matchExpressions": []interface{}{
+					map[string]interface{}{"key": "tier", "operator": "In", "values": []interface{}{"db"}},
+				},
+			},
+		}), "matrix")
+		Expect(err).To(BeNil())
+		Expect(spec["labelSelector"]).To(HaveKey("matchExpressions"))
+	})
+
+	DescribeTable("should reject invalid values",
+		func(m map[string]interface{}) {
+			_, err := specFor(backupVals(m), "matrix")
+			Expect(errors.Is(err, ErrInvalidValues)).To(BeTrue())
+		},
+		Entry("non-duration ttl", map[string]interface{}{"ttl": "a month"}),
+		Entry("zero ttl", map[string]interface{}{"ttl": "0s"}),
+		Entry("invalid storage location", map[string]interface{}{"storageLocation": "Not Valid"}),
+		Entry("non-list snapshot locations", map[string]interface{}{"volumeSnapshotLocations": "aws"}),
+		Entry("non-bool snapshotVolumes", map[string]interface{}{"snapshotVolumes": "yes"}),
+		Entry("wildcard exclude", map[string]interface{}{"excludedResources": []interface{}{"*"}}),
+		Entry("conflicting resources", map[string]interface{}{
+			"includedResources": []interface{}{"secrets"},
+			"excludedResources": []interface{}{"secrets"},
+		}),
+		Entry("invalid label selector", map[string]interface{}{"labelSelector": "app in matrix"}),
+	)
+})
+
+var _ = Describe("CloneSpec", func() {
+	It("should map the namespaces and leave out the custom resource", func() {
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion("matrix.example.com/v1")
+		obj.SetKind("Matrix")
+		obj.SetNamespace("matrix")
+		obj.SetName("test")
+		spec := CloneSpec(obj, &release.Release{Name: "test", Namespace: "matrix"}, "nightly", map[string]string{
+			"matrix":     "staging",
+			"monitoring": "staging-monitoring",
+		})
+		Expect(spec["backupName"]).To(Equal("nightly"))
+		Expect(spec["includedNamespaces"]).To(ConsistOf("matrix", "monitoring"))
+		Expect(spec["namespaceMapping"]).To(Equal(map[string]interface{}{
+			"matrix":     "staging",
+			"monitoring": "staging-monitoring",
+		}))
+		Expect(spec["excludedResources"]).To(ContainElement("matrix.matrix.example.com"))
+	})
+})
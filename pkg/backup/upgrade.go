@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/joelanford/helm-operator/pkg/internal/values"
+)
+
+// upgradePolicy decides what happens around an upgrade of a release. It is
+// read from the following values:
+//
+//   - backup.preUpgrade - whether a backup of the deployed release is taken
+//     before it is upgraded (default false). The upgrade waits until the
+//     backup has completed.
+//   - backup.restoreOnUpgradeFailure - whether the pre-upgrade backup is
+//     restored in place, database included, when the upgrade fails (default
+//     false). Otherwise the backup is only reported, as a Helm rollback does
+//     not undo schema migrations that ran during the failed upgrade.
+type upgradePolicy struct {
+	preUpgrade       bool
+	restoreOnFailure bool
+}
+
+func upgradePolicyFor(vals chartutil.Values) (upgradePolicy, error) {
+	var p upgradePolicy
+	for path, field := range map[string]*bool{
+		"backup.preUpgrade":              &p.preUpgrade,
+		"backup.restoreOnUpgradeFailure": &p.restoreOnFailure,
+	} {
+		v, ok := values.Lookup(vals, path)
+		if !ok {
+			continue
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return p, invalidValuesError(path, "must be a boolean, got %v", v)
+		}
+		*field = b
+	}
+	return p, nil
+}
+
+// PreUpgradeEnabled returns whether a backup is taken before the release is
+// upgraded to vals.
+func PreUpgradeEnabled(vals chartutil.Values) (bool, error) {
+	p, err := upgradePolicyFor(vals)
+	return p.preUpgrade, err
+}
+
+// PreUpgrade moves the backup of the deployed release rel, taken before it is
+// upgraded to the current generation of obj, forward by at most one step like
+// Reconcile does. The backup is taken once per generation, so that retried
+// upgrades of the same generation share it.
+func (b *Backup) PreUpgrade(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) (*Status, time.Duration, error) {
+	return b.takeOnce(ctx, obj, rel, vals, TriggerPreUpgrade, func(st *Status) bool {
+		return IsPreUpgradeFor(st, obj)
+	}, log)
+}
+
+// IsPreUpgradeFor returns whether st is the pre-upgrade backup of the current
+// generation of obj.
+func IsPreUpgradeFor(st *Status, obj *unstructured.Unstructured) bool {
+	return st != nil && st.Trigger == TriggerPreUpgrade && st.ObservedGeneration == obj.GetGeneration()
+}
+
+// RestoreOnUpgradeFailure returns whether the completed pre-upgrade backup
+// st is to be restored after an upgrade to vals failed. A backup is restored
+// at most once, i.e. not if st already records a restore, as restoring it
+// again would undo the changes made since.
+func RestoreOnUpgradeFailure(vals chartutil.Values, st *Status) (bool, error) {
+	p, err := upgradePolicyFor(vals)
+	if err != nil {
+		return false, err
+	}
+	return p.restoreOnFailure && st.RestoreName == "" && st.Phase == PhaseCompleted, nil
+}
@@ -0,0 +1,110 @@
+package backup_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/kubectl/pkg/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+var _ = Describe("PreUpgrade", func() {
+	var (
+		cl   client.Client
+		b    backup.Backup
+		obj  *unstructured.Unstructured
+		rel  *release.Release
+		vals chartutil.Values
+	)
+
+	BeforeEach(func() {
+		cl = fake.NewFakeClientWithScheme(scheme.Scheme)
+		b = backup.NewBackup(backup.NewVeleroProvider(cl, "velero"))
+		obj = &unstructured.Unstructured{}
+		obj.SetName("test")
+		obj.SetNamespace("matrix")
+		obj.SetGeneration(2)
+		rel = &release.Release{Name: "test", Namespace: "matrix", Version: 1}
+		vals = chartutil.Values{"backup": map[string]interface{}{"preUpgrade": true}}
+	})
+
+	setStatus := func(st *backup.Status) {
+		m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(st)
+		Expect(err).To(BeNil())
+		Expect(unstructured.SetNestedMap(obj.Object, m, "status", "backup")).To(Succeed())
+	}
+
+	It("should read whether a pre-upgrade backup is enabled", func() {
+		enabled, err := backup.PreUpgradeEnabled(vals)
+		Expect(err).To(BeNil())
+		Expect(enabled).To(BeTrue())
+
+		enabled, err = backup.PreUpgradeEnabled(chartutil.Values{})
+		Expect(err).To(BeNil())
+		Expect(enabled).To(BeFalse())
+
+		_, err = backup.PreUpgradeEnabled(chartutil.Values{"backup": map[string]interface{}{"preUpgrade": "yes"}})
+		Expect(errors.Is(err, backup.ErrInvalidValues)).To(BeTrue())
+	})
+
+	It("should back up the deployed release once per generation", func() {
+		st, _, err := b.PreUpgrade(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Trigger).To(Equal(backup.TriggerPreUpgrade))
+		Expect(st.Name).To(HavePrefix("matrix-backup-matrix-test-1-pre-upgrade-"))
+		Expect(backup.IsPreUpgradeFor(st, obj)).To(BeTrue())
+
+		st.Phase = backup.PhaseCompleted
+		setStatus(st)
+		again, requeueAfter, err := b.PreUpgrade(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(again.Name).To(Equal(st.Name))
+		Expect(requeueAfter).To(BeZero())
+
+		obj.SetGeneration(3)
+		rel.Version = 3
+		Expect(backup.IsPreUpgradeFor(st, obj)).To(BeFalse())
+		again, _, err = b.PreUpgrade(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(again.Phase).To(Equal(backup.PhaseInProgress))
+		Expect(again.ObservedGeneration).To(Equal(int64(3)))
+	})
+
+	It("should only restore the backup after a failed upgrade if configured", func() {
+		st := &backup.Status{Name: "before", Phase: backup.PhaseCompleted, Trigger: backup.TriggerPreUpgrade, ObservedGeneration: 2}
+		restore, err := backup.RestoreOnUpgradeFailure(vals, st)
+		Expect(err).To(BeNil())
+		Expect(restore).To(BeFalse())
+
+		vals["backup"].(map[string]interface{})["restoreOnUpgradeFailure"] = true
+		restore, err = backup.RestoreOnUpgradeFailure(vals, st)
+		Expect(err).To(BeNil())
+		Expect(restore).To(BeTrue())
+
+		_, err = backup.RestoreOnUpgradeFailure(chartutil.Values{"backup": map[string]interface{}{"restoreOnUpgradeFailure": "yes"}}, st)
+		Expect(errors.Is(err, backup.ErrInvalidValues)).To(BeTrue())
+	})
+
+	It("should restore the backup at most once", func() {
+		vals["backup"].(map[string]interface{})["restoreOnUpgradeFailure"] = true
+		st := &backup.Status{Name: "before", Phase: backup.PhaseCompleted, Trigger: backup.TriggerPreUpgrade, ObservedGeneration: 2, RestoreName: "restore"}
+		restore, err := backup.RestoreOnUpgradeFailure(vals, st)
+		Expect(err).To(BeNil())
+		Expect(restore).To(BeFalse())
+
+		st = &backup.Status{Name: "before", Phase: backup.PhaseFailed, Trigger: backup.TriggerPreUpgrade, ObservedGeneration: 2}
+		restore, err = backup.RestoreOnUpgradeFailure(vals, st)
+		Expect(err).To(BeNil())
+		Expect(restore).To(BeFalse())
+	})
+})
@@ -0,0 +1,42 @@
+package backup
+
+import (
+	"helm.sh/helm/v3/pkg/chartutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/joelanford/helm-operator/pkg/internal/values"
+)
+
+// ValidateValues checks the backup values of obj without looking at the
+// cluster, so that a custom resource whose backups could never be taken can
+// be rejected before it is admitted. The returned error wraps
+// ErrInvalidValues.
+func (b *Backup) ValidateValues(obj *unstructured.Unstructured, vals chartutil.Values) error {
+	if _, err := specFor(vals, obj.GetNamespace()); err != nil {
+		return err
+	}
+	if _, err := scopeFor(vals); err != nil {
+		return err
+	}
+	if _, err := optionsFor(vals); err != nil {
+		return err
+	}
+	if _, err := retentionFor(vals); err != nil {
+		return err
+	}
+	if _, err := upgradePolicyFor(vals); err != nil {
+		return err
+	}
+	if _, err := verifyPolicyFor(vals); err != nil {
+		return err
+	}
+	if v, ok := values.Lookup(vals, "backup.schedule"); ok {
+		if cron, ok := v.(string); !ok || !isCronExpression(cron) {
+			return invalidValuesError("backup.schedule", "must be a cron expression, got %v", v)
+		}
+		if _, ok := b.provider.(Scheduler); !ok {
+			return invalidValuesError("backup.schedule", "is not supported by the backup provider")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package backup_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/kubectl/pkg/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+var _ = Describe("ValidateValues", func() {
+	var (
+		b   backup.Backup
+		obj *unstructured.Unstructured
+	)
+
+	BeforeEach(func() {
+		b = backup.NewBackup(backup.NewVeleroProvider(fake.NewFakeClientWithScheme(scheme.Scheme), "velero"))
+		obj = &unstructured.Unstructured{}
+		obj.SetName("test")
+		obj.SetNamespace("matrix")
+	})
+
+	It("should accept valid values", func() {
+		Expect(b.ValidateValues(obj, chartutil.Values{})).To(Succeed())
+		Expect(b.ValidateValues(obj, chartutil.Values{"backup": map[string]interface{}{
+			"enabled":  true,
+			"ttl":      "24h",
+			"keepLast": int64(3),
+			"schedule": "0 3 * * *",
+		}})).To(Succeed())
+	})
+
+	It("should reject invalid values", func() {
+		for _, m := range []map[string]interface{}{
+			{"ttl": "forever"},
+			{"keepLast": "all"},
+			{"schedule": "daily"},
+			{"labelSelector": 3},
+		} {
+			err := b.ValidateValues(obj, chartutil.Values{"backup": m})
+			Expect(errors.Is(err, backup.ErrInvalidValues)).To(BeTrue(), "values %v", m)
+		}
+	})
+
+	It("should reject schedules the provider does not support", func() {
+		b = backup.NewBackup(backup.NewLocalProvider(fake.NewFakeClientWithScheme(scheme.Scheme), "/var/lib/helm-operator/backups"))
+		err := b.ValidateValues(obj, chartutil.Values{"backup": map[string]interface{}{"schedule": "0 3 * * *"}})
+		Expect(errors.Is(err, backup.ErrInvalidValues)).To(BeTrue())
+	})
+})
@@ -0,0 +1,265 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	backupGVK = schema.GroupVersionKind{
+		Group:   "velero.io",
+		Kind:    "Backup",
+		Version: "v1",
+	}
+	restoreGVK = schema.GroupVersionKind{
+		Group:   "velero.io",
+		Kind:    "Restore",
+		Version: "v1",
+	}
+	scheduleGVK = schema.GroupVersionKind{
+		Group:   "velero.io",
+		Kind:    "Schedule",
+		Version: "v1",
+	}
+)
+
+// VeleroProvider is a BackupProvider that takes backups with Velero. Backups,
+// restores and schedules are Velero objects in the Velero namespace, labelled
+// with the release they were created for.
+type VeleroProvider struct {
+	client client.Client
+
+	// namespace is the namespace Velero watches for its objects.
+	namespace string
+}
+
+var (
+	_ BackupProvider = &VeleroProvider{}
+	_ Scheduler      = &VeleroProvider{}
+)
+
+// NewVeleroProvider returns a VeleroProvider that creates Velero objects in
+// namespace.
+func NewVeleroProvider(client client.Client, namespace string) *VeleroProvider {
+	return &VeleroProvider{
+		client:    client,
+		namespace: namespace,
+	}
+}
+
+func (p *VeleroProvider) Create(ctx context.Context, obj *unstructured.Unstructured, _ *release.Release, name string, spec map[string]interface{}) error {
+	u := p.newObject(backupGVK, obj, name, spec)
+	labels := u.GetLabels()
+	if location, ok := spec["storageLocation"].(string); ok {
+		labels["velero.io/storage-location"] = location
+	}
+	u.SetLabels(labels)
+	if err := p.client.Create(ctx, u); err != nil {
+		if apierrors.IsAlreadyExists(err) && p.isOfRelease(ctx, backupGVK, name, obj) {
+			return nil
+		}
+		return fmt.Errorf("create velero backup %q: %w", name, err)
+	}
+	return nil
+}
+
+func (p *VeleroProvider) Status(ctx context.Context, name string) (*Summary, error) {
+	u, err := p.get(ctx, backupGVK, name)
+	if err != nil {
+		return nil, err
+	}
+	s := summaryFor(u)
+	return &s, nil
+}
+
+func (p *VeleroProvider) List(ctx context.Context, obj *unstructured.Unstructured) ([]Summary, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(backupGVK.GroupVersion().WithKind(backupGVK.Kind + "List"))
+	if err := p.client.List(ctx, list, client.InNamespace(p.namespace), client.MatchingLabels(ReleaseLabels(obj))); err != nil {
+		return nil, fmt.Errorf("list velero backups: %w", err)
+	}
+	summaries := make([]Summary, 0, len(list.Items))
+	for i := range list.Items {
+		summaries = append(summaries, summaryFor(&list.Items[i]))
+	}
+	return summaries, nil
+}
+
+// Delete asks Velero to delete a Backup together with its data in object
+// storage. Deleting the Backup object itself would leave the data behind and
+// Velero would sync it back. The request is named after the Backup, so that
+// repeated requests for the same Backup are idempotent.
+func (p *VeleroProvider) Delete(ctx context.Context, name string) error {
+	u, err := p.get(ctx, backupGVK, name)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if phase, _, _ := unstructured.NestedString(u.Object, "status", "phase"); phase == VeleroPhaseDeleting {
+		return nil
+	}
+	req := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "velero.io/v1",
+		"kind":       "DeleteBackupRequest",
+		"metadata": map[string]interface{}{
+			"name":      u.GetName(),
+			"namespace": u.GetNamespace(),
+		},
+		"spec": map[string]interface{}{
+			"backupName": u.GetName(),
+		},
+	}}
+	labels := map[string]string{
+		"velero.io/backup-name": u.GetName(),
+		"velero.io/backup-uid":  string(u.GetUID()),
+	}
+	for k, v := range u.GetLabels() {
+		if k == ReleaseNameLabel || k == ReleaseNamespaceLabel {
+			labels[k] = v
+		}
+	}
+	req.SetLabels(labels)
+	if err := p.client.Create(ctx, req); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("request deletion of velero backup %q: %w", u.GetName(), err)
+	}
+	return nil
+}
+
+func (p *VeleroProvider) Restore(ctx context.Context, obj *unstructured.Unstructured, name string, spec map[string]interface{}) error {
+	u := p.newObject(restoreGVK, obj, name, spec)
+	if err := p.client.Create(ctx, u); err != nil {
+		if apierrors.IsAlreadyExists(err) && p.isOfRelease(ctx, restoreGVK, name, obj) {
+			return nil
+		}
+		return fmt.Errorf("create velero restore %q: %w", name, err)
+	}
+	return nil
+}
+
+func (p *VeleroProvider) RestoreStatus(ctx context.Context, name string) (string, error) {
+	u, err := p.get(ctx, restoreGVK, name)
+	if err != nil {
+		return "", err
+	}
+	phase, _, _ := unstructured.NestedString(u.Object, "status", "phase")
+	return phase, nil
+}
+
+func (p *VeleroProvider) DeleteRestore(ctx context.Context, name string) error {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(restoreGVK)
+	u.SetNamespace(p.namespace)
+	u.SetName(name)
+	if err := p.client.Delete(ctx, u); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete velero restore %q: %w", name, err)
+	}
+	return nil
+}
+
+// ReconcileSchedule creates or updates the Velero Schedule of the release of
+// obj. Velero copies the labels of the Schedule to the Backups it creates, so
+// scheduled backups are listed together with on-demand ones.
+func (p *VeleroProvider) ReconcileSchedule(ctx context.Context, obj *unstructured.Unstructured, cron string, template map[string]interface{}, log logr.Logger) error {
+	desired := p.newObject(scheduleGVK, obj, scheduleName(obj), map[string]interface{}{
+		"schedule": cron,
+		"template": template,
+	})
+
+	existing, err := p.get(ctx, scheduleGVK, desired.GetName())
+	if errors.Is(err, ErrNotFound) {
+		if err := p.client.Create(ctx, desired); err != nil {
+			return fmt.Errorf("create velero schedule %q: %w", desired.GetName(), err)
+		}
+		log.Info("Backup schedule created", "schedule", desired.GetName(), "cron", cron)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if equality.Semantic.DeepEqual(existing.Object["spec"], desired.Object["spec"]) &&
+		equality.Semantic.DeepEqual(existing.GetLabels(), desired.GetLabels()) {
+		return nil
+	}
+	existing.Object["spec"] = desired.Object["spec"]
+	existing.SetLabels(desired.GetLabels())
+	if err := p.client.Update(ctx, existing); err != nil {
+		return fmt.Errorf("update velero schedule %q: %w", existing.GetName(), err)
+	}
+	log.Info("Backup schedule updated", "schedule", existing.GetName(), "cron", cron)
+	return nil
+}
+
+// DeleteSchedule deletes the Velero Schedule of the release of obj. It is
+// called on every reconciliation of a release without a schedule, so the
+// Schedule is looked up first and only deleted if it exists.
+func (p *VeleroProvider) DeleteSchedule(ctx context.Context, obj *unstructured.Unstructured, log logr.Logger) error {
+	u, err := p.get(ctx, scheduleGVK, scheduleName(obj))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.client.Delete(ctx, u); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("delete velero schedule %q: %w", u.GetName(), err)
+	}
+	log.Info("Backup schedule deleted", "schedule", u.GetName())
+	return nil
+}
+
+// newObject builds a Velero object for the release of obj.
+func (p *VeleroProvider) newObject(gvk schema.GroupVersionKind, obj *unstructured.Unstructured, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": spec,
+	}}
+	u.SetGroupVersionKind(gvk)
+	u.SetNamespace(p.namespace)
+	u.SetName(name)
+	u.SetLabels(ReleaseLabels(obj))
+	return u
+}
+
+// isOfRelease returns whether the Velero object named name exists and was
+// created for the release of obj.
+func (p *VeleroProvider) isOfRelease(ctx context.Context, gvk schema.GroupVersionKind, name string, obj *unstructured.Unstructured) bool {
+	u, err := p.get(ctx, gvk, name)
+	if err != nil {
+		return false
+	}
+	labels := u.GetLabels()
+	for k, v := range ReleaseLabels(obj) {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns the Velero object named name. If it does not exist, the
+// returned error matches ErrNotFound.
+func (p *VeleroProvider) get(ctx context.Context, gvk schema.GroupVersionKind, name string) (*unstructured.Unstructured, error) {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	if err := p.client.Get(ctx, client.ObjectKey{Namespace: p.namespace, Name: name}, u); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %v", ErrNotFound, err)
+		}
+		return nil, err
+	}
+	return u, nil
+}
@@ -0,0 +1,292 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joelanford/helm-operator/pkg/internal/values"
+)
+
+// DefaultVerifyTimeout is how long the trial restore of a backup, including
+// the readiness checks, may take when `backup.verify.timeout` is not set.
+const DefaultVerifyTimeout = 30 * time.Minute
+
+// VerificationPhase is the phase of the trial restore of a backup.
+type VerificationPhase string
+
+const (
+	VerificationInProgress VerificationPhase = "InProgress"
+	VerificationSucceeded  VerificationPhase = "Succeeded"
+	VerificationFailed     VerificationPhase = "Failed"
+)
+
+// Verification records the trial restore of a completed backup into a
+// scratch namespace. It is stored with the Status of the backup, so every
+// backup is verified at most once.
+type Verification struct {
+	Phase               VerificationPhase `json:"phase"`
+	RestoreName         string            `json:"restoreName"`
+	Namespace           string            `json:"namespace"`
+	Message             string            `json:"message,omitempty"`
+	StartTimestamp      *metav1.Time      `json:"startTimestamp,omitempty"`
+	CompletionTimestamp *metav1.Time      `json:"completionTimestamp,omitempty"`
+}
+
+// workloadKinds are the kinds whose readiness is checked after a trial
+// restore.
+var workloadKinds = []schema.GroupVersionKind{
+	{Group: "apps", Version: "v1", Kind: "Deployment"},
+	{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+}
+
+// verifyPolicy decides whether and how completed backups are verified. It is
+// read from the following values:
+//
+//   - backup.verify.enabled - whether every completed backup is restored
+//     into a scratch namespace to check that it can be restored (default
+//     false).
+//   - backup.verify.timeout - how long the restore and the readiness checks
+//     may take before the verification fails, as a duration string (default
+//     30m).
+type verifyPolicy struct {
+	enabled bool
+	timeout time.Duration
+}
+
+func verifyPolicyFor(vals chartutil.Values) (verifyPolicy, error) {
+	p := verifyPolicy{timeout: DefaultVerifyTimeout}
+	if v, ok := values.Lookup(vals, "backup.verify.enabled"); ok {
+		b, ok := v.(bool)
+		if !ok {
+			return p, invalidValuesError("backup.verify.enabled", "must be a boolean, got %v", v)
+		}
+		p.enabled = b
+	}
+	if v, ok := values.Lookup(vals, "backup.verify.timeout"); ok {
+		d, err := parseDuration(v)
+		if err != nil || d == 0 {
+			return p, invalidValuesError("backup.verify.timeout", "must be a positive duration, got %v", v)
+		}
+		p.timeout = d
+	}
+	return p, nil
+}
+
+// Verifier verifies completed backups by restoring them into a scratch
+// namespace and checking that the restored workloads become ready. The
+// scratch namespace is deleted once the verification has finished.
+type Verifier struct {
+	provider BackupProvider
+	client   client.Client
+}
+
+// NewVerifier returns a Verifier that restores backups with provider and
+// checks the restored workloads with client.
+func NewVerifier(provider BackupProvider, client client.Client) *Verifier {
+	return &Verifier{
+		provider: provider,
+		client:   client,
+	}
+}
+
+// Verify moves the verification of the completed backup recorded in st
+// forward by at most one step and records it in st. Like Backup.Reconcile, it
+// never waits for the restore itself, but returns how long to wait before
+// the next step is due:
+//
+//   - If the backup has not been verified yet, the scratch namespace is
+//     created and a restore into it is started.
+//   - If the verification is in progress, the restore and then the readiness
+//     of the restored Deployments and StatefulSets are checked once. When
+//     they are done, the scratch namespace is deleted and the verification
+//     is moved to Succeeded or Failed.
+//
+// Backups that have not completed are never verified.
+func (v *Verifier) Verify(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status, log logr.Logger) (*Status, time.Duration, error) {
+	if st == nil || st.Phase != PhaseCompleted {
+		return st, 0, nil
+	}
+	p, err := verifyPolicyFor(vals)
+	if err != nil {
+		return st, 0, err
+	}
+	switch {
+	case st.Verification == nil && p.enabled:
+		return v.start(ctx, obj, rel, st, log)
+	case st.Verification != nil && st.Verification.Phase == VerificationInProgress:
+		return v.advance(ctx, st, p, log)
+	}
+	return st, 0, nil
+}
+
+// Cleanup deletes the restore and the scratch namespace of a verification
+// that is still in progress, e.g. because its backup has been replaced by a
+// newer one.
+func (v *Verifier) Cleanup(ctx context.Context, st *Status, log logr.Logger) error {
+	if st == nil || st.Verification == nil || st.Verification.Phase != VerificationInProgress {
+		return nil
+	}
+	return v.cleanup(ctx, st.Verification, log)
+}
+
+func (v *Verifier) start(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, st *Status, log logr.Logger) (*Status, time.Duration, error) {
+	namespace := scratchNamespaceFor(obj, st.Name)
+	ns := &unstructured.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	ns.SetName(namespace)
+	ns.SetLabels(ReleaseLabels(obj))
+	if err := v.client.Create(ctx, ns); err != nil && !apierrors.IsAlreadyExists(err) {
+		return st, 0, fmt.Errorf("create scratch namespace %q: %w", namespace, err)
+	}
+
+	name := ShortenName("matrix-verify-" + st.Name)
+	if err := v.provider.Restore(ctx, obj, name, verifySpecFor(obj, rel, st.Name, namespace)); err != nil {
+		// The verification is not recorded yet, so nothing else would
+		// delete the namespace if the backup is not verified again.
+		if err := v.deleteNamespace(ctx, namespace, log); err != nil {
+			log.Error(err, "Failed to delete scratch namespace", "namespace", namespace)
+		}
+		return st, 0, err
+	}
+	log.Info("Backup verification started", "backup", st.Name, "restore", name, "namespace", namespace)
+
+	now := metav1.Now().Rfc3339Copy()
+	st.Verification = &Verification{
+		Phase:          VerificationInProgress,
+		RestoreName:    name,
+		Namespace:      namespace,
+		StartTimestamp: &now,
+	}
+	return st, DefaultPollInterval, nil
+}
+
+func (v *Verifier) advance(ctx context.Context, st *Status, p verifyPolicy, log logr.Logger) (*Status, time.Duration, error) {
+	ver := st.Verification
+	if ver.StartTimestamp != nil && time.Since(ver.StartTimestamp.Time) > p.timeout {
+		message := fmt.Sprintf("verification did not finish within %s", p.timeout)
+		if ver.Message != "" {
+			message += ": " + ver.Message
+		}
+		return v.finish(ctx, st, VerificationFailed, message, log)
+	}
+
+	phase, err := v.provider.RestoreStatus(ctx, ver.RestoreName)
+	if errors.Is(err, ErrNotFound) {
+		return v.finish(ctx, st, VerificationFailed, "restore no longer exists", log)
+	}
+	if err != nil {
+		return st, 0, err
+	}
+	switch phase {
+	case VeleroPhaseCompleted:
+		notReady, err := v.notReady(ctx, ver.Namespace)
+		if err != nil {
+			return st, 0, err
+		}
+		if len(notReady) > 0 {
+			ver.Message = "waiting for " + strings.Join(notReady, ", ")
+			return st, DefaultPollInterval, nil
+		}
+		return v.finish(ctx, st, VerificationSucceeded, "", log)
+	case VeleroPhasePartiallyFailed, VeleroPhaseFailed, VeleroPhaseFailedValidation:
+		return v.finish(ctx, st, VerificationFailed, fmt.Sprintf("restore finished in phase %s", phase), log)
+	}
+	return st, DefaultPollInterval, nil
+}
+
+// finish deletes the restore and the scratch namespace and moves the
+// verification to phase. The verification stays in progress if they cannot
+// be deleted, so that the deletion is retried.
+func (v *Verifier) finish(ctx context.Context, st *Status, phase VerificationPhase, message string, log logr.Logger) (*Status, time.Duration, error) {
+	if err := v.cleanup(ctx, st.Verification, log); err != nil {
+		return st, 0, err
+	}
+	now := metav1.Now().Rfc3339Copy()
+	st.Verification.Phase = phase
+	st.Verification.Message = message
+	st.Verification.CompletionTimestamp = &now
+	log.Info("Backup verification finished", "backup", st.Name, "phase", phase, "message", message)
+	return st, 0, nil
+}
+
+// notReady returns the restored workloads in namespace that do not have all
+// of their replicas ready yet.
+func (v *Verifier) notReady(ctx context.Context, namespace string) ([]string, error) {
+	var notReady []string
+	for _, gvk := range workloadKinds {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		if err := v.client.List(ctx, list, client.InNamespace(namespace)); err != nil {
+			return nil, fmt.Errorf("list restored %ss: %w", strings.ToLower(gvk.Kind), err)
+		}
+		for _, item := range list.Items {
+			replicas := 1
+			if n, ok, _ := unstructured.NestedFieldNoCopy(item.Object, "spec", "replicas"); ok {
+				replicas, _ = values.ToInt(n)
+			}
+			if ready := nestedInt(item.Object, "status", "readyReplicas"); ready < replicas {
+				notReady = append(notReady, fmt.Sprintf("%s %q (%d/%d ready)", strings.ToLower(gvk.Kind), item.GetName(), ready, replicas))
+			}
+		}
+	}
+	return notReady, nil
+}
+
+// cleanup deletes the restore and the scratch namespace of ver. Velero does
+// not expire restores, so they would be left behind otherwise.
+func (v *Verifier) cleanup(ctx context.Context, ver *Verification, log logr.Logger) error {
+	if err := v.provider.DeleteRestore(ctx, ver.RestoreName); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return v.deleteNamespace(ctx, ver.Namespace, log)
+}
+
+func (v *Verifier) deleteNamespace(ctx context.Context, namespace string, log logr.Logger) error {
+	ns := &unstructured.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	ns.SetName(namespace)
+	if err := v.client.Delete(ctx, ns); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("delete scratch namespace %q: %w", namespace, err)
+	}
+	log.Info("Scratch namespace deleted", "namespace", namespace)
+	return nil
+}
+
+// verifySpecFor returns the spec of a restore of the backup named backupName
+// into the scratch namespace.
+func verifySpecFor(obj *unstructured.Unstructured, rel *release.Release, backupName, namespace string) map[string]interface{} {
+	return CloneSpec(obj, rel, backupName, map[string]string{ReleaseNamespace(obj, rel): namespace})
+}
+
+// scratchNamespaceFor returns the name of the scratch namespace the backup
+// named backupName of the release of obj is restored into. It is derived from
+// obj's name and a hash of backupName, so that a verification that is started
+// again after a failed attempt reuses the namespace and restore of that
+// attempt, and fits into the 63 characters of a namespace name.
+func scratchNamespaceFor(obj *unstructured.Unstructured, backupName string) string {
+	name := strings.ReplaceAll(obj.GetName(), ".", "-")
+	if len(name) > 40 {
+		name = strings.TrimRight(name[:40], "-")
+	}
+	sum := sha256.Sum256([]byte(backupName))
+	return name + "-verify-" + hex.EncodeToString(sum[:])[:10]
+}
@@ -0,0 +1,239 @@
+package backup_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+var _ = Describe("Verifier", func() {
+	var (
+		cl   client.Client
+		v    *backup.Verifier
+		obj  *unstructured.Unstructured
+		rel  *release.Release
+		vals chartutil.Values
+		st   *backup.Status
+	)
+
+	BeforeEach(func() {
+		// The fake client cannot list typed objects into an
+		// UnstructuredList, so workloads are handled as unstructured.
+		sch := runtime.NewScheme()
+		for _, kind := range []string{"DeploymentList", "StatefulSetList"} {
+			sch.AddKnownTypeWithName(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: kind}, &unstructured.UnstructuredList{})
+		}
+		cl = fake.NewFakeClientWithScheme(sch)
+		v = backup.NewVerifier(backup.NewVeleroProvider(cl, "velero"), cl)
+		obj = &unstructured.Unstructured{}
+		obj.SetAPIVersion("matrix.example.com/v1")
+		obj.SetKind("Matrix")
+		obj.SetName("test")
+		obj.SetNamespace("matrix")
+		rel = &release.Release{Name: "test", Namespace: "matrix", Version: 1}
+		vals = chartutil.Values{"backup": map[string]interface{}{"verify": map[string]interface{}{"enabled": true}}}
+		st = &backup.Status{Name: "matrix-backup-test-1", Phase: backup.PhaseCompleted}
+	})
+
+	getObject := func(apiVersion, kind, namespace, name string) (*unstructured.Unstructured, error) {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion(apiVersion)
+		u.SetKind(kind)
+		err := cl.Get(context.TODO(), client.ObjectKey{Namespace: namespace, Name: name}, u)
+		return u, err
+	}
+
+	setRestorePhase := func(name, phase string) {
+		u, err := getObject("velero.io/v1", "Restore", "velero", name)
+		Expect(err).To(BeNil())
+		Expect(unstructured.SetNestedField(u.Object, phase, "status", "phase")).To(Succeed())
+		Expect(cl.Update(context.TODO(), u)).To(Succeed())
+	}
+
+	createDeployment := func(namespace string, replicas, ready int64) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("apps/v1")
+		u.SetKind("Deployment")
+		u.SetNamespace(namespace)
+		u.SetName("synapse")
+		Expect(unstructured.SetNestedField(u.Object, replicas, "spec", "replicas")).To(Succeed())
+		Expect(unstructured.SetNestedField(u.Object, ready, "status", "readyReplicas")).To(Succeed())
+		Expect(cl.Create(context.TODO(), u)).To(Succeed())
+		return u
+	}
+
+	start := func() *backup.Verification {
+		var err error
+		st, _, err = v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Verification).NotTo(BeNil())
+		return st.Verification
+	}
+
+	It("should not verify backups unless enabled", func() {
+		st, requeueAfter, err := v.Verify(context.TODO(), obj, rel, chartutil.Values{}, st, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(BeZero())
+		Expect(st.Verification).To(BeNil())
+	})
+
+	It("should not verify backups that have not completed", func() {
+		st.Phase = backup.PhaseFailed
+		st, _, err := v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Verification).To(BeNil())
+	})
+
+	It("should reject invalid values", func() {
+		vals = chartutil.Values{"backup": map[string]interface{}{"verify": map[string]interface{}{"enabled": true, "timeout": "soon"}}}
+		_, _, err := v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(errors.Is(err, backup.ErrInvalidValues)).To(BeTrue())
+	})
+
+	It("should restore the backup into a scratch namespace without the custom resource", func() {
+		ver := start()
+		Expect(ver.Phase).To(Equal(backup.VerificationInProgress))
+		Expect(ver.Namespace).To(HavePrefix("test-verify-"))
+		Expect(ver.StartTimestamp).NotTo(BeNil())
+
+		ns, err := getObject("v1", "Namespace", "", ver.Namespace)
+		Expect(err).To(BeNil())
+		Expect(ns.GetLabels()).To(HaveKeyWithValue(backup.ReleaseNameLabel, "test"))
+
+		restore, err := getObject("velero.io/v1", "Restore", "velero", ver.RestoreName)
+		Expect(err).To(BeNil())
+		spec := restore.Object["spec"].(map[string]interface{})
+		Expect(spec["backupName"]).To(Equal(st.Name))
+		Expect(spec["namespaceMapping"]).To(Equal(map[string]interface{}{"matrix": ver.Namespace}))
+		Expect(spec["excludedResources"]).To(ContainElement("matrix.matrix.example.com"))
+	})
+
+	It("should reuse the namespace and restore of an earlier attempt", func() {
+		ver := start()
+		// The status of the first attempt was not recorded.
+		st.Verification = nil
+		again := start()
+		Expect(again.Namespace).To(Equal(ver.Namespace))
+		Expect(again.RestoreName).To(Equal(ver.RestoreName))
+	})
+
+	It("should delete the scratch namespace if the restore cannot be started", func() {
+		// A successful attempt tells the name of the namespace.
+		ver := start()
+		Expect(v.Cleanup(context.TODO(), st, testing.NullLogger{})).To(Succeed())
+		st.Verification = nil
+
+		errRestore := errors.New("restore rejected")
+		v = backup.NewVerifier(failingRestoreProvider{backup.NewVeleroProvider(cl, "velero"), errRestore}, cl)
+		st, _, err := v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(err).To(MatchError(errRestore))
+		Expect(st.Verification).To(BeNil())
+		_, err = getObject("v1", "Namespace", "", ver.Namespace)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should succeed once the restored workloads are ready", func() {
+		ver := start()
+		st, requeueAfter, err := v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(Equal(backup.DefaultPollInterval))
+		Expect(ver.Phase).To(Equal(backup.VerificationInProgress))
+
+		setRestorePhase(ver.RestoreName, backup.VeleroPhaseCompleted)
+		deployment := createDeployment(ver.Namespace, 2, 1)
+		st, _, err = v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(ver.Phase).To(Equal(backup.VerificationInProgress))
+		Expect(ver.Message).To(ContainSubstring(`deployment "synapse" (1/2 ready)`))
+
+		Expect(unstructured.SetNestedField(deployment.Object, int64(2), "status", "readyReplicas")).To(Succeed())
+		Expect(cl.Update(context.TODO(), deployment)).To(Succeed())
+		st, requeueAfter, err = v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(BeZero())
+		Expect(ver.Phase).To(Equal(backup.VerificationSucceeded))
+		Expect(ver.Message).To(BeEmpty())
+		Expect(ver.CompletionTimestamp).NotTo(BeNil())
+
+		_, err = getObject("v1", "Namespace", "", ver.Namespace)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		_, err = getObject("velero.io/v1", "Restore", "velero", ver.RestoreName)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		// A verified backup is not verified again.
+		again, _, err := v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(again.Verification.RestoreName).To(Equal(ver.RestoreName))
+		Expect(again.Verification.Phase).To(Equal(backup.VerificationSucceeded))
+	})
+
+	It("should fail if the restore fails", func() {
+		ver := start()
+		setRestorePhase(ver.RestoreName, backup.VeleroPhasePartiallyFailed)
+		_, _, err := v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(ver.Phase).To(Equal(backup.VerificationFailed))
+		Expect(ver.Message).To(ContainSubstring(backup.VeleroPhasePartiallyFailed))
+
+		_, err = getObject("v1", "Namespace", "", ver.Namespace)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		_, err = getObject("velero.io/v1", "Restore", "velero", ver.RestoreName)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should finish if the restore no longer exists", func() {
+		ver := start()
+		_, err := getObject("velero.io/v1", "Restore", "velero", ver.RestoreName)
+		Expect(err).To(BeNil())
+		Expect(backup.NewVeleroProvider(cl, "velero").DeleteRestore(context.TODO(), ver.RestoreName)).To(Succeed())
+		_, _, err = v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(ver.Phase).To(Equal(backup.VerificationFailed))
+		Expect(ver.Message).To(Equal("restore no longer exists"))
+	})
+
+	It("should fail if the verification times out", func() {
+		ver := start()
+		started := metav1.NewTime(time.Now().Add(-backup.DefaultVerifyTimeout - time.Minute))
+		ver.StartTimestamp = &started
+		_, _, err := v.Verify(context.TODO(), obj, rel, vals, st, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(ver.Phase).To(Equal(backup.VerificationFailed))
+		Expect(ver.Message).To(ContainSubstring("did not finish within"))
+	})
+
+	It("should clean up a verification in progress", func() {
+		ver := start()
+		Expect(v.Cleanup(context.TODO(), st, testing.NullLogger{})).To(Succeed())
+		_, err := getObject("v1", "Namespace", "", ver.Namespace)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		_, err = getObject("velero.io/v1", "Restore", "velero", ver.RestoreName)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(v.Cleanup(context.TODO(), nil, testing.NullLogger{})).To(Succeed())
+	})
+})
+
+// failingRestoreProvider is a BackupProvider that fails to start restores.
+type failingRestoreProvider struct {
+	backup.BackupProvider
+	err error
+}
+
+func (p failingRestoreProvider) Restore(context.Context, *unstructured.Unstructured, string, map[string]interface{}) error {
+	return p.err
+}
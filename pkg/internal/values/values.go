@@ -0,0 +1,53 @@
+// Package values reads the settings of the backup, restore and snapshot
+// features from the values of a release.
+package values
+
+import (
+	"fmt"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// InvalidError returns an error wrapping err, the sentinel of invalid values
+// of a feature, that reports the value at path as invalid.
+func InvalidError(err error, path string, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s: %s", err, path, fmt.Sprintf(format, args...))
+}
+
+// Lookup returns the value at path, which unlike with
+// chartutil.Values.PathValue may also be a map. Null values and empty
+// strings are treated as not set, so that charts can list them in their
+// default values.
+func Lookup(vals chartutil.Values, path string) (interface{}, bool) {
+	parent, key := "", path
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		parent, key = path[:i], path[i+1:]
+	}
+	table := vals
+	if parent != "" {
+		t, err := vals.Table(parent)
+		if err != nil {
+			return nil, false
+		}
+		table = t
+	}
+	v, ok := table[key]
+	return v, ok && v != nil && v != ""
+}
+
+// ToInt converts a number decoded from YAML or JSON into an int.
+func ToInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		if n != float64(int(n)) {
+			return 0, false
+		}
+		return int(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,515 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+	"github.com/joelanford/helm-operator/pkg/internal/sdk/status"
+	"github.com/joelanford/helm-operator/pkg/reconciler/internal/conditions"
+	"github.com/joelanford/helm-operator/pkg/reconciler/internal/updater"
+	"github.com/joelanford/helm-operator/pkg/restore"
+)
+
+// WithPreDeleteBackup is an Option that configures whether a final backup of
+// a release is taken before it is uninstalled. The custom resource keeps its
+// uninstall finalizer until the backup completes, for at most timeout after it
+// was deleted; a timeout of 0 waits indefinitely. backup.PreDeleteAnnotation
+// overrides enabled for a single custom resource.
+//
+// It only has an effect together with WithBackup.
+func WithPreDeleteBackup(enabled bool, timeout time.Duration) Option {
+	return func(r *Reconciler) error {
+		if timeout < 0 {
+			return errors.New("pre-delete backup timeout must not be negative")
+		}
+		r.preDeleteBackup = enabled
+		r.preDeleteBackupTimeout = timeout
+		return nil
+	}
+}
+
+// WithBackupMetrics is an Option that configures the reconciler to export the
+// metrics of the backups and restores of its releases. The metrics are
+// registered with the controller-runtime metrics registry.
+func WithBackupMetrics(m *backup.Metrics) Option {
+	return func(r *Reconciler) error {
+		r.backupMetrics = m
+		return nil
+	}
+}
+
+// WithBackupVerifier is an Option that configures the reconciler to verify
+// completed backups whose values ask for it by restoring them into a scratch
+// namespace. The result is recorded in the BackupVerified condition.
+//
+// It only has an effect together with WithBackup.
+func WithBackupVerifier(v *backup.Verifier) Option {
+	return func(r *Reconciler) error {
+		r.verifier = v
+		return nil
+	}
+}
+
+// WithBackup is an Option that configures the reconciler to take Velero
+// backups of releases whose values or backup.RequestAnnotation request one.
+// Backup progress is tracked in the custom resource status and advanced on
+// later reconciliations.
+func WithBackup(b *backup.Backup) Option {
+	return func(r *Reconciler) error {
+		r.backup = b
+		return nil
+	}
+}
+
+// doBackup advances the backup state machine for rel by one step and records
+// the result in the status of obj. Every phase transition is also reported
+// as an event on obj. Completed backups are then verified, if a verifier is
+// configured. It returns how long to wait before the backup needs to be
+// looked at again, or 0 if no further steps are pending.
+func (r *Reconciler) doBackup(ctx context.Context, u *updater.Updater, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) (time.Duration, error) {
+	prev := backup.StatusFor(obj)
+	st, requeueAfter, err := r.backup.Reconcile(ctx, obj, rel, vals, log)
+	if err := r.reportBackup(u, obj, prev, st, requeueAfter, err); err != nil || r.verifier == nil {
+		return requeueAfter, err
+	}
+	verifyRequeueAfter, err := r.doBackupVerification(ctx, u, obj, rel, vals, prev, st, log)
+	return minRequeueAfter(requeueAfter, verifyRequeueAfter), err
+}
+
+// doBackupVerification advances the verification of the backup recorded in
+// st by one step and reports it in the BackupVerified condition of obj and
+// as events. The scratch namespace of a verification that was still in
+// progress for the previous backup prev is deleted once st replaces it.
+func (r *Reconciler) doBackupVerification(ctx context.Context, u *updater.Updater, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, prev, st *backup.Status, log logr.Logger) (time.Duration, error) {
+	if prev != nil && (st == nil || st.Name != prev.Name) {
+		if err := r.verifier.Cleanup(ctx, prev, log); err != nil {
+			return 0, err
+		}
+	}
+	st, requeueAfter, err := r.verifier.Verify(ctx, obj, rel, vals, st, log)
+	if errors.Is(err, backup.ErrInvalidValues) {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupVerified(corev1.ConditionFalse, conditions.ReasonInvalidBackupValues, err)),
+		)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonInvalidBackupValues), "Backup not verified: %v", err)
+		return 0, nil
+	}
+	if err != nil {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupVerified(corev1.ConditionFalse, conditions.ReasonVerificationError, err)),
+		)
+		return 0, err
+	}
+	if st == nil || st.Verification == nil {
+		return 0, nil
+	}
+
+	v := st.Verification
+	u.UpdateStatus(updater.EnsureBackupStatus(st))
+	transitioned := prev == nil || prev.Name != st.Name || prev.Verification == nil || prev.Verification.Phase != v.Phase
+	switch v.Phase {
+	case backup.VerificationInProgress:
+		message := fmt.Sprintf("restoring backup %q into namespace %q", st.Name, v.Namespace)
+		if v.Message != "" {
+			message += ": " + v.Message
+		}
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupVerified(corev1.ConditionUnknown, conditions.ReasonVerificationStarted, message)),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonVerificationStarted),
+				"Verifying backup %q by restoring it into namespace %q", st.Name, v.Namespace)
+		}
+	case backup.VerificationSucceeded:
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupVerified(corev1.ConditionTrue, conditions.ReasonVerificationSucceeded,
+				fmt.Sprintf("backup %q was restored and its workloads became ready", st.Name))),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonVerificationSucceeded),
+				"Backup %q verified", st.Name)
+		}
+	case backup.VerificationFailed:
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupVerified(corev1.ConditionFalse, conditions.ReasonVerificationFailed,
+				fmt.Sprintf("backup %q could not be verified: %s", st.Name, v.Message))),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonVerificationFailed),
+				"Backup %q could not be verified: %s", st.Name, v.Message)
+		}
+	}
+	return requeueAfter, nil
+}
+
+// reportBackup records the result of a step of the backup state machine in
+// the status of obj, and reports phase transitions as events. It returns err
+// unless the error is caused by invalid values, which will not fix
+// themselves, so there is no point in retrying until the custom resource
+// changes.
+func (r *Reconciler) reportBackup(u *updater.Updater, obj *unstructured.Unstructured, prev, st *backup.Status, requeueAfter time.Duration, err error) error {
+	if errors.Is(err, backup.ErrInvalidValues) {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupInProgress(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.BackupFailed(corev1.ConditionTrue, conditions.ReasonInvalidBackupValues, err)),
+		)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonInvalidBackupValues), "Backup not started: %v", err)
+		return nil
+	}
+	if err != nil {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupInProgress(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.BackupFailed(corev1.ConditionTrue, conditions.ReasonBackupError, err)),
+		)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonBackupError), "Backup failed: %v", err)
+		return err
+	}
+	if st == nil {
+		return nil
+	}
+
+	u.UpdateStatus(updater.EnsureBackupStatus(st))
+	transitioned := prev == nil || prev.Name != st.Name || prev.Phase != st.Phase
+	if transitioned {
+		r.backupMetrics.ObserveBackup(obj, st)
+	}
+	switch st.Phase {
+	case backup.PhaseInProgress:
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupInProgress(corev1.ConditionTrue, conditions.ReasonBackupStarted,
+				fmt.Sprintf("backup %q is in progress (attempt %d)", st.Name, st.Attempt))),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonBackupStarted),
+				"Started Velero backup %q (attempt %d)", st.Name, st.Attempt)
+		}
+	case backup.PhaseRetrying:
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupInProgress(corev1.ConditionTrue, conditions.ReasonBackupRetrying,
+				fmt.Sprintf("backup %q failed, retrying: %s", st.Name, st.Message))),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonBackupRetrying),
+				"Velero backup %q failed (attempt %d), retrying after %s: %s", st.Name, st.Attempt, requeueAfter, st.Message)
+		}
+	case backup.PhaseCompleted:
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupInProgress(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.BackupSucceeded(corev1.ConditionTrue, conditions.ReasonBackupCompleted,
+				fmt.Sprintf("backup %q completed", st.Name))),
+			updater.EnsureCondition(conditions.BackupFailed(corev1.ConditionFalse, "", "")),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonBackupCompleted),
+				"Velero backup %q completed with %d errors and %d warnings", st.Name, st.Errors, st.Warnings)
+		}
+	case backup.PhaseFailed:
+		reason := backupFailedReason(st)
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupInProgress(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.BackupSucceeded(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.BackupFailed(corev1.ConditionTrue, reason,
+				fmt.Sprintf("backup %q failed: %s", st.Name, st.Message))),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Warning", string(reason),
+				"Velero backup %q failed after %d attempt(s): %s", st.Name, st.Attempt, st.Message)
+		}
+	}
+	return nil
+}
+
+// doPreDeleteBackup takes the final backup of rel before it is uninstalled,
+// if the pre-delete backup is enabled for obj. It returns whether the
+// uninstall can go ahead, and if not, how long to wait before looking at the
+// backup again.
+//
+// The uninstall goes ahead once the final backup completed, once the
+// pre-delete backup timeout has passed since obj was deleted, or when
+// backup.SkipPreDeleteAnnotation is set. Until then a failed final backup
+// blocks the uninstall, so that the release is not lost without a backup.
+func (r *Reconciler) doPreDeleteBackup(ctx context.Context, u *updater.Updater, obj *unstructured.Unstructured, rel *release.Release, log logr.Logger) (bool, time.Duration, error) {
+	if !r.preDeleteBackupEnabled(obj) || rel == nil {
+		return true, 0, nil
+	}
+	if skip, _ := strconv.ParseBool(obj.GetAnnotations()[backup.SkipPreDeleteAnnotation]); skip {
+		log.Info("Skipping final backup", "annotation", backup.SkipPreDeleteAnnotation)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonPreDeleteBackupSkipped),
+			"Uninstalling without a final backup, as requested by annotation %s", backup.SkipPreDeleteAnnotation)
+		return true, 0, nil
+	}
+	var remaining time.Duration
+	if r.preDeleteBackupTimeout > 0 && obj.GetDeletionTimestamp() != nil {
+		remaining = r.preDeleteBackupTimeout - time.Since(obj.GetDeletionTimestamp().Time)
+		if remaining <= 0 {
+			log.Info("Final backup timed out", "timeout", r.preDeleteBackupTimeout)
+			r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonPreDeleteBackupTimedOut),
+				"Uninstalling without a completed final backup after waiting %s", r.preDeleteBackupTimeout)
+			return true, 0, nil
+		}
+	}
+
+	vals, err := r.getValues(obj)
+	if err != nil {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupFailed(corev1.ConditionTrue, conditions.ReasonErrorGettingValues, err)),
+		)
+		return false, 0, err
+	}
+	prev := backup.StatusFor(obj)
+	st, requeueAfter, err := r.backup.PreDelete(ctx, obj, rel, vals, log)
+	if err := r.reportBackup(u, obj, prev, st, requeueAfter, err); err != nil {
+		return false, 0, err
+	}
+	if st != nil && st.Trigger == backup.TriggerPreDelete && st.Phase == backup.PhaseCompleted {
+		return true, 0, nil
+	}
+
+	if st != nil && st.Trigger == backup.TriggerPreDelete && st.Phase == backup.PhaseFailed && (prev == nil || prev.Name != st.Name || prev.Phase != st.Phase) {
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonPreDeleteBackupFailed),
+			"Uninstall is blocked until a final backup completes, set annotation %s to \"true\" to uninstall anyway", backup.SkipPreDeleteAnnotation)
+	}
+	if requeueAfter == 0 {
+		requeueAfter = backup.DefaultPollInterval
+	}
+	return false, minRequeueAfter(requeueAfter, remaining), nil
+}
+
+// doPreUpgradeBackup takes a backup of the deployed release rel before it is
+// upgraded, if the values of obj enable it. It returns whether the upgrade can
+// go ahead, the completed pre-upgrade backup if there is one, and how long to
+// wait before looking at the backup again.
+//
+// The upgrade waits while the backup is in flight. It is blocked until obj
+// changes if the backup failed, if the values are invalid, or if the backup
+// has already been restored after a failed upgrade of the same generation,
+// as upgrading again would undo that restore.
+func (r *Reconciler) doPreUpgradeBackup(ctx context.Context, u *updater.Updater, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) (bool, *backup.Status, time.Duration, error) {
+	enabled, err := backup.PreUpgradeEnabled(vals)
+	if err == nil && !enabled {
+		return true, nil, 0, nil
+	}
+	prev := backup.StatusFor(obj)
+	var (
+		st           *backup.Status
+		requeueAfter time.Duration
+	)
+	if err == nil {
+		st, requeueAfter, err = r.backup.PreUpgrade(ctx, obj, rel, vals, log)
+	}
+	invalid := errors.Is(err, backup.ErrInvalidValues)
+	if err := r.reportBackup(u, obj, prev, st, requeueAfter, err); err != nil {
+		return false, nil, 0, err
+	}
+	if invalid {
+		return false, nil, 0, nil
+	}
+	if !backup.IsPreUpgradeFor(st, obj) {
+		// A backup with another trigger is still in flight, or has just
+		// finished and the pre-upgrade backup is next.
+		if requeueAfter == 0 {
+			requeueAfter = backup.DefaultPollInterval
+		}
+		return false, nil, requeueAfter, nil
+	}
+	// A blocked upgrade is still looked at periodically, so that the
+	// release keeps being reconciled.
+	switch {
+	case st.RestoreName != "":
+		log.Info("Not upgrading again, the pre-upgrade backup has been restored", "backup", st.Name, "restore", st.RestoreName)
+		return false, nil, backup.DefaultPollInterval, nil
+	case st.Phase == backup.PhaseCompleted:
+		return true, st, 0, nil
+	case st.Phase == backup.PhaseFailed:
+		if prev == nil || prev.Name != st.Name || prev.Phase != st.Phase {
+			r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonPreUpgradeBackupFailed),
+				"Upgrade is blocked until a pre-upgrade backup completes, change the custom resource to try again")
+		}
+		return false, nil, backup.DefaultPollInterval, nil
+	}
+	return false, nil, requeueAfter, nil
+}
+
+// doUpgradeFailure points the status of obj at the pre-upgrade backup st
+// after an upgrade of rel failed, and restores the backup if the values ask
+// for it and a restore is configured. The restore is recorded in the status
+// of obj, so that it is moved forward by doRestore on later reconciliations
+// like any other restore.
+func (r *Reconciler) doUpgradeFailure(ctx context.Context, u *updater.Updater, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *backup.Status, upgradeErr error, log logr.Logger) {
+	rollback, err := backup.RestoreOnUpgradeFailure(vals, st)
+	if err == nil && rollback && r.restore != nil {
+		prev := restore.StatusFor(obj)
+		rs, requeueAfter, rollbackErr := r.restore.Rollback(ctx, obj, rel, vals, st.Name, log)
+		if rollbackErr == nil {
+			st.RestoreName = rs.Name
+		}
+		_, err = r.reportRestore(u, obj, prev, rs, requeueAfter, rollbackErr)
+	}
+	if err != nil {
+		log.Error(err, "Failed to restore pre-upgrade backup", "backup", st.Name)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonBackupError),
+			"Failed to restore pre-upgrade backup %q: %v", st.Name, err)
+	}
+	message := fmt.Sprintf("%v; the release can be restored from pre-upgrade backup %q", upgradeErr, st.Name)
+	if st.RestoreName != "" {
+		message = fmt.Sprintf("%v; restoring pre-upgrade backup %q with restore %q", upgradeErr, st.Name, st.RestoreName)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonPreUpgradeBackupRestored),
+			"Upgrade failed, started restore %q of pre-upgrade backup %q", st.RestoreName, st.Name)
+	}
+	u.UpdateStatus(
+		updater.EnsureBackupStatus(st),
+		updater.EnsureCondition(conditions.ReleaseFailed(corev1.ConditionTrue, conditions.ReasonUpgradeError, message)),
+	)
+}
+
+// preDeleteBackupEnabled returns whether a final backup is taken before the
+// release of obj is uninstalled.
+func (r *Reconciler) preDeleteBackupEnabled(obj *unstructured.Unstructured) bool {
+	if v, err := strconv.ParseBool(obj.GetAnnotations()[backup.PreDeleteAnnotation]); err == nil {
+		return v
+	}
+	return r.preDeleteBackup
+}
+
+// doBackupSchedule makes sure the Velero Schedule of rel matches its values
+// and records the result in the BackupScheduled condition of obj. The
+// condition is removed once the release no longer has a schedule.
+func (r *Reconciler) doBackupSchedule(ctx context.Context, u *updater.Updater, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) error {
+	cron, err := r.backup.ReconcileSchedule(ctx, obj, rel, vals, log)
+	if errors.Is(err, backup.ErrInvalidValues) {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupScheduled(corev1.ConditionFalse, conditions.ReasonInvalidBackupValues, err)),
+		)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonInvalidBackupValues), "Backup schedule not applied: %v", err)
+		return nil
+	}
+	if err != nil {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.BackupScheduled(corev1.ConditionFalse, conditions.ReasonScheduleError, err)),
+		)
+		return err
+	}
+	if cron == "" {
+		u.UpdateStatus(updater.RemoveCondition(conditions.TypeBackupScheduled))
+		return nil
+	}
+	u.UpdateStatus(
+		updater.EnsureCondition(conditions.BackupScheduled(corev1.ConditionTrue, conditions.ReasonScheduleReconciled,
+			fmt.Sprintf("backups are scheduled at %q", cron))),
+	)
+	return nil
+}
+
+// doBackupPrune deletes the backups of obj that fall outside its retention
+// policy. Pruning is reported through events only, as it does not change the
+// state of the release.
+func (r *Reconciler) doBackupPrune(ctx context.Context, obj *unstructured.Unstructured, vals chartutil.Values, log logr.Logger) error {
+	pruned, err := r.backup.Prune(ctx, obj, vals, log)
+	if len(pruned) > 0 {
+		r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonBackupsPruned),
+			"Requested deletion of %d Velero backup(s): %s", len(pruned), strings.Join(pruned, ", "))
+	}
+	if errors.Is(err, backup.ErrInvalidValues) {
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonInvalidBackupValues), "Backups not pruned: %v", err)
+		return nil
+	}
+	if err != nil {
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonPruneError), "Failed to prune backups: %v", err)
+		return err
+	}
+	return nil
+}
+
+// pruneBackupsOnUninstall deletes all backups of obj if its values set
+// `backup.pruneOnUninstall`. Values that cannot be read are not allowed to
+// block the deletion of obj, so the backups are kept in that case.
+func (r *Reconciler) pruneBackupsOnUninstall(ctx context.Context, obj *unstructured.Unstructured, log logr.Logger) error {
+	// The final backup is the one the release can be restored from after
+	// the uninstall, so it is kept regardless.
+	var keep string
+	if st := backup.StatusFor(obj); st != nil && st.Trigger == backup.TriggerPreDelete {
+		keep = st.Name
+	}
+
+	vals, err := r.getValues(obj)
+	if err != nil {
+		log.Error(err, "Failed to get values, keeping backups")
+		return nil
+	}
+	prune, err := backup.PruneOnUninstall(vals)
+	if err != nil {
+		log.Error(err, "Invalid backup values, keeping backups")
+		return nil
+	}
+	if !prune {
+		return nil
+	}
+	pruned, err := r.backup.PruneAll(ctx, obj, keep, log)
+	if len(pruned) > 0 {
+		r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonBackupsPruned),
+			"Requested deletion of %d Velero backup(s): %s", len(pruned), strings.Join(pruned, ", "))
+	}
+	return err
+}
+
+// doBackupInventory lists the newest backups of obj in `status.backups`
+// and reports the number of completed ones and the completion of the newest
+// of them as metrics. The inventory is informational only, so failing
+// to list the backups, e.g. because Velero is not installed, does not fail
+// the reconciliation.
+func (r *Reconciler) doBackupInventory(ctx context.Context, u *updater.Updater, obj *unstructured.Unstructured, log logr.Logger) {
+	entries, err := r.backup.Inventory(ctx, obj)
+	if err != nil {
+		log.Error(err, "Failed to list backups")
+		return
+	}
+	r.backupMetrics.SetRetained(obj, entries)
+	r.backupMetrics.SetLastSuccess(obj, backup.LatestCompleted(entries, time.Time{}))
+	u.UpdateStatus(updater.EnsureBackups(backup.Newest(entries, backup.MaxStatusBackups)))
+}
+
+// backupFailedReason maps a failed backup to the reason of its BackupFailed
+// condition.
+func backupFailedReason(st *backup.Status) status.ConditionReason {
+	if st.TimedOut {
+		return conditions.ReasonBackupTimedOut
+	}
+	switch st.VeleroPhase {
+	case backup.VeleroPhasePartiallyFailed:
+		return conditions.ReasonBackupPartiallyFailed
+	case backup.VeleroPhaseFailed:
+		return conditions.ReasonBackupFailed
+	case backup.VeleroPhaseFailedValidation:
+		return conditions.ReasonBackupFailedValidation
+	case backup.VeleroPhaseDeleting:
+		return conditions.ReasonBackupDeleted
+	}
+	return conditions.ReasonBackupError
+}
@@ -30,6 +30,20 @@ const (
 	TypeReleaseFailed  = "ReleaseFailed"
 	TypeIrreconcilable = "Irreconcilable"
 
+	TypeBackupInProgress = "BackupInProgress"
+	TypeBackupSucceeded  = "BackupSucceeded"
+	TypeBackupFailed     = "BackupFailed"
+	TypeBackupScheduled  = "BackupScheduled"
+	TypeBackupVerified   = "BackupVerified"
+
+	TypeRestoreInProgress = "RestoreInProgress"
+	TypeRestoreSucceeded  = "RestoreSucceeded"
+	TypeRestoreFailed     = "RestoreFailed"
+
+	TypeSnapshotInProgress = "SnapshotInProgress"
+	TypeSnapshotSucceeded  = "SnapshotSucceeded"
+	TypeSnapshotFailed     = "SnapshotFailed"
+
 	ReasonInstallSuccessful   = status.ConditionReason("InstallSuccessful")
 	ReasonUpgradeSuccessful   = status.ConditionReason("UpgradeSuccessful")
 	ReasonUninstallSuccessful = status.ConditionReason("UninstallSuccessful")
@@ -41,6 +55,46 @@ const (
 	ReasonUpgradeError             = status.ConditionReason("UpgradeError")
 	ReasonReconcileError           = status.ConditionReason("ReconcileError")
 	ReasonUninstallError           = status.ConditionReason("UninstallError")
+
+	ReasonBackupStarted          = status.ConditionReason("BackupStarted")
+	ReasonBackupRetrying         = status.ConditionReason("BackupRetrying")
+	ReasonBackupCompleted        = status.ConditionReason("BackupCompleted")
+	ReasonBackupError            = status.ConditionReason("BackupError")
+	ReasonBackupFailed           = status.ConditionReason("BackupFailed")
+	ReasonBackupPartiallyFailed  = status.ConditionReason("BackupPartiallyFailed")
+	ReasonBackupFailedValidation = status.ConditionReason("BackupFailedValidation")
+	ReasonBackupDeleted          = status.ConditionReason("BackupDeleted")
+	ReasonBackupTimedOut         = status.ConditionReason("BackupTimedOut")
+	ReasonInvalidBackupValues    = status.ConditionReason("InvalidBackupValues")
+	ReasonScheduleReconciled     = status.ConditionReason("ScheduleReconciled")
+	ReasonScheduleError          = status.ConditionReason("ScheduleError")
+	ReasonBackupsPruned          = status.ConditionReason("BackupsPruned")
+	ReasonPruneError             = status.ConditionReason("PruneError")
+
+	ReasonPreDeleteBackupFailed   = status.ConditionReason("PreDeleteBackupFailed")
+	ReasonPreDeleteBackupSkipped  = status.ConditionReason("PreDeleteBackupSkipped")
+	ReasonPreDeleteBackupTimedOut = status.ConditionReason("PreDeleteBackupTimedOut")
+
+	ReasonPreUpgradeBackupFailed   = status.ConditionReason("PreUpgradeBackupFailed")
+	ReasonPreUpgradeBackupRestored = status.ConditionReason("PreUpgradeBackupRestored")
+
+	ReasonVerificationStarted   = status.ConditionReason("VerificationStarted")
+	ReasonVerificationSucceeded = status.ConditionReason("VerificationSucceeded")
+	ReasonVerificationFailed    = status.ConditionReason("VerificationFailed")
+	ReasonVerificationError     = status.ConditionReason("VerificationError")
+
+	ReasonRestoreStarted       = status.ConditionReason("RestoreStarted")
+	ReasonRestoreCompleted     = status.ConditionReason("RestoreCompleted")
+	ReasonRestoreFailed        = status.ConditionReason("RestoreFailed")
+	ReasonRestoreError         = status.ConditionReason("RestoreError")
+	ReasonInvalidRestoreValues = status.ConditionReason("InvalidRestoreValues")
+
+	ReasonSnapshotStarted       = status.ConditionReason("SnapshotStarted")
+	ReasonSnapshotCompleted     = status.ConditionReason("SnapshotCompleted")
+	ReasonSnapshotFailed        = status.ConditionReason("SnapshotFailed")
+	ReasonSnapshotError         = status.ConditionReason("SnapshotError")
+	ReasonInvalidSnapshotValues = status.ConditionReason("InvalidSnapshotValues")
+	ReasonSnapshotsPruned       = status.ConditionReason("SnapshotsPruned")
 )
 
 func Initialized(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
@@ -59,6 +113,50 @@ func Irreconcilable(stat corev1.ConditionStatus, reason status.ConditionReason,
 	return newCondition(TypeIrreconcilable, stat, reason, message)
 }
 
+func BackupInProgress(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeBackupInProgress, stat, reason, message)
+}
+
+func BackupSucceeded(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeBackupSucceeded, stat, reason, message)
+}
+
+func BackupFailed(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeBackupFailed, stat, reason, message)
+}
+
+func BackupScheduled(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeBackupScheduled, stat, reason, message)
+}
+
+func BackupVerified(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeBackupVerified, stat, reason, message)
+}
+
+func RestoreInProgress(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeRestoreInProgress, stat, reason, message)
+}
+
+func RestoreSucceeded(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeRestoreSucceeded, stat, reason, message)
+}
+
+func RestoreFailed(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeRestoreFailed, stat, reason, message)
+}
+
+func SnapshotInProgress(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeSnapshotInProgress, stat, reason, message)
+}
+
+func SnapshotSucceeded(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeSnapshotSucceeded, stat, reason, message)
+}
+
+func SnapshotFailed(stat corev1.ConditionStatus, reason status.ConditionReason, message interface{}) status.Condition {
+	return newCondition(TypeSnapshotFailed, stat, reason, message)
+}
+
 func newCondition(t status.ConditionType, s corev1.ConditionStatus, r status.ConditionReason, m interface{}) status.Condition {
 	message := fmt.Sprintf("%s", m)
 	return status.Condition{
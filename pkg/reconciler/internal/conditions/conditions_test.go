@@ -77,4 +77,137 @@ var _ = Describe("Conditions", func() {
 			Expect(Irreconcilable(e.Status, e.Reason, err)).To(Equal(e))
 		})
 	})
+
+	var _ = Describe("BackupInProgress", func() {
+		It("should return a BackupInProgress condition with the correct status, reason, and message", func() {
+			e := status.Condition{
+				Type:    TypeBackupInProgress,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonBackupStarted,
+				Message: "message",
+			}
+			Expect(BackupInProgress(e.Status, e.Reason, e.Message)).To(Equal(e))
+		})
+	})
+
+	var _ = Describe("BackupSucceeded", func() {
+		It("should return a BackupSucceeded condition with the correct status, reason, and message", func() {
+			e := status.Condition{
+				Type:    TypeBackupSucceeded,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonBackupCompleted,
+				Message: "message",
+			}
+			Expect(BackupSucceeded(e.Status, e.Reason, e.Message)).To(Equal(e))
+		})
+	})
+
+	var _ = Describe("BackupFailed", func() {
+		It("should return a BackupFailed condition with the correct reason and message", func() {
+			err := errors.New("error message")
+			e := status.Condition{
+				Type:    TypeBackupFailed,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonBackupError,
+				Message: err.Error(),
+			}
+			Expect(BackupFailed(e.Status, e.Reason, err)).To(Equal(e))
+		})
+	})
+
+	var _ = Describe("BackupScheduled", func() {
+		It("should return a BackupScheduled condition with the correct reason and message", func() {
+			e := status.Condition{
+				Type:    TypeBackupScheduled,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonScheduleReconciled,
+				Message: "message",
+			}
+			Expect(BackupScheduled(e.Status, e.Reason, e.Message)).To(Equal(e))
+		})
+	})
+
+	var _ = Describe("BackupVerified", func() {
+		It("should return a BackupVerified condition with the correct reason and message", func() {
+			e := status.Condition{
+				Type:    TypeBackupVerified,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonVerificationSucceeded,
+				Message: "message",
+			}
+			Expect(BackupVerified(e.Status, e.Reason, e.Message)).To(Equal(e))
+		})
+	})
+
+	var _ = Describe("RestoreInProgress", func() {
+		It("should return a RestoreInProgress condition with the correct reason and message", func() {
+			e := status.Condition{
+				Type:    TypeRestoreInProgress,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonRestoreStarted,
+				Message: "message",
+			}
+			Expect(RestoreInProgress(e.Status, e.Reason, e.Message)).To(Equal(e))
+		})
+	})
+
+	var _ = Describe("RestoreSucceeded", func() {
+		It("should return a RestoreSucceeded condition with the correct reason and message", func() {
+			e := status.Condition{
+				Type:    TypeRestoreSucceeded,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonRestoreCompleted,
+				Message: "message",
+			}
+			Expect(RestoreSucceeded(e.Status, e.Reason, e.Message)).To(Equal(e))
+		})
+	})
+
+	var _ = Describe("RestoreFailed", func() {
+		It("should return a RestoreFailed condition with the correct reason and message", func() {
+			e := status.Condition{
+				Type:    TypeRestoreFailed,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonRestoreFailed,
+				Message: "message",
+			}
+			Expect(RestoreFailed(e.Status, e.Reason, e.Message)).To(Equal(e))
+		})
+	})
+
+	var _ = Describe("SnapshotInProgress", func() {
+		It("should return a SnapshotInProgress condition with the correct reason and message", func() {
+			e := status.Condition{
+				Type:    TypeSnapshotInProgress,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonSnapshotStarted,
+				Message: "message",
+			}
+			Expect(SnapshotInProgress(e.Status, e.Reason, e.Message)).To(Equal(e))
+		})
+	})
+
+	var _ = Describe("SnapshotSucceeded", func() {
+		It("should return a SnapshotSucceeded condition with the correct reason and message", func() {
+			e := status.Condition{
+				Type:    TypeSnapshotSucceeded,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonSnapshotCompleted,
+				Message: "message",
+			}
+			Expect(SnapshotSucceeded(e.Status, e.Reason, e.Message)).To(Equal(e))
+		})
+	})
+
+	var _ = Describe("SnapshotFailed", func() {
+		It("should return a SnapshotFailed condition with the correct reason and message", func() {
+			e := status.Condition{
+				Type:    TypeSnapshotFailed,
+				Status:  corev1.ConditionTrue,
+				Reason:  ReasonSnapshotFailed,
+				Message: "message",
+			}
+			Expect(SnapshotFailed(e.Status, e.Reason, e.Message)).To(Equal(e))
+		})
+	})
 })
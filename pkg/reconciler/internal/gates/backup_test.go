@@ -0,0 +1,335 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gates_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"helm.sh/helm/v3/pkg/release"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubectl/pkg/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+	"github.com/joelanford/helm-operator/pkg/internal/testutil"
+	"github.com/joelanford/helm-operator/pkg/reconciler"
+	internalfake "github.com/joelanford/helm-operator/pkg/reconciler/internal/fake"
+	internalvalues "github.com/joelanford/helm-operator/pkg/reconciler/internal/values"
+	"github.com/joelanford/helm-operator/pkg/restore"
+)
+
+var _ = Describe("Reconcile with backups and restores", func() {
+	var (
+		obj      *unstructured.Unstructured
+		cl       client.Client
+		ac       internalfake.ActionClient
+		provider *fakeBackupProvider
+		recorder *record.FakeRecorder
+		deployed *release.Release
+		opts     []reconciler.Option
+
+		r *reconciler.Reconciler
+	)
+
+	errUninstall := errors.New("uninstall reached")
+
+	BeforeEach(func() {
+		obj = testutil.BuildTestCR(gvk)
+		// The fake client deep copies obj, which takes int64 numbers only.
+		Expect(unstructured.SetNestedField(obj.Object, int64(2), "spec", "replicas")).To(Succeed())
+		obj.SetGeneration(1)
+		obj.SetFinalizers([]string{"uninstall-helm-release"})
+
+		deployed = &release.Release{Name: obj.GetName(), Namespace: obj.GetNamespace(), Version: 1, Manifest: "deployed"}
+		ac = internalfake.NewActionClient()
+		ac.HandleGet = func() (*release.Release, error) { return deployed, nil }
+		ac.HandleUpgrade = func() (*release.Release, error) {
+			return &release.Release{Name: obj.GetName(), Namespace: obj.GetNamespace(), Version: 2, Manifest: "upgraded"}, nil
+		}
+		ac.HandleUninstall = func() (*release.UninstallReleaseResponse, error) { return nil, errUninstall }
+
+		provider = newFakeBackupProvider()
+		recorder = record.NewFakeRecorder(100)
+		b := backup.NewBackup(provider)
+		opts = []reconciler.Option{
+			reconciler.WithActionClientGetter(internalfake.NewActionClientGetter(&ac, nil)),
+			reconciler.WithValueMapper(internalvalues.DefaultMapper),
+			reconciler.WithEventRecorder(recorder),
+			reconciler.WithBackup(&b),
+			reconciler.WithLog(testing.NullLogger{}),
+			reconciler.WithGroupVersionKind(gvk),
+			reconciler.WithChart(chrt),
+		}
+	})
+
+	AfterEach(func() {
+		// New registers the info metric of the custom resource kind, which
+		// has to go before the next reconciler is created.
+		metrics.Registry.Unregister(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "testapp_info",
+			Help: "Information about the TestApp custom resource.",
+		}, []string{"namespace", "name"}))
+	})
+
+	// start creates obj in a fake client and a reconciler that uses it.
+	start := func() {
+		cl = fake.NewFakeClientWithScheme(scheme.Scheme, obj)
+		var err error
+		r, err = reconciler.New(append(opts,
+			reconciler.WithClient(cl),
+			reconciler.WithBackupVerifier(backup.NewVerifier(provider, cl)),
+		)...)
+		Expect(err).To(BeNil())
+	}
+
+	reconcileObj := func() (reconcile.Result, error) {
+		return r.Reconcile(reconcile.Request{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}})
+	}
+
+	current := func() *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(gvk)
+		Expect(cl.Get(context.TODO(), types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}, u)).To(Succeed())
+		return u
+	}
+
+	setStatus := func(field string, st interface{}) {
+		m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(st)
+		Expect(err).To(BeNil())
+		Expect(unstructured.SetNestedMap(obj.Object, m, "status", field)).To(Succeed())
+	}
+
+	setValues := func(m map[string]interface{}) {
+		Expect(unstructured.SetNestedMap(obj.Object, m, "spec", "backup")).To(Succeed())
+	}
+
+	deleted := func(since time.Duration) {
+		ts := metav1.NewTime(time.Now().Add(-since))
+		obj.SetDeletionTimestamp(&ts)
+	}
+
+	When("the custom resource is deleted", func() {
+		BeforeEach(func() {
+			opts = append(opts, reconciler.WithPreDeleteBackup(true, 0))
+			deleted(time.Minute)
+		})
+		It("should block the uninstall until the final backup completes", func() {
+			start()
+			res, err := reconcileObj()
+			Expect(err).To(BeNil())
+			Expect(res.RequeueAfter).To(BeNumerically(">", 0))
+			Expect(ac.Uninstalls).To(BeEmpty())
+			Expect(provider.backups).To(HaveLen(1))
+
+			st := backup.StatusFor(current())
+			Expect(st.Trigger).To(Equal(backup.TriggerPreDelete))
+			Expect(st.Phase).To(Equal(backup.PhaseInProgress))
+
+			provider.backups[st.Name] = backup.VeleroPhaseCompleted
+			_, err = reconcileObj()
+			Expect(err).To(MatchError(errUninstall))
+			Expect(ac.Uninstalls).To(HaveLen(1))
+			Expect(backup.StatusFor(current()).Phase).To(Equal(backup.PhaseCompleted))
+		})
+
+		It("should uninstall without a final backup once the timeout has passed", func() {
+			opts = append(opts, reconciler.WithPreDeleteBackup(true, time.Hour))
+			deleted(2 * time.Hour)
+			start()
+
+			_, err := reconcileObj()
+			Expect(err).To(MatchError(errUninstall))
+			Expect(ac.Uninstalls).To(HaveLen(1))
+			Expect(provider.backups).To(BeEmpty())
+			Expect(recorder.Events).To(Receive(ContainSubstring("PreDeleteBackupTimedOut")))
+		})
+
+		It("should wait for the final backup no longer than the timeout", func() {
+			opts = append(opts, reconciler.WithPreDeleteBackup(true, 2*time.Minute))
+			start()
+			res, err := reconcileObj()
+			Expect(err).To(BeNil())
+			Expect(ac.Uninstalls).To(BeEmpty())
+			Expect(res.RequeueAfter).To(BeNumerically("<=", time.Minute))
+		})
+
+		It("should delete the backup schedule and the restore of a verification in progress", func() {
+			provider.restores["matrix-verify-b"] = backup.VeleroPhaseNew
+			setStatus("backup", &backup.Status{
+				Name:  "b",
+				Phase: backup.PhaseCompleted,
+				Verification: &backup.Verification{
+					Phase:       backup.VerificationInProgress,
+					RestoreName: "matrix-verify-b",
+					Namespace:   "matrix-verify-test",
+				},
+			})
+			start()
+
+			_, err := reconcileObj()
+			Expect(err).To(BeNil())
+			Expect(provider.deletedSchedules).To(Equal([]string{obj.GetName()}))
+			Expect(provider.restores).To(BeEmpty())
+		})
+	})
+
+	When("a pre-upgrade backup is enabled", func() {
+		BeforeEach(func() {
+			setValues(map[string]interface{}{"preUpgrade": true})
+		})
+
+		It("should hold the upgrade until the backup completes", func() {
+			start()
+			res, err := reconcileObj()
+			Expect(err).To(BeNil())
+			Expect(res.RequeueAfter).To(Equal(backup.DefaultPollInterval))
+			// Only the dry run that detects the change.
+			Expect(ac.Upgrades).To(HaveLen(1))
+
+			st := backup.StatusFor(current())
+			Expect(st.Trigger).To(Equal(backup.TriggerPreUpgrade))
+			Expect(st.Phase).To(Equal(backup.PhaseInProgress))
+
+			provider.backups[st.Name] = backup.VeleroPhaseCompleted
+			_, err = reconcileObj()
+			Expect(err).To(BeNil())
+			Expect(ac.Upgrades).To(HaveLen(3))
+			Expect(backup.StatusFor(current()).Phase).To(Equal(backup.PhaseCompleted))
+		})
+
+		It("should not upgrade while a backup with another trigger is in progress", func() {
+			provider.backups["manual"] = backup.VeleroPhaseNew
+			setStatus("backup", &backup.Status{Name: "manual", Phase: backup.PhaseInProgress, Trigger: backup.TriggerRequest})
+			start()
+
+			_, err := reconcileObj()
+			Expect(err).To(BeNil())
+			Expect(ac.Upgrades).To(HaveLen(1))
+			Expect(provider.backups).To(HaveLen(1))
+		})
+	})
+
+	When("a restore is in progress", func() {
+		BeforeEach(func() {
+			rs := restore.NewRestore(provider, internalfake.NewActionClientGetter(&ac, nil), nil, nil)
+			opts = append(opts, reconciler.WithRestore(&rs))
+			provider.restores["r"] = backup.VeleroPhaseNew
+			setStatus("restore", &restore.Status{
+				Name:        "r",
+				BackupName:  "b",
+				Phase:       restore.PhaseInProgress,
+				VeleroPhase: backup.VeleroPhaseNew,
+				Steps: []restore.StepStatus{
+					{Step: restore.Step{Type: restore.StepRestore}, Phase: restore.StepInProgress},
+				},
+			})
+		})
+
+		It("should advance the restore without looking at the release state", func() {
+			start()
+			res, err := reconcileObj()
+			Expect(err).To(BeNil())
+			Expect(res.RequeueAfter).To(Equal(restore.DefaultPollInterval))
+			Expect(ac.Upgrades).To(BeEmpty())
+			Expect(ac.Installs).To(BeEmpty())
+			Expect(provider.backups).To(BeEmpty())
+			Expect(restore.StatusFor(current()).Steps[0].Message).To(ContainSubstring(backup.VeleroPhaseNew))
+		})
+	})
+})
+
+// fakeBackupProvider keeps the Velero phases of backups and restores in
+// memory.
+type fakeBackupProvider struct {
+	backups          map[string]string
+	restores         map[string]string
+	deletedSchedules []string
+}
+
+var _ backup.BackupProvider = &fakeBackupProvider{}
+var _ backup.Scheduler = &fakeBackupProvider{}
+
+func newFakeBackupProvider() *fakeBackupProvider {
+	return &fakeBackupProvider{backups: map[string]string{}, restores: map[string]string{}}
+}
+
+func (p *fakeBackupProvider) Create(_ context.Context, _ *unstructured.Unstructured, _ *release.Release, name string, _ map[string]interface{}) error {
+	p.backups[name] = backup.VeleroPhaseNew
+	return nil
+}
+
+func (p *fakeBackupProvider) Status(_ context.Context, name string) (*backup.Summary, error) {
+	phase, ok := p.backups[name]
+	if !ok {
+		return nil, backup.ErrNotFound
+	}
+	return &backup.Summary{Name: name, Phase: phase}, nil
+}
+
+func (p *fakeBackupProvider) List(_ context.Context, _ *unstructured.Unstructured) ([]backup.Summary, error) {
+	var summaries []backup.Summary
+	for name, phase := range p.backups {
+		summaries = append(summaries, backup.Summary{Name: name, Phase: phase})
+	}
+	return summaries, nil
+}
+
+func (p *fakeBackupProvider) Delete(_ context.Context, name string) error {
+	delete(p.backups, name)
+	return nil
+}
+
+func (p *fakeBackupProvider) Restore(_ context.Context, _ *unstructured.Unstructured, name string, _ map[string]interface{}) error {
+	p.restores[name] = backup.VeleroPhaseNew
+	return nil
+}
+
+func (p *fakeBackupProvider) RestoreStatus(_ context.Context, name string) (string, error) {
+	phase, ok := p.restores[name]
+	if !ok {
+		return "", backup.ErrNotFound
+	}
+	return phase, nil
+}
+
+func (p *fakeBackupProvider) DeleteRestore(_ context.Context, name string) error {
+	delete(p.restores, name)
+	return nil
+}
+
+func (p *fakeBackupProvider) ReconcileSchedule(_ context.Context, _ *unstructured.Unstructured, _ string, _ map[string]interface{}, _ logr.Logger) error {
+	return nil
+}
+
+func (p *fakeBackupProvider) DeleteSchedule(_ context.Context, obj *unstructured.Unstructured, _ logr.Logger) error {
+	p.deletedSchedules = append(p.deletedSchedules, obj.GetName())
+	return nil
+}
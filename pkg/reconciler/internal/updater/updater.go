@@ -21,13 +21,17 @@ import (
 
 	"helm.sh/helm/v3/pkg/release"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	"github.com/joelanford/helm-operator/pkg/backup"
 	"github.com/joelanford/helm-operator/pkg/internal/sdk/controllerutil"
 	"github.com/joelanford/helm-operator/pkg/internal/sdk/status"
+	"github.com/joelanford/helm-operator/pkg/restore"
+	"github.com/joelanford/helm-operator/pkg/snapshot"
 )
 
 func New(client client.Client) Updater {
@@ -129,6 +133,12 @@ func EnsureConditionUnknown(t status.ConditionType) UpdateStatusFunc {
 	}
 }
 
+func RemoveCondition(t status.ConditionType) UpdateStatusFunc {
+	return func(s *helmAppStatus) bool {
+		return s.Conditions.RemoveCondition(t)
+	}
+}
+
 func EnsureDeployedRelease(rel *release.Release) UpdateStatusFunc {
 	return func(status *helmAppStatus) bool {
 		newRel := helmAppReleaseFor(rel)
@@ -148,9 +158,56 @@ func RemoveDeployedRelease() UpdateStatusFunc {
 	return EnsureDeployedRelease(nil)
 }
 
+func EnsureBackupStatus(st *backup.Status) UpdateStatusFunc {
+	return func(status *helmAppStatus) bool {
+		if equality.Semantic.DeepEqual(status.Backup, st) {
+			return false
+		}
+		status.Backup = st
+		return true
+	}
+}
+
+func EnsureRestoreStatus(st *restore.Status) UpdateStatusFunc {
+	return func(status *helmAppStatus) bool {
+		if equality.Semantic.DeepEqual(status.Restore, st) {
+			return false
+		}
+		status.Restore = st
+		return true
+	}
+}
+
+func EnsureSnapshotStatus(st *snapshot.Status) UpdateStatusFunc {
+	return func(status *helmAppStatus) bool {
+		if equality.Semantic.DeepEqual(status.Snapshot, st) {
+			return false
+		}
+		status.Snapshot = st
+		return true
+	}
+}
+
+func EnsureBackups(entries []backup.Summary) UpdateStatusFunc {
+	return func(status *helmAppStatus) bool {
+		if len(entries) == 0 {
+			entries = nil
+		}
+		if equality.Semantic.DeepEqual(status.Backups, entries) {
+			return false
+		}
+		status.Backups = entries
+		return true
+	}
+}
+
 type helmAppStatus struct {
 	Conditions      status.Conditions `json:"conditions"`
 	DeployedRelease *helmAppRelease   `json:"deployedRelease,omitempty"`
+	Backup          *backup.Status    `json:"backup,omitempty"`
+	Backups         []backup.Summary  `json:"backups,omitempty"`
+	Restore         *restore.Status   `json:"restore,omitempty"`
+	Snapshot        *snapshot.Status  `json:"snapshot,omitempty"`
 }
 
 type helmAppRelease struct {
@@ -30,7 +30,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
+	"github.com/joelanford/helm-operator/pkg/backup"
 	"github.com/joelanford/helm-operator/pkg/reconciler/internal/conditions"
+	"github.com/joelanford/helm-operator/pkg/restore"
+	"github.com/joelanford/helm-operator/pkg/snapshot"
 )
 
 const testFinalizer = "testFinalizer"
@@ -147,6 +150,24 @@ var _ = Describe("EnsureCondition", func() {
 	})
 })
 
+var _ = Describe("RemoveCondition", func() {
+	var obj *helmAppStatus
+
+	BeforeEach(func() {
+		obj = &helmAppStatus{}
+	})
+
+	It("should remove condition if present", func() {
+		obj.Conditions.SetCondition(conditions.Deployed(corev1.ConditionTrue, "", ""))
+		Expect(RemoveCondition(conditions.TypeDeployed)(obj)).To(BeTrue())
+		Expect(obj.Conditions.GetCondition(conditions.TypeDeployed)).To(BeNil())
+	})
+
+	It("should return false if condition is not present", func() {
+		Expect(RemoveCondition(conditions.TypeDeployed)(obj)).To(BeFalse())
+	})
+})
+
 var _ = Describe("EnsureDeployedRelease", func() {
 	var obj *helmAppStatus
 	var rel *release.Release
@@ -212,6 +233,126 @@ var _ = Describe("RemoveDeployedRelease", func() {
 	})
 })
 
+var _ = Describe("EnsureBackupStatus", func() {
+	var obj *helmAppStatus
+	var st *backup.Status
+
+	BeforeEach(func() {
+		obj = &helmAppStatus{}
+		st = &backup.Status{
+			Name:  "initialName",
+			Phase: backup.PhaseInProgress,
+		}
+	})
+
+	It("should add backup status if not present", func() {
+		Expect(EnsureBackupStatus(st)(obj)).To(BeTrue())
+		Expect(obj.Backup).To(Equal(st))
+	})
+
+	It("should not update identical backup status", func() {
+		obj.Backup = &backup.Status{Name: "initialName", Phase: backup.PhaseInProgress}
+		Expect(EnsureBackupStatus(st)(obj)).To(BeFalse())
+	})
+
+	It("should update backup status if different phase", func() {
+		obj.Backup = st
+		Expect(EnsureBackupStatus(&backup.Status{Name: "initialName", Phase: backup.PhaseCompleted})(obj)).To(BeTrue())
+		Expect(obj.Backup.Phase).To(Equal(backup.PhaseCompleted))
+	})
+})
+
+var _ = Describe("EnsureRestoreStatus", func() {
+	var obj *helmAppStatus
+	var st *restore.Status
+
+	BeforeEach(func() {
+		obj = &helmAppStatus{}
+		st = &restore.Status{
+			Name:  "initialName",
+			Phase: restore.PhaseInProgress,
+		}
+	})
+
+	It("should add restore status if not present", func() {
+		Expect(EnsureRestoreStatus(st)(obj)).To(BeTrue())
+		Expect(obj.Restore).To(Equal(st))
+	})
+
+	It("should not update identical restore status", func() {
+		obj.Restore = &restore.Status{Name: "initialName", Phase: restore.PhaseInProgress}
+		Expect(EnsureRestoreStatus(st)(obj)).To(BeFalse())
+	})
+
+	It("should update restore status if different phase", func() {
+		obj.Restore = st
+		Expect(EnsureRestoreStatus(&restore.Status{Name: "initialName", Phase: restore.PhaseCompleted})(obj)).To(BeTrue())
+		Expect(obj.Restore.Phase).To(Equal(restore.PhaseCompleted))
+	})
+})
+
+var _ = Describe("EnsureSnapshotStatus", func() {
+	var obj *helmAppStatus
+	var st *snapshot.Status
+
+	BeforeEach(func() {
+		obj = &helmAppStatus{}
+		st = &snapshot.Status{
+			Name:  "initialName",
+			Phase: snapshot.PhaseInProgress,
+		}
+	})
+
+	It("should add snapshot status if not present", func() {
+		Expect(EnsureSnapshotStatus(st)(obj)).To(BeTrue())
+		Expect(obj.Snapshot).To(Equal(st))
+	})
+
+	It("should not update identical snapshot status", func() {
+		obj.Snapshot = &snapshot.Status{Name: "initialName", Phase: snapshot.PhaseInProgress}
+		Expect(EnsureSnapshotStatus(st)(obj)).To(BeFalse())
+	})
+
+	It("should update snapshot status if different phase", func() {
+		obj.Snapshot = st
+		Expect(EnsureSnapshotStatus(&snapshot.Status{Name: "initialName", Phase: snapshot.PhaseCompleted})(obj)).To(BeTrue())
+		Expect(obj.Snapshot.Phase).To(Equal(snapshot.PhaseCompleted))
+	})
+})
+
+var _ = Describe("EnsureBackups", func() {
+	var obj *helmAppStatus
+	var entries []backup.Summary
+
+	BeforeEach(func() {
+		obj = &helmAppStatus{}
+		entries = []backup.Summary{{Name: "initialName", Phase: "Completed"}}
+	})
+
+	It("should add backups if not present", func() {
+		Expect(EnsureBackups(entries)(obj)).To(BeTrue())
+		Expect(obj.Backups).To(Equal(entries))
+	})
+
+	It("should not update identical backups", func() {
+		obj.Backups = []backup.Summary{{Name: "initialName", Phase: "Completed"}}
+		Expect(EnsureBackups(entries)(obj)).To(BeFalse())
+	})
+
+	It("should update backups if different", func() {
+		obj.Backups = entries
+		Expect(EnsureBackups([]backup.Summary{{Name: "initialName", Phase: "Deleting"}})(obj)).To(BeTrue())
+		Expect(obj.Backups[0].Phase).To(Equal("Deleting"))
+	})
+
+	It("should remove backups if there are none", func() {
+		obj.Backups = entries
+		Expect(EnsureBackups([]backup.Summary{})(obj)).To(BeTrue())
+		Expect(obj.Backups).To(BeNil())
+		Expect(EnsureBackups(nil)(obj)).To(BeFalse())
+	})
+})
+
 var _ = Describe("statusFor", func() {
 	var obj *unstructured.Unstructured
 
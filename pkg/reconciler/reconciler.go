@@ -44,8 +44,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	"github.com/joelanford/helm-operator/pkg/annotation"
+	"github.com/joelanford/helm-operator/pkg/backup"
 	helmclient "github.com/joelanford/helm-operator/pkg/client"
 	"github.com/joelanford/helm-operator/pkg/hook"
 	"github.com/joelanford/helm-operator/pkg/internal/sdk/controllerutil"
@@ -53,6 +55,8 @@ import (
 	internalhook "github.com/joelanford/helm-operator/pkg/reconciler/internal/hook"
 	"github.com/joelanford/helm-operator/pkg/reconciler/internal/updater"
 	internalvalues "github.com/joelanford/helm-operator/pkg/reconciler/internal/values"
+	"github.com/joelanford/helm-operator/pkg/restore"
+	"github.com/joelanford/helm-operator/pkg/snapshot"
 	"github.com/joelanford/helm-operator/pkg/values"
 )
 
@@ -66,6 +70,13 @@ type Reconciler struct {
 	eventRecorder      record.EventRecorder
 	preHooks           []hook.PreHook
 	postHooks          []hook.PostHook
+	backup             *backup.Backup
+	verifier           *backup.Verifier
+	restore            *restore.Restore
+	snapshotter        *snapshot.Snapshotter
+
+	preDeleteBackup        bool
+	preDeleteBackupTimeout time.Duration
 
 	log                     logr.Logger
 	gvk                     *schema.GroupVersionKind
@@ -74,6 +85,7 @@ type Reconciler struct {
 	skipDependentWatches    bool
 	maxConcurrentReconciles int
 	reconcilePeriod         time.Duration
+	validatingWebhook       bool
 
 	annotSetupOnce       sync.Once
 	annotations          map[string]struct{}
@@ -81,7 +93,8 @@ type Reconciler struct {
 	upgradeAnnotations   map[string]annotation.Upgrade
 	uninstallAnnotations map[string]annotation.Uninstall
 
-	infoMetric *prometheus.GaugeVec
+	infoMetric    *prometheus.GaugeVec
+	backupMetrics *backup.Metrics
 }
 
 // New creates a new Reconciler that reconciles custom resources that define a
@@ -128,13 +141,20 @@ func (r *Reconciler) setupMetrics() error {
 		Help: fmt.Sprintf("Information about the %s custom resource.", r.gvk.Kind),
 	}, []string{"namespace", "name"})
 
-	return metrics.Registry.Register(r.infoMetric)
+	if err := metrics.Registry.Register(r.infoMetric); err != nil {
+		return err
+	}
+	if r.backupMetrics != nil {
+		return r.backupMetrics.Register(metrics.Registry)
+	}
+	return nil
 }
 
 // SetupWithManager configures a controller for the Reconciler and registers
 // watches. It also uses the passed Manager to initialize default values for the
 // Reconciler and sets up the manager's scheme with the Reconciler's configured
-// GroupVersionKind.
+// GroupVersionKind. If WithValidatingWebhook enabled it, the validating webhook
+// is registered with the manager's webhook server.
 //
 // If an error occurs setting up the Reconciler with the manager, it is
 // returned.
@@ -153,6 +173,10 @@ func (r *Reconciler) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
+	if r.validatingWebhook {
+		mgr.GetWebhookServer().Register(ValidatingWebhookPath(*r.gvk), &webhook.Admission{Handler: &validator{r: r}})
+	}
+
 	r.log.Info("Watching resource",
 		"group", r.gvk.Group,
 		"version", r.gvk.Version,
@@ -391,26 +415,41 @@ func WithValueMapper(m values.Mapper) Option {
 //
 //   - If a release does not exist for this CR, a new release is installed.
 //   - If a release exists and the CR spec has changed since the last,
-//     reconciliation, the release is upgraded.
+//     reconciliation, the release is upgraded. If its values enable a
+//     pre-upgrade backup, the upgrade waits until the backup has completed.
 //   - If a release exists and the CR spec has not changed since the last
 //     reconciliation, the release is reconciled. Any dependent resources that
 //     have diverged from the release manifest are re-created or patched so that
 //     they are re-aligned with the release.
 //   - If the CR has been deleted, the release will be uninstalled. The
 //     Reconciler uses a finalizer to ensure the release uninstall succeeds
-//     before CR deletion occurs.
+//     before CR deletion occurs. If a pre-delete backup is enabled, the
+//     uninstall waits until a final backup of the release has completed.
 //
 // If an error occurs during release installation or upgrade, the change will be
 // rolled back to restore the previous state.
 //
 // Reconcile also manages the status field of the custom resource. It includes
-// the release name and manifest in `status.deployedRelease`, and it updates
+// the release name and manifest in `status.deployedRelease`, the Velero
+// backups of the release in `status.backups`, the volume snapshots of the
+// release in `status.snapshot`, and it updates
 // `status.conditions` based on reconciliation progress and success. Condition
 // types include:
 //
 //   - Deployed - a release for this CR is deployed (but not necessarily ready).
 //   - ReleaseFailed - an installation or upgrade failed.
 //   - Irreconcilable - an error occurred during reconciliation
+//   - BackupInProgress - a Velero backup of the release is running.
+//   - BackupSucceeded - the most recent backup completed.
+//   - BackupFailed - the most recent backup could not be taken.
+//   - BackupScheduled - a Velero Schedule takes periodic backups of the release.
+//   - RestoreInProgress - the release is being restored from a backup.
+//   - RestoreSucceeded - the most recent restore completed and the release is
+//     healthy again.
+//   - RestoreFailed - the most recent restore failed.
+//   - SnapshotInProgress - volume snapshots of the release are being taken.
+//   - SnapshotSucceeded - the most recent volume snapshots are ready to use.
+//   - SnapshotFailed - the most recent volume snapshots could not be taken.
 func (r *Reconciler) Reconcile(req ctrl.Request) (res ctrl.Result, err error) {
 	// todo:https://github.com/kubernetes-sigs/controller-runtime/issues/801
 	ctx := context.TODO()
@@ -472,9 +511,8 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (res ctrl.Result, err error) {
 	u.UpdateStatus(updater.EnsureCondition(conditions.Initialized(corev1.ConditionTrue, "", "")))
 
 	if obj.GetDeletionTimestamp() != nil {
-		log.Info("Deletion here @ 477 reconciler.go")
-		err := r.handleDeletion(ctx, actionClient, obj, log)
-		return ctrl.Result{}, err
+		requeueAfter, err := r.handleDeletion(ctx, actionClient, &u, obj, rel, log)
+		return ctrl.Result{RequeueAfter: requeueAfter}, err
 	}
 
 	vals, err := r.getValues(obj)
@@ -486,6 +524,18 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (res ctrl.Result, err error) {
 		return ctrl.Result{}, err
 	}
 
+	// The release is left alone while a restore is in progress, as
+	// upgrading it would undo the changes made for the restore. It is
+	// upgraded to the values of obj again once the restore has finished.
+	// Its state is not looked at either, since the release records
+	// restored from the backup may not allow an upgrade, not even a dry
+	// run, until the restore has reconciled them. Restores into other
+	// namespaces do not touch the release.
+	if st := restore.StatusFor(obj); r.restore != nil && st.IsInProgress() && !st.IsClone() {
+		requeueAfter, err := r.doRestore(ctx, &u, obj, rel, vals, log)
+		return ctrl.Result{RequeueAfter: requeueAfter}, err
+	}
+
 	rel, state, err := r.getReleaseState(actionClient, obj, vals.AsMap())
 	if err != nil {
 		u.UpdateStatus(
@@ -507,6 +557,9 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (res ctrl.Result, err error) {
 		}
 	}
 
+	// preUpgradeBackup is the pre-upgrade backup the release was upgraded
+	// after, if any.
+	var preUpgradeBackup *backup.Status
 	switch state {
 	case stateNeedsInstall:
 		rel, err = r.doInstall(actionClient, &u, obj, vals.AsMap(), log)
@@ -515,8 +568,19 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (res ctrl.Result, err error) {
 		}
 
 	case stateNeedsUpgrade:
+		if r.backup != nil {
+			ready, st, requeueAfter, err := r.doPreUpgradeBackup(ctx, &u, obj, rel, vals, log)
+			if err != nil || !ready {
+				return ctrl.Result{RequeueAfter: requeueAfter}, err
+			}
+			preUpgradeBackup = st
+		}
+		deployedRelease := rel
 		rel, err = r.doUpgrade(actionClient, &u, obj, vals.AsMap(), log)
 		if err != nil {
+			if preUpgradeBackup != nil {
+				r.doUpgradeFailure(ctx, &u, obj, deployedRelease, vals, preUpgradeBackup, err, log)
+			}
 			return ctrl.Result{}, err
 		}
 
@@ -551,6 +615,43 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (res ctrl.Result, err error) {
 		updater.EnsureCondition(conditions.Irreconcilable(corev1.ConditionFalse, "", "")),
 	)
 
+	requeueAfter := r.reconcilePeriod
+	if r.restore != nil {
+		restoreRequeueAfter, err := r.doRestore(ctx, &u, obj, rel, vals, log)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		requeueAfter = minRequeueAfter(requeueAfter, restoreRequeueAfter)
+	}
+	if r.backup != nil {
+		if err := r.doBackupSchedule(ctx, &u, obj, rel, vals, log); err != nil {
+			return ctrl.Result{}, err
+		}
+		// The status of obj does not include the pre-upgrade backup's last
+		// step yet, so other backups wait for the next reconciliation.
+		if preUpgradeBackup == nil {
+			backupRequeueAfter, err := r.doBackup(ctx, &u, obj, rel, vals, log)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			requeueAfter = minRequeueAfter(requeueAfter, backupRequeueAfter)
+		}
+		if err := r.doBackupPrune(ctx, obj, vals, log); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.doBackupInventory(ctx, &u, obj, log)
+	}
+	if r.snapshotter != nil {
+		snapshotRequeueAfter, err := r.doSnapshot(ctx, &u, obj, rel, vals, log)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		requeueAfter = minRequeueAfter(requeueAfter, snapshotRequeueAfter)
+		if err := r.doSnapshotPrune(ctx, obj, vals, log); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
 	/*//try installing here:
 	chart, err := snapshot.LoadSnapshotChart(log)
 	if err != nil {
@@ -567,7 +668,16 @@ func (r *Reconciler) Reconcile(req ctrl.Request) (res ctrl.Result, err error) {
 	log.Info(fmt.Sprintf("release info: %v", rel1))
 	log.Info("Done/NOT")
 	*/
-	return ctrl.Result{RequeueAfter: r.reconcilePeriod}, nil
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// minRequeueAfter returns the shorter of two requeue delays, where 0 means
+// that no requeue is needed.
+func minRequeueAfter(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
 }
 
 //imp
@@ -596,10 +706,34 @@ const (
 	stateError        helmReleaseState = "error"
 )
 
-func (r *Reconciler) handleDeletion(ctx context.Context, actionClient helmclient.ActionInterface, obj *unstructured.Unstructured, log logr.Logger) error {
+// handleDeletion uninstalls the release of a deleted CR and removes its
+// finalizer. If a final backup is to be taken first, the uninstall waits for
+// it and handleDeletion returns how long to wait before trying again.
+func (r *Reconciler) handleDeletion(ctx context.Context, actionClient helmclient.ActionInterface, u *updater.Updater, obj *unstructured.Unstructured, rel *release.Release, log logr.Logger) (time.Duration, error) {
 	if !controllerutil.ContainsFinalizer(obj, uninstallFinalizer) {
 		log.Info("Resource is terminated, skipping reconciliation")
-		return nil
+		return 0, nil
+	}
+
+	// The Schedule lives in the Velero namespace and is not garbage collected
+	// with the CR, so it is deleted explicitly. Backups are only deleted with
+	// it if the values ask for it.
+	if r.backup != nil {
+		if err := r.backup.DeleteSchedule(ctx, obj, log); err != nil {
+			return 0, err
+		}
+		if r.verifier != nil {
+			if err := r.verifier.Cleanup(ctx, backup.StatusFor(obj), log); err != nil {
+				return 0, err
+			}
+		}
+		done, requeueAfter, err := r.doPreDeleteBackup(ctx, u, obj, rel, log)
+		if err != nil || !done {
+			return requeueAfter, err
+		}
+		if err := r.pruneBackupsOnUninstall(ctx, obj, log); err != nil {
+			return 0, err
+		}
 	}
 
 	// Use defer in a closure so that it executes before we wait for
@@ -618,7 +752,7 @@ func (r *Reconciler) handleDeletion(ctx context.Context, actionClient helmclient
 		}()
 		return r.doUninstall(actionClient, &uninstallUpdater, obj, log)
 	}(); err != nil {
-		return err
+		return 0, err
 	}
 
 	labels := map[string]string{
@@ -626,15 +760,16 @@ func (r *Reconciler) handleDeletion(ctx context.Context, actionClient helmclient
 		"name":      obj.GetName(),
 	}
 	_ = r.infoMetric.Delete(labels)
+	r.backupMetrics.Delete(obj)
 
 	// Since the client is hitting a cache, waiting for the
 	// deletion here will guarantee that the next reconciliation
 	// will see that the CR has been deleted and that there's
 	// nothing left to do.
 	if err := controllerutil.WaitForDeletion(ctx, r.client, obj); err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return 0, nil
 }
 
 func (r *Reconciler) getReleaseState(client helmclient.ActionInterface, obj metav1.Object, vals map[string]interface{}) (*release.Release, helmReleaseState, error) {
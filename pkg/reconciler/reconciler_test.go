@@ -51,6 +51,7 @@ import (
 	"sigs.k8s.io/yaml"
 
 	"github.com/joelanford/helm-operator/pkg/annotation"
+	"github.com/joelanford/helm-operator/pkg/backup"
 	helmclient "github.com/joelanford/helm-operator/pkg/client"
 	"github.com/joelanford/helm-operator/pkg/hook"
 	"github.com/joelanford/helm-operator/pkg/internal/sdk/controllerutil"
@@ -58,6 +59,8 @@ import (
 	"github.com/joelanford/helm-operator/pkg/internal/testutil"
 	"github.com/joelanford/helm-operator/pkg/reconciler/internal/conditions"
 	helmfake "github.com/joelanford/helm-operator/pkg/reconciler/internal/fake"
+	"github.com/joelanford/helm-operator/pkg/restore"
+	"github.com/joelanford/helm-operator/pkg/snapshot"
 	"github.com/joelanford/helm-operator/pkg/values"
 )
 
@@ -337,6 +340,57 @@ var _ = Describe("Reconciler", func() {
 				Expect(called).To(BeTrue())
 			})
 		})
+		var _ = Describe("WithBackup", func() {
+			It("should set the reconciler backup", func() {
+				b := backup.NewBackup(nil)
+				Expect(WithBackup(&b)(r)).To(Succeed())
+				Expect(r.backup).To(Equal(&b))
+			})
+		})
+		var _ = Describe("WithPreDeleteBackup", func() {
+			It("should set the reconciler pre-delete backup policy", func() {
+				Expect(WithPreDeleteBackup(true, time.Hour)(r)).To(Succeed())
+				Expect(r.preDeleteBackup).To(BeTrue())
+				Expect(r.preDeleteBackupTimeout).To(Equal(time.Hour))
+			})
+			It("should fail if the timeout is negative", func() {
+				Expect(WithPreDeleteBackup(true, -time.Second)(r)).NotTo(Succeed())
+			})
+		})
+		var _ = Describe("WithRestore", func() {
+			It("should set the reconciler restore", func() {
+				rs := restore.NewRestore(nil, nil, nil, nil)
+				Expect(WithRestore(&rs)(r)).To(Succeed())
+				Expect(r.restore).To(Equal(&rs))
+			})
+		})
+		var _ = Describe("WithSnapshotter", func() {
+			It("should set the reconciler snapshotter", func() {
+				s := snapshot.NewSnapshotter(nil)
+				Expect(WithSnapshotter(&s)(r)).To(Succeed())
+				Expect(r.snapshotter).To(Equal(&s))
+			})
+		})
+		var _ = Describe("WithValidatingWebhook", func() {
+			It("should enable the validating webhook", func() {
+				Expect(WithValidatingWebhook(true)(r)).To(Succeed())
+				Expect(r.validatingWebhook).To(BeTrue())
+			})
+		})
+		var _ = Describe("WithBackupVerifier", func() {
+			It("should set the reconciler backup verifier", func() {
+				v := backup.NewVerifier(nil, nil)
+				Expect(WithBackupVerifier(v)(r)).To(Succeed())
+				Expect(r.verifier).To(Equal(v))
+			})
+		})
+		var _ = Describe("WithBackupMetrics", func() {
+			It("should set the reconciler backup metrics", func() {
+				m := backup.NewMetrics("Matrix")
+				Expect(WithBackupMetrics(m)(r)).To(Succeed())
+				Expect(r.backupMetrics).To(Equal(m))
+			})
+		})
 		var _ = Describe("WithPostHook", func() {
 			It("should set a reconciler posthook", func() {
 				called := false
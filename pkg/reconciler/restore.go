@@ -0,0 +1,129 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/joelanford/helm-operator/pkg/reconciler/internal/conditions"
+	"github.com/joelanford/helm-operator/pkg/reconciler/internal/updater"
+	"github.com/joelanford/helm-operator/pkg/restore"
+)
+
+// WithRestore is an Option that configures the reconciler to restore
+// releases from a backup when their values set `restore.enabled`. Restore
+// progress is tracked in the custom resource status and advanced on later
+// reconciliations.
+func WithRestore(rs *restore.Restore) Option {
+	return func(r *Reconciler) error {
+		r.restore = rs
+		return nil
+	}
+}
+
+// doRestore advances the restore state machine for rel by one step and
+// records the result in the status of obj. Every phase transition is also
+// reported as an event on obj. It returns how long to wait before the
+// restore needs to be looked at again, or 0 if no further steps are pending.
+func (r *Reconciler) doRestore(ctx context.Context, u *updater.Updater, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) (time.Duration, error) {
+	prev := restore.StatusFor(obj)
+	st, requeueAfter, err := r.restore.Reconcile(ctx, obj, rel, vals, log)
+	return r.reportRestore(u, obj, prev, st, requeueAfter, err)
+}
+
+// reportRestore records the restore status st, which replaces prev, and the
+// error of the step that produced it in the status of obj, and reports
+// phase transitions as events. It returns the requeue delay and the error to
+// return from the reconciliation.
+func (r *Reconciler) reportRestore(u *updater.Updater, obj *unstructured.Unstructured, prev, st *restore.Status, requeueAfter time.Duration, err error) (time.Duration, error) {
+	if errors.Is(err, restore.ErrInvalidValues) {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.RestoreInProgress(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.RestoreFailed(corev1.ConditionTrue, conditions.ReasonInvalidRestoreValues, err)),
+		)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonInvalidRestoreValues), "Restore not started: %v", err)
+		return 0, nil
+	}
+	if err != nil {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.RestoreFailed(corev1.ConditionTrue, conditions.ReasonRestoreError, err)),
+		)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonRestoreError), "Restore failed: %v", err)
+		return 0, err
+	}
+	if st == nil {
+		return 0, nil
+	}
+
+	u.UpdateStatus(updater.EnsureRestoreStatus(st))
+	transitioned := prev == nil || prev.Name != st.Name || prev.Phase != st.Phase
+	switch st.Phase {
+	case restore.PhaseInProgress:
+		message := fmt.Sprintf("restore %q of backup %q is in progress", st.Name, st.BackupName)
+		if st.Message != "" {
+			message += ": " + st.Message
+		}
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.RestoreInProgress(corev1.ConditionTrue, conditions.ReasonRestoreStarted, message)),
+			updater.EnsureCondition(conditions.RestoreFailed(corev1.ConditionFalse, "", "")),
+		)
+		if transitioned {
+			source := fmt.Sprintf("backup %q", st.BackupName)
+			if st.BackupTimestamp != nil {
+				source += " taken at " + st.BackupTimestamp.UTC().Format(time.RFC3339)
+			}
+			if st.IsClone() {
+				source += fmt.Sprintf(" into namespace %q", st.TargetNamespace)
+			}
+			r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonRestoreStarted),
+				"Started restore %q of %s", st.Name, source)
+		}
+	case restore.PhaseCompleted:
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.RestoreInProgress(corev1.ConditionFalse, conditions.ReasonRestoreCompleted,
+				fmt.Sprintf("restore %q of backup %q completed", st.Name, st.BackupName))),
+			updater.EnsureCondition(conditions.RestoreSucceeded(corev1.ConditionTrue, conditions.ReasonRestoreCompleted,
+				fmt.Sprintf("restore %q of backup %q completed and the release is healthy", st.Name, st.BackupName))),
+			updater.EnsureCondition(conditions.RestoreFailed(corev1.ConditionFalse, "", "")),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonRestoreCompleted),
+				"Restore %q of backup %q completed and the release is healthy", st.Name, st.BackupName)
+		}
+	case restore.PhaseFailed:
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.RestoreInProgress(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.RestoreSucceeded(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.RestoreFailed(corev1.ConditionTrue, conditions.ReasonRestoreFailed,
+				fmt.Sprintf("restore %q of backup %q failed: %s", st.Name, st.BackupName, st.Message))),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonRestoreFailed),
+				"Restore %q of backup %q failed: %s", st.Name, st.BackupName, st.Message)
+		}
+	}
+	return requeueAfter, nil
+}
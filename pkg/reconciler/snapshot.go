@@ -0,0 +1,133 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/joelanford/helm-operator/pkg/reconciler/internal/conditions"
+	"github.com/joelanford/helm-operator/pkg/reconciler/internal/updater"
+	"github.com/joelanford/helm-operator/pkg/snapshot"
+)
+
+// WithSnapshotter is an Option that configures the reconciler to take CSI
+// volume snapshots of the persistent volume claims of releases when their
+// values set `snapshot.enabled` or snapshot.RequestAnnotation is set on
+// their custom resource. Snapshot progress is tracked in the custom resource
+// status and advanced on later reconciliations.
+func WithSnapshotter(s *snapshot.Snapshotter) Option {
+	return func(r *Reconciler) error {
+		r.snapshotter = s
+		return nil
+	}
+}
+
+// doSnapshot advances the volume snapshots of rel by one step and records
+// the result in the status of obj. Every phase transition is also reported
+// as an event on obj. It returns how long to wait before the snapshots need
+// to be looked at again, or 0 if nothing is pending.
+func (r *Reconciler) doSnapshot(ctx context.Context, u *updater.Updater, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) (time.Duration, error) {
+	prev := snapshot.StatusFor(obj)
+	st, requeueAfter, err := r.snapshotter.Reconcile(ctx, obj, rel, vals, log)
+	if errors.Is(err, snapshot.ErrInvalidValues) {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.SnapshotInProgress(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.SnapshotFailed(corev1.ConditionTrue, conditions.ReasonInvalidSnapshotValues, err)),
+		)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonInvalidSnapshotValues), "Volume snapshots not taken: %v", err)
+		return 0, nil
+	}
+	if err != nil {
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.SnapshotFailed(corev1.ConditionTrue, conditions.ReasonSnapshotError, err)),
+		)
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonSnapshotError), "Volume snapshots failed: %v", err)
+		return 0, err
+	}
+	if st == nil {
+		return requeueAfter, nil
+	}
+
+	u.UpdateStatus(updater.EnsureSnapshotStatus(st))
+	transitioned := prev == nil || prev.Name != st.Name || prev.Phase != st.Phase
+	switch st.Phase {
+	case snapshot.PhaseInProgress:
+		message := fmt.Sprintf("volume snapshots %q are in progress", st.Name)
+		if st.Message != "" {
+			message += ": " + st.Message
+		}
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.SnapshotInProgress(corev1.ConditionTrue, conditions.ReasonSnapshotStarted, message)),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonSnapshotStarted),
+				"Started volume snapshots %q of %d persistent volume claim(s)", st.Name, len(st.Volumes))
+		}
+	case snapshot.PhaseCompleted:
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.SnapshotInProgress(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.SnapshotSucceeded(corev1.ConditionTrue, conditions.ReasonSnapshotCompleted,
+				fmt.Sprintf("volume snapshots %q are ready to use", st.Name))),
+			updater.EnsureCondition(conditions.SnapshotFailed(corev1.ConditionFalse, "", "")),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonSnapshotCompleted),
+				"Volume snapshots %q of %d persistent volume claim(s) are ready to use", st.Name, len(st.Volumes))
+		}
+	case snapshot.PhaseFailed:
+		u.UpdateStatus(
+			updater.EnsureCondition(conditions.SnapshotInProgress(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.SnapshotSucceeded(corev1.ConditionFalse, "", "")),
+			updater.EnsureCondition(conditions.SnapshotFailed(corev1.ConditionTrue, conditions.ReasonSnapshotFailed,
+				fmt.Sprintf("volume snapshots %q failed: %s", st.Name, st.Message))),
+		)
+		if transitioned {
+			r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonSnapshotFailed),
+				"Volume snapshots %q failed: %s", st.Name, st.Message)
+		}
+	}
+	return requeueAfter, nil
+}
+
+// doSnapshotPrune deletes the volume snapshots of obj that fall outside
+// `snapshot.keepLast` and reports them as an event.
+func (r *Reconciler) doSnapshotPrune(ctx context.Context, obj *unstructured.Unstructured, vals chartutil.Values, log logr.Logger) error {
+	pruned, err := r.snapshotter.Prune(ctx, obj, vals, log)
+	if len(pruned) > 0 {
+		r.eventRecorder.Eventf(obj, "Normal", string(conditions.ReasonSnapshotsPruned),
+			"Deleted %d volume snapshot set(s): %s", len(pruned), strings.Join(pruned, ", "))
+	}
+	if errors.Is(err, snapshot.ErrInvalidValues) {
+		// Reported by doSnapshot already.
+		return nil
+	}
+	if err != nil {
+		r.eventRecorder.Eventf(obj, "Warning", string(conditions.ReasonPruneError), "Failed to prune volume snapshots: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/joelanford/helm-operator/pkg/restore"
+	"github.com/joelanford/helm-operator/pkg/snapshot"
+)
+
+// WithValidatingWebhook is an Option that configures the reconciler to
+// serve a validating admission webhook for its custom resources at
+// ValidatingWebhookPath, on the webhook server of the manager passed to
+// SetupWithManager. The webhook rejects custom resources whose values do not
+// meet the values.schema.json of the chart, or whose backup, restore or
+// snapshot values could never be reconciled, before a release is installed
+// or upgraded with them.
+func WithValidatingWebhook(enabled bool) Option {
+	return func(r *Reconciler) error {
+		r.validatingWebhook = enabled
+		return nil
+	}
+}
+
+// ValidatingWebhookPath returns the path the validating webhook for the
+// custom resources of gvk is served at, e.g.
+// /validate-example-com-v1-matrix.
+func ValidatingWebhookPath(gvk schema.GroupVersionKind) string {
+	return fmt.Sprintf("/validate-%s-%s-%s", strings.ReplaceAll(gvk.Group, ".", "-"), gvk.Version, strings.ToLower(gvk.Kind))
+}
+
+// validator is the validating webhook of a Reconciler.
+type validator struct {
+	r *Reconciler
+}
+
+var _ admission.Handler = &validator{}
+
+// Handle admits the custom resource of req if its values can be reconciled.
+// Updates that leave the spec alone are always admitted, so that custom
+// resources admitted before the webhook was enabled can still be finalized
+// and deleted.
+func (v *validator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1beta1.Create && req.Operation != admissionv1beta1.Update {
+		return admission.Allowed("")
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(req.Object.Raw); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	var old *unstructured.Unstructured
+	if req.Operation == admissionv1beta1.Update {
+		old = &unstructured.Unstructured{}
+		if err := old.UnmarshalJSON(req.OldObject.Raw); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if equality.Semantic.DeepEqual(old.Object["spec"], obj.Object["spec"]) {
+			return admission.Allowed("")
+		}
+	}
+
+	if err := v.validate(ctx, obj, old); err != nil {
+		if errors.Is(err, errRejected) {
+			v.r.log.Info("Rejected custom resource", "namespace", obj.GetNamespace(), "name", obj.GetName(), "reason", err.Error())
+			return admission.Denied(strings.TrimPrefix(err.Error(), errRejected.Error()+": "))
+		}
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.Allowed("")
+}
+
+// errRejected is wrapped by the errors of validate that reject a custom
+// resource rather than fail to validate it.
+var errRejected = errors.New("rejected")
+
+func (v *validator) validate(ctx context.Context, obj, old *unstructured.Unstructured) error {
+	vals, err := v.r.getValues(obj)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRejected, err)
+	}
+	if err := chartutil.ValidateAgainstSchema(v.r.chrt, vals); err != nil {
+		return fmt.Errorf("%w: %v", errRejected, err)
+	}
+	if v.r.backup != nil {
+		if err := v.r.backup.ValidateValues(obj, vals); err != nil {
+			return fmt.Errorf("%w: %v", errRejected, err)
+		}
+	}
+	if v.r.snapshotter != nil {
+		if err := snapshot.ValidateValues(vals); err != nil {
+			return fmt.Errorf("%w: %v", errRejected, err)
+		}
+	}
+	if v.r.restore != nil {
+		err := v.r.restore.Validate(ctx, obj, old, vals)
+		if errors.Is(err, restore.ErrInvalidValues) {
+			return fmt.Errorf("%w: %v", errRejected, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2020 The Operator-SDK Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chart"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+	internalvalues "github.com/joelanford/helm-operator/pkg/reconciler/internal/values"
+	"github.com/joelanford/helm-operator/pkg/restore"
+	"github.com/joelanford/helm-operator/pkg/snapshot"
+)
+
+var _ = Describe("ValidatingWebhook", func() {
+	var (
+		v   *validator
+		obj *unstructured.Unstructured
+	)
+
+	BeforeEach(func() {
+		sch := runtime.NewScheme()
+		sch.AddKnownTypeWithName(schema.GroupVersionKind{Group: "velero.io", Version: "v1", Kind: "BackupList"}, &unstructured.UnstructuredList{})
+		cl := fake.NewFakeClientWithScheme(sch)
+		provider := backup.NewVeleroProvider(cl, "velero")
+		b := backup.NewBackup(provider)
+		rs := restore.NewRestore(provider, nil, cl, nil)
+		s := snapshot.NewSnapshotter(cl)
+		// New registers metrics, which can only be done once.
+		v = &validator{r: &Reconciler{
+			gvk: &gvk,
+			chrt: &chart.Chart{
+				Metadata: &chart.Metadata{Name: "test", Version: "0.1.0", APIVersion: chart.APIVersionV2},
+				Values:   map[string]interface{}{"replicas": int64(1)},
+				Schema:   []byte(`{"type": "object", "properties": {"replicas": {"type": "integer"}}}`),
+			},
+			valueMapper: internalvalues.DefaultMapper,
+			log:         testing.NullLogger{},
+			backup:      &b,
+			restore:     &rs,
+			snapshotter: &s,
+		}}
+
+		obj = &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gvk)
+		obj.SetNamespace("matrix")
+		obj.SetName("test")
+	})
+
+	request := func(op admissionv1beta1.Operation, obj, old *unstructured.Unstructured) admission.Request {
+		req := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Operation: op}}
+		raw, err := obj.MarshalJSON()
+		Expect(err).To(BeNil())
+		req.Object.Raw = raw
+		if old != nil {
+			raw, err := old.MarshalJSON()
+			Expect(err).To(BeNil())
+			req.OldObject.Raw = raw
+		}
+		return req
+	}
+
+	setSpec := func(u *unstructured.Unstructured, spec map[string]interface{}) {
+		Expect(unstructured.SetNestedMap(u.Object, spec, "spec")).To(Succeed())
+	}
+
+	It("should admit valid values", func() {
+		setSpec(obj, map[string]interface{}{"replicas": int64(3)})
+		resp := v.Handle(context.TODO(), request(admissionv1beta1.Create, obj, nil))
+		Expect(resp.Allowed).To(BeTrue())
+	})
+
+	It("should reject values that do not meet the chart schema", func() {
+		setSpec(obj, map[string]interface{}{"replicas": "three"})
+		resp := v.Handle(context.TODO(), request(admissionv1beta1.Create, obj, nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("replicas"))
+	})
+
+	It("should reject backup and restore enabled together", func() {
+		setSpec(obj, map[string]interface{}{
+			"backup":  map[string]interface{}{"enabled": true},
+			"restore": map[string]interface{}{"enabled": true, "backupName": "first"},
+		})
+		resp := v.Handle(context.TODO(), request(admissionv1beta1.Create, obj, nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("backup and restore cannot be enabled simultaneously"))
+	})
+
+	It("should reject invalid backup values", func() {
+		setSpec(obj, map[string]interface{}{"backup": map[string]interface{}{"schedule": "daily"}})
+		resp := v.Handle(context.TODO(), request(admissionv1beta1.Create, obj, nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("backup.schedule"))
+	})
+
+	It("should reject invalid snapshot values", func() {
+		setSpec(obj, map[string]interface{}{"snapshot": map[string]interface{}{"keepLast": int64(0)}})
+		resp := v.Handle(context.TODO(), request(admissionv1beta1.Create, obj, nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("snapshot.keepLast"))
+	})
+
+	It("should require a backup name if no backup can be chosen", func() {
+		setSpec(obj, map[string]interface{}{"restore": map[string]interface{}{"enabled": true}})
+		resp := v.Handle(context.TODO(), request(admissionv1beta1.Create, obj, nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("restore.backupName: required"))
+	})
+
+	It("should admit updates that leave the spec alone", func() {
+		setSpec(obj, map[string]interface{}{"replicas": "three"})
+		updated := obj.DeepCopy()
+		updated.SetFinalizers([]string{uninstallFinalizer})
+		resp := v.Handle(context.TODO(), request(admissionv1beta1.Update, updated, obj))
+		Expect(resp.Allowed).To(BeTrue())
+
+		setSpec(updated, map[string]interface{}{"replicas": "four"})
+		resp = v.Handle(context.TODO(), request(admissionv1beta1.Update, updated, obj))
+		Expect(resp.Allowed).To(BeFalse())
+	})
+
+	It("should serve at a path derived from the GVK", func() {
+		Expect(ValidatingWebhookPath(schema.GroupVersionKind{Group: "matrix.example.com", Version: "v1", Kind: "Matrix"})).To(Equal("/validate-matrix-example-com-v1-matrix"))
+	})
+})
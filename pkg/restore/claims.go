@@ -0,0 +1,148 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+// deleteClaims deletes the persistent volume claims of the components of
+// step, or of the components the restore is limited to if the step names
+// none, and returns whether all of them are gone. Claims that are still
+// mounted are only removed once their pods have stopped, so the claims that
+// remain are listed in the step's message until then.
+func (r *Restore) deleteClaims(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status, step *StepStatus) (bool, error) {
+	components := step.Components
+	if len(components) == 0 && st.Filter != nil {
+		components = st.Filter.Components
+	}
+	if len(components) == 0 {
+		return false, stepFailed("no components to delete the persistent volume claims of")
+	}
+	namespace := backup.ReleaseNamespace(obj, rel)
+	claims, err := r.componentClaims(ctx, namespace, vals, components)
+	if err != nil {
+		return false, err
+	}
+	deleted := false
+	for i := range claims {
+		if claims[i].GetDeletionTimestamp() != nil {
+			continue
+		}
+		if err := r.client.Delete(ctx, &claims[i]); err != nil && !apierrors.IsNotFound(err) {
+			return false, fmt.Errorf("delete persistent volume claim %q: %w", claims[i].GetName(), err)
+		}
+		deleted = true
+	}
+	if deleted {
+		if claims, err = r.componentClaims(ctx, namespace, vals, components); err != nil {
+			return false, err
+		}
+	}
+	if len(claims) > 0 {
+		names := make([]string, 0, len(claims))
+		for _, c := range claims {
+			names = append(names, c.GetName())
+		}
+		step.Message = "waiting for persistent volume claims " + strings.Join(names, ", ") + " to be deleted"
+		return false, nil
+	}
+	return true, nil
+}
+
+// componentClaims returns the persistent volume claims in namespace that
+// match the selector of any of components, sorted by name.
+func (r *Restore) componentClaims(ctx context.Context, namespace string, vals chartutil.Values, components []string) ([]unstructured.Unstructured, error) {
+	restoreVals, _ := vals.Table("restore")
+	selectors, err := componentSelectorsFor(restoreVals)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]unstructured.Unstructured{}
+	for _, c := range components {
+		selector, ok := selectors[c]
+		if !ok {
+			return nil, stepFailed("unknown component %q", c)
+		}
+		s, err := metav1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			return nil, stepFailed("invalid selector of component %q: %v", c, err)
+		}
+		list := &unstructured.UnstructuredList{}
+		list.SetAPIVersion("v1")
+		list.SetKind("PersistentVolumeClaimList")
+		if err := r.client.List(ctx, list, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: s}); err != nil {
+			return nil, fmt.Errorf("list persistent volume claims of component %q: %w", c, err)
+		}
+		for _, pvc := range list.Items {
+			byName[pvc.GetName()] = pvc
+		}
+	}
+	claims := make([]unstructured.Unstructured, 0, len(byName))
+	for _, pvc := range byName {
+		claims = append(claims, pvc)
+	}
+	sort.Slice(claims, func(i, j int) bool { return claims[i].GetName() < claims[j].GetName() })
+	return claims, nil
+}
+
+// claimWorkloads returns the workloads among workloads that mount any of the
+// persistent volume claims of components.
+func (r *Restore) claimWorkloads(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, workloads []unstructured.Unstructured, components []string) ([]unstructured.Unstructured, error) {
+	claims, err := r.componentClaims(ctx, backup.ReleaseNamespace(obj, rel), vals, components)
+	if err != nil {
+		return nil, err
+	}
+	var mounting []unstructured.Unstructured
+	for i := range workloads {
+		for _, c := range claims {
+			if mountsClaim(&workloads[i], c.GetName()) {
+				mounting = append(mounting, workloads[i])
+				break
+			}
+		}
+	}
+	return mounting, nil
+}
+
+// mountsClaim returns whether the pods of workload w mount the persistent
+// volume claim named claim, either through a volume of the pod template or,
+// for a StatefulSet, as a claim created from one of its volume claim
+// templates.
+func mountsClaim(w *unstructured.Unstructured, claim string) bool {
+	volumes, _, _ := unstructured.NestedSlice(w.Object, "spec", "template", "spec", "volumes")
+	for _, v := range volumes {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _, _ := unstructured.NestedString(m, "persistentVolumeClaim", "claimName"); name == claim {
+			return true
+		}
+	}
+	if w.GetKind() != "StatefulSet" {
+		return false
+	}
+	templates, _, _ := unstructured.NestedSlice(w.Object, "spec", "volumeClaimTemplates")
+	for _, t := range templates {
+		m, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(m, "metadata", "name")
+		if strings.HasPrefix(claim, name+"-"+w.GetName()+"-") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+// RestoredFromAnnotation is set on custom resources created for a restore
+// into another namespace. Its value is the namespace and name of the custom
+// resource whose backup was restored.
+const RestoredFromAnnotation = "helm.operator-sdk/restored-from"
+
+// clonePolicy decides whether a release is restored into other namespaces
+// rather than in place. It is read from the following values:
+//
+//   - restore.targetNamespace - the namespace the release is restored into.
+//   - restore.namespaceMapping - a map of further namespaces in the backup to
+//     the namespaces they are restored into. It may map the release
+//     namespace instead of restore.targetNamespace, but has to map it if
+//     restore.targetNamespace is not set.
+//   - restore.createResource - whether a copy of the custom resource is
+//     created in the target namespace once the backup has been restored, so
+//     that it takes over the restored release (default false).
+//
+// The release itself is left alone by restores into other namespaces, so
+// they always consist of the Velero restore only.
+type clonePolicy struct {
+	namespaceMapping map[string]string
+	createResource   bool
+}
+
+func clonePolicyFor(obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values) (clonePolicy, error) {
+	var p clonePolicy
+	namespace := backup.ReleaseNamespace(obj, rel)
+	target, err := stringValue(vals, "restore.targetNamespace")
+	if err != nil {
+		return p, err
+	}
+	// PathValue does not return tables, so the mapping is looked up in the
+	// restore table instead.
+	restoreVals, _ := vals.Table("restore")
+	if v := restoreVals["namespaceMapping"]; v != nil {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return p, invalidValuesError("restore.namespaceMapping", "must be a map of namespaces, got %v", v)
+		}
+		p.namespaceMapping = map[string]string{}
+		for from, to := range m {
+			s, ok := to.(string)
+			if !ok || s == "" {
+				return p, invalidValuesError("restore.namespaceMapping."+from, "must be a namespace, got %v", to)
+			}
+			p.namespaceMapping[from] = s
+		}
+	}
+	if target != "" {
+		if to, ok := p.namespaceMapping[namespace]; ok && to != target {
+			return p, invalidValuesError("restore.namespaceMapping."+namespace, "conflicts with restore.targetNamespace %q", target)
+		}
+		if p.namespaceMapping == nil {
+			p.namespaceMapping = map[string]string{}
+		}
+		p.namespaceMapping[namespace] = target
+	}
+	for from, to := range p.namespaceMapping {
+		if errs := validation.IsDNS1123Label(to); len(errs) > 0 {
+			return p, invalidValuesError("restore.namespaceMapping."+from, "%q is not a valid namespace", to)
+		}
+		if to == from {
+			return p, invalidValuesError("restore.namespaceMapping."+from, "must differ from the namespace it maps")
+		}
+	}
+	if v, err := vals.PathValue("restore.createResource"); err == nil && v != nil {
+		b, ok := v.(bool)
+		if !ok {
+			return p, invalidValuesError("restore.createResource", "must be a boolean, got %v", v)
+		}
+		p.createResource = b
+	}
+	if len(p.namespaceMapping) > 0 && p.namespaceMapping[namespace] == "" {
+		return p, invalidValuesError("restore.namespaceMapping", "must map the release namespace %q unless restore.targetNamespace is set", namespace)
+	}
+	if p.createResource && len(p.namespaceMapping) == 0 {
+		return p, invalidValuesError("restore.createResource", "requires restore.targetNamespace")
+	}
+	if len(p.namespaceMapping) > 0 {
+		if v, err := vals.PathValue("restore.plan"); err == nil && v != nil {
+			return p, invalidValuesError("restore.plan", "not supported when restoring into other namespaces")
+		}
+	}
+	return p, nil
+}
+
+// adopt hands the release objects restored into the target namespace of st
+// over to a copy of obj in that namespace, which is created first if the
+// restore asks for it. The owner references of the restored objects still
+// point to obj, which does not exist in the target namespace, so they would
+// be deleted by the garbage collector otherwise. Without a copy of obj the
+// references are removed.
+func (r *Restore) adopt(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, st *Status) error {
+	var owner *unstructured.Unstructured
+	if st.CreateResource {
+		var err error
+		if owner, err = r.ensureResource(ctx, obj, st.TargetNamespace); err != nil {
+			return err
+		}
+	}
+
+	objs, err := manifestObjects(obj, rel, st.TargetNamespace)
+	if err != nil {
+		return err
+	}
+	for _, u := range objs {
+		if err := r.client.Get(ctx, client.ObjectKey{Namespace: u.GetNamespace(), Name: u.GetName()}, &u); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		var (
+			refs    []metav1.OwnerReference
+			changed bool
+		)
+		for _, ref := range u.GetOwnerReferences() {
+			switch {
+			case ref.Kind != obj.GetKind() || ref.Name != obj.GetName():
+			case owner == nil:
+				changed = true
+				continue
+			case ref.UID != owner.GetUID():
+				changed = true
+				ref.UID = owner.GetUID()
+			}
+			refs = append(refs, ref)
+		}
+		if !changed {
+			continue
+		}
+		u.SetOwnerReferences(refs)
+		if err := r.client.Update(ctx, &u); err != nil {
+			return fmt.Errorf("adopt restored %s %q: %w", u.GetKind(), u.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// ensureResource returns the copy of obj in namespace, and creates it if it
+// does not exist yet. The copy has the spec of obj without its restore
+// values, so that it does not restore the backup again.
+func (r *Restore) ensureResource(ctx context.Context, obj *unstructured.Unstructured, namespace string) (*unstructured.Unstructured, error) {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(obj.GroupVersionKind())
+	err := r.client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: obj.GetName()}, u)
+	if err == nil {
+		if u.GetAnnotations()[RestoredFromAnnotation] != obj.GetNamespace()+"/"+obj.GetName() {
+			return nil, stepFailed("%s %q already exists in namespace %q", obj.GetKind(), obj.GetName(), namespace)
+		}
+		return u, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	u = &unstructured.Unstructured{Object: map[string]interface{}{}}
+	u.SetGroupVersionKind(obj.GroupVersionKind())
+	u.SetNamespace(namespace)
+	u.SetName(obj.GetName())
+	u.SetLabels(obj.GetLabels())
+	u.SetAnnotations(map[string]string{RestoredFromAnnotation: obj.GetNamespace() + "/" + obj.GetName()})
+	if spec, ok := obj.Object["spec"].(map[string]interface{}); ok {
+		spec = runtime.DeepCopyJSONValue(spec).(map[string]interface{})
+		delete(spec, "restore")
+		u.Object["spec"] = spec
+	}
+	if err := r.client.Create(ctx, u); err != nil {
+		return nil, fmt.Errorf("create %s %q in namespace %q: %w", obj.GetKind(), obj.GetName(), namespace, err)
+	}
+	return u, nil
+}
@@ -0,0 +1,197 @@
+package restore
+
+import (
+	"sort"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+const (
+	// ExistingResourcesNone leaves objects that already exist in the cluster
+	// alone, which is what Velero does by default.
+	ExistingResourcesNone = "none"
+	// ExistingResourcesUpdate updates objects that already exist in the
+	// cluster to the state in the backup. Persistent volumes and their data
+	// are never overwritten.
+	ExistingResourcesUpdate = "update"
+)
+
+// DatabaseComponent is the component of the PostgreSQL subchart. Restores
+// limited to components only disable PostgreSQL by default if they include
+// it.
+const DatabaseComponent = "database"
+
+// DefaultComponentSelectors select the objects of the components that can be
+// restored on their own through `restore.components`.
+var DefaultComponentSelectors = map[string]string{
+	DatabaseComponent: backup.DefaultPostgresPodSelector,
+	"media":           "app.kubernetes.io/component=media",
+}
+
+// componentResources are restored by default when a restore is limited to
+// components: their persistent volume claims and the volumes bound to them.
+var componentResources = []string{"persistentvolumeclaims", "persistentvolumes"}
+
+// Filter limits a restore to part of a backup. It is copied into the status
+// when the restore starts.
+//
+// Objects are restored if they match any of LabelSelectors. Components are
+// the components whose selectors were added to LabelSelectors.
+type Filter struct {
+	Components             []string               `json:"components,omitempty"`
+	IncludedResources      []string               `json:"includedResources,omitempty"`
+	LabelSelectors         []metav1.LabelSelector `json:"labelSelectors,omitempty"`
+	ExistingResourcePolicy string                 `json:"existingResourcePolicy,omitempty"`
+}
+
+// apply adds the filter to the spec of a Velero Restore.
+func (f *Filter) apply(spec map[string]interface{}) error {
+	if f == nil {
+		return nil
+	}
+	if len(f.IncludedResources) > 0 {
+		resources := make([]interface{}, 0, len(f.IncludedResources))
+		for _, r := range f.IncludedResources {
+			resources = append(resources, r)
+		}
+		spec["includedResources"] = resources
+	}
+	var selectors []interface{}
+	for i := range f.LabelSelectors {
+		s, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&f.LabelSelectors[i])
+		if err != nil {
+			return err
+		}
+		selectors = append(selectors, s)
+	}
+	switch len(selectors) {
+	case 0:
+	case 1:
+		spec["labelSelector"] = selectors[0]
+	default:
+		spec["orLabelSelectors"] = selectors
+	}
+	if f.ExistingResourcePolicy != "" {
+		spec["existingResourcePolicy"] = f.ExistingResourcePolicy
+	}
+	return nil
+}
+
+// filterFor reads the filter of a restore from the following values:
+//
+//   - restore.includedResources - the resources to restore, e.g.
+//     "persistentvolumeclaims" (default all, or the persistent volume claims
+//     and volumes of the components in restore.components).
+//   - restore.labelSelector - only restore objects matching this selector,
+//     given either as a string ("app=matrix") or as a LabelSelector map.
+//   - restore.components - only restore the objects of these components,
+//     e.g. media or database. It cannot be combined with
+//     restore.labelSelector.
+//   - restore.componentSelectors - a map of component names to the label
+//     selectors of their objects, which adds to and overrides
+//     DefaultComponentSelectors.
+//   - restore.existingResourcePolicy - none or update (default none).
+//
+// It returns nil if the whole backup is restored.
+func filterFor(vals chartutil.Values) (*Filter, error) {
+	restoreVals, _ := vals.Table("restore")
+	f := &Filter{}
+
+	if v := restoreVals["includedResources"]; v != nil {
+		resources, err := stringList(restoreVals, "includedResources", "restore")
+		if err != nil {
+			return nil, err
+		}
+		if len(resources) == 0 {
+			return nil, invalidValuesError("restore.includedResources", "must not be empty")
+		}
+		f.IncludedResources = resources
+	}
+
+	if v := restoreVals["labelSelector"]; v != nil {
+		selector, err := backup.ParseLabelSelector(v)
+		if err != nil {
+			return nil, invalidValuesError("restore.labelSelector", "%v", err)
+		}
+		f.LabelSelectors = append(f.LabelSelectors, *selector)
+	}
+
+	components, err := stringList(restoreVals, "components", "restore")
+	if err != nil {
+		return nil, err
+	}
+	if len(components) > 0 {
+		if len(f.LabelSelectors) > 0 {
+			return nil, invalidValuesError("restore.components", "cannot be combined with restore.labelSelector")
+		}
+		selectors, err := componentSelectorsFor(restoreVals)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range components {
+			selector, ok := selectors[c]
+			if !ok {
+				return nil, invalidValuesError("restore.components", "unknown component %q, must be one of %v", c, componentNames(selectors))
+			}
+			f.LabelSelectors = append(f.LabelSelectors, *selector)
+		}
+		f.Components = components
+		if f.IncludedResources == nil {
+			f.IncludedResources = componentResources
+		}
+	}
+
+	if v := restoreVals["existingResourcePolicy"]; v != nil {
+		switch v {
+		case ExistingResourcesNone, ExistingResourcesUpdate:
+			f.ExistingResourcePolicy = v.(string)
+		default:
+			return nil, invalidValuesError("restore.existingResourcePolicy", "must be %s or %s, got %v", ExistingResourcesNone, ExistingResourcesUpdate, v)
+		}
+	}
+
+	if f.IncludedResources == nil && f.LabelSelectors == nil && f.ExistingResourcePolicy == "" {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// componentSelectorsFor returns the label selectors of the components that
+// can be restored on their own.
+func componentSelectorsFor(restoreVals map[string]interface{}) (map[string]*metav1.LabelSelector, error) {
+	raw := map[string]interface{}{}
+	for c, s := range DefaultComponentSelectors {
+		raw[c] = s
+	}
+	if v := restoreVals["componentSelectors"]; v != nil {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, invalidValuesError("restore.componentSelectors", "must be a map of components to label selectors, got %v", v)
+		}
+		for c, s := range m {
+			raw[c] = s
+		}
+	}
+	selectors := map[string]*metav1.LabelSelector{}
+	for c, s := range raw {
+		selector, err := backup.ParseLabelSelector(s)
+		if err != nil {
+			return nil, invalidValuesError("restore.componentSelectors."+c, "%v", err)
+		}
+		selectors[c] = selector
+	}
+	return selectors, nil
+}
+
+func componentNames(selectors map[string]*metav1.LabelSelector) []string {
+	names := make([]string, 0, len(selectors))
+	for c := range selectors {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	return names
+}
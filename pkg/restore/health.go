@@ -0,0 +1,145 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// healthTimeoutFor reads from `restore.healthTimeout` how long the release
+// may take to become healthy once the steps of a restore have finished, as a
+// duration string (default 10m).
+func healthTimeoutFor(vals chartutil.Values) (time.Duration, error) {
+	v, err := vals.PathValue("restore.healthTimeout")
+	if err != nil || v == nil || v == "" {
+		return DefaultWaitTimeout, nil
+	}
+	s, _ := v.(string)
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, invalidValuesError("restore.healthTimeout", "must be a positive duration, got %v", v)
+	}
+	return d, nil
+}
+
+// verifyHealth finishes a restore whose steps have all completed. The
+// components and workloads that the plan left disabled or scaled down are
+// restored first, or the restored objects are adopted for a restore into
+// another namespace. The restore is then only moved to Completed once all
+// Deployments and StatefulSets of the restored release are ready and all of
+// its persistent volume claims are bound, and to Failed if that takes longer
+// than `restore.healthTimeout`.
+func (r *Restore) verifyHealth(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status, log logr.Logger) (*Status, time.Duration, error) {
+	var err error
+	if st.IsClone() {
+		err = r.adopt(ctx, obj, rel, st)
+	} else {
+		rel, err = r.undo(ctx, obj, rel, vals, st)
+	}
+	if errors.Is(err, errStepFailed) {
+		return r.finish(obj, st, PhaseFailed, strings.TrimPrefix(err.Error(), errStepFailed.Error()+": "), log), 0, nil
+	}
+	if err != nil {
+		return st, 0, err
+	}
+	timeout, err := healthTimeoutFor(vals)
+	if err != nil {
+		return st, 0, err
+	}
+
+	notReady, err := r.notReady(ctx, obj, rel, nil, st.TargetNamespace)
+	if errors.Is(err, errStepFailed) {
+		return r.finish(obj, st, PhaseFailed, strings.TrimPrefix(err.Error(), errStepFailed.Error()+": "), log), 0, nil
+	}
+	if err != nil {
+		return st, 0, err
+	}
+	if len(notReady) == 0 {
+		return r.finish(obj, st, PhaseCompleted, "", log), 0, nil
+	}
+	st.Message = "waiting for " + strings.Join(notReady, ", ")
+	if last := st.Steps[len(st.Steps)-1]; last.CompletionTimestamp != nil && time.Since(last.CompletionTimestamp.Time) > timeout {
+		return r.finish(obj, st, PhaseFailed, fmt.Sprintf("release did not become healthy within %s: %s", timeout, st.Message), log), 0, nil
+	}
+	return st, DefaultPollInterval, nil
+}
+
+// notReady returns the Deployments and StatefulSets of rel named in names,
+// or all of them if names is empty, that do not have all of their replicas
+// ready, and the persistent volume claims of rel that are not bound. The
+// claims created from the volume claim templates of StatefulSets are checked
+// along with their StatefulSet; other claims only if names is empty. Objects
+// of the release namespace are looked for in namespace, if it is set.
+func (r *Restore) notReady(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, names []string, namespace string) ([]string, error) {
+	workloads, err := releaseWorkloads(obj, rel, names, namespace)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		notReady []string
+		claims   []client.ObjectKey
+	)
+	for _, w := range workloads {
+		if err := r.client.Get(ctx, client.ObjectKey{Namespace: w.GetNamespace(), Name: w.GetName()}, &w); err != nil {
+			if apierrors.IsNotFound(err) {
+				notReady = append(notReady, fmt.Sprintf("%s %q (missing)", strings.ToLower(w.GetKind()), w.GetName()))
+				continue
+			}
+			return nil, err
+		}
+		replicas := replicasOf(&w)
+		ready, _, _ := unstructured.NestedInt64(w.Object, "status", "readyReplicas")
+		if ready < replicas {
+			notReady = append(notReady, fmt.Sprintf("%s %q (%d/%d ready)", strings.ToLower(w.GetKind()), w.GetName(), ready, replicas))
+		}
+		if w.GetKind() == "StatefulSet" {
+			templates, _, _ := unstructured.NestedSlice(w.Object, "spec", "volumeClaimTemplates")
+			for _, t := range templates {
+				name, _, _ := unstructured.NestedString(t.(map[string]interface{}), "metadata", "name")
+				for i := int64(0); i < replicas; i++ {
+					claims = append(claims, client.ObjectKey{Namespace: w.GetNamespace(), Name: fmt.Sprintf("%s-%s-%d", name, w.GetName(), i)})
+				}
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		objs, err := manifestObjects(obj, rel, namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range objs {
+			if u.GroupVersionKind().Group == "" && u.GetKind() == "PersistentVolumeClaim" {
+				claims = append(claims, client.ObjectKey{Namespace: u.GetNamespace(), Name: u.GetName()})
+			}
+		}
+	}
+	for _, key := range claims {
+		pvc := &unstructured.Unstructured{}
+		pvc.SetAPIVersion("v1")
+		pvc.SetKind("PersistentVolumeClaim")
+		if err := r.client.Get(ctx, key, pvc); err != nil {
+			if apierrors.IsNotFound(err) {
+				notReady = append(notReady, fmt.Sprintf("persistentvolumeclaim %q (missing)", key.Name))
+				continue
+			}
+			return nil, err
+		}
+		if phase, _, _ := unstructured.NestedString(pvc.Object, "status", "phase"); phase != "Bound" {
+			if phase == "" {
+				phase = "Pending"
+			}
+			notReady = append(notReady, fmt.Sprintf("persistentvolumeclaim %q (%s)", key.Name, phase))
+		}
+	}
+	return notReady, nil
+}
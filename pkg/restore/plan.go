@@ -0,0 +1,634 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+// DefaultWaitTimeout is how long a WaitForReady step waits for the workloads
+// of the release when it has no timeout of its own.
+const DefaultWaitTimeout = 10 * time.Minute
+
+// StepType is the kind of a step of a restore plan.
+type StepType string
+
+const (
+	// StepDisableComponents upgrades the release with `<component>.enabled`
+	// set to false for each of its components that is enabled, so that
+	// their data is not written to while it is restored.
+	StepDisableComponents StepType = "DisableComponents"
+	// StepScaleDown scales the Deployments and StatefulSets of the release
+	// named in its workloads, or all of them, to zero replicas. If it names
+	// components, only the workloads that mount the persistent volume claims
+	// of these components are scaled down.
+	StepScaleDown StepType = "ScaleDown"
+	// StepDeleteClaims deletes the persistent volume claims of the
+	// components it names, or of the components in `restore.components`,
+	// and waits until they are gone. Velero leaves claims that already
+	// exist alone, so they have to be deleted to be restored in place. The
+	// workloads that mount them have to be scaled down or disabled first.
+	StepDeleteClaims StepType = "DeleteClaims"
+	// StepRestore runs the Velero restore and waits for it to finish. Every
+	// plan has exactly one.
+	StepRestore StepType = "Restore"
+	// StepScaleUp scales workloads scaled down by an earlier step back to
+	// their original number of replicas.
+	StepScaleUp StepType = "ScaleUp"
+	// StepEnableComponents upgrades the release with components disabled by
+	// an earlier step enabled again.
+	StepEnableComponents StepType = "EnableComponents"
+	// StepWaitForReady waits until the Deployments and StatefulSets of the
+	// release named in its workloads, or all of them, have all of their
+	// replicas ready.
+	StepWaitForReady StepType = "WaitForReady"
+)
+
+// Step is one step of a restore plan, as set in `restore.plan`.
+type Step struct {
+	Type       StepType `json:"type"`
+	Components []string `json:"components,omitempty"`
+	Workloads  []string `json:"workloads,omitempty"`
+	Timeout    string   `json:"timeout,omitempty"`
+}
+
+// StepPhase is the phase of a step of a restore in progress.
+type StepPhase string
+
+const (
+	StepPending    StepPhase = "Pending"
+	StepInProgress StepPhase = "InProgress"
+	StepCompleted  StepPhase = "Completed"
+	StepFailed     StepPhase = "Failed"
+)
+
+// StepStatus records the progress of a step of a restore. The plan is copied
+// into the status when the restore starts, so that changes to it do not
+// affect restores in progress.
+type StepStatus struct {
+	Step                `json:",inline"`
+	Phase               StepPhase    `json:"phase"`
+	Message             string       `json:"message,omitempty"`
+	StartTimestamp      *metav1.Time `json:"startTimestamp,omitempty"`
+	CompletionTimestamp *metav1.Time `json:"completionTimestamp,omitempty"`
+}
+
+// ScaledWorkload is a workload scaled down by a restore, along with the
+// number of replicas it is scaled back up to.
+type ScaledWorkload struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Replicas int64  `json:"replicas"`
+}
+
+// DefaultPlan is the plan of restores whose values do not set
+// `restore.plan`. PostgreSQL is disabled while its volume is restored, and
+// enabled again once the restore has finished. Restores limited to
+// components follow ComponentPlan instead.
+func DefaultPlan() []Step {
+	return []Step{
+		{Type: StepDisableComponents, Components: []string{"postgresql"}},
+		{Type: StepRestore},
+		{Type: StepEnableComponents, Components: []string{"postgresql"}},
+	}
+}
+
+// ComponentPlan is the plan of restores limited to components whose values
+// do not set `restore.plan`. The workloads that mount the persistent volume
+// claims of the components are scaled down and the claims deleted, so that
+// Velero restores them from the backup, and the workloads are scaled back up
+// once the restore has finished. PostgreSQL is disabled as well if the
+// database is one of the components.
+func ComponentPlan(components []string) []Step {
+	plan := []Step{
+		{Type: StepScaleDown, Components: components},
+		{Type: StepDeleteClaims, Components: components},
+		{Type: StepRestore},
+		{Type: StepScaleUp},
+	}
+	if contains(components, DatabaseComponent) {
+		plan = append([]Step{{Type: StepDisableComponents, Components: []string{"postgresql"}}}, plan...)
+		plan = append(plan, Step{Type: StepEnableComponents, Components: []string{"postgresql"}})
+	}
+	return plan
+}
+
+// RollbackPlan is the plan of the restore of a pre-upgrade backup after the
+// upgrade failed. PostgreSQL is disabled and its claims are deleted, so that
+// the database is restored to its state before the upgrade, and it is
+// enabled again once the restore has finished.
+func RollbackPlan() []Step {
+	return []Step{
+		{Type: StepDisableComponents, Components: []string{"postgresql"}},
+		{Type: StepDeleteClaims, Components: []string{DatabaseComponent}},
+		{Type: StepRestore},
+		{Type: StepEnableComponents, Components: []string{"postgresql"}},
+	}
+}
+
+// planFor reads the restore plan from `restore.plan`, a list of steps with
+// the following fields:
+//
+//   - type - DisableComponents, ScaleDown, DeleteClaims, Restore, ScaleUp,
+//     EnableComponents or WaitForReady.
+//   - components - the chart components, i.e. the top-level values with an
+//     `enabled` flag, that DisableComponents and EnableComponents act on,
+//     or the components as in `restore.components` whose claims ScaleDown
+//     and DeleteClaims act on.
+//   - workloads - the names of the Deployments and StatefulSets that
+//     ScaleDown, ScaleUp and WaitForReady act on (default all of the
+//     release).
+//   - timeout - how long Restore and WaitForReady wait before the restore
+//     fails, as a duration string (default no limit for Restore and 10m for
+//     WaitForReady).
+//
+// The plan must contain exactly one Restore step. It returns nil if no plan
+// is set.
+func planFor(vals chartutil.Values) ([]Step, error) {
+	v, err := vals.PathValue("restore.plan")
+	if err != nil || v == nil {
+		return nil, nil
+	}
+	items, ok := v.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, invalidValuesError("restore.plan", "must be a non-empty list of steps, got %v", v)
+	}
+	var (
+		plan     []Step
+		restores int
+	)
+	for i, item := range items {
+		path := fmt.Sprintf("restore.plan[%d]", i)
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, invalidValuesError(path, "must be a step, got %v", item)
+		}
+		var s Step
+		t, _ := m["type"].(string)
+		switch s.Type = StepType(t); s.Type {
+		case StepDisableComponents, StepScaleDown, StepDeleteClaims, StepScaleUp, StepEnableComponents, StepWaitForReady:
+		case StepRestore:
+			restores++
+		default:
+			return nil, invalidValuesError(path+".type", "must be one of %s, %s, %s, %s, %s, %s or %s, got %v",
+				StepDisableComponents, StepScaleDown, StepDeleteClaims, StepRestore, StepScaleUp, StepEnableComponents, StepWaitForReady, m["type"])
+		}
+		if s.Components, err = stringList(m, "components", path); err != nil {
+			return nil, err
+		}
+		if len(s.Components) > 0 && s.Type != StepDisableComponents && s.Type != StepEnableComponents && s.Type != StepScaleDown && s.Type != StepDeleteClaims {
+			return nil, invalidValuesError(path+".components", "not supported by %s steps", s.Type)
+		}
+		if s.Workloads, err = stringList(m, "workloads", path); err != nil {
+			return nil, err
+		}
+		if len(s.Workloads) > 0 && s.Type != StepScaleDown && s.Type != StepScaleUp && s.Type != StepWaitForReady {
+			return nil, invalidValuesError(path+".workloads", "not supported by %s steps", s.Type)
+		}
+		if timeout, ok := m["timeout"]; ok && timeout != nil {
+			if s.Type != StepRestore && s.Type != StepWaitForReady {
+				return nil, invalidValuesError(path+".timeout", "not supported by %s steps", s.Type)
+			}
+			s.Timeout, _ = timeout.(string)
+			if d, err := time.ParseDuration(s.Timeout); err != nil || d <= 0 {
+				return nil, invalidValuesError(path+".timeout", "must be a positive duration, got %v", timeout)
+			}
+		}
+		plan = append(plan, s)
+	}
+	if restores != 1 {
+		return nil, invalidValuesError("restore.plan", "must contain exactly one %s step, got %d", StepRestore, restores)
+	}
+	return plan, nil
+}
+
+// checkPlanComponents checks the components of the ScaleDown and
+// DeleteClaims steps of plan against the components that can be restored.
+// DeleteClaims steps need components, which default to the ones of filter,
+// and are only allowed for restores in place, as they would delete the claims
+// of the release rather than of its copy otherwise.
+func checkPlanComponents(plan []Step, filter *Filter, clone clonePolicy, vals chartutil.Values) error {
+	restoreVals, _ := vals.Table("restore")
+	selectors, err := componentSelectorsFor(restoreVals)
+	if err != nil {
+		return err
+	}
+	for i, s := range plan {
+		path := fmt.Sprintf("restore.plan[%d]", i)
+		if s.Type != StepScaleDown && s.Type != StepDeleteClaims {
+			continue
+		}
+		components := s.Components
+		if s.Type == StepDeleteClaims {
+			if len(clone.namespaceMapping) > 0 {
+				return invalidValuesError(path, "%s steps are not supported by restores into other namespaces", s.Type)
+			}
+			if len(components) == 0 && filter != nil {
+				components = filter.Components
+			}
+			if len(components) == 0 {
+				return invalidValuesError(path+".components", "required by %s steps unless restore.components is set", s.Type)
+			}
+		}
+		for _, c := range components {
+			if _, ok := selectors[c]; !ok {
+				return invalidValuesError(path+".components", "unknown component %q, must be one of %v", c, componentNames(selectors))
+			}
+		}
+	}
+	return nil
+}
+
+func stringList(m map[string]interface{}, key, path string) ([]string, error) {
+	v, ok := m[key]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, invalidValuesError(path+"."+key, "must be a list of strings, got %v", v)
+	}
+	l := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok || s == "" {
+			return nil, invalidValuesError(path+"."+key, "must be a list of strings, got %v", v)
+		}
+		l = append(l, s)
+	}
+	return l, nil
+}
+
+// errStepFailed is wrapped by the errors of steps that cannot succeed any
+// more, as opposed to errors that may go away when the step is retried.
+var errStepFailed = errors.New("step failed")
+
+func stepFailed(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errStepFailed, fmt.Sprintf(format, args...))
+}
+
+// runSteps runs the steps of the restore recorded in st in order, until one
+// of them has to wait or all of them are done, and then checks the health of
+// the release. It returns how long to wait before the restore needs to be
+// looked at again.
+//
+// If a step fails, the remaining steps are skipped, the components and
+// workloads the plan disabled or scaled down are restored, and the restore is
+// moved to Failed.
+func (r *Restore) runSteps(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status, log logr.Logger) (*Status, time.Duration, error) {
+	for i := range st.Steps {
+		step := &st.Steps[i]
+		if step.Phase == StepCompleted {
+			continue
+		}
+		if step.Phase == StepFailed {
+			return r.fail(ctx, obj, rel, vals, st, i, log)
+		}
+		if step.Phase != StepInProgress {
+			now := metav1.Now().Rfc3339Copy()
+			step.Phase = StepInProgress
+			step.StartTimestamp = &now
+			log.Info("Restore step started", "restore", st.Name, "step", i, "type", step.Type)
+		}
+
+		var (
+			done bool
+			err  error
+		)
+		switch step.Type {
+		case StepDisableComponents:
+			rel, err = r.disableComponents(obj, rel, vals, st, step)
+			done = err == nil
+		case StepEnableComponents:
+			rel, err = r.enableComponents(obj, rel, vals, st, step.Components)
+			done = err == nil
+		case StepScaleDown:
+			done, err = true, r.scaleDown(ctx, obj, rel, vals, st, step)
+		case StepDeleteClaims:
+			done, err = r.deleteClaims(ctx, obj, rel, vals, st, step)
+		case StepScaleUp:
+			done, err = true, r.scaleUp(ctx, obj, st, step.Workloads)
+		case StepRestore:
+			rel, done, err = r.runRestore(ctx, obj, rel, st, step)
+		case StepWaitForReady:
+			done, err = r.waitForReady(ctx, obj, rel, step)
+		default:
+			err = stepFailed("unknown step type %q", step.Type)
+		}
+		if err == nil && !done && step.Timeout != "" && step.StartTimestamp != nil {
+			if timeout, _ := time.ParseDuration(step.Timeout); time.Since(step.StartTimestamp.Time) > timeout {
+				err = stepFailed("did not finish within %s: %s", timeout, step.Message)
+			}
+		}
+		switch {
+		case errors.Is(err, errStepFailed):
+			now := metav1.Now().Rfc3339Copy()
+			step.Phase = StepFailed
+			step.Message = strings.TrimPrefix(err.Error(), errStepFailed.Error()+": ")
+			step.CompletionTimestamp = &now
+			log.Info("Restore step failed", "restore", st.Name, "step", i, "type", step.Type, "message", step.Message)
+			return r.fail(ctx, obj, rel, vals, st, i, log)
+		case err != nil:
+			return st, 0, err
+		case !done:
+			return st, DefaultPollInterval, nil
+		}
+		now := metav1.Now().Rfc3339Copy()
+		step.Phase = StepCompleted
+		step.Message = ""
+		step.CompletionTimestamp = &now
+		log.Info("Restore step completed", "restore", st.Name, "step", i, "type", step.Type)
+	}
+	return r.verifyHealth(ctx, obj, rel, vals, st, log)
+}
+
+// fail restores the components and workloads that the plan of st disabled
+// or scaled down, and moves the restore to Failed because of the failed step
+// at index i.
+func (r *Restore) fail(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status, i int, log logr.Logger) (*Status, time.Duration, error) {
+	if _, err := r.undo(ctx, obj, rel, vals, st); err != nil && !errors.Is(err, errStepFailed) {
+		return st, 0, err
+	}
+	step := st.Steps[i]
+	return r.finish(obj, st, PhaseFailed, fmt.Sprintf("step %d (%s) failed: %s", i+1, step.Type, step.Message), log), 0, nil
+}
+
+// undo enables the components and scales up the workloads that the plan of
+// st left disabled or scaled down.
+func (r *Restore) undo(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status) (*release.Release, error) {
+	rel, err := r.enableComponents(obj, rel, vals, st, nil)
+	if err != nil {
+		return rel, err
+	}
+	return rel, r.scaleUp(ctx, obj, st, nil)
+}
+
+// runRestore starts the Velero restore of st when it has not been started
+// yet, and checks on it otherwise. It returns whether the restore has
+// completed. Once it has, the restored release records are reconciled, and
+// the release they were reconciled to is returned for restores in place.
+func (r *Restore) runRestore(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, st *Status, step *StepStatus) (*release.Release, bool, error) {
+	phase, err := r.provider.RestoreStatus(ctx, st.Name)
+	if errors.Is(err, backup.ErrNotFound) {
+		if st.VeleroPhase != "" {
+			return rel, false, stepFailed("restore no longer exists")
+		}
+		spec := backup.RestoreSpec(st.BackupName, backup.ReleaseNamespace(obj, rel))
+		if len(st.NamespaceMapping) > 0 {
+			spec = backup.CloneSpec(obj, rel, st.BackupName, st.NamespaceMapping)
+		}
+		if err := st.Filter.apply(spec); err != nil {
+			return rel, false, err
+		}
+		if err := r.provider.Restore(ctx, obj, st.Name, spec); err != nil {
+			return rel, false, err
+		}
+		st.VeleroPhase = backup.VeleroPhaseNew
+		return rel, false, nil
+	}
+	if err != nil {
+		return rel, false, err
+	}
+	st.VeleroPhase = phase
+	switch phase {
+	case backup.VeleroPhaseCompleted:
+		restored, err := r.reconcileReleaseStorage(ctx, obj, rel, st)
+		if err != nil {
+			return rel, false, err
+		}
+		if !st.IsClone() {
+			rel = restored
+		}
+		return rel, true, nil
+	case backup.VeleroPhasePartiallyFailed, backup.VeleroPhaseFailed, backup.VeleroPhaseFailedValidation:
+		return rel, false, stepFailed("restore finished in phase %s", phase)
+	}
+	step.Message = fmt.Sprintf("restore is in phase %s", phase)
+	return rel, false, nil
+}
+
+// disableComponents disables the components of step that are enabled in
+// vals and records them in st.
+func (r *Restore) disableComponents(obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status, step *StepStatus) (*release.Release, error) {
+	changed := false
+	for _, c := range step.Components {
+		if isEnabled(vals, c+".enabled") && !contains(st.DisabledComponents, c) {
+			st.DisabledComponents = append(st.DisabledComponents, c)
+			changed = true
+		}
+	}
+	if !changed {
+		return rel, nil
+	}
+	return r.upgrade(obj, rel, vals, st)
+}
+
+// enableComponents enables the components named in names, or all of them if
+// names is empty, that were disabled by an earlier step.
+func (r *Restore) enableComponents(obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status, names []string) (*release.Release, error) {
+	var disabled []string
+	for _, c := range st.DisabledComponents {
+		if len(names) > 0 && !contains(names, c) {
+			disabled = append(disabled, c)
+		}
+	}
+	if len(disabled) == len(st.DisabledComponents) {
+		return rel, nil
+	}
+	st.DisabledComponents = disabled
+	return r.upgrade(obj, rel, vals, st)
+}
+
+// upgrade upgrades rel to vals with the components recorded in st disabled.
+func (r *Restore) upgrade(obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status) (*release.Release, error) {
+	if rel == nil {
+		return nil, stepFailed("release is not installed")
+	}
+	overrides := map[string]interface{}{}
+	for _, c := range st.DisabledComponents {
+		overrides[c] = map[string]interface{}{"enabled": false}
+	}
+	acf, err := r.acg.ActionClientFor(obj)
+	if err != nil {
+		return rel, err
+	}
+	upgraded, err := acf.Upgrade(rel.Name, rel.Namespace, rel.Chart, chartutil.CoalesceTables(overrides, vals.AsMap()))
+	if err != nil {
+		return rel, fmt.Errorf("upgrade release with components %v disabled: %w", st.DisabledComponents, err)
+	}
+	return upgraded, nil
+}
+
+// scaleDown scales the workloads of step to zero replicas and records their
+// original number of replicas in st.
+func (r *Restore) scaleDown(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, st *Status, step *StepStatus) error {
+	workloads, err := releaseWorkloads(obj, rel, step.Workloads, "")
+	if err != nil {
+		return err
+	}
+	if len(step.Components) > 0 {
+		if workloads, err = r.claimWorkloads(ctx, obj, rel, vals, workloads, step.Components); err != nil {
+			return err
+		}
+	}
+	for _, w := range workloads {
+		if scaledDown(st, w.GetKind(), w.GetName()) {
+			continue
+		}
+		if err := r.client.Get(ctx, client.ObjectKey{Namespace: w.GetNamespace(), Name: w.GetName()}, &w); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		replicas := replicasOf(&w)
+		if err := unstructured.SetNestedField(w.Object, int64(0), "spec", "replicas"); err != nil {
+			return err
+		}
+		if err := r.client.Update(ctx, &w); err != nil {
+			return fmt.Errorf("scale down %s %q: %w", strings.ToLower(w.GetKind()), w.GetName(), err)
+		}
+		st.ScaledDown = append(st.ScaledDown, ScaledWorkload{Kind: w.GetKind(), Name: w.GetName(), Replicas: replicas})
+	}
+	return nil
+}
+
+// scaleUp scales the workloads named in names, or all of them if names is
+// empty, that were scaled down by an earlier step back to their original
+// number of replicas.
+func (r *Restore) scaleUp(ctx context.Context, obj *unstructured.Unstructured, st *Status, names []string) error {
+	for len(st.ScaledDown) > 0 {
+		i := -1
+		for j, w := range st.ScaledDown {
+			if len(names) == 0 || contains(names, w.Name) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return nil
+		}
+		w := st.ScaledDown[i]
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("apps/v1")
+		u.SetKind(w.Kind)
+		err := r.client.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: w.Name}, u)
+		if err == nil {
+			if err := unstructured.SetNestedField(u.Object, w.Replicas, "spec", "replicas"); err != nil {
+				return err
+			}
+			err = r.client.Update(ctx, u)
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("scale up %s %q: %w", strings.ToLower(w.Kind), w.Name, err)
+		}
+		st.ScaledDown = append(st.ScaledDown[:i], st.ScaledDown[i+1:]...)
+	}
+	return nil
+}
+
+// waitForReady returns whether the workloads of step have all of their
+// replicas ready. The ones that do not are listed in the step's message.
+func (r *Restore) waitForReady(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, step *StepStatus) (bool, error) {
+	if step.Timeout == "" {
+		step.Timeout = DefaultWaitTimeout.String()
+	}
+	notReady, err := r.notReady(ctx, obj, rel, step.Workloads, "")
+	if err != nil {
+		return false, err
+	}
+	if len(notReady) > 0 {
+		step.Message = "waiting for " + strings.Join(notReady, ", ")
+		return false, nil
+	}
+	return true, nil
+}
+
+// releaseWorkloads returns the Deployments and StatefulSets in the manifest
+// of rel, limited to the ones named in names unless it is empty. Workloads
+// of the release namespace are looked for in namespace, if it is set.
+func releaseWorkloads(obj *unstructured.Unstructured, rel *release.Release, names []string, namespace string) ([]unstructured.Unstructured, error) {
+	objs, err := manifestObjects(obj, rel, namespace)
+	if err != nil {
+		return nil, err
+	}
+	var workloads []unstructured.Unstructured
+	for _, u := range objs {
+		if u.GroupVersionKind().Group != "apps" || (u.GetKind() != "Deployment" && u.GetKind() != "StatefulSet") {
+			continue
+		}
+		if len(names) > 0 && !contains(names, u.GetName()) {
+			continue
+		}
+		workloads = append(workloads, u)
+	}
+	return workloads, nil
+}
+
+// manifestObjects returns the objects in the manifest of rel. Objects
+// without a namespace or in the release namespace are put into namespace, or
+// the release namespace if it is not set.
+func manifestObjects(obj *unstructured.Unstructured, rel *release.Release, namespace string) ([]unstructured.Unstructured, error) {
+	if rel == nil {
+		return nil, stepFailed("release is not installed")
+	}
+	if namespace == "" {
+		namespace = backup.ReleaseNamespace(obj, rel)
+	}
+	var objs []unstructured.Unstructured
+	for _, manifest := range releaseutil.SplitManifests(rel.Manifest) {
+		var u unstructured.Unstructured
+		if err := yaml.Unmarshal([]byte(manifest), &u); err != nil {
+			return nil, err
+		}
+		if u.Object == nil || u.GetKind() == "" {
+			continue
+		}
+		if u.GetNamespace() == "" || u.GetNamespace() == backup.ReleaseNamespace(obj, rel) {
+			u.SetNamespace(namespace)
+		}
+		objs = append(objs, u)
+	}
+	return objs, nil
+}
+
+// replicasOf returns the number of replicas of a workload, which defaults to
+// one.
+func replicasOf(u *unstructured.Unstructured) int64 {
+	if n, ok, err := unstructured.NestedInt64(u.Object, "spec", "replicas"); err == nil && ok {
+		return n
+	}
+	return 1
+}
+
+func scaledDown(st *Status, kind, name string) bool {
+	for _, w := range st.ScaledDown {
+		if w.Kind == kind && w.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(l []string, s string) bool {
+	for _, item := range l {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,370 +2,585 @@ package restore
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/joelanford/helm-operator/pkg/backup"
 	helmclient "github.com/joelanford/helm-operator/pkg/client"
-	"github.com/joelanford/helm-operator/pkg/hook"
-	"github.com/prometheus/common/log"
 	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joelanford/helm-operator/pkg/internal/values"
 )
 
-type Restore struct {
-	hook.PostHookFunc
-	client client.Client
-	acg    helmclient.ActionClientGetter
+// ErrInvalidValues is wrapped by every error caused by restore values that
+// cannot be turned into a restore. Such errors do not go away until the
+// custom resource is changed, so they are reported rather than retried.
+var ErrInvalidValues = errors.New("invalid restore values")
+
+func invalidValuesError(path string, format string, args ...interface{}) error {
+	return values.InvalidError(ErrInvalidValues, path, format, args...)
 }
 
+// ErrNoBackup is wrapped by the error returned when no backup could be
+// chosen for a restore that does not name one.
+var ErrNoBackup = errors.New("no backup to restore")
+
+// DefaultPollInterval is how long to wait before checking on a restore that
+// has not finished yet.
+const DefaultPollInterval = 10 * time.Second
+
+// DefaultCleanupAfter is how long a finished restore is kept before it is
+// deleted by its cleanup policy when `restore.cleanupAfter` is not set, so
+// that it can still be inspected.
+const DefaultCleanupAfter = 24 * time.Hour
+
+// CleanupPolicy decides which finished restores are deleted.
+type CleanupPolicy string
+
 const (
-	//VeleroDir is the relative directory where snapshot chart is loaded
-	VeleroDir string = "Velero"
+	// CleanupKeep keeps every restore. Velero does not expire restores, so
+	// they have to be deleted by hand.
+	CleanupKeep CleanupPolicy = "Keep"
+	// CleanupDelete deletes every finished restore.
+	CleanupDelete CleanupPolicy = "Delete"
+	// CleanupDeleteOnSuccess deletes completed restores and keeps failed
+	// ones for inspection.
+	CleanupDeleteOnSuccess CleanupPolicy = "DeleteOnSuccess"
 )
 
-func NewRestore(client client.Client, acg helmclient.ActionClientGetter) Restore {
-	return Restore{
-		client: client,
-		acg:    acg,
-		//exec:   BckupPostHook,
-	}
+// Phase is the phase of a restore as tracked in the custom resource status.
+type Phase string
+
+const (
+	PhaseInProgress Phase = "InProgress"
+	PhaseCompleted  Phase = "Completed"
+	PhaseFailed     Phase = "Failed"
+)
+
+// Status records the most recent restore of a custom resource's release. It
+// is stored in `status.restore` so that the progress of a restore can be
+// followed across reconciliations instead of waiting for it in a single one.
+//
+// BackupName is the backup that is restored, and BackupTimestamp the time it
+// was started, if the backup was chosen by the operator. Steps records the
+// progress through the restore plan, and DisabledComponents and ScaledDown
+// what the plan has changed so far. Filter limits the restore to part of the
+// backup, if it is set. For a restore into other namespaces,
+// NamespaceMapping maps the namespaces in the backup to the ones they are
+// restored into, TargetNamespace is the namespace of the restored release
+// and CreateResource whether a copy of the custom resource is created there.
+// ReleaseStorage records how the release records restored from the backup
+// are reconciled with the release. ValuesHash identifies the restore values
+// the restore was started for, see ValuesHash. Rollback is set for the
+// restore of a pre-upgrade backup after the upgrade failed. CleanedUp is set
+// once the restore has been deleted by its cleanup policy.
+type Status struct {
+	Name                string            `json:"name"`
+	BackupName          string            `json:"backupName"`
+	BackupTimestamp     *metav1.Time      `json:"backupTimestamp,omitempty"`
+	Phase               Phase             `json:"phase"`
+	VeleroPhase         string            `json:"veleroPhase,omitempty"`
+	Message             string            `json:"message,omitempty"`
+	ObservedGeneration  int64             `json:"observedGeneration,omitempty"`
+	ValuesHash          string            `json:"valuesHash,omitempty"`
+	StartTimestamp      *metav1.Time      `json:"startTimestamp,omitempty"`
+	CompletionTimestamp *metav1.Time      `json:"completionTimestamp,omitempty"`
+	Steps               []StepStatus      `json:"steps,omitempty"`
+	DisabledComponents  []string          `json:"disabledComponents,omitempty"`
+	ScaledDown          []ScaledWorkload  `json:"scaledDown,omitempty"`
+	Filter              *Filter           `json:"filter,omitempty"`
+	NamespaceMapping    map[string]string `json:"namespaceMapping,omitempty"`
+	TargetNamespace     string            `json:"targetNamespace,omitempty"`
+	CreateResource      bool              `json:"createResource,omitempty"`
+	ReleaseStorage      *ReleaseStorage   `json:"releaseStorage,omitempty"`
+	Rollback            bool              `json:"rollback,omitempty"`
+	CleanedUp           bool              `json:"cleanedUp,omitempty"`
 }
 
-//Restore Posthook : upgrade to no postgresql, restore cr
-func (r *Restore) RestorePostHook(obj *unstructured.Unstructured, rel release.Release, log logr.Logger) error {
+// IsInProgress returns whether the restore has been started and not finished
+// yet.
+func (s *Status) IsInProgress() bool {
+	return s != nil && s.Phase == PhaseInProgress
+}
 
-	log.Info("IN restore HOOK")
+// IsClone returns whether the release is restored into another namespace
+// rather than in place.
+func (s *Status) IsClone() bool {
+	return s != nil && s.TargetNamespace != ""
+}
 
-	var vals chartutil.Values = rel.Chart.Values
-	restoreEnabled, err := vals.PathValue("restore.enabled")
-	if err != nil || restoreEnabled.(bool) == false {
-		log.Info("RESTORE DISABLED")
-		return nil
+// isFor returns whether the restore was started for the restore values of
+// vals. Restores recorded before values were hashed were started once per
+// generation of obj.
+func (s *Status) isFor(obj *unstructured.Unstructured, vals chartutil.Values) bool {
+	switch {
+	case s == nil || s.Rollback:
+		return false
+	case s.ValuesHash == "":
+		return s.ObservedGeneration == obj.GetGeneration()
 	}
+	return s.ValuesHash == ValuesHash(vals)
+}
 
-	//validate before restore
-	if !ValidateValues(rel.Chart.Values) {
-		err := errors.New("backup and restore cannot be enabled simultaneously")
-		log.Error(err, "please choose a single operation")
-		return err
+// IsFinished returns whether the restore has reached a terminal phase.
+func (s *Status) IsFinished() bool {
+	return s != nil && (s.Phase == PhaseCompleted || s.Phase == PhaseFailed)
+}
+
+// StatusFor returns the restore status recorded in obj, or nil if none has
+// been recorded yet.
+func StatusFor(obj *unstructured.Unstructured) *Status {
+	if obj == nil {
+		return nil
+	}
+	m, ok, err := unstructured.NestedMap(obj.Object, "status", "restore")
+	if err != nil || !ok {
+		return nil
+	}
+	st := &Status{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(m, st); err != nil {
+		return nil
 	}
+	return st
+}
 
-	acf, err := r.acg.ActionClientFor(obj)
-	if err != nil {
-		log.Error(err, "unable to create acf")
-		return err
+type Restore struct {
+	provider backup.BackupProvider
+	acg      helmclient.ActionClientGetter
+	client   client.Client
+	metrics  *backup.Metrics
+}
+
+// NewRestore returns a Restore that restores backups with provider, changes
+// the release for the steps of the restore plan with acg and client, and
+// records finished restores in metrics, which may be nil.
+func NewRestore(provider backup.BackupProvider, acg helmclient.ActionClientGetter, client client.Client, metrics *backup.Metrics) Restore {
+	return Restore{
+		provider: provider,
+		acg:      acg,
+		client:   client,
+		metrics:  metrics,
 	}
-	postgresEnabled, err := vals.PathValue("postgres.enabled")
-	if err == nil && postgresEnabled.(bool) == true {
-		postgresMap := map[string]interface{}{
-			"postgresql": map[string]interface{}{
-				"enabled": false,
-			},
+}
+
+// Reconcile moves the restore of the release of obj forward and returns the
+// resulting status, along with how long to wait before the next step is due.
+// It never waits for the restore itself:
+//
+//   - If `restore.enabled` is set and no restore has been started for the
+//     current restore values yet, a restore is started and the steps of its
+//     plan are run until one of them has to wait. Changes to the rest of the
+//     spec of obj do not start another restore. To restore the same values
+//     again, `restore.enabled` has to be unset in between.
+//   - If a restore is in progress, the steps of its plan are run from where
+//     they stopped. The release records restored from the backup are
+//     reconciled as soon as the Velero restore has completed, so that the
+//     release is not reinstalled or upgraded over the restored objects.
+//     Once all of the steps have finished, the components and
+//     workloads the plan disabled or scaled down are restored, and the
+//     status is moved to Completed when the release is healthy again. It is
+//     moved to Failed if a step fails or the release does not become healthy
+//     in time.
+//   - If a finished restore is due to be deleted by its cleanup policy, it
+//     is deleted.
+//
+// Every restore gets a unique name derived from obj, its generation and the
+// time it was started, so that restores of different custom resources, or several
+// restores of the same one, never collide. A nil status means no restore has
+// been requested.
+func (r *Restore) Reconcile(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) (*Status, time.Duration, error) {
+	st := StatusFor(obj)
+	if st.IsInProgress() {
+		if len(st.Steps) == 0 {
+			// Restores started before plans were introduced only
+			// consist of the Velero restore.
+			st.Steps = []StepStatus{{Step: Step{Type: StepRestore}, Phase: StepInProgress, StartTimestamp: st.StartTimestamp}}
+			if st.VeleroPhase == "" {
+				st.VeleroPhase = backup.VeleroPhaseNew
+			}
 		}
-		semrel, err := acf.Upgrade(rel.Name, rel.Namespace, rel.Chart, postgresMap)
-		if err != nil {
-			log.Error(err, "failed to update matrix")
-			return err
+		if st.Rollback {
+			vals = releaseValues(rel, vals)
 		}
-		log.Info(fmt.Sprintf("release: %+v", semrel.Info))
-	}
-	u, err := createRestoreCR(rel.Chart.Values, log)
-	if err != nil {
-		return err
+		return r.runSteps(ctx, obj, rel, vals, st, log)
 	}
 
-	err = r.client.Create(context.Background(), u)
+	policy, cleanupAfter, err := cleanupPolicyFor(vals)
 	if err != nil {
-		log.Error(err, "unable to create Restore CR")
-		return err
+		return st, 0, err
 	}
-	u1 := &unstructured.Unstructured{}
-	u1.SetGroupVersionKind(schema.GroupVersionKind{
-		Group:   "velero.io",
-		Kind:    "Restore",
-		Version: "v1",
-	})
-
-	for {
-		r.client.Get(context.TODO(), client.ObjectKey{
-			Namespace: "default",
-			Name:      "matrix-restore",
-		}, u1)
-		//log.Info(fmt.Sprintf("restore: %v", u1))
-
-		/*for k := range u1.Object {
-			log.Info(fmt.Sprintf("keys: %+v", k))
-		}*/
-
-		//log.Info(fmt.Sprintf("status: %v", u1.Object["status"]))
-		if u1.Object["status"] != nil {
-			status := u1.Object["status"].(map[string]interface{})
-			//log.Info(fmt.Sprintf("phase: %v", status["phase"]))
-			if status["phase"] == "Completed" {
-				log.Info("Restore Completed. Cleaning up Restore CR")
-				r.client.Delete(context.TODO(), u1)
-				break
-			}
+	if !isEnabled(vals, "restore.enabled") {
+		if st != nil && st.ValuesHash != "" {
+			// Enabling the restore again restores again.
+			st.ValuesHash = ""
 		}
+		return r.cleanup(ctx, st, policy, cleanupAfter, log)
 	}
-	//} // if restore enabled
-
-	//}
-	return nil
-
-}
-
-func createRestoreCR(vals chartutil.Values, log logr.Logger) (*unstructured.Unstructured, error) {
-
-	//v := vals.AsMap()
-
-	//log.Info(fmt.Sprintf("created %+v", v))
-
-	backupName, err := vals.PathValue("restore.backupName")
-	if err != nil || backupName == "" {
-		log.Error(err, "Please provide a valid restore.backupName in the CR")
-		return nil, err
+	if st.isFor(obj, vals) {
+		return r.cleanup(ctx, st, policy, cleanupAfter, log)
 	}
 
-	u := &unstructured.Unstructured{}
-	u.SetGroupVersionKind(schema.GroupVersionKind{
-		Group:   "velero.io",
-		Kind:    "Restore",
-		Version: "v1",
-	})
-
-	u.Object = map[string]interface{}{
-		"apiVersion": "velero.io/v1",
-		"kind":       "Restore",
-		"metadata": map[string]interface{}{
-			"name":      "matrix-restore",
-			"namespace": "default",
-		},
-		"spec": map[string]interface{}{
-			"backupName": backupName.(string),
-			"excludedResources": []interface{}{
-				"nodes",
-				"events",
-				"events.events.k8s.io",
-				"backups.velero.io",
-				"restores.velero.io",
-				"resticrepositories.velero.io",
-			},
-			"restorePVs": true,
-		},
-	}
-
-	return u, nil
-}
-
-func ValidateValues(vals chartutil.Values) bool {
-
-	restore, err := vals.PathValue("restore.enabled")
+	// The restore of earlier values is replaced in the status, so it is
+	// cleaned up now rather than forgotten.
+	if _, _, err := r.cleanup(ctx, st, policy, 0, log); err != nil {
+		return st, 0, err
+	}
+	settings, err := settingsFor(obj, rel, vals)
 	if err != nil {
-		return true
+		return st, 0, err
 	}
-	log.Info(fmt.Sprintf("restore e: %v", restore.(bool)))
-	backup, err := vals.PathValue("backup.enabled")
+	source, err := r.backupFor(ctx, obj, vals)
 	if err != nil {
-		return true
+		return st, 0, err
 	}
-	log.Info(fmt.Sprintf("backup e: %v", backup.(bool)))
-	if restore.(bool) == true && backup.(bool) == true {
-		return false
+	st, requeueAfter, err := r.start(ctx, obj, rel, vals, source, settings, log)
+	if st != nil {
+		st.ValuesHash = ValuesHash(vals)
 	}
-
-	return true
-
+	return st, requeueAfter, err
 }
 
-//TODO: Remove comment blob on cleanup
-/*
-//RestorePostHook restores matrix to a previously backed release
-func (r *Restore) RestorePreHook(obj *unstructured.Unstructured, val chartutil.Values, log logr.Logger) error {
-
-	log.Info("IN restore HOOK")
-
-	acf, err := r.acg.ActionClientFor(obj)
+// ignoredValues are the restore values that do not change what is restored,
+// so that changing them does not start another restore.
+var ignoredValues = []string{"enabled", "cleanupPolicy", "cleanupAfter", "healthTimeout"}
+
+// ValuesHash returns a hash of the restore values of vals that decide what is
+// restored and how. A restore is started once for every hash.
+func ValuesHash(vals chartutil.Values) string {
+	restoreVals, _ := vals.Table("restore")
+	m := map[string]interface{}{}
+	for k, v := range restoreVals {
+		m[k] = v
+	}
+	for _, k := range ignoredValues {
+		delete(m, k)
+	}
+	// Maps are marshalled with sorted keys, so equal values hash equally.
+	data, err := json.Marshal(m)
 	if err != nil {
-		log.Error(err, "unable to create acf")
-		return err
+		data = []byte(fmt.Sprint(m))
 	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16]
+}
 
-	acf.Upgrade()
-
-
-	_, err = launchVelero(val, acf, log)
+// Rollback starts a restore in place of the pre-upgrade backup named
+// backupName after an upgrade of rel failed, replacing a finished restore
+// recorded in obj. It follows RollbackPlan and is then moved forward by
+// Reconcile like any other restore. The steps of the plan upgrade the
+// release with its own values rather than with vals, so that the failed
+// upgrade is not repeated before the restore has finished.
+func (r *Restore) Rollback(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, backupName string, log logr.Logger) (*Status, time.Duration, error) {
+	st := StatusFor(obj)
+	if st.IsInProgress() {
+		return st, 0, fmt.Errorf("restore %q is still in progress", st.Name)
+	}
+	policy, _, err := cleanupPolicyFor(vals)
 	if err != nil {
-		//log.Error(err, "Failed to load velero chart")
-		return err
-	}*/
-/*
-			u := createRestoreCR(val, log)
-
-			err := r.client.Create(context.Background(), u)
-			if err != nil {
-				log.Error(err, "unable to create 37")
-			}
-
-
-		log.Info(fmt.Sprintf("new restore: %v", u))
-
-	* /
-	return nil
+		return st, 0, err
+	}
+	storage, err := releaseStoragePolicyFor(vals)
+	if err != nil {
+		return st, 0, err
+	}
+	if _, _, err := r.cleanup(ctx, st, policy, 0, log); err != nil {
+		return st, 0, err
+	}
+	st, requeueAfter, err := r.start(ctx, obj, rel, releaseValues(rel, vals), &backup.Summary{Name: backupName}, settings{plan: RollbackPlan(), storage: storage}, log)
+	if st != nil {
+		st.Rollback = true
+	}
+	return st, requeueAfter, err
 }
 
-
-/*
-//Load Chart
-func launchVelero(vals chartutil.Values, acf helmclient.ActionInterface, log logr.Logger) (*release.Release, error) {
-	//log.Info(fmt.Sprintf("values: %+v", velero))
-	v := vals.AsMap()
-	//log.Info(fmt.Sprintf("velero values: %+v", v))
-
-	for k := range v {
-		log.Info(fmt.Sprintf("keys: %+v", k))
+// releaseValues returns the values rel was installed with, along with the
+// defaults of its chart, or vals if rel is not known.
+func releaseValues(rel *release.Release, vals chartutil.Values) chartutil.Values {
+	if rel == nil || rel.Chart == nil {
+		return vals
 	}
-
-	log.Info(fmt.Sprintf("velero: %+v", v["velero"]))
-
-	//acf.Install("velero-restore", "")
-
-	vMap := v["velero"]
-	log.Info(fmt.Sprintf("type: %+v", reflect.TypeOf(vMap)))
-
-
-	velMap := vMap.(map[string]interface{})
-
-	//config := velMap["configuration"]
-	//credentials := velMap["credentials"]
-	//log.Info(fmt.Sprintf("config: %+v", config))
-
-	//chart, err := loadChart(log)
-	chart, err := LoadSnapshotChart(log)
+	relVals, err := chartutil.CoalesceValues(rel.Chart, rel.Config)
 	if err != nil {
-		log.Error(err, "Failed to load velero chart")
-		return nil, err
+		return vals
 	}
-	log.Info(fmt.Sprintf("chart: %+v", chart.Name()))
-	log.Info(fmt.Sprintf("chart-metadata: %+v", chart.Metadata))
-
-	/*
-		annotation := make(map[string]string)
+	return relVals
+}
 
-		annotation["meta.helm.sh/release-name"] = "velero"
-		annotation["meta.helm.sh/release-namespace"] = "default"
-		chart.Metadata.Annotations = annotation
+// settings are the values a restore is started with.
+type settings struct {
+	clone   clonePolicy
+	filter  *Filter
+	plan    []Step
+	storage ReleaseStoragePolicy
+}
 
-		log.Info(fmt.Sprintf("annotation : %+v", chart.Metadata.Annotations))
-	*
+// settingsFor reads the settings of a restore of rel from vals and checks
+// the values that are only used later on. Without `restore.plan`, a
+// restore consists of the Velero restore only if it is into other
+// namespaces, follows ComponentPlan if it is limited to components, and
+// DefaultPlan otherwise.
+func settingsFor(obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values) (settings, error) {
+	var s settings
+	// A backup taken during the restore would be of a release that is
+	// being replaced.
+	if isEnabled(vals, "backup.enabled") {
+		return s, invalidValuesError("restore", "backup and restore cannot be enabled simultaneously")
+	}
+	if _, _, err := backupSelectorFor(vals); err != nil {
+		return s, err
+	}
+	var err error
+	if s.clone, err = clonePolicyFor(obj, rel, vals); err != nil {
+		return s, err
+	}
+	if s.filter, err = filterFor(vals); err != nil {
+		return s, err
+	}
+	if s.plan, err = planFor(vals); err != nil {
+		return s, err
+	}
+	if s.plan == nil {
+		switch {
+		case len(s.clone.namespaceMapping) > 0:
+			s.plan = []Step{{Type: StepRestore}}
+		case s.filter != nil && len(s.filter.Components) > 0:
+			s.plan = ComponentPlan(s.filter.Components)
+		default:
+			s.plan = DefaultPlan()
+		}
+	}
+	if err := checkPlanComponents(s.plan, s.filter, s.clone, vals); err != nil {
+		return s, err
+	}
+	if _, err := healthTimeoutFor(vals); err != nil {
+		return s, err
+	}
+	if s.storage, err = releaseStoragePolicyFor(vals); err != nil {
+		return s, err
+	}
+	return s, nil
+}
 
-	/*rel, err := acf.Install("velero", "", chart, velMap)
+// start starts a restore of rel from the backup source with settings. The
+// plan is recorded in the status, and its steps are run until one of them has
+// to wait.
+func (r *Restore) start(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, source *backup.Summary, s settings, log logr.Logger) (*Status, time.Duration, error) {
+	name := backup.ObjectName("matrix-restore", obj.GetNamespace(), obj.GetName(), strconv.FormatInt(obj.GetGeneration(), 10), time.Now().UTC().Format("20060102150405"))
+	now := metav1.Now().Rfc3339Copy()
+	st := &Status{
+		Name:               name,
+		BackupName:         source.Name,
+		BackupTimestamp:    source.StartTimestamp,
+		Phase:              PhaseInProgress,
+		ObservedGeneration: obj.GetGeneration(),
+		StartTimestamp:     &now,
+		Filter:             s.filter,
+		NamespaceMapping:   s.clone.namespaceMapping,
+		TargetNamespace:    s.clone.namespaceMapping[backup.ReleaseNamespace(obj, rel)],
+		CreateResource:     s.clone.createResource,
+		ReleaseStorage:     &ReleaseStorage{Policy: s.storage},
+	}
+	for _, step := range s.plan {
+		st.Steps = append(st.Steps, StepStatus{Step: step, Phase: StepPending})
+	}
+	log.Info("Restore started", "restore", name, "backup", source.Name, "steps", len(st.Steps))
+	return r.runSteps(ctx, obj, rel, vals, st, log)
+}
 
+// backupFor returns the backup to restore the release of obj from. It is
+// chosen by the following values:
+//
+//   - restore.backupName - the name of the backup.
+//   - restore.fromTimestamp - an RFC 3339 time; the newest completed backup
+//     of the release that was started no later than this time is restored.
+//
+// If neither is set, the newest completed backup of the release is restored.
+// Only the name is known of a backup chosen by restore.backupName.
+func (r *Restore) backupFor(ctx context.Context, obj *unstructured.Unstructured, vals chartutil.Values) (*backup.Summary, error) {
+	name, before, err := backupSelectorFor(vals)
 	if err != nil {
-		log.Error(err, "Failed to install velero chart")
 		return nil, err
 	}
-	*
-	settings := helmcli.New()
-
-	actionConfig := new(action.Configuration)
-
-	if err := actionConfig.Init(settings.RESTClientGetter(), "", os.Getenv("HELM_DRIVER"), lg.Printf); err != nil {
-		return nil, err
+	if name != "" {
+		return &backup.Summary{Name: name}, nil
 	}
-
-	installer := action.NewInstall(actionConfig)
-	//installer.Namespace = "default"
-	installer.ReleaseName = "velero"
-
-	rel, err := installer.Run(chart, velMap)
+	summaries, err := r.provider.List(ctx, obj)
 	if err != nil {
-		log.Error(err, "failed to install velero")
 		return nil, err
 	}
-
-	log.Info(fmt.Sprintf("release: %+v", rel))
-
-	return nil, nil
-
+	latest := backup.LatestCompleted(summaries, before)
+	if latest == nil {
+		if !before.IsZero() {
+			return nil, fmt.Errorf("%w: no completed backup of %q started before %s", ErrNoBackup, obj.GetName(), before.Format(time.RFC3339))
+		}
+		return nil, fmt.Errorf("%w: no completed backup of %q found", ErrNoBackup, obj.GetName())
+	}
+	return latest, nil
 }
 
-
-func loadChart(log logr.Logger) (*chart.Chart, error) {
-	projectDir, err := os.Getwd()
+// backupSelectorFor returns the backup name or the time before which the
+// newest backup is restored, as read by backupFor.
+func backupSelectorFor(vals chartutil.Values) (string, time.Time, error) {
+	var before time.Time
+	name, err := stringValue(vals, "restore.backupName")
 	if err != nil {
-		return nil, err
+		return "", before, err
 	}
-
-	//var HelmChartsDir string = "helm-charts/matrix"
-	//var dependencies string = "charts"
-	var chartPath string = "helm-charts/matrix/charts/velero-2.12.0.tgz"
-	velChartPath := filepath.Join(projectDir, chartPath)
-
-	chart, err := loader.Load(velChartPath)
-	//log.Info(fmt.Sprintf("chart: %+v", chart.Files))
-
-	return chart, nil
+	from, err := stringValue(vals, "restore.fromTimestamp")
+	if err != nil {
+		return "", before, err
+	}
+	if name != "" && from != "" {
+		return "", before, invalidValuesError("restore.fromTimestamp", "cannot be set together with restore.backupName")
+	}
+	if from != "" {
+		if before, err = time.Parse(time.RFC3339, from); err != nil {
+			return "", before, invalidValuesError("restore.fromTimestamp", "must be an RFC 3339 time, got %q", from)
+		}
+	}
+	return name, before, nil
 }
 
-
-//Load Snapshot Chart
-func LoadSnapshotChart(log logr.Logger) (*chart.Chart, error) {
-
-	log.Info("Attempt to load snapshot chart")
-
-	settings := helmcli.New()
-	getters := getter.All(settings)
-	c := downloader.ChartDownloader{
-		Out:              os.Stderr,
-		Getters:          getters,
-		RepositoryConfig: settings.RepositoryConfig,
-		RepositoryCache:  settings.RepositoryCache,
+// finish moves the restore recorded in st to phase. A restore that did not
+// fail in the Velero restore itself is recorded in the metrics without a
+// Velero phase.
+func (r *Restore) finish(obj *unstructured.Unstructured, st *Status, phase Phase, message string, log logr.Logger) *Status {
+	now := metav1.Now().Rfc3339Copy()
+	st.Phase = phase
+	st.Message = message
+	st.CompletionTimestamp = &now
+	if st.StartTimestamp != nil {
+		veleroPhase := st.VeleroPhase
+		switch {
+		case phase == PhaseCompleted:
+			veleroPhase = backup.VeleroPhaseCompleted
+		case veleroPhase != backup.VeleroPhasePartiallyFailed && veleroPhase != backup.VeleroPhaseFailed && veleroPhase != backup.VeleroPhaseFailedValidation:
+			veleroPhase = ""
+		}
+		r.metrics.ObserveRestore(obj, veleroPhase, now.Sub(st.StartTimestamp.Time))
 	}
+	log.Info("Restore finished", "restore", st.Name, "phase", phase, "message", message)
+	return st
+}
 
-	chartURL, err := repo.FindChartInRepoURL("https://vmware-tanzu.github.io/helm-charts", "velero", "2.12.0", "", "", "", getters)
-	if err != nil {
-		return nil, err
+// cleanup deletes the finished restore recorded in st if policy asks for it
+// and it finished at least cleanupAfter ago. Otherwise it returns how long
+// to wait until it is due.
+func (r *Restore) cleanup(ctx context.Context, st *Status, policy CleanupPolicy, cleanupAfter time.Duration, log logr.Logger) (*Status, time.Duration, error) {
+	if !st.IsFinished() || st.CleanedUp {
+		return st, 0, nil
 	}
-
-	tmpDir, err := ioutil.TempDir("", "velero-helm-chart")
-	if err != nil {
-		return nil, err
+	if policy == CleanupKeep || (policy == CleanupDeleteOnSuccess && st.Phase != PhaseCompleted) {
+		return st, 0, nil
 	}
-	defer func() {
-		if err := os.RemoveAll(tmpDir); err != nil {
-			//log.Errorf("Failed to remove temporary directory %s: %s", tmpDir, err)
-			log.Error(err, fmt.Sprintf("Failed to remove temporary directory %s: %s", tmpDir, err))
+	if st.CompletionTimestamp != nil {
+		if wait := cleanupAfter - time.Since(st.CompletionTimestamp.Time); wait > 0 {
+			return st, wait, nil
 		}
-	}()
+	}
+	if err := r.provider.DeleteRestore(ctx, st.Name); err != nil {
+		return st, 0, err
+	}
+	log.Info("Restore deleted", "restore", st.Name, "policy", policy)
+	st.CleanedUp = true
+	return st, 0, nil
+}
 
-	chartArchive, _, err := c.DownloadTo(chartURL, "2.12.0", tmpDir)
-	if err != nil {
-		return nil, err
+// cleanupPolicyFor reads the cleanup policy of finished restores from the
+// following values:
+//
+//   - restore.cleanupPolicy - Keep, Delete or DeleteOnSuccess (default
+//     Keep).
+//   - restore.cleanupAfter - how long a finished restore is kept before it
+//     is deleted, as a duration string (default 24h).
+func cleanupPolicyFor(vals chartutil.Values) (CleanupPolicy, time.Duration, error) {
+	policy, cleanupAfter := CleanupKeep, DefaultCleanupAfter
+	if v, err := vals.PathValue("restore.cleanupPolicy"); err == nil && v != nil && v != "" {
+		switch p := CleanupPolicy(fmt.Sprint(v)); p {
+		case CleanupKeep, CleanupDelete, CleanupDeleteOnSuccess:
+			policy = p
+		default:
+			return policy, 0, invalidValuesError("restore.cleanupPolicy", "must be one of %s, %s or %s, got %v", CleanupKeep, CleanupDelete, CleanupDeleteOnSuccess, v)
+		}
 	}
+	if v, err := vals.PathValue("restore.cleanupAfter"); err == nil && v != nil && v != "" {
+		s, _ := v.(string)
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return policy, 0, invalidValuesError("restore.cleanupAfter", "must be a non-negative duration, got %v", v)
+		}
+		cleanupAfter = d
+	}
+	return policy, cleanupAfter, nil
+}
 
-	chart, err := loader.Load(chartArchive)
+func isEnabled(vals chartutil.Values, path string) bool {
+	v, err := vals.PathValue(path)
 	if err != nil {
-		return nil, err
+		return false
 	}
+	enabled, ok := v.(bool)
+	return ok && enabled
+}
 
-	//save chart to snapshot dir
-	if err := chartutil.SaveDir(chart, SnapshotDir); err != nil {
-		return nil, err
+// stringValue returns the string at path, or "" if it is not set.
+func stringValue(vals chartutil.Values, path string) (string, error) {
+	v, err := vals.PathValue(path)
+	if err != nil || v == nil {
+		return "", nil
 	}
+	s, ok := v.(string)
+	if !ok {
+		return "", invalidValuesError(path, "must be a string, got %v", v)
+	}
+	return s, nil
+}
 
-	log.Info("loaded velero chart")
-
-	return chart, nil
-
+// ValidateValues checks the restore values of obj without looking at the
+// cluster, so that a custom resource that could never be restored can be
+// rejected before it is admitted. The restore settings are only checked if
+// `restore.enabled` is set. The returned error wraps ErrInvalidValues.
+func ValidateValues(obj *unstructured.Unstructured, vals chartutil.Values) error {
+	if _, _, err := cleanupPolicyFor(vals); err != nil {
+		return err
+	}
+	if !isEnabled(vals, "restore.enabled") {
+		return nil
+	}
+	_, err := settingsFor(obj, nil, vals)
+	return err
 }
 
-const (
-	//SnapshotDir is the relative directory where snapshot chart is loaded
-	SnapshotDir string = "velero"
-)
-*/
+// Validate checks the restore values of obj like ValidateValues. If they
+// request a new restore, i.e. obj is new or the restore recorded in old was
+// not started for them, it also makes sure that a backup to restore can be
+// chosen, and otherwise requires `restore.backupName`.
+func (r *Restore) Validate(ctx context.Context, obj, old *unstructured.Unstructured, vals chartutil.Values) error {
+	if err := ValidateValues(obj, vals); err != nil {
+		return err
+	}
+	if !isEnabled(vals, "restore.enabled") {
+		return nil
+	}
+	if old != nil && (equality.Semantic.DeepEqual(old.Object["spec"], obj.Object["spec"]) || StatusFor(old).isFor(old, vals)) {
+		return nil
+	}
+	_, err := r.backupFor(ctx, obj, vals)
+	if errors.Is(err, ErrNoBackup) {
+		return invalidValuesError("restore.backupName", "required (%s)", strings.TrimPrefix(err.Error(), ErrNoBackup.Error()+": "))
+	}
+	return err
+}
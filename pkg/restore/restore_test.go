@@ -0,0 +1,1173 @@
+package restore_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+	helmclient "github.com/joelanford/helm-operator/pkg/client"
+	"github.com/joelanford/helm-operator/pkg/restore"
+)
+
+// fakeActionClient records the values of the upgrades done by a restore
+// plan. Its other methods are not used by restores.
+type fakeActionClient struct {
+	helmclient.ActionInterface
+	manifest string
+	upgrades []map[string]interface{}
+}
+
+func (c *fakeActionClient) Upgrade(name, namespace string, chrt *chart.Chart, vals map[string]interface{}, _ ...helmclient.UpgradeOption) (*release.Release, error) {
+	c.upgrades = append(c.upgrades, vals)
+	return &release.Release{Name: name, Namespace: namespace, Chart: chrt, Config: vals, Manifest: c.manifest}, nil
+}
+
+var _ = Describe("Restore", func() {
+	var (
+		cl   client.Client
+		ac   *fakeActionClient
+		acg  helmclient.ActionClientGetter
+		r    restore.Restore
+		obj  *unstructured.Unstructured
+		rel  *release.Release
+		vals chartutil.Values
+	)
+
+	BeforeEach(func() {
+		// The fake client cannot list Velero objects or release records
+		// unless their list kind is registered.
+		sch := runtime.NewScheme()
+		sch.AddKnownTypeWithName(schema.GroupVersionKind{Group: "velero.io", Version: "v1", Kind: "BackupList"}, &unstructured.UnstructuredList{})
+		sch.AddKnownTypeWithName(schema.GroupVersionKind{Version: "v1", Kind: "SecretList"}, &unstructured.UnstructuredList{})
+		sch.AddKnownTypeWithName(schema.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaimList"}, &unstructured.UnstructuredList{})
+		cl = fake.NewFakeClientWithScheme(sch)
+		ac = &fakeActionClient{}
+		acg = helmclient.ActionClientGetterFunc(func(helmclient.Object) (helmclient.ActionInterface, error) { return ac, nil })
+		r = restore.NewRestore(backup.NewVeleroProvider(cl, "velero"), acg, cl, nil)
+		obj = &unstructured.Unstructured{}
+		obj.SetName("test")
+		obj.SetNamespace("matrix")
+		obj.SetGeneration(1)
+		rel = &release.Release{Name: "test", Namespace: "matrix", Version: 1}
+		vals = chartutil.Values{"restore": map[string]interface{}{"enabled": true, "backupName": "first"}}
+	})
+
+	setStatus := func(st *restore.Status) {
+		m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(st)
+		Expect(err).To(BeNil())
+		Expect(unstructured.SetNestedMap(obj.Object, m, "status", "restore")).To(Succeed())
+	}
+
+	getRestore := func(name string) (*unstructured.Unstructured, error) {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("velero.io/v1")
+		u.SetKind("Restore")
+		err := cl.Get(context.TODO(), client.ObjectKey{Namespace: "velero", Name: name}, u)
+		return u, err
+	}
+
+	setVeleroPhase := func(name, phase string) {
+		u, err := getRestore(name)
+		Expect(err).To(BeNil())
+		Expect(unstructured.SetNestedField(u.Object, phase, "status", "phase")).To(Succeed())
+		Expect(cl.Update(context.TODO(), u)).To(Succeed())
+	}
+
+	It("should do nothing unless a restore is enabled", func() {
+		st, requeueAfter, err := r.Reconcile(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st).To(BeNil())
+		Expect(requeueAfter).To(BeZero())
+	})
+
+	It("should start a uniquely named restore without waiting for it", func() {
+		st, requeueAfter, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(Equal(restore.DefaultPollInterval))
+		Expect(st.Phase).To(Equal(restore.PhaseInProgress))
+		Expect(st.Name).To(HavePrefix("matrix-restore-matrix-test-1-"))
+		Expect(st.BackupName).To(Equal("first"))
+		Expect(st.ObservedGeneration).To(Equal(int64(1)))
+		Expect(st.StartTimestamp).NotTo(BeNil())
+
+		u, err := getRestore(st.Name)
+		Expect(err).To(BeNil())
+		Expect(u.GetLabels()).To(HaveKeyWithValue(backup.ReleaseNameLabel, "test"))
+		Expect(u.Object["spec"].(map[string]interface{})["backupName"]).To(Equal("first"))
+	})
+
+	It("should follow the restore across reconciliations", func() {
+		st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+
+		again, requeueAfter, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(again.Name).To(Equal(st.Name))
+		Expect(again.Phase).To(Equal(restore.PhaseInProgress))
+		Expect(requeueAfter).To(Equal(restore.DefaultPollInterval))
+
+		setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+		again, requeueAfter, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(again.Phase).To(Equal(restore.PhaseCompleted))
+		Expect(again.CompletionTimestamp).NotTo(BeNil())
+		Expect(requeueAfter).To(BeZero())
+
+		// The values have been restored, so they are not restored again.
+		setStatus(again)
+		again, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(again.Name).To(Equal(st.Name))
+	})
+
+	var _ = Describe("trigger", func() {
+		var st *restore.Status
+
+		BeforeEach(func() {
+			var err error
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			st.Phase = restore.PhaseCompleted
+			setStatus(st)
+		})
+
+		It("should not restore again when the rest of the spec changes", func() {
+			obj.SetGeneration(2)
+			vals["image"] = map[string]interface{}{"tag": "v2"}
+			vals["restore"].(map[string]interface{})["cleanupPolicy"] = "Delete"
+			again, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(again.Name).To(Equal(st.Name))
+			Expect(again.Phase).To(Equal(restore.PhaseCompleted))
+		})
+
+		It("should restore again when the restore values change", func() {
+			obj.SetGeneration(2)
+			vals["restore"].(map[string]interface{})["backupName"] = "second"
+			again, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(again.Name).NotTo(Equal(st.Name))
+			Expect(again.BackupName).To(Equal("second"))
+			Expect(again.Phase).To(Equal(restore.PhaseInProgress))
+		})
+
+		It("should restore the same values again once the restore was disabled", func() {
+			obj.SetGeneration(2)
+			vals["restore"].(map[string]interface{})["enabled"] = false
+			again, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(again.ValuesHash).To(BeEmpty())
+			setStatus(again)
+
+			obj.SetGeneration(3)
+			vals["restore"].(map[string]interface{})["enabled"] = true
+			again, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(again.Name).NotTo(Equal(st.Name))
+			Expect(again.Phase).To(Equal(restore.PhaseInProgress))
+		})
+
+		It("should treat restores recorded without a hash as restores of their generation", func() {
+			st.ValuesHash = ""
+			setStatus(st)
+			again, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(again.Name).To(Equal(st.Name))
+
+			obj.SetGeneration(2)
+			again, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(again.Name).NotTo(Equal(st.Name))
+		})
+	})
+
+	It("should fail on Velero failure phases", func() {
+		for _, phase := range []string{backup.VeleroPhasePartiallyFailed, backup.VeleroPhaseFailed, backup.VeleroPhaseFailedValidation} {
+			name := "matrix-restore-test-" + phase
+			Expect(cl.Create(context.TODO(), &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "velero.io/v1",
+				"kind":       "Restore",
+				"metadata":   map[string]interface{}{"name": name, "namespace": "velero"},
+				"status":     map[string]interface{}{"phase": phase},
+			}})).To(Succeed())
+			setStatus(&restore.Status{Name: name, BackupName: "first", Phase: restore.PhaseInProgress, ObservedGeneration: 1})
+
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Phase).To(Equal(restore.PhaseFailed))
+			Expect(st.VeleroPhase).To(Equal(phase))
+			Expect(st.Message).To(ContainSubstring(phase))
+		}
+	})
+
+	It("should fail if the restore disappeared", func() {
+		setStatus(&restore.Status{Name: "gone", BackupName: "first", Phase: restore.PhaseInProgress, ObservedGeneration: 1})
+		st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(restore.PhaseFailed))
+	})
+
+	var _ = Describe("backup selection", func() {
+		createBackup := func(name, phase, start string, labels map[string]string) {
+			u := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "velero.io/v1",
+				"kind":       "Backup",
+				"metadata":   map[string]interface{}{"name": name, "namespace": "velero"},
+				"status":     map[string]interface{}{"phase": phase, "startTimestamp": start},
+			}}
+			u.SetLabels(labels)
+			Expect(cl.Create(context.TODO(), u)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			releaseLabels := map[string]string{backup.ReleaseNameLabel: "test", backup.ReleaseNamespaceLabel: "matrix"}
+			createBackup("monday", backup.VeleroPhaseCompleted, "2020-01-06T03:00:00Z", releaseLabels)
+			createBackup("tuesday", backup.VeleroPhaseCompleted, "2020-01-07T03:00:00Z", releaseLabels)
+			createBackup("wednesday", backup.VeleroPhaseFailed, "2020-01-08T03:00:00Z", releaseLabels)
+			createBackup("other", backup.VeleroPhaseCompleted, "2020-01-09T03:00:00Z", map[string]string{backup.ReleaseNameLabel: "other", backup.ReleaseNamespaceLabel: "matrix"})
+			delete(vals["restore"].(map[string]interface{}), "backupName")
+		})
+
+		It("should restore the newest completed backup of the release", func() {
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.BackupName).To(Equal("tuesday"))
+			Expect(st.BackupTimestamp.UTC()).To(Equal(time.Date(2020, 1, 7, 3, 0, 0, 0, time.UTC)))
+
+			u, err := getRestore(st.Name)
+			Expect(err).To(BeNil())
+			Expect(u.Object["spec"].(map[string]interface{})["backupName"]).To(Equal("tuesday"))
+		})
+
+		It("should restore the newest completed backup before fromTimestamp", func() {
+			vals["restore"].(map[string]interface{})["fromTimestamp"] = "2020-01-07T00:00:00Z"
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.BackupName).To(Equal("monday"))
+		})
+
+		It("should fail without a matching backup", func() {
+			vals["restore"].(map[string]interface{})["fromTimestamp"] = "2020-01-01T00:00:00Z"
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(MatchError(ContainSubstring("no completed backup")))
+			Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeFalse())
+			Expect(st).To(BeNil())
+		})
+
+		It("should only require a backup name if no backup can be chosen", func() {
+			Expect(r.Validate(context.TODO(), obj, nil, vals)).To(Succeed())
+
+			vals["restore"].(map[string]interface{})["fromTimestamp"] = "2020-01-01T00:00:00Z"
+			err := r.Validate(context.TODO(), obj, nil, vals)
+			Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue())
+			Expect(err).To(MatchError(`invalid restore values: restore.backupName: required (no completed backup of "test" started before 2020-01-01T00:00:00Z)`))
+
+			// Restores that were already requested are not checked again,
+			// as their backups may have expired since.
+			Expect(r.Validate(context.TODO(), obj, obj.DeepCopy(), vals)).To(Succeed())
+
+			delete(vals["restore"].(map[string]interface{}), "fromTimestamp")
+			vals["restore"].(map[string]interface{})["backupName"] = "expired"
+			Expect(r.Validate(context.TODO(), obj, nil, vals)).To(Succeed())
+		})
+
+		It("should reject an invalid fromTimestamp", func() {
+			vals["restore"].(map[string]interface{})["fromTimestamp"] = "yesterday"
+			_, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue())
+
+			vals["restore"].(map[string]interface{})["fromTimestamp"] = "2020-01-07T00:00:00Z"
+			vals["restore"].(map[string]interface{})["backupName"] = "monday"
+			_, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue())
+		})
+	})
+
+	var _ = Describe("plan", func() {
+		const manifest = `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: synapse
+spec:
+  replicas: 3
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: synapse
+`
+
+		getDeployment := func() *unstructured.Unstructured {
+			u := &unstructured.Unstructured{}
+			u.SetAPIVersion("apps/v1")
+			u.SetKind("Deployment")
+			Expect(cl.Get(context.TODO(), client.ObjectKey{Namespace: "matrix", Name: "synapse"}, u)).To(Succeed())
+			return u
+		}
+
+		setReadyReplicas := func(n int64) {
+			u := getDeployment()
+			Expect(unstructured.SetNestedField(u.Object, n, "status", "readyReplicas")).To(Succeed())
+			Expect(cl.Update(context.TODO(), u)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			rel.Manifest = manifest
+			ac.manifest = manifest
+			Expect(cl.Create(context.TODO(), &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "synapse", "namespace": "matrix"},
+				"spec":       map[string]interface{}{"replicas": int64(3)},
+			}})).To(Succeed())
+		})
+
+		It("should disable PostgreSQL during the restore and enable it again by default", func() {
+			vals["postgresql"] = map[string]interface{}{"enabled": true}
+			st, requeueAfter, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(requeueAfter).To(Equal(restore.DefaultPollInterval))
+			Expect(st.DisabledComponents).To(Equal([]string{"postgresql"}))
+			Expect(ac.upgrades).To(HaveLen(1))
+			Expect(ac.upgrades[0]["postgresql"]).To(HaveKeyWithValue("enabled", false))
+			Expect(st.Steps).To(HaveLen(3))
+			Expect(st.Steps[0].Phase).To(Equal(restore.StepCompleted))
+			Expect(st.Steps[1].Phase).To(Equal(restore.StepInProgress))
+			Expect(st.Steps[2].Phase).To(Equal(restore.StepPending))
+			_, err = getRestore(st.Name)
+			Expect(err).To(BeNil())
+
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, requeueAfter, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.DisabledComponents).To(BeEmpty())
+			Expect(ac.upgrades).To(HaveLen(2))
+			Expect(ac.upgrades[1]["postgresql"]).To(HaveKeyWithValue("enabled", true))
+			Expect(st.Phase).To(Equal(restore.PhaseInProgress))
+			Expect(st.Steps[2].Phase).To(Equal(restore.StepCompleted))
+			Expect(st.Message).To(ContainSubstring(`deployment "synapse" (0/3 ready)`))
+			Expect(requeueAfter).To(Equal(restore.DefaultPollInterval))
+
+			setStatus(st)
+			setReadyReplicas(3)
+			st, requeueAfter, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Phase).To(Equal(restore.PhaseCompleted))
+			Expect(requeueAfter).To(BeZero())
+			for _, step := range st.Steps {
+				Expect(step.Phase).To(Equal(restore.StepCompleted))
+				Expect(step.CompletionTimestamp).NotTo(BeNil())
+			}
+		})
+
+		It("should not upgrade the release for components that are not enabled", func() {
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.DisabledComponents).To(BeEmpty())
+			Expect(ac.upgrades).To(BeEmpty())
+		})
+
+		It("should scale workloads down and back up", func() {
+			vals["restore"].(map[string]interface{})["plan"] = []interface{}{
+				map[string]interface{}{"type": "ScaleDown", "workloads": []interface{}{"synapse"}},
+				map[string]interface{}{"type": "Restore"},
+				map[string]interface{}{"type": "ScaleUp"},
+			}
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.ScaledDown).To(Equal([]restore.ScaledWorkload{{Kind: "Deployment", Name: "synapse", Replicas: 3}}))
+			replicas, _, _ := unstructured.NestedInt64(getDeployment().Object, "spec", "replicas")
+			Expect(replicas).To(BeZero())
+
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.ScaledDown).To(BeEmpty())
+			replicas, _, _ = unstructured.NestedInt64(getDeployment().Object, "spec", "replicas")
+			Expect(replicas).To(Equal(int64(3)))
+		})
+
+		It("should restore what the plan changed even if it does not do so itself", func() {
+			vals["postgresql"] = map[string]interface{}{"enabled": true}
+			vals["restore"].(map[string]interface{})["plan"] = []interface{}{
+				map[string]interface{}{"type": "DisableComponents", "components": []interface{}{"postgresql"}},
+				map[string]interface{}{"type": "ScaleDown"},
+				map[string]interface{}{"type": "Restore"},
+			}
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.DisabledComponents).To(HaveLen(1))
+			Expect(st.ScaledDown).To(HaveLen(1))
+
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.DisabledComponents).To(BeEmpty())
+			Expect(st.ScaledDown).To(BeEmpty())
+			Expect(ac.upgrades).To(HaveLen(2))
+			Expect(ac.upgrades[1]["postgresql"]).To(HaveKeyWithValue("enabled", true))
+			replicas, _, _ := unstructured.NestedInt64(getDeployment().Object, "spec", "replicas")
+			Expect(replicas).To(Equal(int64(3)))
+		})
+
+		It("should restore what the plan changed when the restore fails", func() {
+			vals["postgresql"] = map[string]interface{}{"enabled": true}
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseFailed)
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Phase).To(Equal(restore.PhaseFailed))
+			Expect(st.Message).To(Equal("step 2 (Restore) failed: restore finished in phase Failed"))
+			Expect(st.Steps[1].Phase).To(Equal(restore.StepFailed))
+			Expect(st.Steps[2].Phase).To(Equal(restore.StepPending))
+			Expect(st.DisabledComponents).To(BeEmpty())
+			Expect(ac.upgrades).To(HaveLen(2))
+		})
+
+		It("should wait for the release to become healthy", func() {
+			rel.Manifest = manifest + `---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: media
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: postgresql
+spec:
+  replicas: 1
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+`
+			for _, u := range []*unstructured.Unstructured{
+				{Object: map[string]interface{}{
+					"apiVersion": "apps/v1",
+					"kind":       "StatefulSet",
+					"metadata":   map[string]interface{}{"name": "postgresql", "namespace": "matrix"},
+					"spec": map[string]interface{}{"replicas": int64(1), "volumeClaimTemplates": []interface{}{
+						map[string]interface{}{"metadata": map[string]interface{}{"name": "data"}},
+					}},
+					"status": map[string]interface{}{"readyReplicas": int64(1)},
+				}},
+				{Object: map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "PersistentVolumeClaim",
+					"metadata":   map[string]interface{}{"name": "media", "namespace": "matrix"},
+					"status":     map[string]interface{}{"phase": "Pending"},
+				}},
+			} {
+				Expect(cl.Create(context.TODO(), u)).To(Succeed())
+			}
+			setReadyReplicas(3)
+
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, requeueAfter, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Phase).To(Equal(restore.PhaseInProgress))
+			Expect(requeueAfter).To(Equal(restore.DefaultPollInterval))
+			Expect(st.Message).To(Equal(`waiting for persistentvolumeclaim "data-postgresql-0" (missing), persistentvolumeclaim "media" (Pending)`))
+
+			// The release has to become healthy within restore.healthTimeout
+			// after the last step.
+			vals["restore"].(map[string]interface{})["healthTimeout"] = "1m"
+			finished := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+			st.Steps[len(st.Steps)-1].CompletionTimestamp = &finished
+			setStatus(st)
+			failed, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(failed.Phase).To(Equal(restore.PhaseFailed))
+			Expect(failed.Message).To(HavePrefix("release did not become healthy within 1m0s"))
+
+			delete(vals["restore"].(map[string]interface{}), "healthTimeout")
+			setStatus(st)
+			pvc := &unstructured.Unstructured{}
+			pvc.SetAPIVersion("v1")
+			pvc.SetKind("PersistentVolumeClaim")
+			Expect(cl.Get(context.TODO(), client.ObjectKey{Namespace: "matrix", Name: "media"}, pvc)).To(Succeed())
+			Expect(unstructured.SetNestedField(pvc.Object, "Bound", "status", "phase")).To(Succeed())
+			Expect(cl.Update(context.TODO(), pvc)).To(Succeed())
+			Expect(cl.Create(context.TODO(), &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "PersistentVolumeClaim",
+				"metadata":   map[string]interface{}{"name": "data-postgresql-0", "namespace": "matrix"},
+				"status":     map[string]interface{}{"phase": "Bound"},
+			}})).To(Succeed())
+			st, requeueAfter, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Phase).To(Equal(restore.PhaseCompleted))
+			Expect(requeueAfter).To(BeZero())
+		})
+
+		It("should fail the restore when a step times out", func() {
+			vals["restore"].(map[string]interface{})["plan"] = []interface{}{
+				map[string]interface{}{"type": "Restore"},
+				map[string]interface{}{"type": "WaitForReady", "timeout": "1m"},
+			}
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Steps[1].Phase).To(Equal(restore.StepInProgress))
+
+			started := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+			st.Steps[1].StartTimestamp = &started
+			setStatus(st)
+			st, requeueAfter, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(requeueAfter).To(BeZero())
+			Expect(st.Phase).To(Equal(restore.PhaseFailed))
+			Expect(st.Steps[1].Phase).To(Equal(restore.StepFailed))
+			Expect(st.Message).To(HavePrefix("step 2 (WaitForReady) failed: did not finish within 1m0s"))
+		})
+
+		It("should reject invalid plans", func() {
+			for _, plan := range []interface{}{
+				"restore",
+				[]interface{}{},
+				[]interface{}{map[string]interface{}{"type": "ScaleDown"}},
+				[]interface{}{map[string]interface{}{"type": "Restore"}, map[string]interface{}{"type": "Restore"}},
+				[]interface{}{map[string]interface{}{"type": "Restore"}, map[string]interface{}{"type": "Reboot"}},
+				[]interface{}{map[string]interface{}{"type": "Restore"}, map[string]interface{}{"type": "ScaleDown", "components": []interface{}{"postgresql"}}},
+				[]interface{}{map[string]interface{}{"type": "Restore"}, map[string]interface{}{"type": "ScaleUp", "workloads": "synapse"}},
+				[]interface{}{map[string]interface{}{"type": "Restore"}, map[string]interface{}{"type": "WaitForReady", "timeout": "soon"}},
+				[]interface{}{map[string]interface{}{"type": "Restore"}, map[string]interface{}{"type": "ScaleUp", "timeout": "1m"}},
+			} {
+				vals["restore"].(map[string]interface{})["plan"] = plan
+				_, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+				Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue(), "plan %v", plan)
+			}
+		})
+	})
+
+	var _ = Describe("rollback", func() {
+		BeforeEach(func() {
+			rel.Chart = &chart.Chart{
+				Metadata: &chart.Metadata{Name: "matrix"},
+				Values:   map[string]interface{}{"postgresql": map[string]interface{}{"enabled": true}},
+			}
+			rel.Config = map[string]interface{}{"image": "old"}
+			vals = chartutil.Values{"image": "new", "postgresql": map[string]interface{}{"enabled": true}}
+			Expect(cl.Create(context.TODO(), &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "PersistentVolumeClaim",
+				"metadata": map[string]interface{}{
+					"name":      "data-test-postgresql-0",
+					"namespace": "matrix",
+					"labels":    map[string]interface{}{"app.kubernetes.io/name": "postgresql"},
+				},
+			}})).To(Succeed())
+		})
+
+		It("should restore the database in place with the values of the release", func() {
+			st, requeueAfter, err := r.Rollback(context.TODO(), obj, rel, vals, "before", testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(requeueAfter).To(Equal(restore.DefaultPollInterval))
+			Expect(st.Rollback).To(BeTrue())
+			Expect(st.Phase).To(Equal(restore.PhaseInProgress))
+			Expect(st.BackupName).To(Equal("before"))
+			Expect(st.Steps).To(HaveLen(len(restore.RollbackPlan())))
+			Expect(st.DisabledComponents).To(Equal([]string{"postgresql"}))
+			Expect(ac.upgrades).To(HaveLen(1))
+			Expect(ac.upgrades[0]).To(HaveKeyWithValue("image", "old"))
+
+			pvc := &unstructured.Unstructured{}
+			pvc.SetAPIVersion("v1")
+			pvc.SetKind("PersistentVolumeClaim")
+			err = cl.Get(context.TODO(), client.ObjectKey{Namespace: "matrix", Name: "data-test-postgresql-0"}, pvc)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+			u, err := getRestore(st.Name)
+			Expect(err).To(BeNil())
+			Expect(u.Object["spec"].(map[string]interface{})["backupName"]).To(Equal("before"))
+			Expect(u.Object["spec"].(map[string]interface{})["includedNamespaces"]).To(Equal([]interface{}{"matrix"}))
+
+			// The rollback is moved forward by Reconcile, whatever the
+			// restore values of the custom resource are.
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.DisabledComponents).To(BeEmpty())
+			Expect(ac.upgrades).To(HaveLen(2))
+			Expect(ac.upgrades[1]).To(HaveKeyWithValue("image", "old"))
+			Expect(ac.upgrades[1]["postgresql"]).To(HaveKeyWithValue("enabled", true))
+		})
+
+		It("should not replace a restore in progress", func() {
+			setStatus(&restore.Status{Name: "running", BackupName: "first", Phase: restore.PhaseInProgress})
+			_, _, err := r.Rollback(context.TODO(), obj, rel, vals, "before", testing.NullLogger{})
+			Expect(err).NotTo(BeNil())
+			Expect(ac.upgrades).To(BeEmpty())
+		})
+	})
+
+	var _ = Describe("into another namespace", func() {
+		const manifest = `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: synapse
+`
+
+		createDeployment := func(owners []interface{}) {
+			Expect(cl.Create(context.TODO(), &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata": map[string]interface{}{
+					"name":            "synapse",
+					"namespace":       "staging",
+					"ownerReferences": owners,
+				},
+				"status": map[string]interface{}{"readyReplicas": int64(1)},
+			}})).To(Succeed())
+		}
+
+		getDeployment := func() *unstructured.Unstructured {
+			u := &unstructured.Unstructured{}
+			u.SetAPIVersion("apps/v1")
+			u.SetKind("Deployment")
+			Expect(cl.Get(context.TODO(), client.ObjectKey{Namespace: "staging", Name: "synapse"}, u)).To(Succeed())
+			return u
+		}
+
+		BeforeEach(func() {
+			obj.SetAPIVersion("matrix.example.com/v1")
+			obj.SetKind("Matrix")
+			obj.SetUID("source-uid")
+			Expect(unstructured.SetNestedMap(obj.Object, map[string]interface{}{
+				"serverName": "matrix.example.com",
+				"restore":    map[string]interface{}{"enabled": true, "targetNamespace": "staging"},
+			}, "spec")).To(Succeed())
+			rel.Manifest = manifest
+			vals["restore"].(map[string]interface{})["targetNamespace"] = "staging"
+			vals["postgresql"] = map[string]interface{}{"enabled": true}
+			createDeployment([]interface{}{map[string]interface{}{
+				"apiVersion": "matrix.example.com/v1",
+				"kind":       "Matrix",
+				"name":       "test",
+				"uid":        "source-uid",
+				"controller": true,
+			}})
+		})
+
+		It("should restore into the target namespace without touching the release", func() {
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.IsClone()).To(BeTrue())
+			Expect(st.TargetNamespace).To(Equal("staging"))
+			Expect(st.Steps).To(HaveLen(1))
+			Expect(ac.upgrades).To(BeEmpty())
+
+			u, err := getRestore(st.Name)
+			Expect(err).To(BeNil())
+			spec := u.Object["spec"].(map[string]interface{})
+			Expect(spec["namespaceMapping"]).To(Equal(map[string]interface{}{"matrix": "staging"}))
+			Expect(spec["excludedResources"]).To(ContainElement("matrix.matrix.example.com"))
+		})
+
+		It("should remove owner references to the custom resource without a copy of it", func() {
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Phase).To(Equal(restore.PhaseCompleted))
+			Expect(getDeployment().GetOwnerReferences()).To(BeEmpty())
+		})
+
+		It("should create a copy of the custom resource that adopts the restored release", func() {
+			vals["restore"].(map[string]interface{})["createResource"] = true
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Phase).To(Equal(restore.PhaseCompleted))
+
+			cr := &unstructured.Unstructured{}
+			cr.SetAPIVersion("matrix.example.com/v1")
+			cr.SetKind("Matrix")
+			Expect(cl.Get(context.TODO(), client.ObjectKey{Namespace: "staging", Name: "test"}, cr)).To(Succeed())
+			Expect(cr.GetAnnotations()).To(HaveKeyWithValue(restore.RestoredFromAnnotation, "matrix/test"))
+			Expect(cr.Object["spec"]).To(Equal(map[string]interface{}{"serverName": "matrix.example.com"}))
+
+			refs := getDeployment().GetOwnerReferences()
+			Expect(refs).To(HaveLen(1))
+			Expect(refs[0].UID).To(Equal(cr.GetUID()))
+			Expect(refs[0].UID).NotTo(Equal(obj.GetUID()))
+		})
+
+		It("should not take over a custom resource it did not create", func() {
+			vals["restore"].(map[string]interface{})["createResource"] = true
+			Expect(cl.Create(context.TODO(), &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "matrix.example.com/v1",
+				"kind":       "Matrix",
+				"metadata":   map[string]interface{}{"name": "test", "namespace": "staging"},
+			}})).To(Succeed())
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Phase).To(Equal(restore.PhaseFailed))
+			Expect(st.Message).To(ContainSubstring(`already exists in namespace "staging"`))
+		})
+
+		It("should reject invalid namespace values", func() {
+			for _, m := range []map[string]interface{}{
+				{"targetNamespace": "matrix"},
+				{"targetNamespace": "Not Valid"},
+				{"targetNamespace": "staging", "namespaceMapping": map[string]interface{}{"matrix": "other"}},
+				{"targetNamespace": nil, "namespaceMapping": map[string]interface{}{"monitoring": "staging-monitoring"}},
+				{"targetNamespace": nil, "createResource": true},
+				{"targetNamespace": "staging", "plan": []interface{}{map[string]interface{}{"type": "Restore"}}},
+			} {
+				restoreVals := map[string]interface{}{"enabled": true, "backupName": "first"}
+				for k, v := range m {
+					restoreVals[k] = v
+				}
+				vals["restore"] = restoreVals
+				_, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+				Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue(), "values %v", m)
+			}
+		})
+	})
+
+	var _ = Describe("selective restore", func() {
+		restoreSpec := func(st *restore.Status) map[string]interface{} {
+			u, err := getRestore(st.Name)
+			Expect(err).To(BeNil())
+			return u.Object["spec"].(map[string]interface{})
+		}
+
+		BeforeEach(func() {
+			vals["postgresql"] = map[string]interface{}{"enabled": true}
+		})
+
+		It("should restore the volumes of a component without touching the database", func() {
+			vals["restore"].(map[string]interface{})["components"] = []interface{}{"media"}
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Steps).To(HaveLen(len(restore.ComponentPlan([]string{"media"}))))
+			Expect(ac.upgrades).To(BeEmpty())
+
+			spec := restoreSpec(st)
+			Expect(spec["includedResources"]).To(Equal([]interface{}{"persistentvolumeclaims", "persistentvolumes"}))
+			Expect(spec["labelSelector"]).To(Equal(map[string]interface{}{
+				"matchLabels": map[string]interface{}{"app.kubernetes.io/component": "media"},
+			}))
+			Expect(spec).NotTo(HaveKey("orLabelSelectors"))
+
+			setStatus(st)
+			filter := restore.StatusFor(obj).Filter
+			Expect(filter.Components).To(Equal([]string{"media"}))
+			Expect(filter.LabelSelectors).To(HaveLen(1))
+			Expect(filter.LabelSelectors[0].MatchLabels).To(HaveKeyWithValue("app.kubernetes.io/component", "media"))
+		})
+
+		It("should restore objects matching any of several components", func() {
+			vals["restore"].(map[string]interface{})["components"] = []interface{}{"media", "database"}
+			vals["restore"].(map[string]interface{})["componentSelectors"] = map[string]interface{}{"media": "app=synapse-media"}
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Steps).To(HaveLen(len(restore.ComponentPlan([]string{"media", "database"}))))
+			Expect(ac.upgrades).To(HaveLen(1))
+
+			spec := restoreSpec(st)
+			Expect(spec).NotTo(HaveKey("labelSelector"))
+			Expect(spec["orLabelSelectors"]).To(ConsistOf(
+				map[string]interface{}{"matchLabels": map[string]interface{}{"app": "synapse-media"}},
+				map[string]interface{}{"matchLabels": map[string]interface{}{"app.kubernetes.io/name": "postgresql"}},
+			))
+		})
+
+		It("should replace the existing claims of a component", func() {
+			const manifest = `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: synapse
+spec:
+  replicas: 2
+  template:
+    spec:
+      volumes:
+      - name: media
+        persistentVolumeClaim:
+          claimName: media
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: element
+spec:
+  replicas: 1
+`
+			rel.Manifest = manifest
+			for name, replicas := range map[string]int64{"synapse": 2, "element": 1} {
+				Expect(cl.Create(context.TODO(), &unstructured.Unstructured{Object: map[string]interface{}{
+					"apiVersion": "apps/v1",
+					"kind":       "Deployment",
+					"metadata":   map[string]interface{}{"name": name, "namespace": "matrix"},
+					"spec":       map[string]interface{}{"replicas": replicas},
+				}})).To(Succeed())
+			}
+			for name, labels := range map[string]map[string]interface{}{
+				"media": {"app.kubernetes.io/component": "media"},
+				"data":  {"app.kubernetes.io/name": "postgresql"},
+			} {
+				Expect(cl.Create(context.TODO(), &unstructured.Unstructured{Object: map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "PersistentVolumeClaim",
+					"metadata":   map[string]interface{}{"name": name, "namespace": "matrix", "labels": labels},
+				}})).To(Succeed())
+			}
+			replicasOf := func(name string) int64 {
+				u := &unstructured.Unstructured{}
+				u.SetAPIVersion("apps/v1")
+				u.SetKind("Deployment")
+				Expect(cl.Get(context.TODO(), client.ObjectKey{Namespace: "matrix", Name: name}, u)).To(Succeed())
+				n, _, _ := unstructured.NestedInt64(u.Object, "spec", "replicas")
+				return n
+			}
+			claimExists := func(name string) bool {
+				u := &unstructured.Unstructured{}
+				u.SetAPIVersion("v1")
+				u.SetKind("PersistentVolumeClaim")
+				err := cl.Get(context.TODO(), client.ObjectKey{Namespace: "matrix", Name: name}, u)
+				Expect(err == nil || apierrors.IsNotFound(err)).To(BeTrue())
+				return err == nil
+			}
+
+			vals["restore"].(map[string]interface{})["components"] = []interface{}{"media"}
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Steps[0].Type).To(Equal(restore.StepScaleDown))
+			Expect(st.Steps[0].Phase).To(Equal(restore.StepCompleted))
+			Expect(st.Steps[1].Type).To(Equal(restore.StepDeleteClaims))
+			Expect(st.Steps[1].Phase).To(Equal(restore.StepCompleted))
+			Expect(st.Steps[2].Type).To(Equal(restore.StepRestore))
+			Expect(st.Steps[2].Phase).To(Equal(restore.StepInProgress))
+			Expect(st.ScaledDown).To(Equal([]restore.ScaledWorkload{{Kind: "Deployment", Name: "synapse", Replicas: 2}}))
+			Expect(replicasOf("synapse")).To(BeZero())
+			Expect(replicasOf("element")).To(Equal(int64(1)))
+			Expect(claimExists("media")).To(BeFalse())
+			Expect(claimExists("data")).To(BeTrue())
+			_, err = getRestore(st.Name)
+			Expect(err).To(BeNil())
+
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.ScaledDown).To(BeEmpty())
+			Expect(replicasOf("synapse")).To(Equal(int64(2)))
+		})
+
+		It("should reject DeleteClaims steps without components or into other namespaces", func() {
+			for _, m := range []map[string]interface{}{
+				{"plan": []interface{}{map[string]interface{}{"type": "DeleteClaims"}, map[string]interface{}{"type": "Restore"}}},
+				{"plan": []interface{}{map[string]interface{}{"type": "DeleteClaims", "components": []interface{}{"config"}}, map[string]interface{}{"type": "Restore"}}},
+				{"plan": []interface{}{map[string]interface{}{"type": "DeleteClaims"}, map[string]interface{}{"type": "Restore"}}, "components": []interface{}{"media"}, "targetNamespace": "matrix-copy"},
+			} {
+				restoreVals := map[string]interface{}{"enabled": true, "backupName": "first"}
+				for k, v := range m {
+					restoreVals[k] = v
+				}
+				vals["restore"] = restoreVals
+				_, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+				Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue(), "values %v", m)
+			}
+		})
+
+		It("should map resource filters and the existing resource policy", func() {
+			vals["restore"].(map[string]interface{})["includedResources"] = []interface{}{"configmaps", "secrets"}
+			vals["restore"].(map[string]interface{})["labelSelector"] = "app=synapse"
+			vals["restore"].(map[string]interface{})["existingResourcePolicy"] = "update"
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+
+			spec := restoreSpec(st)
+			Expect(spec["includedResources"]).To(Equal([]interface{}{"configmaps", "secrets"}))
+			Expect(spec["labelSelector"]).To(Equal(map[string]interface{}{
+				"matchLabels": map[string]interface{}{"app": "synapse"},
+			}))
+			Expect(spec["existingResourcePolicy"]).To(Equal("update"))
+		})
+
+		It("should restore everything without filters", func() {
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Filter).To(BeNil())
+			spec := restoreSpec(st)
+			Expect(spec).NotTo(HaveKey("includedResources"))
+			Expect(spec).NotTo(HaveKey("labelSelector"))
+		})
+
+		It("should reject invalid filters", func() {
+			for _, m := range []map[string]interface{}{
+				{"components": []interface{}{"config"}},
+				{"components": "media"},
+				{"components": []interface{}{"media"}, "labelSelector": "app=synapse"},
+				{"components": []interface{}{"media"}, "componentSelectors": map[string]interface{}{"media": "app in media"}},
+				{"labelSelector": 3},
+				{"includedResources": []interface{}{}},
+				{"existingResourcePolicy": "replace"},
+			} {
+				restoreVals := map[string]interface{}{"enabled": true, "backupName": "first"}
+				for k, v := range m {
+					restoreVals[k] = v
+				}
+				vals["restore"] = restoreVals
+				_, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+				Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue(), "values %v", m)
+			}
+		})
+	})
+
+	var _ = Describe("release storage", func() {
+		createRecord := func(version int, status release.Status) {
+			b, err := json.Marshal(&release.Release{Name: "test", Namespace: "matrix", Version: version, Info: &release.Info{Status: status}})
+			Expect(err).To(BeNil())
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			_, err = zw.Write(b)
+			Expect(err).To(BeNil())
+			Expect(zw.Close()).To(Succeed())
+			data := base64.StdEncoding.EncodeToString([]byte(base64.StdEncoding.EncodeToString(buf.Bytes())))
+			Expect(cl.Create(context.TODO(), &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"type":       "helm.sh/release.v1",
+				"metadata": map[string]interface{}{
+					"name":      fmt.Sprintf("sh.helm.release.v1.test.v%d", version),
+					"namespace": "matrix",
+					"labels": map[string]interface{}{
+						"name":    "test",
+						"owner":   "helm",
+						"status":  status.String(),
+						"version": strconv.Itoa(version),
+					},
+				},
+				"data": map[string]interface{}{"release": data},
+			}})).To(Succeed())
+		}
+
+		// records returns the status of every release record by revision.
+		records := func() map[string]string {
+			list := &unstructured.UnstructuredList{}
+			list.SetAPIVersion("v1")
+			list.SetKind("SecretList")
+			Expect(cl.List(context.TODO(), list, client.InNamespace("matrix"))).To(Succeed())
+			m := map[string]string{}
+			for _, u := range list.Items {
+				m[u.GetLabels()["version"]] = u.GetLabels()["status"]
+			}
+			return m
+		}
+
+		restoreRelease := func() *restore.Status {
+			st, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.ReleaseStorage.Action).To(BeEmpty())
+			setStatus(st)
+			setVeleroPhase(st.Name, backup.VeleroPhaseCompleted)
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(st.Phase).To(Equal(restore.PhaseCompleted))
+			return st
+		}
+
+		It("should leave a deployed revision alone", func() {
+			createRecord(1, release.StatusSuperseded)
+			createRecord(2, release.StatusDeployed)
+			st := restoreRelease()
+			Expect(st.ReleaseStorage).To(Equal(&restore.ReleaseStorage{Policy: restore.ReleaseStorageAdopt, Action: restore.ReleaseStorageUnchanged, Revision: 2}))
+			Expect(records()).To(Equal(map[string]string{"1": "superseded", "2": "deployed"}))
+		})
+
+		It("should adopt the deployed revision over newer pending ones", func() {
+			createRecord(1, release.StatusDeployed)
+			createRecord(2, release.StatusPendingUpgrade)
+			st := restoreRelease()
+			Expect(st.ReleaseStorage.Action).To(Equal(restore.ReleaseStorageAdopted))
+			Expect(st.ReleaseStorage.Revision).To(Equal(1))
+			Expect(records()).To(Equal(map[string]string{"1": "deployed"}))
+		})
+
+		It("should mark the newest revision deployed if none is", func() {
+			createRecord(1, release.StatusFailed)
+			st := restoreRelease()
+			Expect(st.ReleaseStorage.Action).To(Equal(restore.ReleaseStorageAdopted))
+			Expect(records()).To(Equal(map[string]string{"1": "deployed"}))
+		})
+
+		It("should rebuild the release storage if no records were restored", func() {
+			st := restoreRelease()
+			Expect(st.ReleaseStorage.Action).To(Equal(restore.ReleaseStorageRebuilt))
+			Expect(st.ReleaseStorage.Revision).To(Equal(1))
+			Expect(records()).To(Equal(map[string]string{"1": "deployed"}))
+		})
+
+		It("should rebuild the release storage if asked to", func() {
+			vals["restore"].(map[string]interface{})["releaseStorage"] = "Rebuild"
+			createRecord(1, release.StatusSuperseded)
+			createRecord(2, release.StatusDeployed)
+			createRecord(3, release.StatusPendingUpgrade)
+			st := restoreRelease()
+			Expect(st.ReleaseStorage.Policy).To(Equal(restore.ReleaseStorageRebuild))
+			Expect(st.ReleaseStorage.Action).To(Equal(restore.ReleaseStorageRebuilt))
+			Expect(st.ReleaseStorage.Revision).To(Equal(3))
+			Expect(records()).To(Equal(map[string]string{"3": "deployed"}))
+		})
+
+		It("should reject an unknown policy", func() {
+			vals["restore"].(map[string]interface{})["releaseStorage"] = "Replace"
+			_, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue())
+		})
+	})
+
+	It("should validate values without looking at the cluster", func() {
+		Expect(restore.ValidateValues(obj, vals)).To(Succeed())
+		Expect(restore.ValidateValues(obj, chartutil.Values{})).To(Succeed())
+
+		for _, v := range []chartutil.Values{
+			{"restore": map[string]interface{}{"enabled": true}, "backup": map[string]interface{}{"enabled": true}},
+			{"restore": map[string]interface{}{"enabled": true, "backupName": 3}},
+			{"restore": map[string]interface{}{"enabled": true, "plan": "restore"}},
+			{"restore": map[string]interface{}{"enabled": true, "releaseStorage": "Replace"}},
+			{"restore": map[string]interface{}{"enabled": false, "cleanupPolicy": "Sometimes"}},
+		} {
+			Expect(errors.Is(restore.ValidateValues(obj, v), restore.ErrInvalidValues)).To(BeTrue(), "values %v", v)
+		}
+
+		// Values that are not booleans do not enable anything.
+		Expect(restore.ValidateValues(obj, chartutil.Values{
+			"restore": map[string]interface{}{"enabled": "yes"},
+			"backup":  map[string]interface{}{"enabled": "yes"},
+		})).To(Succeed())
+	})
+
+	It("should reject invalid values", func() {
+		vals["restore"].(map[string]interface{})["healthTimeout"] = "never"
+		_, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue())
+		delete(vals["restore"].(map[string]interface{}), "healthTimeout")
+
+		vals["restore"].(map[string]interface{})["backupName"] = 3
+		_, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue())
+
+		vals = chartutil.Values{
+			"restore": map[string]interface{}{"enabled": true, "backupName": "first"},
+			"backup":  map[string]interface{}{"enabled": true},
+		}
+		_, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue())
+
+		vals = chartutil.Values{"restore": map[string]interface{}{"enabled": true, "backupName": "first", "cleanupPolicy": "Sometimes"}}
+		_, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(errors.Is(err, restore.ErrInvalidValues)).To(BeTrue())
+	})
+
+	var _ = Describe("cleanup", func() {
+		var st *restore.Status
+
+		BeforeEach(func() {
+			var err error
+			st, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			finished := metav1.NewTime(time.Now().Add(-time.Hour))
+			st.Phase = restore.PhaseCompleted
+			st.CompletionTimestamp = &finished
+			setStatus(st)
+		})
+
+		It("should keep restores by default", func() {
+			again, requeueAfter, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(requeueAfter).To(BeZero())
+			Expect(again.CleanedUp).To(BeFalse())
+			_, err = getRestore(st.Name)
+			Expect(err).To(BeNil())
+		})
+
+		It("should delete finished restores once they are due", func() {
+			vals["restore"].(map[string]interface{})["cleanupPolicy"] = "Delete"
+			again, requeueAfter, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(again.CleanedUp).To(BeFalse())
+			Expect(requeueAfter).To(BeNumerically("~", restore.DefaultCleanupAfter-time.Hour, time.Minute))
+
+			vals["restore"].(map[string]interface{})["cleanupAfter"] = "30m"
+			again, _, err = r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(again.CleanedUp).To(BeTrue())
+			_, err = getRestore(st.Name)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should keep failed restores with DeleteOnSuccess", func() {
+			vals["restore"].(map[string]interface{})["cleanupPolicy"] = "DeleteOnSuccess"
+			vals["restore"].(map[string]interface{})["cleanupAfter"] = "0s"
+			st.Phase = restore.PhaseFailed
+			setStatus(st)
+			again, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(again.CleanedUp).To(BeFalse())
+			_, err = getRestore(st.Name)
+			Expect(err).To(BeNil())
+		})
+
+		It("should clean up the previous restore when new values are restored", func() {
+			vals["restore"].(map[string]interface{})["cleanupPolicy"] = "Delete"
+			vals["restore"].(map[string]interface{})["backupName"] = "second"
+			obj.SetGeneration(2)
+			again, _, err := r.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+			Expect(err).To(BeNil())
+			Expect(again.ObservedGeneration).To(Equal(int64(2)))
+			Expect(again.Phase).To(Equal(restore.PhaseInProgress))
+			_, err = getRestore(st.Name)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,296 @@
+package restore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	helmtime "helm.sh/helm/v3/pkg/time"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+// ReleaseStoragePolicy decides how the Helm release records restored from a
+// backup are reconciled with the release. They may come back at another
+// revision than the one the release was at, in a pending or failed state if
+// the backup was taken during an upgrade, or not at all. The operator would
+// then reinstall or upgrade the release over the restored objects.
+type ReleaseStoragePolicy string
+
+const (
+	// ReleaseStorageAdopt keeps the restored release records. The newest
+	// deployed revision is adopted and the records of newer revisions,
+	// which were still pending or had failed, are deleted. If no revision
+	// was deployed, the newest one is marked as deployed. If no records were
+	// restored at all, the release storage is rebuilt.
+	ReleaseStorageAdopt ReleaseStoragePolicy = "Adopt"
+	// ReleaseStorageRebuild replaces the release records with a single
+	// deployed revision of the newest restored release, or of the release
+	// the restore was started for if none was restored, which describes the
+	// restored objects.
+	ReleaseStorageRebuild ReleaseStoragePolicy = "Rebuild"
+)
+
+const (
+	// ReleaseStorageUnchanged means the newest restored revision was
+	// already deployed.
+	ReleaseStorageUnchanged = "Unchanged"
+	// ReleaseStorageAdopted means a restored revision was adopted.
+	ReleaseStorageAdopted = "Adopted"
+	// ReleaseStorageRebuilt means the release records were rebuilt.
+	ReleaseStorageRebuilt = "Rebuilt"
+)
+
+// ReleaseStorage records how the release records of a restore were
+// reconciled. Action is one of ReleaseStorageUnchanged, ReleaseStorageAdopted
+// and ReleaseStorageRebuilt, and Revision the deployed revision of the release
+// afterwards. Both are set once the Velero restore has completed.
+type ReleaseStorage struct {
+	Policy   ReleaseStoragePolicy `json:"policy"`
+	Action   string               `json:"action,omitempty"`
+	Revision int                  `json:"revision,omitempty"`
+}
+
+// releaseStoragePolicyFor reads `restore.releaseStorage`, which is Adopt or
+// Rebuild (default Adopt).
+func releaseStoragePolicyFor(vals chartutil.Values) (ReleaseStoragePolicy, error) {
+	v, err := stringValue(vals, "restore.releaseStorage")
+	if err != nil {
+		return "", err
+	}
+	switch p := ReleaseStoragePolicy(v); p {
+	case "":
+		return ReleaseStorageAdopt, nil
+	case ReleaseStorageAdopt, ReleaseStorageRebuild:
+		return p, nil
+	default:
+		return "", invalidValuesError("restore.releaseStorage", "must be %s or %s, got %q", ReleaseStorageAdopt, ReleaseStorageRebuild, v)
+	}
+}
+
+// releaseRecord is a release record as stored by the secrets driver of
+// Helm, which keeps the name, revision and status of the release in the
+// labels of the secret.
+type releaseRecord struct {
+	secret  unstructured.Unstructured
+	version int
+	status  string
+}
+
+// reconcileReleaseStorage reconciles the release records of obj in the
+// namespace the backup was restored into with the restored objects,
+// according to the release storage policy of st. It returns the deployed
+// release afterwards.
+func (r *Restore) reconcileReleaseStorage(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, st *Status) (*release.Release, error) {
+	namespace := backup.ReleaseNamespace(obj, rel)
+	if st.IsClone() {
+		namespace = st.TargetNamespace
+	}
+	if st.ReleaseStorage == nil {
+		st.ReleaseStorage = &ReleaseStorage{Policy: ReleaseStorageAdopt}
+	}
+	records, err := r.releaseRecords(ctx, namespace, obj.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	var deployed *release.Release
+	if st.ReleaseStorage.Policy == ReleaseStorageAdopt && len(records) > 0 {
+		deployed, err = r.adoptRecords(ctx, namespace, records, st.ReleaseStorage)
+	} else {
+		deployed, err = r.rebuildRecords(ctx, namespace, records, rel, st)
+	}
+	if err != nil {
+		return nil, err
+	}
+	st.ReleaseStorage.Revision = deployed.Version
+	return deployed, nil
+}
+
+// adoptRecords adopts the newest deployed revision of records, or the newest
+// revision if none is deployed, and deletes the records of newer revisions.
+func (r *Restore) adoptRecords(ctx context.Context, namespace string, records []releaseRecord, rs *ReleaseStorage) (*release.Release, error) {
+	adopted := 0
+	for i, rec := range records {
+		if rec.status == release.StatusDeployed.String() {
+			adopted = i
+			break
+		}
+	}
+	for _, rec := range records[:adopted] {
+		if err := r.client.Delete(ctx, &rec.secret); err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("delete release record %q: %w", rec.secret.GetName(), err)
+		}
+	}
+
+	rec := records[adopted]
+	rls, err := decodeRecord(&rec.secret)
+	if err != nil {
+		return nil, err
+	}
+	if rls.Info == nil {
+		rls.Info = &release.Info{}
+	}
+	rs.Action = ReleaseStorageUnchanged
+	if adopted > 0 {
+		rs.Action = ReleaseStorageAdopted
+	}
+	// Restores into other namespaces bring back records of the source
+	// namespace.
+	if rls.Info.Status == release.StatusDeployed && rls.Namespace == namespace {
+		return rls, nil
+	}
+	rls.Info.Status = release.StatusDeployed
+	rls.Namespace = namespace
+	if err := encodeRecord(&rec.secret, rls); err != nil {
+		return nil, err
+	}
+	if err := r.client.Update(ctx, &rec.secret); err != nil {
+		return nil, fmt.Errorf("adopt release record %q: %w", rec.secret.GetName(), err)
+	}
+	rs.Action = ReleaseStorageAdopted
+	return rls, nil
+}
+
+// rebuildRecords replaces records with a single deployed revision of the
+// newest of them, or of rel if there are none.
+func (r *Restore) rebuildRecords(ctx context.Context, namespace string, records []releaseRecord, rel *release.Release, st *Status) (*release.Release, error) {
+	var rls *release.Release
+	if len(records) > 0 {
+		var err error
+		if rls, err = decodeRecord(&records[0].secret); err != nil {
+			return nil, err
+		}
+	} else if rel != nil {
+		copied := *rel
+		rls = &copied
+	} else {
+		return nil, stepFailed("no release records were restored and the release is not installed")
+	}
+	for _, rec := range records {
+		if err := r.client.Delete(ctx, &rec.secret); err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("delete release record %q: %w", rec.secret.GetName(), err)
+		}
+	}
+
+	now := helmtime.Now()
+	info := release.Info{FirstDeployed: now, LastDeployed: now, Status: release.StatusDeployed, Description: fmt.Sprintf("Rebuilt after restore %s", st.Name)}
+	if rls.Info != nil {
+		info.FirstDeployed = rls.Info.FirstDeployed
+		info.Notes = rls.Info.Notes
+	}
+	rls.Info = &info
+	rls.Namespace = namespace
+	if rls.Version == 0 {
+		rls.Version = 1
+	}
+
+	secret := &unstructured.Unstructured{Object: map[string]interface{}{"type": "helm.sh/release.v1"}}
+	secret.SetAPIVersion("v1")
+	secret.SetKind("Secret")
+	secret.SetNamespace(namespace)
+	secret.SetName(fmt.Sprintf("sh.helm.release.v1.%s.v%d", rls.Name, rls.Version))
+	secret.SetLabels(map[string]string{"createdAt": strconv.FormatInt(now.Unix(), 10)})
+	if err := encodeRecord(secret, rls); err != nil {
+		return nil, err
+	}
+	if err := r.client.Create(ctx, secret); err != nil {
+		return nil, fmt.Errorf("rebuild release record %q: %w", secret.GetName(), err)
+	}
+	st.ReleaseStorage.Action = ReleaseStorageRebuilt
+	return rls, nil
+}
+
+// releaseRecords returns the records of the release name in namespace,
+// newest first.
+func (r *Restore) releaseRecords(ctx context.Context, namespace, name string) ([]releaseRecord, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetAPIVersion("v1")
+	list.SetKind("SecretList")
+	if err := r.client.List(ctx, list, client.InNamespace(namespace), client.MatchingLabels{"owner": "helm", "name": name}); err != nil {
+		return nil, fmt.Errorf("list release records: %w", err)
+	}
+	var records []releaseRecord
+	for _, u := range list.Items {
+		version, err := strconv.Atoi(u.GetLabels()["version"])
+		if err != nil {
+			continue
+		}
+		records = append(records, releaseRecord{secret: u, version: version, status: u.GetLabels()["status"]})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].version > records[j].version })
+	return records, nil
+}
+
+// decodeRecord decodes the release stored in a release record, which is
+// gzipped JSON in base64, like the secrets driver of Helm does.
+func decodeRecord(secret *unstructured.Unstructured) (*release.Release, error) {
+	data, _, _ := unstructured.NestedString(secret.Object, "data", "release")
+	// The secret data is base64 encoded once more in unstructured objects.
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode release record %q: %w", secret.GetName(), err)
+	}
+	b, err := base64.StdEncoding.DecodeString(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("decode release record %q: %w", secret.GetName(), err)
+	}
+	if len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("decode release record %q: %w", secret.GetName(), err)
+		}
+		if b, err = ioutil.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("decode release record %q: %w", secret.GetName(), err)
+		}
+	}
+	rls := &release.Release{}
+	if err := json.Unmarshal(b, rls); err != nil {
+		return nil, fmt.Errorf("decode release record %q: %w", secret.GetName(), err)
+	}
+	return rls, nil
+}
+
+// encodeRecord stores rls in a release record and updates its labels.
+func encodeRecord(secret *unstructured.Unstructured, rls *release.Release) error {
+	b, err := json.Marshal(rls)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(b); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	data := base64.StdEncoding.EncodeToString([]byte(base64.StdEncoding.EncodeToString(buf.Bytes())))
+	if err := unstructured.SetNestedField(secret.Object, data, "data", "release"); err != nil {
+		return err
+	}
+	labels := secret.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels["name"] = rls.Name
+	labels["owner"] = "helm"
+	labels["status"] = rls.Info.Status.String()
+	labels["version"] = strconv.Itoa(rls.Version)
+	secret.SetLabels(labels)
+	return nil
+}
@@ -0,0 +1,99 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// claims returns the names of the persistent volume claims in namespace to
+// snapshot, sorted by name. These are the claims in the manifest of rel,
+// the claims created from the volume claim templates of its StatefulSets,
+// and the claims matched by `snapshot.labelSelector`. Claims that do not
+// exist (yet) are left out.
+func (s *Snapshotter) claims(ctx context.Context, namespace string, rel *release.Release, opts options) ([]string, error) {
+	names := map[string]bool{}
+	candidates, err := manifestClaims(rel, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range candidates {
+		pvc := &unstructured.Unstructured{}
+		pvc.SetAPIVersion("v1")
+		pvc.SetKind("PersistentVolumeClaim")
+		if err := s.client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, pvc); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("get persistent volume claim %q: %w", name, err)
+		}
+		names[name] = true
+	}
+
+	if opts.selector != nil {
+		list := &unstructured.UnstructuredList{}
+		list.SetAPIVersion("v1")
+		list.SetKind("PersistentVolumeClaimList")
+		if err := s.client.List(ctx, list, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: opts.selector}); err != nil {
+			return nil, fmt.Errorf("list persistent volume claims: %w", err)
+		}
+		for _, pvc := range list.Items {
+			names[pvc.GetName()] = true
+		}
+	}
+
+	claims := make([]string, 0, len(names))
+	for name := range names {
+		claims = append(claims, name)
+	}
+	sort.Strings(claims)
+	return claims, nil
+}
+
+// manifestClaims returns the names of the persistent volume claims of rel in
+// namespace: the claims in its manifest, and the claims created for every
+// replica from the volume claim templates of its StatefulSets. Objects
+// without a namespace are in the release namespace.
+func manifestClaims(rel *release.Release, namespace string) ([]string, error) {
+	if rel == nil {
+		return nil, nil
+	}
+	var claims []string
+	for _, manifest := range releaseutil.SplitManifests(rel.Manifest) {
+		var u unstructured.Unstructured
+		if err := yaml.Unmarshal([]byte(manifest), &u); err != nil {
+			return nil, err
+		}
+		if u.Object == nil || (u.GetNamespace() != "" && u.GetNamespace() != namespace) {
+			continue
+		}
+		switch gvk := u.GroupVersionKind(); {
+		case gvk.Group == "" && gvk.Kind == "PersistentVolumeClaim":
+			claims = append(claims, u.GetName())
+		case gvk.Group == "apps" && gvk.Kind == "StatefulSet":
+			replicas, ok, err := unstructured.NestedInt64(u.Object, "spec", "replicas")
+			if err != nil || !ok {
+				replicas = 1
+			}
+			templates, _, _ := unstructured.NestedSlice(u.Object, "spec", "volumeClaimTemplates")
+			for _, t := range templates {
+				m, ok := t.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				name, _, _ := unstructured.NestedString(m, "metadata", "name")
+				for i := int64(0); i < replicas; i++ {
+					claims = append(claims, fmt.Sprintf("%s-%s-%d", name, u.GetName(), i))
+				}
+			}
+		}
+	}
+	return claims, nil
+}
@@ -0,0 +1,115 @@
+package snapshot
+
+import (
+	"time"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+	"github.com/joelanford/helm-operator/pkg/internal/values"
+)
+
+const (
+	// DefaultKeepLast is how many completed snapshot sets of a release are
+	// kept when `snapshot.keepLast` is not set.
+	DefaultKeepLast = 3
+
+	// DefaultReadyTimeout is how long the snapshots of a set may take to
+	// become ready to use when `snapshot.readyTimeout` is not set.
+	DefaultReadyTimeout = 10 * time.Minute
+)
+
+// options holds the settings of the volume snapshots of a release. They are
+// read from the following values:
+//
+//   - snapshot.enabled - whether the volumes are snapshotted once per
+//     generation of the custom resource (default false).
+//   - snapshot.interval - how often the volumes are snapshotted again, as a
+//     duration string (default never).
+//   - snapshot.volumeSnapshotClassName - the VolumeSnapshotClass of the
+//     snapshots (default the default class of the CSI driver).
+//   - snapshot.labelSelector - the persistent volume claims in the release
+//     namespace that are snapshotted along with the ones of the release,
+//     given either as a string ("app=matrix") or as a LabelSelector map.
+//   - snapshot.keepLast - how many completed snapshot sets are kept
+//     (default 3).
+//   - snapshot.readyTimeout - how long the snapshots may take to become
+//     ready to use, as a duration string (default 10m).
+type options struct {
+	enabled                 bool
+	interval                time.Duration
+	volumeSnapshotClassName string
+	selector                labels.Selector
+	keepLast                int
+	readyTimeout            time.Duration
+}
+
+func invalidValuesError(path string, format string, args ...interface{}) error {
+	return values.InvalidError(ErrInvalidValues, path, format, args...)
+}
+
+func optionsFor(vals chartutil.Values) (options, error) {
+	opts := options{keepLast: DefaultKeepLast, readyTimeout: DefaultReadyTimeout}
+
+	if v, ok := values.Lookup(vals, "snapshot.enabled"); ok {
+		b, ok := v.(bool)
+		if !ok {
+			return opts, invalidValuesError("snapshot.enabled", "must be a boolean, got %v", v)
+		}
+		opts.enabled = b
+	}
+	if v, ok := values.Lookup(vals, "snapshot.volumeSnapshotClassName"); ok {
+		s, ok := v.(string)
+		if !ok || len(validation.IsDNS1123Subdomain(s)) > 0 {
+			return opts, invalidValuesError("snapshot.volumeSnapshotClassName", "%v is not a valid object name", v)
+		}
+		opts.volumeSnapshotClassName = s
+	}
+	if v, ok := values.Lookup(vals, "snapshot.labelSelector"); ok {
+		selector, err := backup.ParseLabelSelector(v)
+		if err != nil {
+			return opts, invalidValuesError("snapshot.labelSelector", "%v", err)
+		}
+		// An empty selector would match every claim in the namespace.
+		if len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0 {
+			return opts, invalidValuesError("snapshot.labelSelector", "must not be empty")
+		}
+		if opts.selector, err = metav1.LabelSelectorAsSelector(selector); err != nil {
+			return opts, invalidValuesError("snapshot.labelSelector", "%v", err)
+		}
+	}
+	if v, ok := values.Lookup(vals, "snapshot.keepLast"); ok {
+		n, ok := values.ToInt(v)
+		if !ok || n < 1 {
+			return opts, invalidValuesError("snapshot.keepLast", "must be a positive integer, got %v", v)
+		}
+		opts.keepLast = n
+	}
+	for path, d := range map[string]*time.Duration{
+		"snapshot.interval":     &opts.interval,
+		"snapshot.readyTimeout": &opts.readyTimeout,
+	} {
+		v, ok := values.Lookup(vals, path)
+		if !ok {
+			continue
+		}
+		s, ok := v.(string)
+		parsed, err := time.ParseDuration(s)
+		if !ok || err != nil || parsed <= 0 {
+			return opts, invalidValuesError(path, "must be a positive duration, got %v", v)
+		}
+		*d = parsed
+	}
+	return opts, nil
+}
+
+// ValidateValues checks the snapshot values without looking at the cluster,
+// so that a custom resource whose volumes could never be snapshotted can be
+// rejected before it is admitted. The returned error wraps ErrInvalidValues.
+func ValidateValues(vals chartutil.Values) error {
+	_, err := optionsFor(vals)
+	return err
+}
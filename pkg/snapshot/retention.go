@@ -0,0 +1,110 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	"helm.sh/helm/v3/pkg/chartutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+)
+
+// snapshotSet is the VolumeSnapshots of a release that were taken together.
+type snapshotSet struct {
+	name      string
+	snapshots []unstructured.Unstructured
+	ready     bool
+}
+
+// Prune deletes the snapshot sets of the release of obj that fall outside
+// `snapshot.keepLast`, newest first by name. Sets that are incomplete, i.e.
+// failed or interrupted, are deleted as well, except for the set recorded in
+// the status of obj, which may still be in progress. The most recent
+// completed set is always kept, so that the volumes can be restored.
+//
+// It returns the names of the sets whose deletion was requested.
+func (s *Snapshotter) Prune(ctx context.Context, obj *unstructured.Unstructured, vals chartutil.Values, log logr.Logger) ([]string, error) {
+	opts, err := optionsFor(vals)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := s.sets(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	var current string
+	if st := StatusFor(obj); st != nil {
+		current = st.Name
+	}
+
+	var pruned []string
+	kept := 0
+	for _, set := range sets {
+		switch {
+		case set.name == current:
+			if set.ready {
+				kept++
+			}
+			continue
+		case set.ready && kept < opts.keepLast:
+			kept++
+			continue
+		}
+		for i := range set.snapshots {
+			if err := s.client.Delete(ctx, &set.snapshots[i]); err != nil && !apierrors.IsNotFound(err) {
+				return pruned, fmt.Errorf("delete volume snapshot %q: %w", set.snapshots[i].GetName(), err)
+			}
+		}
+		log.Info("Pruned volume snapshots", "snapshot", set.name, "volumes", len(set.snapshots))
+		pruned = append(pruned, set.name)
+	}
+	return pruned, nil
+}
+
+// sets returns the snapshot sets of the release of obj, newest first. Set
+// names end in the time they were started, so they sort by age. Snapshots
+// are taken in the namespace of the release, which is recorded in the
+// status of obj once a snapshot has been taken.
+func (s *Snapshotter) sets(ctx context.Context, obj *unstructured.Unstructured) ([]snapshotSet, error) {
+	namespace := backup.ReleaseNamespace(obj, nil)
+	if st := StatusFor(obj); st != nil && st.Namespace != "" {
+		namespace = st.Namespace
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(VolumeSnapshotGVK.GroupVersion().WithKind(VolumeSnapshotGVK.Kind + "List"))
+	if err := s.client.List(ctx, list, client.InNamespace(namespace), client.MatchingLabels(backup.ReleaseLabels(obj))); err != nil {
+		// Without the CRD, there are no snapshots to prune.
+		if meta.IsNoMatchError(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list volume snapshots: %w", err)
+	}
+	byName := map[string]*snapshotSet{}
+	for _, vs := range list.Items {
+		name := vs.GetLabels()[SetLabel]
+		if name == "" {
+			continue
+		}
+		set, ok := byName[name]
+		if !ok {
+			set = &snapshotSet{name: name, ready: true}
+			byName[name] = set
+		}
+		set.snapshots = append(set.snapshots, vs)
+		if ready, _, _ := unstructured.NestedBool(vs.Object, "status", "readyToUse"); !ready {
+			set.ready = false
+		}
+	}
+	sets := make([]snapshotSet, 0, len(byName))
+	for _, set := range byName {
+		sets = append(sets, *set)
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].name > sets[j].name })
+	return sets, nil
+}
@@ -0,0 +1,123 @@
+package snapshot_test
+
+import (
+	"context"
+
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+	"github.com/joelanford/helm-operator/pkg/snapshot"
+)
+
+var _ = Describe("Prune", func() {
+	var (
+		cl  client.Client
+		s   snapshot.Snapshotter
+		obj *unstructured.Unstructured
+	)
+
+	BeforeEach(func() {
+		cl = newFakeClient()
+		s = snapshot.NewSnapshotter(cl)
+		obj = &unstructured.Unstructured{}
+		obj.SetName("test")
+		obj.SetNamespace("matrix")
+	})
+
+	createSetIn := func(namespace, name string, ready bool) {
+		for _, claim := range []string{"media", "data"} {
+			vs := &unstructured.Unstructured{}
+			vs.SetGroupVersionKind(snapshot.VolumeSnapshotGVK)
+			vs.SetNamespace(namespace)
+			vs.SetName(name + "-" + claim)
+			vs.SetLabels(map[string]string{
+				backup.ReleaseNameLabel:      "test",
+				backup.ReleaseNamespaceLabel: "matrix",
+				snapshot.SetLabel:            name,
+			})
+			Expect(unstructured.SetNestedField(vs.Object, ready, "status", "readyToUse")).To(Succeed())
+			Expect(cl.Create(context.TODO(), vs)).To(Succeed())
+		}
+	}
+
+	createSet := func(name string, ready bool) {
+		createSetIn("matrix", name, ready)
+	}
+
+	remaining := func() []string {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(snapshot.VolumeSnapshotGVK.GroupVersion().WithKind("VolumeSnapshotList"))
+		Expect(cl.List(context.TODO(), list)).To(Succeed())
+		var names []string
+		for _, vs := range list.Items {
+			names = append(names, vs.GetName())
+		}
+		return names
+	}
+
+	It("should keep the newest completed sets", func() {
+		createSet("matrix-snapshot-test-20200101000000", true)
+		createSet("matrix-snapshot-test-20200102000000", true)
+		createSet("matrix-snapshot-test-20200103000000", true)
+
+		pruned, err := s.Prune(context.TODO(), obj, chartutil.Values{"snapshot": map[string]interface{}{"keepLast": 2}}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(Equal([]string{"matrix-snapshot-test-20200101000000"}))
+		Expect(remaining()).To(ConsistOf(
+			"matrix-snapshot-test-20200102000000-media", "matrix-snapshot-test-20200102000000-data",
+			"matrix-snapshot-test-20200103000000-media", "matrix-snapshot-test-20200103000000-data",
+		))
+	})
+
+	It("should keep three completed sets by default", func() {
+		for _, name := range []string{"20200101000000", "20200102000000", "20200103000000", "20200104000000"} {
+			createSet("matrix-snapshot-test-"+name, true)
+		}
+		pruned, err := s.Prune(context.TODO(), obj, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(Equal([]string{"matrix-snapshot-test-20200101000000"}))
+	})
+
+	It("should delete incomplete sets but the one in progress", func() {
+		createSet("matrix-snapshot-test-20200101000000", true)
+		createSet("matrix-snapshot-test-20200102000000", false)
+		createSet("matrix-snapshot-test-20200103000000", false)
+		Expect(unstructured.SetNestedField(obj.Object, "matrix-snapshot-test-20200103000000", "status", "snapshot", "name")).To(Succeed())
+
+		pruned, err := s.Prune(context.TODO(), obj, chartutil.Values{"snapshot": map[string]interface{}{"keepLast": 1}}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(Equal([]string{"matrix-snapshot-test-20200102000000"}))
+		Expect(remaining()).To(ConsistOf(
+			"matrix-snapshot-test-20200101000000-media", "matrix-snapshot-test-20200101000000-data",
+			"matrix-snapshot-test-20200103000000-media", "matrix-snapshot-test-20200103000000-data",
+		))
+	})
+
+	It("should leave the snapshots of other releases alone", func() {
+		createSet("matrix-snapshot-test-20200101000000", true)
+		createSet("matrix-snapshot-test-20200102000000", true)
+		other := &unstructured.Unstructured{}
+		other.SetName("other")
+		other.SetNamespace("matrix")
+
+		pruned, err := s.Prune(context.TODO(), other, chartutil.Values{"snapshot": map[string]interface{}{"keepLast": 1}}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(BeEmpty())
+		Expect(remaining()).To(HaveLen(4))
+	})
+
+	It("should leave the snapshots in other namespaces alone", func() {
+		createSetIn("elsewhere", "matrix-snapshot-test-20200101000000", true)
+		createSet("matrix-snapshot-test-20200102000000", true)
+
+		pruned, err := s.Prune(context.TODO(), obj, chartutil.Values{"snapshot": map[string]interface{}{"keepLast": 1}}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(pruned).To(BeEmpty())
+		Expect(remaining()).To(HaveLen(4))
+	})
+})
@@ -1,14 +1,14 @@
 package snapshot
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	lg "log"
 	"os"
+	"time"
 
 	"github.com/go-logr/logr"
-	//helmclient "github.com/joelanford/helm-operator/pkg/client"
-	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/chartutil"
@@ -17,70 +17,302 @@ import (
 	"helm.sh/helm/v3/pkg/getter"
 	"helm.sh/helm/v3/pkg/release"
 	"helm.sh/helm/v3/pkg/repo"
-
-	//"k8s.io/apimachinery/pkg/api/meta"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	//"k8s.io/apimachinery/pkg/runtime/schema"
-	//ctrl "sigs.k8s.io/controller-runtime"
-	//"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
 )
 
+// ErrInvalidValues is wrapped by every error caused by snapshot values that
+// cannot be turned into volume snapshots. Such errors do not go away until
+// the custom resource is changed, so they are reported rather than retried.
+var ErrInvalidValues = errors.New("invalid snapshot values")
+
+// VolumeSnapshotGVK is the CSI VolumeSnapshot kind the snapshots are taken
+// with.
+var VolumeSnapshotGVK = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1beta1", Kind: "VolumeSnapshot"}
+
+// DefaultPollInterval is how long to wait before checking on volume
+// snapshots that are not ready to use yet.
+const DefaultPollInterval = 10 * time.Second
+
 const (
-	//SnapshotDir is the relative directory where snapshot chart is loaded
-	SnapshotDir string = "velero"
+	// SetLabel is set on every VolumeSnapshot to the name of the snapshot
+	// set it belongs to, so that the snapshots taken together can be found
+	// and pruned together.
+	SetLabel = "helm.operator-sdk/snapshot-set"
+
+	// RequestAnnotation requests an on-demand snapshot of the volumes of
+	// the release of a custom resource. Snapshots are taken whenever its
+	// value changes to one that has not been handled yet, e.g. a timestamp
+	// or a counter.
+	RequestAnnotation = "helm.operator-sdk/snapshot-request"
 )
 
-//SnapPreHook1 helps to take snapshot at deletion
-func SnapPreHook1(obj *unstructured.Unstructured, vals chartutil.Values, log logr.Logger) error {
-	log.Info("IN SNAPSHOT1 HOOK")
-	return nil
+// Phase is the phase of a snapshot set as tracked in the custom resource
+// status.
+type Phase string
+
+const (
+	PhaseInProgress Phase = "InProgress"
+	PhaseCompleted  Phase = "Completed"
+	PhaseFailed     Phase = "Failed"
+)
+
+// Status records the most recent set of volume snapshots of a custom
+// resource's release. It is stored in `status.snapshot` so that the
+// snapshots can be followed across reconciliations until they are ready to
+// use instead of waiting for them in a single one.
+//
+// RequestToken is the value of RequestAnnotation when the set was started,
+// so that every value is handled once. Volumes lists the snapshot of every
+// persistent volume claim in the set, all of which are in Namespace, the
+// namespace of the release.
+type Status struct {
+	Name                string       `json:"name"`
+	Namespace           string       `json:"namespace"`
+	Phase               Phase        `json:"phase"`
+	Message             string       `json:"message,omitempty"`
+	RequestToken        string       `json:"requestToken,omitempty"`
+	ObservedGeneration  int64        `json:"observedGeneration,omitempty"`
+	StartTimestamp      *metav1.Time `json:"startTimestamp,omitempty"`
+	CompletionTimestamp *metav1.Time `json:"completionTimestamp,omitempty"`
+	Volumes             []Volume     `json:"volumes,omitempty"`
 }
 
-//SnapPreHook helps to take snapshot at deletion
-func SnapPreHook(obj *unstructured.Unstructured, vals chartutil.Values, log logr.Logger) error {
+// Volume is the VolumeSnapshot SnapshotName of the persistent volume claim
+// ClaimName. RestoreSize is the minimum size of a volume restored from it
+// and Error the last error reported by the snapshot controller, if any.
+type Volume struct {
+	ClaimName    string `json:"claimName"`
+	SnapshotName string `json:"snapshotName"`
+	ReadyToUse   bool   `json:"readyToUse,omitempty"`
+	RestoreSize  string `json:"restoreSize,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// IsInProgress returns whether the snapshot set has been started and not
+// all of its snapshots are ready to use yet.
+func (s *Status) IsInProgress() bool {
+	return s != nil && s.Phase == PhaseInProgress
+}
 
-	log.Info("IN SNAPSHOT HOOK")
+// StatusFor returns the snapshot status recorded in obj, or nil if none has
+// been recorded yet.
+func StatusFor(obj *unstructured.Unstructured) *Status {
+	if obj == nil {
+		return nil
+	}
+	m, ok, err := unstructured.NestedMap(obj.Object, "status", "snapshot")
+	if err != nil || !ok {
+		return nil
+	}
+	st := &Status{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(m, st); err != nil {
+		return nil
+	}
+	return st
+}
 
-	/*chart, err := LoadSnapshotChart(log)
+// Snapshotter takes CSI volume snapshots of the persistent volume claims of
+// releases, tracks them in the status of their custom resources and prunes
+// the ones that are no longer kept.
+type Snapshotter struct {
+	client client.Client
+}
+
+// NewSnapshotter returns a Snapshotter that takes volume snapshots with
+// client.
+func NewSnapshotter(client client.Client) Snapshotter {
+	return Snapshotter{
+		client: client,
+	}
+}
+
+// Reconcile moves the snapshot set of the release of obj forward and returns
+// the resulting status, along with how long to wait before it needs to be
+// looked at again. It never waits for the snapshots itself:
+//
+//   - If no set is in progress and one is requested, a VolumeSnapshot is
+//     created for every persistent volume claim of the release and an
+//     InProgress status is returned.
+//   - If a set is in progress, its VolumeSnapshots are checked once and the
+//     status is moved to Completed when all of them are ready to use, or to
+//     Failed if that takes longer than `snapshot.readyTimeout`.
+//
+// A set is requested by a new value of RequestAnnotation, or by
+// `snapshot.enabled`, in which case it is taken once per generation of the
+// custom resource and again whenever `snapshot.interval` has passed since
+// the last one was started. A nil status means no snapshots have been
+// requested.
+func (s *Snapshotter) Reconcile(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, vals chartutil.Values, log logr.Logger) (*Status, time.Duration, error) {
+	st := StatusFor(obj)
+	opts, err := optionsFor(vals)
 	if err != nil {
-		log.Error(err, "Failed to load velero chart")
-		return err
-	}*/
-	/*
-		cfg, err := config.GetConfig()
-		if err != nil {
-			log.Error(err, "unable to get config")
-			os.Exit(1)
+		return st, 0, err
+	}
+	if st.IsInProgress() {
+		return s.sync(ctx, st, opts, log)
+	}
+	if token := obj.GetAnnotations()[RequestAnnotation]; token != "" && (st == nil || st.RequestToken != token) {
+		return s.start(ctx, obj, rel, opts, log)
+	}
+	if !opts.enabled {
+		return st, 0, nil
+	}
+	if st == nil || st.ObservedGeneration != obj.GetGeneration() {
+		return s.start(ctx, obj, rel, opts, log)
+	}
+	if opts.interval > 0 && st.StartTimestamp != nil {
+		if wait := time.Until(st.StartTimestamp.Add(opts.interval)); wait > 0 {
+			return st, wait, nil
 		}
-		mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{})
-		snapLog := ctrl.Log.WithName("Snapshot_Helm_CLient")
-		cfgGetter := helmclient.NewActionConfigGetter(cfg, mapper, snapLog)
-		acg := helmclient.NewActionClientGetter(cfgGetter)
-		acf, err := acg.ActionClientFor(obj)
-		var opts []helmclient.InstallOption
-		rel, err := acf.Install("velero", "", chart, vals.AsMap(), opts...)
-		if err != nil {
-			log.Error(err, "Failed to install velero chart")
-			return err
+		return s.start(ctx, obj, rel, opts, log)
+	}
+	return st, 0, nil
+}
+
+// start creates a VolumeSnapshot of every persistent volume claim of rel.
+// A release without claims gets a Completed set without volumes.
+func (s *Snapshotter) start(ctx context.Context, obj *unstructured.Unstructured, rel *release.Release, opts options, log logr.Logger) (*Status, time.Duration, error) {
+	claims, err := s.claims(ctx, backup.ReleaseNamespace(obj, rel), rel, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := metav1.Now().Rfc3339Copy()
+	st := &Status{
+		Name:               fmt.Sprintf("matrix-snapshot-%s-%s", obj.GetName(), now.UTC().Format("20060102150405")),
+		Namespace:          backup.ReleaseNamespace(obj, rel),
+		Phase:              PhaseInProgress,
+		RequestToken:       obj.GetAnnotations()[RequestAnnotation],
+		ObservedGeneration: obj.GetGeneration(),
+		StartTimestamp:     &now,
+	}
+	if len(claims) == 0 {
+		return finish(st, PhaseCompleted, "the release has no persistent volume claims"), 0, nil
+	}
+	for _, claim := range claims {
+		vs := newVolumeSnapshot(obj, st.Name, st.Namespace, claim, opts.volumeSnapshotClassName)
+		if err := s.client.Create(ctx, vs); err != nil {
+			if meta.IsNoMatchError(err) {
+				return finish(st, PhaseFailed, "the VolumeSnapshot CRD of the CSI snapshotter is not installed"), 0, nil
+			}
+			if !apierrors.IsAlreadyExists(err) {
+				// The set is not recorded in the status, so the snapshots
+				// taken so far are deleted rather than left incomplete.
+				s.deleteVolumes(ctx, st, log)
+				return nil, 0, fmt.Errorf("create volume snapshot %q: %w", vs.GetName(), err)
+			}
 		}
+		st.Volumes = append(st.Volumes, Volume{ClaimName: claim, SnapshotName: vs.GetName()})
+	}
+	log.Info("Volume snapshots started", "snapshot", st.Name, "volumes", len(st.Volumes))
+	return st, DefaultPollInterval, nil
+}
 
-	*/
-	/*
-			rel, err := installChart(chart)
+// deleteVolumes deletes the VolumeSnapshots of the set recorded in st. Errors
+// are only logged, as Prune deletes incomplete sets as well.
+func (s *Snapshotter) deleteVolumes(ctx context.Context, st *Status, log logr.Logger) {
+	for _, v := range st.Volumes {
+		vs := &unstructured.Unstructured{}
+		vs.SetGroupVersionKind(VolumeSnapshotGVK)
+		vs.SetNamespace(st.Namespace)
+		vs.SetName(v.SnapshotName)
+		if err := s.client.Delete(ctx, vs); err != nil && !apierrors.IsNotFound(err) {
+			log.Error(err, "Failed to delete volume snapshot", "snapshot", st.Name, "volumeSnapshot", v.SnapshotName)
+		}
+	}
+}
 
-			if err != nil {
-				log.Error(err, "Failed to install velero chart")
-				return err
+// sync checks the VolumeSnapshots of the set recorded in st once.
+func (s *Snapshotter) sync(ctx context.Context, st *Status, opts options, log logr.Logger) (*Status, time.Duration, error) {
+	ready := 0
+	for i := range st.Volumes {
+		v := &st.Volumes[i]
+		vs := &unstructured.Unstructured{}
+		vs.SetGroupVersionKind(VolumeSnapshotGVK)
+		if err := s.client.Get(ctx, client.ObjectKey{Namespace: st.Namespace, Name: v.SnapshotName}, vs); err != nil {
+			if apierrors.IsNotFound(err) {
+				return finish(st, PhaseFailed, fmt.Sprintf("volume snapshot %q no longer exists", v.SnapshotName)), 0, nil
 			}
+			return st, 0, err
+		}
+		v.ReadyToUse, _, _ = unstructured.NestedBool(vs.Object, "status", "readyToUse")
+		v.RestoreSize, _, _ = unstructured.NestedString(vs.Object, "status", "restoreSize")
+		v.Error, _, _ = unstructured.NestedString(vs.Object, "status", "error", "message")
+		if v.ReadyToUse {
+			ready++
+		}
+	}
+	if ready == len(st.Volumes) {
+		log.Info("Volume snapshots completed", "snapshot", st.Name, "volumes", len(st.Volumes))
+		return finish(st, PhaseCompleted, ""), 0, nil
+	}
 
-		log.Info(fmt.Sprintf("release info: %v", rel))
-	*/
+	// Errors reported by the snapshot controller may be transient, as it
+	// keeps retrying, so the set only fails once it has timed out.
+	st.Message = fmt.Sprintf("%d/%d volume snapshots ready to use", ready, len(st.Volumes))
+	for _, v := range st.Volumes {
+		if v.Error != "" {
+			st.Message += fmt.Sprintf(": %s: %s", v.SnapshotName, v.Error)
+			break
+		}
+	}
+	if st.StartTimestamp != nil && time.Since(st.StartTimestamp.Time) > opts.readyTimeout {
+		log.Info("Volume snapshots timed out", "snapshot", st.Name, "timeout", opts.readyTimeout)
+		return finish(st, PhaseFailed, fmt.Sprintf("volume snapshots were not ready to use within %s: %s", opts.readyTimeout, st.Message)), 0, nil
+	}
+	return st, DefaultPollInterval, nil
+}
 
-	log.Info("OUT SNAPSHOT HOOK")
+func finish(st *Status, phase Phase, message string) *Status {
+	now := metav1.Now().Rfc3339Copy()
+	st.Phase = phase
+	st.Message = message
+	st.CompletionTimestamp = &now
+	return st
+}
+
+// newVolumeSnapshot returns a VolumeSnapshot of claim that belongs to the
+// snapshot set of obj named set. It carries the release labels of backups,
+// so that volume snapshots and backups of a release are found alike.
+func newVolumeSnapshot(obj *unstructured.Unstructured, set, namespace, claim, className string) *unstructured.Unstructured {
+	vs := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{
+				"persistentVolumeClaimName": claim,
+			},
+		},
+	}}
+	if className != "" {
+		_ = unstructured.SetNestedField(vs.Object, className, "spec", "volumeSnapshotClassName")
+	}
+	vs.SetGroupVersionKind(VolumeSnapshotGVK)
+	vs.SetNamespace(namespace)
+	vs.SetName(snapshotName(set, claim))
+	labels := backup.ReleaseLabels(obj)
+	labels[SetLabel] = set
+	vs.SetLabels(labels)
+	return vs
+}
 
-	return nil
+// snapshotName returns the name of the VolumeSnapshot of claim in set,
+// shortened like the names of Velero objects if necessary.
+func snapshotName(set, claim string) string {
+	return backup.ShortenName(set + "-" + claim)
 }
 
+const (
+	//SnapshotDir is the relative directory where snapshot chart is loaded
+	SnapshotDir string = "velero"
+)
+
 //Load Snapshot Chart
 func LoadSnapshotChart(log logr.Logger) (*chart.Chart, error) {
 
@@ -131,27 +363,3 @@ func LoadSnapshotChart(log logr.Logger) (*chart.Chart, error) {
 	return chart, nil
 
 }
-
-func installChart(chart *chart.Chart) (*release.Release, error) {
-
-	settings := helmcli.New()
-
-	//a := action.Configuration.
-	actionConfig := new(action.Configuration)
-
-	if err := actionConfig.Init(settings.RESTClientGetter(), "", os.Getenv("HELM_DRIVER"), lg.Printf); err != nil {
-		return nil, err
-	}
-
-	installer := action.NewInstall(actionConfig)
-	installer.Namespace = "default"
-	installer.ReleaseName = "velero-snapshotter"
-
-	//release
-	//values map
-	rel, err := installer.Run(chart, nil)
-	if err != nil {
-		return nil, err
-	}
-	return rel, nil
-}
@@ -0,0 +1,363 @@
+package snapshot_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joelanford/helm-operator/pkg/backup"
+	"github.com/joelanford/helm-operator/pkg/snapshot"
+)
+
+const manifest = `---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: media
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: postgres
+spec:
+  replicas: 2
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: synapse
+`
+
+// newFakeClient returns a fake client that can list persistent volume
+// claims and volume snapshots, whose list kinds it does not know otherwise.
+func newFakeClient() client.Client {
+	sch := runtime.NewScheme()
+	sch.AddKnownTypeWithName(schema.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaimList"}, &unstructured.UnstructuredList{})
+	sch.AddKnownTypeWithName(snapshot.VolumeSnapshotGVK.GroupVersion().WithKind("VolumeSnapshotList"), &unstructured.UnstructuredList{})
+	return fake.NewFakeClientWithScheme(sch)
+}
+
+func createClaim(cl client.Client, name string, labels map[string]string) {
+	pvc := &unstructured.Unstructured{}
+	pvc.SetAPIVersion("v1")
+	pvc.SetKind("PersistentVolumeClaim")
+	pvc.SetNamespace("matrix")
+	pvc.SetName(name)
+	pvc.SetLabels(labels)
+	Expect(cl.Create(context.TODO(), pvc)).To(Succeed())
+}
+
+// failingCreateClient fails to create the objects whose names end in suffix.
+type failingCreateClient struct {
+	client.Client
+	suffix string
+	err    error
+}
+
+func (c failingCreateClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	if o, ok := obj.(metav1.Object); ok && strings.HasSuffix(o.GetName(), c.suffix) {
+		return c.err
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func getVolumeSnapshot(cl client.Client, name string) (*unstructured.Unstructured, error) {
+	vs := &unstructured.Unstructured{}
+	vs.SetGroupVersionKind(snapshot.VolumeSnapshotGVK)
+	err := cl.Get(context.TODO(), client.ObjectKey{Namespace: "matrix", Name: name}, vs)
+	return vs, err
+}
+
+func setReadyToUse(cl client.Client, name string) {
+	vs, err := getVolumeSnapshot(cl, name)
+	Expect(err).To(BeNil())
+	Expect(unstructured.SetNestedField(vs.Object, true, "status", "readyToUse")).To(Succeed())
+	Expect(unstructured.SetNestedField(vs.Object, "1Gi", "status", "restoreSize")).To(Succeed())
+	Expect(cl.Update(context.TODO(), vs)).To(Succeed())
+}
+
+var _ = Describe("Snapshotter", func() {
+	var (
+		cl   client.Client
+		s    snapshot.Snapshotter
+		obj  *unstructured.Unstructured
+		rel  *release.Release
+		vals chartutil.Values
+	)
+
+	BeforeEach(func() {
+		cl = newFakeClient()
+		s = snapshot.NewSnapshotter(cl)
+		obj = &unstructured.Unstructured{}
+		obj.SetName("test")
+		obj.SetNamespace("matrix")
+		obj.SetGeneration(1)
+		rel = &release.Release{Name: "test", Namespace: "matrix", Version: 1, Manifest: manifest}
+		vals = chartutil.Values{"snapshot": map[string]interface{}{"enabled": true}}
+		createClaim(cl, "media", nil)
+		createClaim(cl, "data-postgres-0", nil)
+		createClaim(cl, "data-postgres-1", nil)
+	})
+
+	setStatus := func(st *snapshot.Status) {
+		m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(st)
+		Expect(err).To(BeNil())
+		Expect(unstructured.SetNestedMap(obj.Object, m, "status", "snapshot")).To(Succeed())
+	}
+
+	It("should do nothing unless snapshots are enabled or requested", func() {
+		st, requeueAfter, err := s.Reconcile(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st).To(BeNil())
+		Expect(requeueAfter).To(BeZero())
+	})
+
+	It("should snapshot every persistent volume claim of the release", func() {
+		st, requeueAfter, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(Equal(snapshot.DefaultPollInterval))
+		Expect(st.Phase).To(Equal(snapshot.PhaseInProgress))
+		Expect(st.Name).To(HavePrefix("matrix-snapshot-test-"))
+		Expect(st.Namespace).To(Equal("matrix"))
+		Expect(st.ObservedGeneration).To(Equal(int64(1)))
+		Expect(st.Volumes).To(HaveLen(3))
+
+		claims := []string{}
+		for _, v := range st.Volumes {
+			claims = append(claims, v.ClaimName)
+			vs, err := getVolumeSnapshot(cl, v.SnapshotName)
+			Expect(err).To(BeNil())
+			Expect(vs.GetLabels()).To(HaveKeyWithValue(backup.ReleaseNameLabel, "test"))
+			Expect(vs.GetLabels()).To(HaveKeyWithValue(snapshot.SetLabel, st.Name))
+			claim, _, _ := unstructured.NestedString(vs.Object, "spec", "source", "persistentVolumeClaimName")
+			Expect(claim).To(Equal(v.ClaimName))
+			_, ok, _ := unstructured.NestedString(vs.Object, "spec", "volumeSnapshotClassName")
+			Expect(ok).To(BeFalse())
+		}
+		Expect(claims).To(Equal([]string{"data-postgres-0", "data-postgres-1", "media"}))
+	})
+
+	It("should use the configured volume snapshot class", func() {
+		vals["snapshot"].(map[string]interface{})["volumeSnapshotClassName"] = "csi-hostpath"
+		st, _, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		vs, err := getVolumeSnapshot(cl, st.Volumes[0].SnapshotName)
+		Expect(err).To(BeNil())
+		class, _, _ := unstructured.NestedString(vs.Object, "spec", "volumeSnapshotClassName")
+		Expect(class).To(Equal("csi-hostpath"))
+	})
+
+	It("should also snapshot claims matched by the label selector", func() {
+		createClaim(cl, "uploads", map[string]string{"app": "matrix"})
+		createClaim(cl, "other", map[string]string{"app": "other"})
+		vals["snapshot"].(map[string]interface{})["labelSelector"] = "app=matrix"
+		st, _, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		claims := []string{}
+		for _, v := range st.Volumes {
+			claims = append(claims, v.ClaimName)
+		}
+		Expect(claims).To(Equal([]string{"data-postgres-0", "data-postgres-1", "media", "uploads"}))
+	})
+
+	It("should leave out claims that do not exist", func() {
+		rel.Manifest += `---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: missing
+`
+		st, _, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Volumes).To(HaveLen(3))
+	})
+
+	It("should shorten long snapshot names and keep them unique", func() {
+		obj.SetName(strings.Repeat("a", 240))
+		st, _, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		names := map[string]bool{}
+		for _, v := range st.Volumes {
+			Expect(len(v.SnapshotName)).To(BeNumerically("<=", 253))
+			names[v.SnapshotName] = true
+		}
+		Expect(names).To(HaveLen(3))
+	})
+
+	It("should delete the snapshots taken so far if a snapshot cannot be created", func() {
+		errCreate := errors.New("create rejected")
+		s = snapshot.NewSnapshotter(failingCreateClient{Client: cl, suffix: "-media", err: errCreate})
+		st, _, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(MatchError(errCreate))
+		Expect(st).To(BeNil())
+
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(snapshot.VolumeSnapshotGVK.GroupVersion().WithKind("VolumeSnapshotList"))
+		Expect(cl.List(context.TODO(), list)).To(Succeed())
+		Expect(list.Items).To(BeEmpty())
+	})
+
+	It("should complete without volumes if the release has no claims", func() {
+		rel.Manifest = ""
+		st, requeueAfter, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(BeZero())
+		Expect(st.Phase).To(Equal(snapshot.PhaseCompleted))
+		Expect(st.Volumes).To(BeEmpty())
+	})
+
+	It("should wait until all snapshots are ready to use", func() {
+		st, _, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setReadyToUse(cl, st.Volumes[0].SnapshotName)
+		setStatus(st)
+
+		st, requeueAfter, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(Equal(snapshot.DefaultPollInterval))
+		Expect(st.Phase).To(Equal(snapshot.PhaseInProgress))
+		Expect(st.Message).To(Equal("1/3 volume snapshots ready to use"))
+		Expect(st.Volumes[0].ReadyToUse).To(BeTrue())
+		Expect(st.Volumes[0].RestoreSize).To(Equal("1Gi"))
+
+		for _, v := range st.Volumes[1:] {
+			setReadyToUse(cl, v.SnapshotName)
+		}
+		setStatus(st)
+		st, requeueAfter, err = s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(BeZero())
+		Expect(st.Phase).To(Equal(snapshot.PhaseCompleted))
+		Expect(st.CompletionTimestamp).NotTo(BeNil())
+	})
+
+	It("should report snapshot errors and fail once the ready timeout has passed", func() {
+		st, _, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		vs, err := getVolumeSnapshot(cl, st.Volumes[0].SnapshotName)
+		Expect(err).To(BeNil())
+		Expect(unstructured.SetNestedField(vs.Object, "driver unavailable", "status", "error", "message")).To(Succeed())
+		Expect(cl.Update(context.TODO(), vs)).To(Succeed())
+		setStatus(st)
+
+		st, _, err = s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(snapshot.PhaseInProgress))
+		Expect(st.Volumes[0].Error).To(Equal("driver unavailable"))
+		Expect(st.Message).To(ContainSubstring("driver unavailable"))
+
+		started := metav1.NewTime(time.Now().Add(-time.Hour))
+		st.StartTimestamp = &started
+		setStatus(st)
+		st, _, err = s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(snapshot.PhaseFailed))
+		Expect(st.Message).To(HavePrefix("volume snapshots were not ready to use within 10m0s"))
+	})
+
+	It("should fail if a snapshot no longer exists", func() {
+		st, _, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		vs, err := getVolumeSnapshot(cl, st.Volumes[1].SnapshotName)
+		Expect(err).To(BeNil())
+		Expect(cl.Delete(context.TODO(), vs)).To(Succeed())
+		setStatus(st)
+
+		st, _, err = s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(snapshot.PhaseFailed))
+		Expect(st.Message).To(ContainSubstring("no longer exists"))
+	})
+
+	It("should snapshot once per generation", func() {
+		st, _, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		for _, v := range st.Volumes {
+			setReadyToUse(cl, v.SnapshotName)
+		}
+		setStatus(st)
+		st, _, err = s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		setStatus(st)
+
+		next, requeueAfter, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(BeZero())
+		Expect(next.Name).To(Equal(st.Name))
+		Expect(next.Phase).To(Equal(snapshot.PhaseCompleted))
+
+		obj.SetGeneration(2)
+		next, _, err = s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(next.Phase).To(Equal(snapshot.PhaseInProgress))
+		Expect(next.ObservedGeneration).To(Equal(int64(2)))
+	})
+
+	It("should snapshot again once the interval has passed", func() {
+		vals["snapshot"].(map[string]interface{})["interval"] = "1h"
+		started := metav1.NewTime(time.Now().Add(-30 * time.Minute).Truncate(time.Second))
+		setStatus(&snapshot.Status{Name: "matrix-snapshot-test-20200101000000", Namespace: "matrix", Phase: snapshot.PhaseCompleted, ObservedGeneration: 1, StartTimestamp: &started})
+
+		st, requeueAfter, err := s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(snapshot.PhaseCompleted))
+		Expect(requeueAfter).To(BeNumerically("~", 30*time.Minute, time.Minute))
+
+		started = metav1.NewTime(time.Now().Add(-2 * time.Hour).Truncate(time.Second))
+		st.StartTimestamp = &started
+		setStatus(st)
+		st, _, err = s.Reconcile(context.TODO(), obj, rel, vals, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(snapshot.PhaseInProgress))
+	})
+
+	It("should snapshot on request even if snapshots are not enabled", func() {
+		obj.SetAnnotations(map[string]string{snapshot.RequestAnnotation: "1"})
+		st, _, err := s.Reconcile(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(st.Phase).To(Equal(snapshot.PhaseInProgress))
+		Expect(st.RequestToken).To(Equal("1"))
+
+		st.Phase = snapshot.PhaseCompleted
+		setStatus(st)
+		next, _, err := s.Reconcile(context.TODO(), obj, rel, chartutil.Values{}, testing.NullLogger{})
+		Expect(err).To(BeNil())
+		Expect(next.Name).To(Equal(st.Name))
+		Expect(next.Phase).To(Equal(snapshot.PhaseCompleted))
+	})
+
+	It("should reject invalid values", func() {
+		for _, v := range []map[string]interface{}{
+			{"enabled": "yes"},
+			{"keepLast": 0},
+			{"readyTimeout": "soon"},
+			{"interval": "-1h"},
+			{"volumeSnapshotClassName": "Not_A_Name"},
+			{"labelSelector": "app in"},
+			{"labelSelector": map[string]interface{}{}},
+		} {
+			err := snapshot.ValidateValues(chartutil.Values{"snapshot": v})
+			Expect(errors.Is(err, snapshot.ErrInvalidValues)).To(BeTrue(), "%v", v)
+
+			_, _, err = s.Reconcile(context.TODO(), obj, rel, chartutil.Values{"snapshot": v}, testing.NullLogger{})
+			Expect(errors.Is(err, snapshot.ErrInvalidValues)).To(BeTrue(), "%v", v)
+		}
+		Expect(snapshot.ValidateValues(vals)).To(Succeed())
+	})
+})
@@ -37,6 +37,11 @@ type Watch struct {
 	OverrideValues          map[string]string `json:"overrideValues,omitempty"`
 	ReconcilePeriod         *metav1.Duration  `json:"reconcilePeriod,omitempty"`
 	MaxConcurrentReconciles *int              `json:"maxConcurrentReconciles,omitempty"`
+	VeleroNamespace         string            `json:"veleroNamespace,omitempty"`
+	BackupProvider          string            `json:"backupProvider,omitempty"`
+	BackupDir               string            `json:"backupDir,omitempty"`
+	PreDeleteBackup         *bool             `json:"preDeleteBackup,omitempty"`
+	PreDeleteBackupTimeout  *metav1.Duration  `json:"preDeleteBackupTimeout,omitempty"`
 
 	Chart *chart.Chart `json:"-"`
 }
@@ -63,6 +68,10 @@ func Load(path string) ([]Watch, error) {
 			return nil, fmt.Errorf("invalid GVK: %s: %w", w.GroupVersionKind, err)
 		}
 
+		if err := verifyBackupProvider(w.BackupProvider); err != nil {
+			return nil, fmt.Errorf("invalid backup provider for %s: %w", w.GroupVersionKind, err)
+		}
+
 		cl, err := loader.Load(w.ChartPath)
 		if err != nil {
 			return nil, fmt.Errorf("invalid chart %s: %w", w.ChartPath, err)
@@ -95,6 +104,21 @@ func expandOverrideEnvs(in map[string]string) map[string]string {
 	return out
 }
 
+// BackupProviders are the backup providers a watch can use.
+var BackupProviders = []string{"velero", "local"}
+
+func verifyBackupProvider(provider string) error {
+	if provider == "" {
+		return nil
+	}
+	for _, p := range BackupProviders {
+		if provider == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %v, got %q", BackupProviders, provider)
+}
+
 func verifyGVK(gvk schema.GroupVersionKind) error {
 	// A GVK without a group is valid. Certain scenarios may cause a GVK
 	// without a group to fail in other ways later in the initialization
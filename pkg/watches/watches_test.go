@@ -19,6 +19,9 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type testCase struct {
@@ -28,10 +31,21 @@ type testCase struct {
 	expectLen       int
 	expectErr       bool
 	expectOverrides []map[string]string
+	expectBackup    *backupSettings
+}
+
+// backupSettings are the backup fields of the first watch of a test case.
+type backupSettings struct {
+	veleroNamespace        string
+	backupProvider         string
+	backupDir              string
+	preDeleteBackup        *bool
+	preDeleteBackupTimeout *metav1.Duration
 }
 
 // TODO(joelanford): convert to ginkgo/gomega
 func TestLoadWatches(t *testing.T) {
+	trueVal := true
 	testCases := []testCase{
 		{
 			name: "valid",
@@ -42,12 +56,24 @@ func TestLoadWatches(t *testing.T) {
   chart: ../../testdata/test-chart-0.1.0.tgz
   watchDependentResources: false
   reconcilePeriod: 10s
+  veleroNamespace: velero
+  backupProvider: local
+  backupDir: /var/lib/backups
+  preDeleteBackup: true
+  preDeleteBackupTimeout: 30m
   overrideValues:
     key: value
 `,
 			expectLen:       1,
 			expectErr:       false,
 			expectOverrides: []map[string]string{{"key": "value"}},
+			expectBackup: &backupSettings{
+				veleroNamespace:        "velero",
+				backupProvider:         "local",
+				backupDir:              "/var/lib/backups",
+				preDeleteBackup:        &trueVal,
+				preDeleteBackupTimeout: &metav1.Duration{Duration: 30 * time.Minute},
+			},
 		},
 		{
 			name: "valid with override expansion",
@@ -122,6 +148,42 @@ func TestLoadWatches(t *testing.T) {
   version: v1alpha1
   kind: MyKind
   chart: nonexistent/path/to/chart
+`,
+			expectLen: 0,
+			expectErr: true,
+		},
+		{
+			name: "invalid backup provider",
+			data: `---
+- group: mygroup
+  version: v1alpha1
+  kind: MyKind
+  chart: ../../testdata/test-chart-0.1.0.tgz
+  backupProvider: restic
+`,
+			expectLen: 0,
+			expectErr: true,
+		},
+		{
+			name: "invalid pre-delete backup",
+			data: `---
+- group: mygroup
+  version: v1alpha1
+  kind: MyKind
+  chart: ../../testdata/test-chart-0.1.0.tgz
+  preDeleteBackup: maybe
+`,
+			expectLen: 0,
+			expectErr: true,
+		},
+		{
+			name: "invalid pre-delete backup timeout",
+			data: `---
+- group: mygroup
+  version: v1alpha1
+  kind: MyKind
+  chart: ../../testdata/test-chart-0.1.0.tgz
+  preDeleteBackupTimeout: soon
 `,
 			expectLen: 0,
 			expectErr: true,
@@ -191,6 +253,13 @@ func doTest(t *testing.T, tc testCase, watchesFile string) {
 	if len(watches) != tc.expectLen {
 		t.Fatalf("Expected %d watches; got %d", tc.expectLen, len(watches))
 	}
+	if tc.expectBackup != nil {
+		w := watches[0]
+		got := backupSettings{w.VeleroNamespace, w.BackupProvider, w.BackupDir, w.PreDeleteBackup, w.PreDeleteBackupTimeout}
+		if !reflect.DeepEqual(*tc.expectBackup, got) {
+			t.Fatalf("Expected backup settings %#v; got %#v", *tc.expectBackup, got)
+		}
+	}
 
 	for i, w := range watches {
 		if len(tc.expectOverrides) <= i {